@@ -0,0 +1,527 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	EXPORT_STARTED_MSG               = "We're gathering your data. You'll get an email with a link to download it shortly."
+	EXPORT_EXPIRED_MSG               = "This export has expired. Ask for a new one from your profile."
+	EXPORT_NOT_YOURS_MSG             = "This export belongs to another account."
+	DELETION_SCHEDULED_MSG           = "Your account will be deleted on %s. Until then, you can change your mind from your profile."
+	DELETION_CANCELLED_MSG           = "Your account will no longer be deleted."
+	NO_DELETION_MSG                  = "Your account isn't going to be deleted."
+	WRONG_PASSWORD_MSG               = "This isn't your password."
+	WRONG_EMAIL_MSG                  = "This isn't your email address."
+	UNSUCCESSFUL_DELETION_MSG        = "Unable to delete your account."
+	UNSUCCESSFUL_CANCEL_DELETION_MSG = "Unable to cancel the deletion of your account."
+	OWNS_ORGANIZATION_MSG            = "You own the team %s, which has other members. Remove them from the team before deleting your account, so that they don't lose the plan it pays for."
+	ERROR_EXPORT_ACCOUNT_MSG         = "error exporting data of user %d: %w"
+	ERROR_GET_DUE_DELETIONS_MSG      = "error getting accounts due for deletion: %w"
+	ERROR_DELETE_ACCOUNT_MSG         = "error deleting account of user %d: %w"
+	ERROR_GET_DELETION_MSG           = "error getting deletion of user %d: %w"
+	ERROR_REMOVE_EXPORTS_MSG         = "error removing expired exports: %w"
+)
+
+// XXX_ATTR is an attribute or element's name embedded in html.
+const (
+	ACCOUNT_DELETION_ATTR = "account-deletion"
+	DELETE_CONFIRM_ATTR   = "delete-confirm"
+	EXPORT_FILE_ATTR      = "file"
+	EXPORT_USER_ATTR      = "user"
+)
+
+const (
+	ACCOUNT_CHECK_INTERVAL        = 1 * time.Hour
+	ACCOUNT_DELETION_GRACE_PERIOD = 14 * 24 * time.Hour // how long the user has to change their mind
+	EXPORT_LINK_MAX_AGE           = 24 * time.Hour      // how long the link to an export, and the export, last
+	EXPORT_ATTCH_NAME             = "account-export.zip"
+	EXPORT_DIR                    = "./tmp"
+	EXPORT_FILE_NAME              = "%s_export.zip" // %s is a placeholder for the random id of the export
+)
+
+// exportAuditEvent is an event of the audit log as an export shows it
+type exportAuditEvent struct {
+	ID        int              `json:"id"`
+	Action    data.AuditAction `json:"action"`
+	ActorID   *int32           `json:"actor_id"`
+	TargetID  *int32           `json:"target_id"`
+	IP        string           `json:"ip"`
+	RequestID string           `json:"request_id"`
+	Diff      data.AuditDiff   `json:"diff"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+func newExportAuditEvent(e *data.AuditEvent) exportAuditEvent {
+	event := exportAuditEvent{
+		ID:        e.ID,
+		Action:    e.Action,
+		IP:        e.IP,
+		RequestID: e.RequestID,
+		Diff:      e.Diff,
+		CreatedAt: e.CreatedAt,
+	}
+	if e.ActorID.Valid {
+		event.ActorID = &e.ActorID.Int32
+	}
+	if e.TargetID.Valid {
+		event.TargetID = &e.TargetID.Int32
+	}
+	return event
+}
+
+// ExportAccount gathers the data of the user in the background, and emails them a link to download it
+func (s *Server) ExportAccount(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+	host := r.Host
+
+	s.AsyncJob.Add(1) // increment counter every time a new export is built
+	go func() {
+		defer s.AsyncJob.Done() // decrement counter every time an export is built and its link passed to the mailer to send
+
+		if err := s.exportAccount(user, host); err != nil {
+			s.AsyncErr <- fmt.Errorf(ERROR_EXPORT_ACCOUNT_MSG, user.ID, err)
+		}
+	}()
+	s.audit(r, data.AccountExported, user.ID, user.ID, nil)
+
+	s.Session.Put(r.Context(), FLASH_CTX, EXPORT_STARTED_MSG)
+	http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+}
+
+// exportAccount writes the zip of the data of the user, and emails them a signed link to download it
+func (s *Server) exportAccount(user data.User, host string) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	exportID := hex.EncodeToString(id)
+
+	f, err := os.Create(s.exportPath(exportID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := s.writeAccountExport(f, user); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	q.Set(EXPORT_FILE_ATTR, exportID)
+	q.Set(EXPORT_USER_ATTR, strconv.Itoa(user.ID))
+	downloadURL := &url.URL{
+		Scheme:   "http",
+		Host:     host,
+		Path:     MembersAccountExportDownloadPath,
+		RawQuery: q.Encode(),
+	}
+	signedURL, err := s.signURL(downloadURL, DOWNLOAD_PURPOSE, EXPORT_LINK_MAX_AGE)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		To:       user.Email,
+		Subject:  "Your data is ready to download",
+		Template: ACCOUNT_EXPORT,
+		Data:     template.HTML(signedURL),
+	}
+	s.sendEmail(msg)
+
+	return nil
+}
+
+// writeAccountExport writes the zip of the profile, subscriptions, invoices and audit log entries of the user,
+// one json file each, the same way the api shows them
+func (s *Server) writeAccountExport(w io.Writer, user data.User) error {
+	subscriptions := []apiSubscription{}
+	sub, err := s.Models.Subscription.GetByUserID(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err == nil {
+		plan, err := s.Models.Plan.GetOne(sub.PlanID)
+		if err != nil {
+			return err
+		}
+		subscriptions = append(subscriptions, newAPISubscription(sub, plan))
+	}
+
+	invoices := []apiInvoice{}
+	all, _, err := s.Models.Invoice.GetByUserID(user.ID, 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, inv := range all {
+		invoices = append(invoices, newAPIInvoice(inv))
+	}
+
+	events, err := s.auditEventsOf(user.ID)
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name string
+		v    any
+	}{
+		{"profile.json", newAPIProfile(user)},
+		{"subscriptions.json", subscriptions},
+		{"invoices.json", invoices},
+		{"audit-log.json", events},
+	}
+
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		fw, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.v); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// auditEventsOf returns the events of the audit log the user took part in, as the actor or the target, newest first
+func (s *Server) auditEventsOf(userID int) ([]exportAuditEvent, error) {
+	byActor, _, err := s.Models.Audit.Find(data.AuditFilter{ActorID: userID}, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	byTarget, _, err := s.Models.Audit.Find(data.AuditFilter{TargetID: userID}, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[int]bool)
+	events := []exportAuditEvent{}
+	for _, e := range append(byActor, byTarget...) {
+		if seen[e.ID] {
+			continue
+		}
+		seen[e.ID] = true
+		events = append(events, newExportAuditEvent(e))
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].CreatedAt.Equal(events[j].CreatedAt) {
+			return events[i].CreatedAt.After(events[j].CreatedAt)
+		}
+		return events[i].ID > events[j].ID
+	})
+
+	return events, nil
+}
+
+// DownloadAccountExport sends the export the signed link points to, as long as it's the export of the user
+// who is logged in and the link hasn't expired
+func (s *Server) DownloadAccountExport(w http.ResponseWriter, r *http.Request) {
+	q, err := s.verifySignedURL(r, DOWNLOAD_PURPOSE)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, tokenErrorMessage(err))
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+
+	if q.Get(EXPORT_USER_ATTR) != strconv.Itoa(s.Session.GetInt(r.Context(), USER_ID_CTX)) {
+		s.Session.Put(r.Context(), ERROR_CTX, EXPORT_NOT_YOURS_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+
+	// the id is signed, but make sure it can only name an export anyway
+	exportID := q.Get(EXPORT_FILE_ATTR)
+	if _, err := hex.DecodeString(exportID); err != nil || exportID == "" {
+		s.Session.Put(r.Context(), ERROR_CTX, INVALID_TOKEN_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+
+	f, err := os.Open(s.exportPath(exportID))
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, EXPORT_EXPIRED_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", EXPORT_ATTCH_NAME))
+	if _, err := io.Copy(w, f); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_EXPORT_ACCOUNT_MSG, s.Session.GetInt(r.Context(), USER_ID_CTX), err))
+	}
+}
+
+// RequestAccountDeletion schedules the deletion of the account of the user, once they have confirmed it with
+// their password, or their email address if they have none. The account is only deleted after a grace period,
+// until when they may cancel.
+func (s *Server) RequestAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	sessionUser, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	// the password in the session may be stale
+	user, err := s.Models.User.GetOne(sessionUser.ID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SESSION_USER_MSG, sessionUser.ID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_DELETION_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+
+	// deleting the owner deletes their team, and the plan its members are covered by
+	org, err := s.sharedOrganizationOf(user.ID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_ORGANIZATION_MSG, user.ID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_DELETION_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	if org != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, fmt.Sprintf(OWNS_ORGANIZATION_MSG, org.Name))
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required(DELETE_CONFIRM_ATTR)
+	if form.Valid() {
+		confirm := form.Get(DELETE_CONFIRM_ATTR)
+		if user.HasPassword() {
+			if matches, err := user.PasswordMatches(confirm); err != nil || !matches {
+				form.Errors.Add(DELETE_CONFIRM_ATTR, WRONG_PASSWORD_MSG)
+			}
+		} else if !strings.EqualFold(strings.TrimSpace(confirm), user.Email) {
+			form.Errors.Add(DELETE_CONFIRM_ATTR, WRONG_EMAIL_MSG)
+		}
+	}
+	if !form.Valid() {
+		form.Set(FIRST_NAME_ATTR, sessionUser.FirstName)
+		form.Set(LAST_NAME_ATTR, sessionUser.LastName)
+		s.renderProfile(w, r, sessionUser, form, "")
+		return
+	}
+
+	deleteAfter := time.Now().Add(ACCOUNT_DELETION_GRACE_PERIOD)
+	if err := s.Models.AccountDeletion.Schedule(user.ID, deleteAfter); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_DELETE_ACCOUNT_MSG, user.ID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_DELETION_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.AccountDeletionScheduled, user.ID, user.ID, change("delete_after", nil, deleteAfter))
+
+	msg := Message{
+		To:      user.Email,
+		Subject: "Your account will be deleted",
+		Data: fmt.Sprintf("Your account will be deleted on %s, along with your data. Invoices are kept for our books, "+
+			"without your name or email address. Log in and cancel from your profile if you change your mind.",
+			deleteAfter.Format(CHARGE_DATE_LAYOUT)),
+	}
+	s.sendEmail(msg)
+
+	s.Session.Put(r.Context(), FLASH_CTX, fmt.Sprintf(DELETION_SCHEDULED_MSG, deleteAfter.Format(CHARGE_DATE_LAYOUT)))
+	http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+}
+
+// CancelAccountDeletion keeps the account of the user, which was going to be deleted
+func (s *Server) CancelAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	userID := s.Session.GetInt(r.Context(), USER_ID_CTX)
+
+	err := s.Models.AccountDeletion.Cancel(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.Session.Put(r.Context(), ERROR_CTX, NO_DELETION_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_DELETE_ACCOUNT_MSG, userID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_CANCEL_DELETION_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.AccountDeletionCancelled, userID, userID, nil)
+
+	s.Session.Put(r.Context(), FLASH_CTX, DELETION_CANCELLED_MSG)
+	http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+}
+
+// listenForAccountDeletions periodically deletes the accounts whose grace period is over,
+// and removes the exports which have expired, until it's told to stop.
+func (s *Server) listenForAccountDeletions() {
+	ticker := time.NewTicker(ACCOUNT_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.deleteDueAccounts(now)
+			s.removeExpiredExports(now)
+		case <-s.StopAccountDeletion:
+			s.InfoLog.Println("stopping deleting accounts...")
+			return
+		}
+	}
+}
+
+// deleteDueAccounts deletes the accounts whose grace period is over, and signs their users out everywhere.
+// Invoices are kept for the books, and forget who paid them as the user is deleted.
+func (s *Server) deleteDueAccounts(now time.Time) {
+	deletions, err := s.Models.AccountDeletion.GetDue(now)
+	if err != nil {
+		s.AsyncErr <- fmt.Errorf(ERROR_GET_DUE_DELETIONS_MSG, err)
+		return
+	}
+
+	for _, deletion := range deletions {
+		user := *deletion.User
+
+		// members may have joined the team of the user during the grace period; rather than deleting
+		// the team and its plan along with the user, keep the account and tell them why
+		org, err := s.sharedOrganizationOf(user.ID)
+		if err != nil {
+			s.AsyncErr <- fmt.Errorf(ERROR_GET_ORGANIZATION_MSG, user.ID, err)
+			continue
+		}
+		if org != nil {
+			s.keepAccountOfOwner(user, *org)
+			continue
+		}
+
+		if err := s.signOutEverywhere(user.ID); err != nil {
+			s.AsyncErr <- fmt.Errorf(ERROR_REVOKE_SESSION_MSG, user.ID, err)
+		}
+
+		if err := s.Models.User.Delete(user); err != nil {
+			s.AsyncErr <- fmt.Errorf(ERROR_DELETE_ACCOUNT_MSG, user.ID, err)
+			continue
+		}
+		// the user is gone, so the event has no actor nor target, and only the id they had tells who they were
+		s.auditJob(data.AccountDeleted, 0, 0, change("id", user.ID, nil))
+
+		msg := Message{
+			To:      user.Email,
+			Subject: "Your account has been deleted",
+			Data:    "Your account has been deleted, along with your data, as you asked. Thank you for having been with us.",
+		}
+		s.sendEmail(msg)
+	}
+}
+
+// sharedOrganizationOf returns the team the user owns if it has other members, or nil
+func (s *Server) sharedOrganizationOf(userID int) (*data.Organization, error) {
+	org, err := s.Models.Organization.GetByUserID(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !org.IsOwner(userID) || len(org.Members) <= 1 {
+		return nil, nil
+	}
+	return org, nil
+}
+
+// keepAccountOfOwner cancels the deletion of the account of the user, who owns a team with other members,
+// and emails them why
+func (s *Server) keepAccountOfOwner(user data.User, org data.Organization) {
+	if err := s.Models.AccountDeletion.Cancel(user.ID); err != nil {
+		s.AsyncErr <- fmt.Errorf(ERROR_DELETE_ACCOUNT_MSG, user.ID, err)
+		return
+	}
+	s.auditJob(data.AccountDeletionCancelled, 0, user.ID, change("organization", nil, org.Name))
+
+	msg := Message{
+		To:      user.Email,
+		Subject: "Your account hasn't been deleted",
+		Data: fmt.Sprintf("Your account hasn't been deleted, as you own the team %s, which has other members, "+
+			"and they would have lost the plan it pays for. Remove them from the team, then ask again to delete your account.",
+			org.Name),
+	}
+	s.sendEmail(msg)
+}
+
+// signOutEverywhere deletes every session of the user, for when there is no request to keep the session of
+func (s *Server) signOutEverywhere(userID int) error {
+	sessions, err := s.Sessions.List(userID)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for _, sess := range sessions {
+		if err := s.Session.Store.Delete(sess.Token); err != nil {
+			return fmt.Errorf(ERROR_DELETE_SESSION_MSG, err)
+		}
+		ids = append(ids, sess.ID)
+	}
+
+	return s.Sessions.Remove(userID, ids...)
+}
+
+// exportPath returns the path of the export with the id, in the directory of the configuration
+func (s *Server) exportPath(exportID string) string {
+	return filepath.Join(s.Config.Exports.Dir, fmt.Sprintf(EXPORT_FILE_NAME, exportID))
+}
+
+// removeExpiredExports removes the exports whose link has expired
+func (s *Server) removeExpiredExports(now time.Time) {
+	paths, err := filepath.Glob(s.exportPath("*"))
+	if err != nil {
+		s.AsyncErr <- fmt.Errorf(ERROR_REMOVE_EXPORTS_MSG, err)
+		return
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || now.Sub(info.ModTime()) < EXPORT_LINK_MAX_AGE {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			s.AsyncErr <- fmt.Errorf(ERROR_REMOVE_EXPORTS_MSG, err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+func Test_writeAccountExport(t *testing.T) {
+	var buf bytes.Buffer
+	user := data.User{ID: 1, Email: "admin@example.com", FirstName: "Admin", LastName: "Admin"}
+	if err := testServer.writeAccountExport(&buf, user); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]any{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v any
+		if err := json.NewDecoder(rc).Decode(&v); err != nil {
+			t.Errorf("expected %s to be json; got %v", f.Name, err)
+		}
+		rc.Close()
+		files[f.Name] = v
+	}
+
+	for _, name := range []string{"profile.json", "subscriptions.json", "invoices.json", "audit-log.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("expected the export to contain %s", name)
+		}
+	}
+	if profile, ok := files["profile.json"].(map[string]any); !ok || profile["email"] != user.Email {
+		t.Errorf("expected the profile of the user; got %v", files["profile.json"])
+	}
+	if _, ok := files["invoices.json"].([]any); !ok {
+		t.Errorf("expected the invoices to be a list; got %v", files["invoices.json"])
+	}
+}
+
+func Test_DownloadAccountExport(t *testing.T) {
+	dir := testServer.Config.Exports.Dir
+	testServer.Config.Exports.Dir = t.TempDir()
+	defer func() { testServer.Config.Exports.Dir = dir }()
+
+	if err := os.WriteFile(testServer.exportPath("abcd"), []byte("zip"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		path          string
+		userID        int
+		expectedCode  int
+		expectedError string
+	}{
+		"own export":     {signedLink(MembersAccountExportDownloadPath, url.Values{EXPORT_FILE_ATTR: {"abcd"}, EXPORT_USER_ATTR: {"1"}}, DOWNLOAD_PURPOSE), 1, http.StatusOK, ""},
+		"another's":      {signedLink(MembersAccountExportDownloadPath, url.Values{EXPORT_FILE_ATTR: {"abcd"}, EXPORT_USER_ATTR: {"1"}}, DOWNLOAD_PURPOSE), 2, http.StatusSeeOther, EXPORT_NOT_YOURS_MSG},
+		"expired export": {signedLink(MembersAccountExportDownloadPath, url.Values{EXPORT_FILE_ATTR: {"ef01"}, EXPORT_USER_ATTR: {"1"}}, DOWNLOAD_PURPOSE), 1, http.StatusSeeOther, EXPORT_EXPIRED_MSG},
+		"not a file id":  {signedLink(MembersAccountExportDownloadPath, url.Values{EXPORT_FILE_ATTR: {"../x"}, EXPORT_USER_ATTR: {"1"}}, DOWNLOAD_PURPOSE), 1, http.StatusSeeOther, INVALID_TOKEN_MSG},
+		"other purpose":  {signedLink(MembersAccountExportDownloadPath, url.Values{EXPORT_FILE_ATTR: {"abcd"}, EXPORT_USER_ATTR: {"1"}}, INVITE_PURPOSE), 1, http.StatusSeeOther, ""},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rawReq, _ := http.NewRequest(http.MethodGet, tt.path, nil)
+			r := newReqWithSession(rawReq)
+			testServer.Session.Put(r.Context(), USER_ID_CTX, tt.userID)
+
+			w := httptest.NewRecorder()
+			testServer.DownloadAccountExport(w, r)
+
+			if w.Code != tt.expectedCode {
+				t.Errorf("expected status code %d; got %d", tt.expectedCode, w.Code)
+			}
+			if tt.expectedCode == http.StatusOK && w.Body.String() != "zip" {
+				t.Errorf("expected the export to be sent; got %q", w.Body.String())
+			}
+			if msg := testServer.Session.GetString(r.Context(), ERROR_CTX); tt.expectedError != "" && msg != tt.expectedError {
+				t.Errorf("expected error message %q; got %q", tt.expectedError, msg)
+			}
+		})
+	}
+}
+
+func Test_deleteDueAccounts(t *testing.T) {
+	due := addTestSession(t, 7, "due")
+	notDue := addTestSession(t, 8, "not-due")
+	for id, deleteAfter := range map[int]time.Time{7: time.Now().Add(-time.Minute), 8: time.Now().Add(time.Hour)} {
+		if err := testServer.Models.AccountDeletion.Schedule(id, deleteAfter); err != nil {
+			t.Fatal(err)
+		}
+		defer func(id int) { _ = testServer.Models.AccountDeletion.Cancel(id) }(id)
+	}
+
+	testServer.deleteDueAccounts(time.Now())
+	testServer.AsyncJob.Wait()
+
+	if sessionExists(t, due) {
+		t.Error("expected the user whose account is deleted to be signed out")
+	}
+	if !sessionExists(t, notDue) {
+		t.Error("expected the user whose grace period isn't over to stay signed in")
+	}
+
+	e := lastAuditEvent(t, data.AuditFilter{Action: data.AccountDeleted})
+	if e.ActorID.Valid || e.TargetID.Valid || e.Diff["id"].From != 7 {
+		t.Errorf("expected the deletion of user 7 to be audited without actor nor target; got %+v", e)
+	}
+}
+
+func Test_deleteDueAccounts_OwnerOfTeam(t *testing.T) {
+	// user 1 owns the sample team, which has another member
+	sess := addTestSession(t, 1, "owner")
+	if err := testServer.Models.AccountDeletion.Schedule(1, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = testServer.Models.AccountDeletion.Cancel(1) }()
+
+	testServer.deleteDueAccounts(time.Now())
+	testServer.AsyncJob.Wait()
+
+	if !sessionExists(t, sess) {
+		t.Error("expected the owner to stay signed in")
+	}
+	if _, err := testServer.Models.AccountDeletion.GetByUserID(1); err == nil {
+		t.Error("expected the deletion to be cancelled")
+	}
+
+	e := lastAuditEvent(t, data.AuditFilter{Action: data.AccountDeletionCancelled})
+	if e.TargetID.Int32 != 1 || e.Diff["organization"].To != "Example Inc." {
+		t.Errorf("expected the cancellation of the deletion of user 1 to be audited; got %+v", e)
+	}
+}
+
+func Test_removeExpiredExports(t *testing.T) {
+	dir := testServer.Config.Exports.Dir
+	testServer.Config.Exports.Dir = t.TempDir()
+	defer func() { testServer.Config.Exports.Dir = dir }()
+
+	expired := testServer.exportPath("old")
+	fresh := testServer.exportPath("new")
+	for _, path := range []string{expired, fresh} {
+		if err := os.WriteFile(path, []byte("zip"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-EXPORT_LINK_MAX_AGE - time.Minute)
+	if err := os.Chtimes(expired, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	testServer.removeExpiredExports(time.Now())
+
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Error("expected the expired export to be removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Error("expected the export which hasn't expired to be kept")
+	}
+}
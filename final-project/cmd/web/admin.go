@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+// XXX_PAGE is the name of the template gohtml file to render for the page
+const (
+	COUPONS_PAGE = "coupons.page.gohtml"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	PERMISSION_DENIED_MSG          = "You don't have permission to view this page."
+	INVALID_COUPON_FORM_MSG        = "Invalid coupon: %s"
+	UNSUCCESSFUL_CREATE_COUPON_MSG = "Unable to create coupon."
+	COUPON_CREATED_MSG             = "Coupon created."
+	ERROR_GET_ALL_COUPONS_MSG      = "error getting all coupons: %w"
+)
+
+// XXX_ATTR is an attribute or element's name embedded in html.
+const (
+	COUPONS_ATTR               = "coupons"
+	CODE_ATTR                  = "code"
+	DISCOUNT_TYPE_ATTR         = "discount-type"
+	DISCOUNT_VALUE_ATTR        = "discount-value"
+	DURATION_ATTR              = "duration"
+	DURATION_IN_INTERVALS_ATTR = "duration-in-intervals"
+	MAX_REDEMPTIONS_ATTR       = "max-redemptions"
+	EXPIRES_AT_ATTR            = "expires-at"
+)
+
+const (
+	PERCENT_OFF = "percent"
+	AMOUNT_OFF  = "amount"
+	DATE_LAYOUT = "2006-01-02"
+)
+
+// couponCodePattern is what a coupon code is made of, once normalized, so that it's safe to show anywhere
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+func (s *Server) AdminCouponsPage(w http.ResponseWriter, r *http.Request) {
+	coupons, err := s.Models.Coupon.GetAll()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_ALL_COUPONS_MSG, err))
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap[COUPONS_ATTR] = coupons
+	dataMap[CURRENCIES_ATTR] = data.SupportedCurrencies
+
+	s.render(w, r, COUPONS_PAGE, &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (s *Server) AdminCreateCoupon(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	coupon, problem := couponFromForm(r)
+	if problem != "" {
+		s.Session.Put(r.Context(), ERROR_CTX, fmt.Sprintf(INVALID_COUPON_FORM_MSG, problem))
+		http.Redirect(w, r, AdminCouponsPath, http.StatusSeeOther)
+		return
+	}
+
+	if _, err := s.Models.Coupon.Insert(coupon); err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_CREATE_COUPON_MSG)
+		http.Redirect(w, r, AdminCouponsPath, http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.CouponCreated, s.Session.GetInt(r.Context(), USER_ID_CTX), 0, change("coupon", nil, coupon.Code))
+
+	s.Session.Put(r.Context(), FLASH_CTX, COUPON_CREATED_MSG)
+	http.Redirect(w, r, AdminCouponsPath, http.StatusSeeOther)
+}
+
+// couponFromForm builds a coupon from the submitted form.
+// If the form is invalid, it returns a description of the problem instead.
+func couponFromForm(r *http.Request) (data.Coupon, string) {
+	coupon := data.Coupon{
+		Code:     data.NormalizeCouponCode(r.Form.Get(CODE_ATTR)),
+		Currency: data.Currency(r.Form.Get(CURRENCY_ATTR)),
+		Duration: data.CouponDuration(r.Form.Get(DURATION_ATTR)),
+	}
+
+	if coupon.Code == "" {
+		return coupon, "a code is required"
+	}
+	if !couponCodePattern.MatchString(coupon.Code) {
+		return coupon, "a code is 3 to 32 letters, digits, dashes or underscores"
+	}
+
+	value, err := strconv.ParseFloat(r.Form.Get(DISCOUNT_VALUE_ATTR), 64)
+	if err != nil || value <= 0 {
+		return coupon, "the discount must be a positive number"
+	}
+
+	switch r.Form.Get(DISCOUNT_TYPE_ATTR) {
+	case PERCENT_OFF:
+		if value > 100 || value != math.Trunc(value) {
+			return coupon, "a percentage must be a whole number up to 100"
+		}
+		coupon.PercentOff = int(value)
+		if !data.IsSupportedCurrency(coupon.Currency) {
+			coupon.Currency = data.DefaultCurrency // not used by percentage coupons
+		}
+	case AMOUNT_OFF:
+		if !data.IsSupportedCurrency(coupon.Currency) {
+			return coupon, "unsupported currency"
+		}
+		// the amount is entered in major units, e.g. dollars, but stored in minor units, e.g. cents
+		coupon.AmountOff = int(math.Round(value * math.Pow10(coupon.Currency.MinorUnits())))
+	default:
+		return coupon, "unknown discount type"
+	}
+
+	switch coupon.Duration {
+	case data.Once, data.Forever:
+	case data.Repeating:
+		coupon.DurationInIntervals, err = strconv.Atoi(r.Form.Get(DURATION_IN_INTERVALS_ATTR))
+		if err != nil || coupon.DurationInIntervals <= 0 {
+			return coupon, "a repeating coupon needs a positive number of intervals"
+		}
+	default:
+		return coupon, "unknown duration"
+	}
+
+	if maxRedemptions := r.Form.Get(MAX_REDEMPTIONS_ATTR); maxRedemptions != "" {
+		coupon.MaxRedemptions, err = strconv.Atoi(maxRedemptions)
+		if err != nil || coupon.MaxRedemptions < 0 {
+			return coupon, "the redemption limit must be a positive number"
+		}
+	}
+
+	if expiresAt := r.Form.Get(EXPIRES_AT_ATTR); expiresAt != "" {
+		t, err := time.Parse(DATE_LAYOUT, expiresAt)
+		if err != nil {
+			return coupon, "the expiry must be a date"
+		}
+		coupon.ExpiresAt = sql.NullTime{Time: t, Valid: true}
+	}
+
+	return coupon, ""
+}
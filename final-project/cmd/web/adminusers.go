@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+// XXX_PAGE is the name of the template gohtml file to render for the page
+const (
+	USERS_PAGE = "users.page.gohtml"
+	USER_PAGE  = "user.page.gohtml"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	USER_NOT_FOUND_MSG          = "Unable to find user."
+	USER_ACTIVATED_MSG          = "The account of %s has been activated."
+	USER_DEACTIVATED_MSG        = "The account of %s has been deactivated."
+	ROLE_CHANGED_MSG            = "%s is now %s."
+	INVALID_ROLE_MSG            = "Unknown role."
+	RESET_EMAIL_SENT_TO_MSG     = "A link to reset their password has been sent to %s."
+	PLAN_CHANGED_MSG            = "%s is now subscribed to the %s."
+	USER_DELETED_MSG            = "The account of %s has been deleted."
+	NOT_ON_OWN_ACCOUNT_MSG      = "You can't do that to your own account."
+	UNSUCCESSFUL_ADMIN_USER_MSG = "Unable to update the user."
+	ERROR_SEARCH_USERS_MSG      = "error searching users: %w"
+)
+
+// XXX_ATTR is an attribute or element's name embedded in html.
+const (
+	USERS_ATTR     = "users"
+	USER_ATTR      = "user"
+	USER_ID_ATTR   = "id"
+	SEARCH_ATTR    = "q"
+	PAGE_ATTR      = "page"
+	PAGES_ATTR     = "pages"
+	TOTAL_ATTR     = "total"
+	PREV_PAGE_ATTR = "prev-page"
+	NEXT_PAGE_ATTR = "next-page"
+	ROLES_ATTR     = "roles"
+	ACTIVE_ATTR    = "active"
+	ROLE_ATTR      = "role"
+)
+
+const (
+	USERS_PER_PAGE = 20
+)
+
+// AdminUsersPage lists the users whose email or name contains the search term, one page at a time
+func (s *Server) AdminUsersPage(w http.ResponseWriter, r *http.Request) {
+	term := r.URL.Query().Get(SEARCH_ATTR)
+	page, _ := strconv.Atoi(r.URL.Query().Get(PAGE_ATTR))
+	if page < 1 {
+		page = 1
+	}
+
+	users, total, err := s.Models.User.Search(term, USERS_PER_PAGE, (page-1)*USERS_PER_PAGE)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_SEARCH_USERS_MSG, err))
+	}
+
+	pages := (total + USERS_PER_PAGE - 1) / USERS_PER_PAGE
+	stringMap := map[string]string{
+		SEARCH_ATTR: term,
+	}
+	if page > 1 {
+		stringMap[PREV_PAGE_ATTR] = usersPageURL(term, page-1)
+	}
+	if page < pages {
+		stringMap[NEXT_PAGE_ATTR] = usersPageURL(term, page+1)
+	}
+
+	dataMap := make(map[string]any)
+	dataMap[USERS_ATTR] = users
+
+	s.render(w, r, USERS_PAGE, &TemplateData{
+		StringMap: stringMap,
+		IntMap: map[string]int{
+			PAGE_ATTR:  page,
+			PAGES_ATTR: pages,
+			TOTAL_ATTR: total,
+		},
+		Data: dataMap,
+	})
+}
+
+// AdminUserPage shows one user, along with their plan, their sessions and what can be done to their account
+func (s *Server) AdminUserPage(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.URL.Query().Get(USER_ID_ATTR))
+	u, err := s.Models.User.GetOne(id)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, USER_NOT_FOUND_MSG)
+		http.Redirect(w, r, AdminUsersPath, http.StatusSeeOther)
+		return
+	}
+
+	sessions, err := s.Sessions.List(u.ID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SESSIONS_MSG, u.ID, err))
+	}
+
+	plans, err := s.Models.Plan.GetAll()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_ALL_PLANS_MSG, err))
+	}
+
+	tf, err := s.Models.TwoFactor.GetByUserID(u.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_TWO_FACTOR_MSG, u.ID, err))
+	}
+
+	dataMap := make(map[string]any)
+	dataMap[USER_ATTR] = u
+	dataMap[SESSIONS_ATTR] = sessions
+	dataMap[PLANS_ATTR] = plans
+	dataMap[ROLES_ATTR] = data.AllRoles
+	dataMap[TWO_FACTOR_ATTR] = tf != nil && tf.Enabled()
+
+	s.render(w, r, USER_PAGE, &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// AdminSetUserActive activates or deactivates the account of a user.
+// Deactivating it signs the user out everywhere.
+func (s *Server) AdminSetUserActive(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	msg, action, wasActive := USER_ACTIVATED_MSG, data.UserActivated, u.IsActive
+	u.IsActive = data.Active
+	if r.Form.Get(ACTIVE_ATTR) != "1" {
+		msg, action = USER_DEACTIVATED_MSG, data.UserDeactivated
+		u.IsActive = data.Inactive
+	}
+
+	if err := s.Models.User.Update(*u); err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_ADMIN_USER_MSG)
+		http.Redirect(w, r, adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+
+	s.audit(r, action, s.Session.GetInt(r.Context(), USER_ID_CTX), u.ID, change("active", wasActive, u.IsActive))
+
+	if u.IsActive == data.Inactive {
+		if err := s.revokeSessions(r, u.ID, true); err != nil {
+			s.ErrorLog.Println(fmt.Errorf(ERROR_REVOKE_SESSION_MSG, u.ID, err))
+		}
+	}
+
+	s.Session.Put(r.Context(), FLASH_CTX, fmt.Sprintf(msg, u.Email))
+	http.Redirect(w, r, adminUserURL(u.ID), http.StatusSeeOther)
+}
+
+// AdminSetUserRole changes the role of a user, and signs them out everywhere,
+// since their sessions still hold their former role
+func (s *Server) AdminSetUserRole(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	role := data.Role(r.Form.Get(ROLE_ATTR))
+	if !role.Valid() {
+		s.Session.Put(r.Context(), ERROR_CTX, INVALID_ROLE_MSG)
+		http.Redirect(w, r, adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+
+	if err := s.Models.User.SetRole(u.ID, role); err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_ADMIN_USER_MSG)
+		http.Redirect(w, r, adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.RoleChanged, s.Session.GetInt(r.Context(), USER_ID_CTX), u.ID, change("role", u.Role, role))
+
+	if err := s.revokeSessions(r, u.ID, true); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_REVOKE_SESSION_MSG, u.ID, err))
+	}
+
+	s.Session.Put(r.Context(), FLASH_CTX, fmt.Sprintf(ROLE_CHANGED_MSG, u.Email, role.Name()))
+	http.Redirect(w, r, adminUserURL(u.ID), http.StatusSeeOther)
+}
+
+// AdminSendPasswordReset emails a user a link to reset their password, as if they had forgotten it
+func (s *Server) AdminSendPasswordReset(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.sendPasswordResetEmail(r, u); err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_RESET_MSG)
+		http.Redirect(w, r, adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.PasswordResetSent, s.Session.GetInt(r.Context(), USER_ID_CTX), u.ID, nil)
+
+	s.Session.Put(r.Context(), FLASH_CTX, fmt.Sprintf(RESET_EMAIL_SENT_TO_MSG, u.Email))
+	http.Redirect(w, r, adminUserURL(u.ID), http.StatusSeeOther)
+}
+
+// AdminChangeUserPlan subscribes a user to another plan, without a coupon
+func (s *Server) AdminChangeUserPlan(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	planID, _ := strconv.Atoi(r.Form.Get(PLAN_ID_CTX))
+	plan, err := s.Models.Plan.GetOne(planID)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_FIND_PLAN_MSG)
+		http.Redirect(w, r, adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+
+	if _, err := s.Models.Plan.SubscribeUserToPlan(*u, *plan, nil); err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_ADMIN_USER_MSG)
+		http.Redirect(w, r, adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.PlanChanged, s.Session.GetInt(r.Context(), USER_ID_CTX), u.ID, change("plan", planName(u.Plan), plan.PlanName))
+
+	s.Session.Put(r.Context(), FLASH_CTX, fmt.Sprintf(PLAN_CHANGED_MSG, u.Email, plan.PlanName))
+	http.Redirect(w, r, adminUserURL(u.ID), http.StatusSeeOther)
+}
+
+// AdminDeleteUser deletes a user along with everything they own, and signs them out everywhere
+func (s *Server) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.revokeSessions(r, u.ID, true); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_REVOKE_SESSION_MSG, u.ID, err))
+	}
+
+	if err := s.Models.User.DeleteByID(u.ID); err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_ADMIN_USER_MSG)
+		http.Redirect(w, r, adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+	// the user is gone, so the target of the event is null, and only the id they had tells who they were
+	s.audit(r, data.UserDeleted, s.Session.GetInt(r.Context(), USER_ID_CTX), 0, change("id", u.ID, nil))
+
+	s.Session.Put(r.Context(), FLASH_CTX, fmt.Sprintf(USER_DELETED_MSG, u.Email))
+	http.Redirect(w, r, AdminUsersPath, http.StatusSeeOther)
+}
+
+// adminTargetUser returns the user an admin action is posted for. Admins can't act on their own account,
+// so that they can't lock themselves out. It redirects and returns false if there is no such user.
+func (s *Server) adminTargetUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	id, _ := strconv.Atoi(r.Form.Get(MEMBER_ID_ATTR))
+	u, err := s.Models.User.GetOne(id)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, USER_NOT_FOUND_MSG)
+		http.Redirect(w, r, AdminUsersPath, http.StatusSeeOther)
+		return nil, false
+	}
+
+	if u.ID == s.Session.GetInt(r.Context(), USER_ID_CTX) {
+		s.Session.Put(r.Context(), ERROR_CTX, NOT_ON_OWN_ACCOUNT_MSG)
+		http.Redirect(w, r, adminUserURL(u.ID), http.StatusSeeOther)
+		return nil, false
+	}
+
+	return u, true
+}
+
+// adminUserURL returns the url of the admin page of the user
+func adminUserURL(id int) string {
+	return AdminUserPath + "?" + url.Values{USER_ID_ATTR: {strconv.Itoa(id)}}.Encode()
+}
+
+// usersPageURL returns the url of one page of the users matching the search term
+func usersPageURL(term string, page int) string {
+	q := url.Values{}
+	if term != "" {
+		q.Set(SEARCH_ATTR, term)
+	}
+	q.Set(PAGE_ATTR, strconv.Itoa(page))
+
+	return AdminUsersPath + "?" + q.Encode()
+}
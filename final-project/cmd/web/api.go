@@ -0,0 +1,517 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	API_MISSING_TOKEN_MSG       = "missing bearer token"
+	API_INVALID_TOKEN_MSG       = "invalid or expired token"
+	API_INACTIVE_USER_MSG       = "the account of the token isn't active"
+	API_INSUFFICIENT_SCOPE_MSG  = "the token lacks the %s scope"
+	API_FEATURE_NOT_IN_PLAN_MSG = "the plan of the account of the token doesn't include api access"
+	API_FEATURE_DISABLED_MSG    = "the api is unavailable for the time being, please try again later"
+	API_NOT_FOUND_MSG           = "not found"
+	API_METHOD_NOT_ALLOWED_MSG  = "method not allowed"
+	API_INVALID_PAGE_MSG        = "page must be a positive number, and per_page a number from 1 to %d"
+	API_INVALID_BODY_MSG        = "invalid request body: %s"
+	API_MISSING_PLAN_MSG        = "plan_id is required"
+	API_PRECONDITION_FAILED_MSG = "the subscription has changed since it was read"
+	API_NO_SUBSCRIPTION_MSG     = "no subscription"
+	API_INTERNAL_ERROR_MSG      = "internal error"
+	ERROR_GET_API_TOKEN_MSG     = "error getting api token: %w"
+	ERROR_TOUCH_API_TOKEN_MSG   = "error recording use of api token %d: %w"
+	ERROR_GET_SUBSCRIPTION_MSG  = "error getting subscription of user %d: %w"
+	ERROR_SUBSCRIBE_MSG         = "error subscribing user %d: %w"
+	ERROR_CANCEL_MSG            = "error cancelling subscription of user %d: %w"
+	ERROR_GET_INVOICES_MSG      = "error getting invoices of user %d: %w"
+	ERROR_WRITE_JSON_MSG        = "error writing json response: %w"
+)
+
+// XXX_CODE is the code of an api error, which scripts can rely on, unlike the message
+const (
+	MISSING_TOKEN_CODE       = "missing_token"
+	INVALID_TOKEN_CODE       = "invalid_token"
+	INACTIVE_USER_CODE       = "inactive_user"
+	INSUFFICIENT_SCOPE_CODE  = "insufficient_scope"
+	FEATURE_NOT_IN_PLAN_CODE = "feature_not_in_plan"
+	FEATURE_DISABLED_CODE    = "feature_disabled"
+	NOT_FOUND_CODE           = "not_found"
+	METHOD_NOT_ALLOWED_CODE  = "method_not_allowed"
+	INVALID_PARAMETER_CODE   = "invalid_parameter"
+	INVALID_BODY_CODE        = "invalid_body"
+	PRECONDITION_FAILED_CODE = "precondition_failed"
+	PLAN_NOT_FOUND_CODE      = "plan_not_found"
+	TEAM_PLAN_ONLY_CODE      = "team_plan_only"
+	INVALID_COUPON_CODE      = "invalid_coupon"
+	NO_SUBSCRIPTION_CODE     = "no_subscription"
+	INTERNAL_ERROR_CODE      = "internal_error"
+)
+
+// XXX_ATTR is an attribute or element's name embedded in html.
+const (
+	PER_PAGE_ATTR = "per_page"
+)
+
+const (
+	API_DEFAULT_PER_PAGE = 20
+	API_MAX_PER_PAGE     = 100
+)
+
+// apiResponse is the envelope of every response of the api with a body, but errors.
+// Meta is only set for lists.
+type apiResponse struct {
+	Data any      `json:"data"`
+	Meta *apiMeta `json:"meta,omitempty"`
+}
+
+// apiMeta is the pagination of a list
+type apiMeta struct {
+	Page    int `json:"page"`
+	PerPage int `json:"per_page"`
+	Total   int `json:"total"`
+	Pages   int `json:"pages"`
+}
+
+func newAPIMeta(page, perPage, total int) *apiMeta {
+	return &apiMeta{
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+		Pages:   (total + perPage - 1) / perPage,
+	}
+}
+
+// apiErrorResponse is the envelope of every error of the api
+type apiErrorResponse struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiProfile is the user as the api shows them
+type apiProfile struct {
+	ID        int           `json:"id"`
+	Email     string        `json:"email"`
+	FirstName string        `json:"first_name"`
+	LastName  string        `json:"last_name"`
+	Role      data.Role     `json:"role"`
+	Currency  data.Currency `json:"currency"`
+	Locale    string        `json:"locale"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+func newAPIProfile(u data.User) apiProfile {
+	return apiProfile{
+		ID:        u.ID,
+		Email:     u.Email,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Role:      u.Role,
+		Currency:  u.Currency,
+		Locale:    u.Locale,
+		CreatedAt: u.CreatedAt,
+	}
+}
+
+// apiPlan is a plan as the api shows it
+type apiPlan struct {
+	ID        int                   `json:"id"`
+	Name      string                `json:"name"`
+	Amount    int                   `json:"amount"` // in minor units of Currency
+	Currency  data.Currency         `json:"currency"`
+	Interval  data.Interval         `json:"interval"`
+	TrialDays int                   `json:"trial_days"`
+	SeatBased bool                  `json:"seat_based"`
+	Features  []data.Feature        `json:"features"`
+	Limits    map[data.LimitKey]int `json:"limits"`
+}
+
+func newAPIPlan(p *data.Plan) apiPlan {
+	return apiPlan{
+		ID:        p.ID,
+		Name:      p.PlanName,
+		Amount:    p.PlanAmount,
+		Currency:  p.Currency,
+		Interval:  p.Interval,
+		TrialDays: p.TrialDays,
+		SeatBased: p.SeatBased,
+		Features:  p.Features,
+		Limits:    p.Limits,
+	}
+}
+
+// apiSubscription is a subscription as the api shows it
+type apiSubscription struct {
+	ID             int           `json:"id"`
+	Plan           *apiPlan      `json:"plan"`
+	Seats          int           `json:"seats"`
+	Currency       data.Currency `json:"currency"`
+	Amount         int           `json:"amount"`          // charged every interval, in minor units of Currency
+	DiscountAmount int           `json:"discount_amount"` // taken off Amount while the discount lasts
+	TrialEndsAt    *time.Time    `json:"trial_ends_at"`
+	NextChargeAt   time.Time     `json:"next_charge_at"`
+	CreatedAt      time.Time     `json:"created_at"`
+}
+
+func newAPISubscription(sub *data.Subscription, plan *data.Plan) apiSubscription {
+	s := apiSubscription{
+		ID:             sub.ID,
+		Seats:          sub.Seats,
+		Currency:       sub.Currency,
+		Amount:         sub.Amount,
+		DiscountAmount: sub.DiscountAmount,
+		NextChargeAt:   sub.NextChargeAt,
+		CreatedAt:      sub.CreatedAt,
+	}
+	if plan != nil {
+		p := newAPIPlan(plan)
+		s.Plan = &p
+	}
+	if sub.TrialEndsAt.Valid {
+		s.TrialEndsAt = &sub.TrialEndsAt.Time
+	}
+	return s
+}
+
+// apiInvoice is an invoice as the api shows it
+type apiInvoice struct {
+	ID             int           `json:"id"`
+	PlanID         int           `json:"plan_id"`
+	PlanName       string        `json:"plan_name"`
+	OrganizationID *int32        `json:"organization_id"`
+	Seats          int           `json:"seats"`
+	Currency       data.Currency `json:"currency"`
+	Amount         int           `json:"amount"` // in minor units of Currency
+	DiscountAmount int           `json:"discount_amount"`
+	PeriodStart    time.Time     `json:"period_start"`
+	PeriodEnd      time.Time     `json:"period_end"`
+	CreatedAt      time.Time     `json:"created_at"`
+}
+
+func newAPIInvoice(inv *data.Invoice) apiInvoice {
+	i := apiInvoice{
+		ID:             inv.ID,
+		PlanID:         inv.PlanID,
+		PlanName:       inv.PlanName,
+		Seats:          inv.Seats,
+		Currency:       inv.Currency,
+		Amount:         inv.Amount,
+		DiscountAmount: inv.DiscountAmount,
+		PeriodStart:    inv.PeriodStart,
+		PeriodEnd:      inv.PeriodEnd,
+		CreatedAt:      inv.CreatedAt,
+	}
+	if inv.OrganizationID.Valid {
+		i.OrganizationID = &inv.OrganizationID.Int32
+	}
+	return i
+}
+
+// apiSubscriptionRequest is the body of a request to change the subscription
+type apiSubscriptionRequest struct {
+	PlanID int    `json:"plan_id"`
+	Coupon string `json:"coupon"`
+}
+
+// writeJSON writes v as the json body of the response, along with its etag. A GET request which already
+// has the same representation, as told by its If-None-Match header, gets a 304 without a body.
+func (s *Server) writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_WRITE_JSON_MSG, err))
+		s.apiError(w, http.StatusInternalServerError, INTERNAL_ERROR_CODE, API_INTERNAL_ERROR_MSG)
+		return
+	}
+
+	etag := etagOf(body)
+	w.Header().Set("ETag", etag)
+	if r.Method == http.MethodGet && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	s.writeBody(w, status, body)
+}
+
+// apiError writes the error in the error envelope of the api
+func (s *Server) apiError(w http.ResponseWriter, status int, code, msg string) {
+	body, _ := json.Marshal(apiErrorResponse{Error: apiErrorBody{Status: status, Code: code, Message: msg}})
+	s.writeBody(w, status, body)
+}
+
+func (s *Server) writeBody(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(append(body, '\n')); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_WRITE_JSON_MSG, err))
+	}
+}
+
+// etagOf returns the strong etag of a json body
+func etagOf(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether the etag is one of those of an If-None-Match or If-Match header.
+// Weak etags are compared as if they were strong, as the api only hands out strong ones.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// apiPagination returns the page and the number of items per page of the query, which default to the
+// first page of API_DEFAULT_PER_PAGE items. ok is false when either can't be used.
+func apiPagination(r *http.Request) (page, perPage int, ok bool) {
+	page, perPage = 1, API_DEFAULT_PER_PAGE
+
+	var err error
+	if v := r.URL.Query().Get(PAGE_ATTR); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return 0, 0, false
+		}
+	}
+	if v := r.URL.Query().Get(PER_PAGE_ATTR); v != "" {
+		if perPage, err = strconv.Atoi(v); err != nil || perPage < 1 || perPage > API_MAX_PER_PAGE {
+			return 0, 0, false
+		}
+	}
+
+	return page, perPage, true
+}
+
+// apiUser returns the user of the api token the request has been authenticated with
+func apiUser(r *http.Request) data.User {
+	user, _ := r.Context().Value(API_USER_CTX).(data.User)
+	return user
+}
+
+// APIMe returns the user of the token
+func (s *Server) APIMe(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, r, http.StatusOK, apiResponse{Data: newAPIProfile(apiUser(r))})
+}
+
+// APIPlans lists the plans, priced in the currency of the user, one page at a time
+func (s *Server) APIPlans(w http.ResponseWriter, r *http.Request) {
+	user := apiUser(r)
+
+	page, perPage, ok := apiPagination(r)
+	if !ok {
+		s.apiError(w, http.StatusBadRequest, INVALID_PARAMETER_CODE, fmt.Sprintf(API_INVALID_PAGE_MSG, API_MAX_PER_PAGE))
+		return
+	}
+
+	plans, err := s.Models.Plan.GetAll()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_ALL_PLANS_MSG, err))
+		s.apiError(w, http.StatusInternalServerError, INTERNAL_ERROR_CODE, API_INTERNAL_ERROR_MSG)
+		return
+	}
+
+	out := make([]apiPlan, 0, perPage)
+	for i := (page - 1) * perPage; i < len(plans) && i < page*perPage; i++ {
+		plans[i].Localize(user.Currency, user.Locale)
+		out = append(out, newAPIPlan(plans[i]))
+	}
+
+	s.writeJSON(w, r, http.StatusOK, apiResponse{Data: out, Meta: newAPIMeta(page, perPage, len(plans))})
+}
+
+// subscriptionResponse returns the response with the subscription of the user, along with its plan.
+// It returns sql.ErrNoRows if the user has no subscription.
+func (s *Server) subscriptionResponse(user data.User) (*apiResponse, error) {
+	sub, err := s.Models.Subscription.GetByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := s.Models.Plan.GetOne(sub.PlanID)
+	if err != nil {
+		return nil, err
+	}
+	plan.Localize(sub.Currency, user.Locale)
+
+	return &apiResponse{Data: newAPISubscription(sub, plan)}, nil
+}
+
+// subscriptionUnchanged reports whether the subscription of the user is still the one the request
+// has read, as told by its If-Match header. A request without the header doesn't care.
+func (s *Server) subscriptionUnchanged(r *http.Request, user data.User) (bool, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true, nil
+	}
+
+	current, err := s.subscriptionResponse(user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	body, err := json.Marshal(current)
+	if err != nil {
+		return false, err
+	}
+	return etagMatches(header, etagOf(body)), nil
+}
+
+// APISubscription returns the subscription of the user, along with its plan
+func (s *Server) APISubscription(w http.ResponseWriter, r *http.Request) {
+	user := apiUser(r)
+
+	resp, err := s.subscriptionResponse(user)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.apiError(w, http.StatusNotFound, NO_SUBSCRIPTION_CODE, API_NO_SUBSCRIPTION_MSG)
+		return
+	}
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SUBSCRIPTION_MSG, user.ID, err))
+		s.apiError(w, http.StatusInternalServerError, INTERNAL_ERROR_CODE, API_INTERNAL_ERROR_MSG)
+		return
+	}
+
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// APIUpdateSubscription subscribes the user to the plan of the body, with its coupon if any,
+// the same way the plans page does
+func (s *Server) APIUpdateSubscription(w http.ResponseWriter, r *http.Request) {
+	user := apiUser(r)
+
+	var req apiSubscriptionRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		s.apiError(w, http.StatusBadRequest, INVALID_BODY_CODE, fmt.Sprintf(API_INVALID_BODY_MSG, err))
+		return
+	}
+	if req.PlanID == 0 {
+		s.apiError(w, http.StatusBadRequest, INVALID_BODY_CODE, API_MISSING_PLAN_MSG)
+		return
+	}
+
+	unchanged, err := s.subscriptionUnchanged(r, user)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SUBSCRIPTION_MSG, user.ID, err))
+		s.apiError(w, http.StatusInternalServerError, INTERNAL_ERROR_CODE, API_INTERNAL_ERROR_MSG)
+		return
+	}
+	if !unchanged {
+		s.apiError(w, http.StatusPreconditionFailed, PRECONDITION_FAILED_CODE, API_PRECONDITION_FAILED_MSG)
+		return
+	}
+
+	if _, err := s.subscribeUser(r, user, req.PlanID, strings.TrimSpace(req.Coupon)); err != nil {
+		status, code := subscribeErrorCode(err)
+		if status == http.StatusInternalServerError {
+			s.ErrorLog.Println(fmt.Errorf(ERROR_SUBSCRIBE_MSG, user.ID, err))
+		}
+		s.apiError(w, status, code, subscribeErrorMessage(err))
+		return
+	}
+
+	resp, err := s.subscriptionResponse(user)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SUBSCRIPTION_MSG, user.ID, err))
+		s.apiError(w, http.StatusInternalServerError, INTERNAL_ERROR_CODE, API_INTERNAL_ERROR_MSG)
+		return
+	}
+
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// APICancelSubscription ends the subscription of the user at once
+func (s *Server) APICancelSubscription(w http.ResponseWriter, r *http.Request) {
+	user := apiUser(r)
+
+	unchanged, err := s.subscriptionUnchanged(r, user)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SUBSCRIPTION_MSG, user.ID, err))
+		s.apiError(w, http.StatusInternalServerError, INTERNAL_ERROR_CODE, API_INTERNAL_ERROR_MSG)
+		return
+	}
+	if !unchanged {
+		s.apiError(w, http.StatusPreconditionFailed, PRECONDITION_FAILED_CODE, API_PRECONDITION_FAILED_MSG)
+		return
+	}
+
+	err = s.cancelSubscription(r, user)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.apiError(w, http.StatusNotFound, NO_SUBSCRIPTION_CODE, API_NO_SUBSCRIPTION_MSG)
+		return
+	}
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_CANCEL_MSG, user.ID, err))
+		s.apiError(w, http.StatusInternalServerError, INTERNAL_ERROR_CODE, API_INTERNAL_ERROR_MSG)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APIInvoices lists the invoices the user has paid, newest first, one page at a time
+func (s *Server) APIInvoices(w http.ResponseWriter, r *http.Request) {
+	user := apiUser(r)
+
+	page, perPage, ok := apiPagination(r)
+	if !ok {
+		s.apiError(w, http.StatusBadRequest, INVALID_PARAMETER_CODE, fmt.Sprintf(API_INVALID_PAGE_MSG, API_MAX_PER_PAGE))
+		return
+	}
+
+	invoices, total, err := s.Models.Invoice.GetByUserID(user.ID, perPage, (page-1)*perPage)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_INVOICES_MSG, user.ID, err))
+		s.apiError(w, http.StatusInternalServerError, INTERNAL_ERROR_CODE, API_INTERNAL_ERROR_MSG)
+		return
+	}
+
+	out := make([]apiInvoice, 0, len(invoices))
+	for _, inv := range invoices {
+		out = append(out, newAPIInvoice(inv))
+	}
+
+	s.writeJSON(w, r, http.StatusOK, apiResponse{Data: out, Meta: newAPIMeta(page, perPage, total)})
+}
+
+// subscribeErrorCode returns the status and the code of the api error when the user can't be subscribed
+func subscribeErrorCode(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrPlanNotFound):
+		return http.StatusUnprocessableEntity, PLAN_NOT_FOUND_CODE
+	case errors.Is(err, ErrTeamPlanOnly):
+		return http.StatusUnprocessableEntity, TEAM_PLAN_ONLY_CODE
+	case errors.Is(err, ErrUnknownCoupon),
+		errors.Is(err, data.ErrCouponExpired),
+		errors.Is(err, data.ErrCouponNotRedeemable),
+		errors.Is(err, data.ErrCouponRedeemed),
+		errors.Is(err, data.ErrCouponCurrency):
+		return http.StatusUnprocessableEntity, INVALID_COUPON_CODE
+	default:
+		return http.StatusInternalServerError, INTERNAL_ERROR_CODE
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+// newTestAPIToken records a new api token of the user, and returns it
+func newTestAPIToken(t *testing.T, userID int, expiresAt sql.NullTime, scopes ...data.APIScope) string {
+	token, err := data.NewAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = testServer.Models.APIToken.Insert(data.APIToken{
+		UserID:    userID,
+		Name:      "test",
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func Test_API(t *testing.T) {
+	plansOnly := newTestAPIToken(t, 1, sql.NullTime{}, data.ReadPlans)
+	everything := newTestAPIToken(t, 1, sql.NullTime{Time: time.Now().Add(time.Hour), Valid: true}, data.AllAPIScopes...)
+	expired := newTestAPIToken(t, 1, sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true}, data.AllAPIScopes...)
+	inactive := newTestAPIToken(t, 3, sql.NullTime{}, data.AllAPIScopes...)
+
+	tests := map[string]struct {
+		path               string
+		authorization      string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		"no token":            {APIPlansPath, "", http.StatusUnauthorized, API_MISSING_TOKEN_MSG},
+		"not a bearer token":  {APIPlansPath, "Basic " + plansOnly, http.StatusUnauthorized, MISSING_TOKEN_CODE},
+		"unknown token":       {APIPlansPath, "Bearer " + data.APITokenPrefix + "unknown", http.StatusUnauthorized, API_INVALID_TOKEN_MSG},
+		"expired token":       {APIPlansPath, "Bearer " + expired, http.StatusUnauthorized, INVALID_TOKEN_CODE},
+		"inactive user":       {APIPlansPath, "Bearer " + inactive, http.StatusUnauthorized, INACTIVE_USER_CODE},
+		"plans":               {APIPlansPath, "Bearer " + plansOnly, http.StatusOK, `"name":"Bronze Plan"`},
+		"plans meta":          {APIPlansPath, "Bearer " + plansOnly, http.StatusOK, `"meta":{"page":1,"per_page":20,"total":2,"pages":1}`},
+		"second page":         {APIPlansPath + "?page=2&per_page=1", "Bearer " + plansOnly, http.StatusOK, `"name":"Team Plan"`},
+		"past the last page":  {APIPlansPath + "?page=3&per_page=1", "Bearer " + plansOnly, http.StatusOK, `"data":[]`},
+		"invalid page":        {APIPlansPath + "?page=0", "Bearer " + plansOnly, http.StatusBadRequest, INVALID_PARAMETER_CODE},
+		"too many per page":   {APIPlansPath + "?per_page=101", "Bearer " + plansOnly, http.StatusBadRequest, INVALID_PARAMETER_CODE},
+		"missing scope":       {APISubscriptionPath, "Bearer " + plansOnly, http.StatusForbidden, fmt.Sprintf(API_INSUFFICIENT_SCOPE_MSG, data.ReadSubscription)},
+		"me":                  {APIMePath, "Bearer " + everything, http.StatusOK, `"email":"admin@example.com"`},
+		"subscription":        {APISubscriptionPath, "Bearer " + everything, http.StatusOK, `"plan":{"id":1,"name":"Bronze Plan"`},
+		"invoices":            {APIInvoicesPath, "Bearer " + everything, http.StatusOK, `"meta":{"page":1,"per_page":20`},
+		"unknown api path":    {API_V1_PATH + "/unknown", "Bearer " + everything, http.StatusNotFound, `"code":"not_found"`},
+		"case of the scheme":  {APIPlansPath, "bearer " + plansOnly, http.StatusOK, `"data":[`},
+		"token after revoked": {APIPlansPath, "Bearer " + newRevokedAPIToken(t), http.StatusUnauthorized, API_INVALID_TOKEN_MSG},
+	}
+
+	handler := testServer.routes()
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatusCode {
+				t.Errorf("expected status code %d; got %d", tt.expectedStatusCode, w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected a json response; got %q", ct)
+			}
+			if !json.Valid(w.Body.Bytes()) {
+				t.Errorf("expected valid json; got %s", w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.expectedBody) {
+				t.Errorf("expected %s in the body; got %s", tt.expectedBody, w.Body.String())
+			}
+			if cookie := w.Header().Get("Set-Cookie"); cookie != "" {
+				t.Errorf("expected the api not to use the session; got cookie %s", cookie)
+			}
+		})
+	}
+
+	if apiToken, _ := testServer.Models.APIToken.GetByToken(plansOnly); !apiToken.LastUsedAt.Valid {
+		t.Error("expected the use of the token to be recorded")
+	}
+}
+
+func Test_API_ETag(t *testing.T) {
+	token := newTestAPIToken(t, 1, sql.NullTime{}, data.ReadPlans)
+	handler := testServer.routes()
+
+	req := httptest.NewRequest(http.MethodGet, APIPlansPath, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an etag")
+	}
+
+	// the same representation isn't sent twice
+	req = httptest.NewRequest(http.MethodGet, APIPlansPath, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected status code %d; got %d", http.StatusNotModified, w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("expected no body; got %s", w.Body.String())
+	}
+
+	// another page is another representation
+	req = httptest.NewRequest(http.MethodGet, APIPlansPath+"?per_page=1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d; got %d", http.StatusOK, w.Code)
+	}
+}
+
+func Test_API_Subscription(t *testing.T) {
+	readOnly := newTestAPIToken(t, 1, sql.NullTime{}, data.ReadSubscription)
+	everything := newTestAPIToken(t, 1, sql.NullTime{}, data.AllAPIScopes...)
+	handler := testServer.routes()
+
+	// the etag of the subscription as it is
+	req := httptest.NewRequest(http.MethodGet, APISubscriptionPath, nil)
+	req.Header.Set("Authorization", "Bearer "+everything)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	etag := w.Header().Get("ETag")
+
+	tests := map[string]struct {
+		method             string
+		token              string
+		body               string
+		ifMatch            string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		"subscribe":              {http.MethodPut, everything, `{"plan_id":1}`, "", http.StatusOK, `"plan":{"id":1,"name":"Bronze Plan"`},
+		"subscribe if unchanged": {http.MethodPut, everything, `{"plan_id":1}`, etag, http.StatusOK, `"data":{"id":1`},
+		"subscribe if changed":   {http.MethodPut, everything, `{"plan_id":1}`, `"stale"`, http.StatusPreconditionFailed, PRECONDITION_FAILED_CODE},
+		"subscribe with coupon":  {http.MethodPut, everything, `{"plan_id":1,"coupon":"unknown"}`, "", http.StatusUnprocessableEntity, INVALID_COUPON_CODE},
+		"subscribe to team plan": {http.MethodPut, everything, `{"plan_id":5}`, "", http.StatusUnprocessableEntity, TEAM_PLAN_ONLY_CODE},
+		"subscribe without plan": {http.MethodPut, everything, `{}`, "", http.StatusBadRequest, API_MISSING_PLAN_MSG},
+		"unknown field":          {http.MethodPut, everything, `{"plan":1}`, "", http.StatusBadRequest, INVALID_BODY_CODE},
+		"not json":               {http.MethodPut, everything, `plan_id=1`, "", http.StatusBadRequest, INVALID_BODY_CODE},
+		"read only token":        {http.MethodPut, readOnly, `{"plan_id":1}`, "", http.StatusForbidden, INSUFFICIENT_SCOPE_CODE},
+		"cancel if changed":      {http.MethodDelete, everything, "", `"stale"`, http.StatusPreconditionFailed, PRECONDITION_FAILED_CODE},
+		"method not allowed":     {http.MethodPost, everything, `{"plan_id":1}`, "", http.StatusMethodNotAllowed, METHOD_NOT_ALLOWED_CODE},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, APISubscriptionPath, strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			req.Header.Set("Content-Type", "application/json")
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatusCode {
+				t.Errorf("expected status code %d; got %d", tt.expectedStatusCode, w.Code)
+			}
+			if !strings.Contains(w.Body.String(), tt.expectedBody) {
+				t.Errorf("expected %s in the body; got %s", tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+
+	testServer.AsyncJob.Wait()
+
+	// cancelling goes last, so that it is the last plan change audited
+	req = httptest.NewRequest(http.MethodDelete, APISubscriptionPath, nil)
+	req.Header.Set("Authorization", "Bearer "+everything)
+	req.Header.Set("If-Match", etag)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status code %d; got %d", http.StatusNoContent, w.Code)
+	}
+	event := lastAuditEvent(t, data.AuditFilter{Action: data.PlanChanged})
+	if event.Diff["plan"].To != nil {
+		t.Errorf("expected the last plan change to be a cancellation; got %v", event.Diff["plan"])
+	}
+}
+
+func Test_APIAuth_PlanWithoutAPIAccess(t *testing.T) {
+	token := newTestAPIToken(t, 1, sql.NullTime{}, data.ReadPlans)
+	handler := testServer.routes()
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, APIPlansPath, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get(); w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d; got %d", http.StatusOK, w.Code)
+	}
+
+	// downgrading to a plan without api access refuses the tokens the user already has
+	user := data.User{ID: 1}
+	if _, err := testServer.Models.Plan.SubscribeUserToPlan(user, data.Plan{ID: 99, PlanName: "Free Plan"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		plan, _ := testServer.Models.Plan.GetOne(1)
+		_, _ = testServer.Models.Plan.SubscribeUserToPlan(user, *plan, nil)
+	}()
+
+	w := get()
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status code %d; got %d", http.StatusForbidden, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), FEATURE_NOT_IN_PLAN_CODE) {
+		t.Errorf("expected %s in the body; got %s", FEATURE_NOT_IN_PLAN_CODE, w.Body.String())
+	}
+}
+
+// newRevokedAPIToken records a new api token of user 1, and revokes it at once
+func newRevokedAPIToken(t *testing.T) string {
+	token := newTestAPIToken(t, 1, sql.NullTime{}, data.AllAPIScopes...)
+
+	apiToken, err := testServer.Models.APIToken.GetByToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testServer.Models.APIToken.Revoke(1, apiToken.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func Test_CreateAPIToken_Limit(t *testing.T) {
+	// user 6 has as many tokens as the sample plan allows, expired ones aside
+	newTestAPIToken(t, 6, sql.NullTime{}, data.ReadPlans)
+	newTestAPIToken(t, 6, sql.NullTime{}, data.ReadPlans)
+	newTestAPIToken(t, 6, sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true}, data.ReadPlans)
+
+	body := url.Values{
+		TOKEN_NAME_ATTR: {"one too many"},
+		SCOPE_ATTR:      {string(data.ReadPlans)},
+		EXPIRES_IN_ATTR: {"30"},
+	}
+	req := newReqWithSession(httptest.NewRequest(http.MethodPost, MembersProfileTokensPath, strings.NewReader(body.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	testServer.Session.Put(req.Context(), USER_CTX, data.User{ID: 6, Email: "sso@example.com"})
+	w := httptest.NewRecorder()
+	testServer.CreateAPIToken(w, req)
+
+	expected := fmt.Sprintf(API_TOKEN_LIMIT_MSG, 2)
+	if msg := testServer.Session.GetString(req.Context(), ERROR_CTX); msg != expected {
+		t.Errorf("expected error message %q; got %q", expected, msg)
+	}
+	if tokens, _ := testServer.Models.APIToken.GetByUserID(6); len(tokens) != 3 {
+		t.Errorf("expected no token to be created; got %d tokens", len(tokens))
+	}
+}
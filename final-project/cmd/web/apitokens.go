@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	API_TOKEN_CREATED_MSG       = "Your API token has been created. Copy it now, as it won't be shown again."
+	API_TOKEN_REVOKED_MSG       = "The API token has been revoked."
+	API_TOKEN_LIMIT_MSG         = "Your plan allows %d API tokens. Revoke one first, or upgrade your plan."
+	UNKNOWN_API_TOKEN_MSG       = "The API token has already been revoked."
+	UNSUCCESSFUL_API_TOKEN_MSG  = "Unable to create the API token."
+	UNSUCCESSFUL_REVOKE_API_MSG = "Unable to revoke the API token."
+	NO_SCOPE_MSG                = "Choose what the token may be used for."
+	INVALID_EXPIRY_MSG          = "Choose when the token expires."
+	ERROR_GET_API_TOKENS_MSG    = "error getting api tokens of user %d: %w"
+	ERROR_CREATE_API_TOKEN_MSG  = "error creating api token of user %d: %w"
+	ERROR_REVOKE_API_TOKEN_MSG  = "error revoking api token %d of user %d: %w"
+)
+
+// XXX_ATTR is an attribute or element's name embedded in html.
+const (
+	API_TOKENS_ATTR      = "api-tokens"
+	API_TOKEN_LIMIT_ATTR = "api-token-limit"
+	API_SCOPES_ATTR      = "api-scopes"
+	NEW_API_TOKEN_ATTR   = "new-api-token"
+	TOKEN_NAME_ATTR      = "token-name"
+	TOKEN_ID_ATTR        = "token-id"
+	SCOPE_ATTR           = "scope"
+	EXPIRES_IN_ATTR      = "expires-in"
+)
+
+// apiTokenExpiries are the numbers of days an api token may last for, 0 being never expiring
+var apiTokenExpiries = []int{30, 90, 365, 0}
+
+// CreateAPIToken creates a named api token for the user, with the scopes and expiry of the form,
+// as long as their plan allows for one more. The token is shown on the page once, and never stored.
+func (s *Server) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required(TOKEN_NAME_ATTR)
+
+	var scopes []data.APIScope
+	for _, scope := range r.PostForm[SCOPE_ATTR] {
+		if data.APIScope(scope).Valid() {
+			scopes = append(scopes, data.APIScope(scope))
+		}
+	}
+	if len(scopes) == 0 {
+		form.Errors.Add(SCOPE_ATTR, NO_SCOPE_MSG)
+	}
+
+	days, err := strconv.Atoi(form.Get(EXPIRES_IN_ATTR))
+	if err != nil || !validExpiry(days) {
+		form.Errors.Add(EXPIRES_IN_ATTR, INVALID_EXPIRY_MSG)
+	}
+
+	if !form.Valid() {
+		form.Set(FIRST_NAME_ATTR, user.FirstName)
+		form.Set(LAST_NAME_ATTR, user.LastName)
+		s.renderProfile(w, r, user, form, "")
+		return
+	}
+
+	tokens, err := s.Models.APIToken.GetByUserID(user.ID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_API_TOKENS_MSG, user.ID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_API_TOKEN_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	limit, err := s.Models.Entitlement.Limit(user, data.MaxAPITokens)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_CHECK_ENTITLEMENT_MSG, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_API_TOKEN_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	if activeAPITokens(tokens, time.Now()) >= limit {
+		s.Session.Put(r.Context(), ERROR_CTX, fmt.Sprintf(API_TOKEN_LIMIT_MSG, limit))
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+
+	token, err := data.NewAPIToken()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_CREATE_API_TOKEN_MSG, user.ID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_API_TOKEN_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+
+	apiToken := data.APIToken{
+		UserID: user.ID,
+		Name:   strings.TrimSpace(form.Get(TOKEN_NAME_ATTR)),
+		Scopes: scopes,
+	}
+	if days > 0 {
+		apiToken.ExpiresAt = sql.NullTime{Time: time.Now().AddDate(0, 0, days), Valid: true}
+	}
+	if _, err := s.Models.APIToken.Insert(apiToken, token); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_CREATE_API_TOKEN_MSG, user.ID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_API_TOKEN_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.APITokenCreated, user.ID, user.ID, change("name", nil, apiToken.Name))
+
+	// render rather than redirect, so that the token never goes through the session
+	s.Session.Put(r.Context(), FLASH_CTX, API_TOKEN_CREATED_MSG)
+	s.renderProfile(w, r, user, NewForm(url.Values{
+		FIRST_NAME_ATTR: {user.FirstName},
+		LAST_NAME_ATTR:  {user.LastName},
+	}), token)
+}
+
+// RevokeAPIToken deletes one of the api tokens of the user, which stops working at once
+func (s *Server) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	userID := s.Session.GetInt(r.Context(), USER_ID_CTX)
+	id, _ := strconv.Atoi(r.Form.Get(TOKEN_ID_ATTR))
+
+	err = s.Models.APIToken.Revoke(userID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.Session.Put(r.Context(), ERROR_CTX, UNKNOWN_API_TOKEN_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_REVOKE_API_TOKEN_MSG, id, userID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_REVOKE_API_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.APITokenRevoked, userID, userID, nil)
+
+	s.Session.Put(r.Context(), FLASH_CTX, API_TOKEN_REVOKED_MSG)
+	http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+}
+
+// validExpiry reports whether the number of days is one of apiTokenExpiries
+func validExpiry(days int) bool {
+	for _, d := range apiTokenExpiries {
+		if d == days {
+			return true
+		}
+	}
+	return false
+}
+
+// activeAPITokens returns how many of the tokens haven't expired, which are those the plan limits
+func activeAPITokens(tokens []*data.APIToken, now time.Time) int {
+	n := 0
+	for _, token := range tokens {
+		if !token.Expired(now) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	SPEC_UNDOCUMENTED_STATUS_MSG = "%s %s answered %d, which the spec doesn't document"
+	SPEC_UNEXPECTED_BODY_MSG     = "%s %s answered %d with a body, which the spec doesn't document"
+	SPEC_INVALID_RESPONSE_MSG    = "%s %s answered %d with a body not matching the spec: %w"
+	SPEC_ACCEPTED_INVALID_MSG    = "%s %s accepted a request body not matching the spec: %w"
+)
+
+// bufferedResponse holds a response until it has been checked against the spec
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// ValidateAPI checks every request and response of the api against apiSpec, and reports those which don't
+// match it to APISpecViolation. The response is sent as is either way. Requests the handler rejects aren't
+// checked, as rejecting them is what the handler is for.
+func (s *Server) ValidateAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody []byte
+		if r.Body != nil {
+			reqBody, _ = io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(reqBody))
+		}
+
+		resp := &bufferedResponse{header: w.Header()}
+		next.ServeHTTP(resp, r)
+		if resp.status == 0 {
+			resp.status = http.StatusOK
+		}
+
+		w.WriteHeader(resp.status)
+		if _, err := w.Write(resp.body.Bytes()); err != nil {
+			s.ErrorLog.Println(fmt.Errorf(ERROR_WRITE_JSON_MSG, err))
+		}
+
+		if err := apiSpec.check(r.Method, strings.TrimPrefix(r.URL.Path, API_V1_PATH), reqBody, resp.status, resp.body.Bytes()); err != nil {
+			s.APISpecViolation(err)
+		}
+	})
+}
+
+// check reports whether an exchange with the api is the way the spec describes it. Paths are matched
+// as they are, as the api has no path parameters. A path or method the api doesn't have is answered
+// with an ErrorResponse.
+func (d *openAPIDocument) check(method, path string, reqBody []byte, status int, body []byte) error {
+	op := d.operation(method, path)
+
+	var resp *openAPIResponse
+	if op == nil {
+		resp = &openAPIResponse{Content: map[string]openAPIMediaType{JSON_CONTENT_TYPE: {Schema: schemaRef("ErrorResponse")}}}
+	} else {
+		resp = op.Responses[statusKey(status)]
+		if resp == nil {
+			return fmt.Errorf(SPEC_UNDOCUMENTED_STATUS_MSG, method, path, status)
+		}
+	}
+
+	content, ok := resp.Content[JSON_CONTENT_TYPE]
+	if !ok {
+		if len(bytes.TrimSpace(body)) > 0 {
+			return fmt.Errorf(SPEC_UNEXPECTED_BODY_MSG, method, path, status)
+		}
+	} else if err := d.validateJSON(content.Schema, body); err != nil {
+		return fmt.Errorf(SPEC_INVALID_RESPONSE_MSG, method, path, status, err)
+	}
+
+	// a request the handler took must have been one the spec allows
+	if op != nil && op.RequestBody != nil && status < http.StatusBadRequest {
+		if err := d.validateJSON(op.RequestBody.Content[JSON_CONTENT_TYPE].Schema, reqBody); err != nil {
+			return fmt.Errorf(SPEC_ACCEPTED_INVALID_MSG, method, path, err)
+		}
+	}
+
+	return nil
+}
+
+// validateJSON reports whether the json body matches the schema
+func (d *openAPIDocument) validateJSON(schema *openAPISchema, body []byte) error {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return err
+	}
+	return d.validate(schema, v, "$")
+}
+
+// validate reports whether the decoded json value matches the schema. at is where the value is in the body.
+func (d *openAPIDocument) validate(schema *openAPISchema, v any, at string) error {
+	schema = d.schema(schema)
+	if schema == nil {
+		return fmt.Errorf("%s: unknown schema", at)
+	}
+
+	if v == nil {
+		if schema.Nullable {
+			return nil
+		}
+		return fmt.Errorf("%s: null isn't allowed", at)
+	}
+
+	for _, sub := range schema.AllOf {
+		if err := d.validate(sub, v, at); err != nil {
+			return err
+		}
+	}
+
+	if len(schema.Enum) > 0 && !inEnum(schema.Enum, v) {
+		return fmt.Errorf("%s: %v isn't one of %v", at, v, schema.Enum)
+	}
+
+	switch schema.Type {
+	case "":
+		return nil
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s: expected a string; got %T", at, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: expected a boolean; got %T", at, v)
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != math.Trunc(n) {
+			return fmt.Errorf("%s: expected an integer; got %v", at, v)
+		}
+		if schema.Minimum != nil && n < float64(*schema.Minimum) {
+			return fmt.Errorf("%s: %v is less than %d", at, n, *schema.Minimum)
+		}
+		if schema.Maximum != nil && n > float64(*schema.Maximum) {
+			return fmt.Errorf("%s: %v is more than %d", at, n, *schema.Maximum)
+		}
+	case "array":
+		items, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("%s: expected an array; got %T", at, v)
+		}
+		for i, item := range items {
+			if err := d.validate(schema.Items, item, at+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected an object; got %T", at, v)
+		}
+		return d.validateObject(schema, obj, at)
+	default:
+		return fmt.Errorf("%s: unknown type %s", at, schema.Type)
+	}
+
+	return nil
+}
+
+func (d *openAPIDocument) validateObject(schema *openAPISchema, obj map[string]any, at string) error {
+	for _, name := range schema.Required {
+		if _, ok := obj[name]; !ok {
+			return fmt.Errorf("%s: missing %s", at, name)
+		}
+	}
+
+	// in order, so that the same body always fails the same way
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		property, ok := schema.Properties[name]
+		if !ok {
+			switch extra := schema.AdditionalProperties.(type) {
+			case *openAPISchema:
+				property = extra
+			case bool:
+				if !extra {
+					return fmt.Errorf("%s: unexpected %s", at, name)
+				}
+				continue
+			default:
+				continue
+			}
+		}
+		if err := d.validate(property, obj[name], at+"."+name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func inEnum(enum []any, v any) bool {
+	for _, e := range enum {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
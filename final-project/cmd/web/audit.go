@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// XXX_PAGE is the name of the template gohtml file to render for the page
+const (
+	AUDIT_PAGE = "audit.page.gohtml"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	ERROR_AUDIT_MSG       = "error recording %s in the audit log: %w"
+	ERROR_FIND_AUDIT_MSG  = "error finding events in the audit log: %w"
+	ERROR_WRITE_AUDIT_MSG = "error writing the audit log export: %w"
+)
+
+// XXX_ATTR is an attribute or element's name embedded in html.
+const (
+	EVENTS_ATTR  = "events"
+	ACTIONS_ATTR = "actions"
+	ACTION_ATTR  = "action"
+	ACTOR_ATTR   = "actor"
+	TARGET_ATTR  = "target"
+	SINCE_ATTR   = "since"
+	UNTIL_ATTR   = "until"
+	EXPORT_ATTR  = "export"
+)
+
+const (
+	EVENTS_PER_PAGE   = 50
+	AUDIT_DATE_FORMAT = "2006-01-02"
+	AUDIT_EXPORT_NAME = "audit-log.csv"
+)
+
+// audit appends an event to the audit log, along with the ip and the id of the request.
+// The ids are 0 when there is no actor or target, and diff is nil when nothing has changed.
+// Failing to record the event doesn't undo the action, which has been taken already.
+func (s *Server) audit(r *http.Request, action data.AuditAction, actorID, targetID int, diff data.AuditDiff) {
+	event := data.AuditEvent{
+		Action:    action,
+		ActorID:   sql.NullInt32{Int32: int32(actorID), Valid: actorID != 0},
+		TargetID:  sql.NullInt32{Int32: int32(targetID), Valid: targetID != 0},
+		IP:        clientIP(r),
+		RequestID: middleware.GetReqID(r.Context()),
+		Diff:      diff,
+	}
+
+	if err := s.Models.Audit.Insert(event); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_AUDIT_MSG, action, err))
+	}
+}
+
+// auditJob appends an event to the audit log for a background job, which has no request, so no ip nor request id
+func (s *Server) auditJob(action data.AuditAction, actorID, targetID int, diff data.AuditDiff) {
+	event := data.AuditEvent{
+		Action:   action,
+		ActorID:  sql.NullInt32{Int32: int32(actorID), Valid: actorID != 0},
+		TargetID: sql.NullInt32{Int32: int32(targetID), Valid: targetID != 0},
+		Diff:     diff,
+	}
+
+	if err := s.Models.Audit.Insert(event); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_AUDIT_MSG, action, err))
+	}
+}
+
+// change returns the diff of a single field
+func change(field string, from, to any) data.AuditDiff {
+	return data.AuditDiff{field: {From: from, To: to}}
+}
+
+// emailHash returns the email as the audit log records it. The log can't be changed, so it never keeps
+// the address itself, which would outlive the account, but the events of an address can still be found by its hash.
+func emailHash(email string) string {
+	sum := sha256.Sum256([]byte(normalizeEmail(email)))
+	return hex.EncodeToString(sum[:])
+}
+
+// planName returns the name of the plan for the diff of a plan change, or nil if there is none
+func planName(plan *data.Plan) any {
+	if plan == nil {
+		return nil
+	}
+	return plan.PlanName
+}
+
+// AdminAuditPage lists the events of the audit log matching the filter, newest first, one page at a time
+func (s *Server) AdminAuditPage(w http.ResponseWriter, r *http.Request) {
+	filter := auditFilter(r.URL.Query())
+	page, _ := strconv.Atoi(r.URL.Query().Get(PAGE_ATTR))
+	if page < 1 {
+		page = 1
+	}
+
+	events, total, err := s.Models.Audit.Find(filter, EVENTS_PER_PAGE, (page-1)*EVENTS_PER_PAGE)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_FIND_AUDIT_MSG, err))
+	}
+
+	pages := (total + EVENTS_PER_PAGE - 1) / EVENTS_PER_PAGE
+	stringMap := map[string]string{
+		ACTION_ATTR: r.URL.Query().Get(ACTION_ATTR),
+		ACTOR_ATTR:  r.URL.Query().Get(ACTOR_ATTR),
+		TARGET_ATTR: r.URL.Query().Get(TARGET_ATTR),
+		SINCE_ATTR:  r.URL.Query().Get(SINCE_ATTR),
+		UNTIL_ATTR:  r.URL.Query().Get(UNTIL_ATTR),
+		EXPORT_ATTR: auditPageURL(AdminAuditExportPath, r.URL.Query(), 0),
+	}
+	if page > 1 {
+		stringMap[PREV_PAGE_ATTR] = auditPageURL(AdminAuditPath, r.URL.Query(), page-1)
+	}
+	if page < pages {
+		stringMap[NEXT_PAGE_ATTR] = auditPageURL(AdminAuditPath, r.URL.Query(), page+1)
+	}
+
+	dataMap := make(map[string]any)
+	dataMap[EVENTS_ATTR] = events
+	dataMap[ACTIONS_ATTR] = data.AllAuditActions
+
+	s.render(w, r, AUDIT_PAGE, &TemplateData{
+		StringMap: stringMap,
+		IntMap: map[string]int{
+			PAGE_ATTR:  page,
+			PAGES_ATTR: pages,
+			TOTAL_ATTR: total,
+		},
+		Data: dataMap,
+	})
+}
+
+// AdminAuditExport downloads all the events of the audit log matching the filter as csv, newest first
+func (s *Server) AdminAuditExport(w http.ResponseWriter, r *http.Request) {
+	events, _, err := s.Models.Audit.Find(auditFilter(r.URL.Query()), 0, 0)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_FIND_AUDIT_MSG, err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", AUDIT_EXPORT_NAME))
+
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"id", "created_at", "action", "actor_id", "target_id", "ip", "request_id", "diff"})
+	for _, e := range events {
+		_ = cw.Write([]string{
+			strconv.Itoa(e.ID),
+			e.CreatedAt.UTC().Format(time.RFC3339),
+			string(e.Action),
+			nullID(e.ActorID),
+			nullID(e.TargetID),
+			e.IP,
+			e.RequestID,
+			e.Diff.String(),
+		})
+	}
+	cw.Flush()
+
+	if err := cw.Error(); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_WRITE_AUDIT_MSG, err))
+	}
+}
+
+// auditFilter returns the filter of the audit log in the query. Values which can't be parsed are ignored,
+// and the until day is included.
+func auditFilter(q url.Values) data.AuditFilter {
+	filter := data.AuditFilter{
+		Action: data.AuditAction(q.Get(ACTION_ATTR)),
+	}
+	filter.ActorID, _ = strconv.Atoi(q.Get(ACTOR_ATTR))
+	filter.TargetID, _ = strconv.Atoi(q.Get(TARGET_ATTR))
+
+	if since, err := time.Parse(AUDIT_DATE_FORMAT, q.Get(SINCE_ATTR)); err == nil {
+		filter.Since = since
+	}
+	if until, err := time.Parse(AUDIT_DATE_FORMAT, q.Get(UNTIL_ATTR)); err == nil {
+		filter.Until = until.AddDate(0, 0, 1)
+	}
+
+	return filter
+}
+
+// auditPageURL returns the url of the path with the filter of the query, and the page if it isn't 0
+func auditPageURL(path string, query url.Values, page int) string {
+	q := url.Values{}
+	for _, attr := range []string{ACTION_ATTR, ACTOR_ATTR, TARGET_ATTR, SINCE_ATTR, UNTIL_ATTR} {
+		if v := query.Get(attr); v != "" {
+			q.Set(attr, v)
+		}
+	}
+	if page != 0 {
+		q.Set(PAGE_ATTR, strconv.Itoa(page))
+	}
+
+	if len(q) == 0 {
+		return path
+	}
+	return path + "?" + q.Encode()
+}
+
+// nullID returns the id as a string, or an empty string if it's null
+func nullID(id sql.NullInt32) string {
+	if !id.Valid {
+		return ""
+	}
+	return strconv.Itoa(int(id.Int32))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func Test_auditFilter(t *testing.T) {
+	tests := map[string]struct {
+		query url.Values
+		want  data.AuditFilter
+	}{
+		"no filter": {
+			query: url.Values{},
+			want:  data.AuditFilter{},
+		},
+		"every field": {
+			query: url.Values{
+				ACTION_ATTR: {"login.failure"},
+				ACTOR_ATTR:  {"1"},
+				TARGET_ATTR: {"2"},
+				SINCE_ATTR:  {"2024-03-01"},
+				UNTIL_ATTR:  {"2024-03-31"},
+			},
+			want: data.AuditFilter{
+				Action:   data.LoginFailed,
+				ActorID:  1,
+				TargetID: 2,
+				Since:    time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+				Until:    time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		"invalid values": {
+			query: url.Values{
+				ACTOR_ATTR: {"admin"},
+				SINCE_ATTR: {"yesterday"},
+			},
+			want: data.AuditFilter{},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := auditFilter(tt.query); got != tt.want {
+				t.Errorf("expected %+v; got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+// lastAuditEvent returns the newest event of the audit log matching the filter
+func lastAuditEvent(t *testing.T, filter data.AuditFilter) data.AuditEvent {
+	events, _, err := testServer.Models.Audit.Find(filter, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 {
+		t.Fatalf("expected an event matching %+v to be recorded", filter)
+	}
+	return *events[0]
+}
+
+func Test_Login_Audited(t *testing.T) {
+	body := url.Values{EMAIL_ATTR: {"admin@example.com"}, PASSWORD_ATTR: {"abc123abc123abc123abc123"}}
+	rawReq, _ := http.NewRequest(http.MethodPost, LOGIN_PATH, strings.NewReader(body.Encode()))
+	rawReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rawReq.RemoteAddr = "192.0.2.10:1234"
+	r := newReqWithSession(rawReq)
+
+	middleware.RequestID(http.HandlerFunc(testServer.Login)).ServeHTTP(httptest.NewRecorder(), r)
+
+	e := lastAuditEvent(t, data.AuditFilter{Action: data.LoginSucceeded, TargetID: 1})
+	if e.ActorID.Int32 != 1 {
+		t.Errorf("expected the user to be the actor; got %+v", e.ActorID)
+	}
+	if e.IP != "192.0.2.10" {
+		t.Errorf("expected the ip of the request; got %q", e.IP)
+	}
+	if e.RequestID == "" {
+		t.Error("expected the id of the request to be recorded")
+	}
+
+	r = newReqWithSession(httptest.NewRequest(http.MethodPost, LOGIN_PATH, nil))
+	testServer.loginFailed(r, "nobody@example.com", clientIP(r), nil)
+
+	e = lastAuditEvent(t, data.AuditFilter{Action: data.LoginFailed})
+	if e.ActorID.Valid || e.TargetID.Valid {
+		t.Errorf("expected no actor nor target for an unknown email; got %+v", e)
+	}
+	if got := e.Diff["email_hash"].To; got != emailHash("Nobody@example.com") {
+		t.Errorf("expected the hash of the email to be recorded; got %v", got)
+	}
+}
+
+func Test_AdminDeleteUser_NoEmailAudited(t *testing.T) {
+	user := data.User{ID: 3, Email: "inactive@example.com"}
+	admin := map[string]any{USER_ID_CTX: 1, USER_CTX: data.User{ID: 1, Email: "admin@example.com", Role: data.RoleAdmin}}
+	post := func(path string, form url.Values, handler http.HandlerFunc) {
+		rawReq, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		rawReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r := newReqWithSession(rawReq)
+		for key, value := range admin {
+			testServer.Session.Put(r.Context(), key, value)
+		}
+		handler(httptest.NewRecorder(), r)
+	}
+
+	r := newReqWithSession(httptest.NewRequest(http.MethodPost, LOGIN_PATH, nil))
+	testServer.loginFailed(r, "Inactive@Example.com", clientIP(r), &user)
+	post(AdminLockedAccountsPath, url.Values{EMAIL_ATTR: {user.Email}}, testServer.AdminUnlockAccount)
+	post(USER_DELETE_PATH, url.Values{MEMBER_ID_ATTR: {"3"}}, testServer.AdminDeleteUser)
+
+	if e := lastAuditEvent(t, data.AuditFilter{Action: data.UserDeleted}); e.Diff["id"].From != 3 {
+		t.Errorf("expected the id of the deleted user to be recorded; got %v", e.Diff)
+	}
+
+	// the audit log can't be changed, so it mustn't keep the email after the account is gone
+	for _, e := range testServer.Models.Audit.(*data.AuditTest).Events() {
+		diff, err := json.Marshal(e.Diff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(strings.ToLower(string(diff)), user.Email) {
+			t.Errorf("expected no email in the audit log; got %s in %s", diff, e.Action)
+		}
+	}
+}
+
+func Test_AdminAuditExport(t *testing.T) {
+	r := newReqWithSession(httptest.NewRequest(http.MethodPost, USER_ROLE_PATH, nil))
+	testServer.audit(r, data.RoleChanged, 1, 301, change("role", data.RoleMember, data.RoleSupport))
+	testServer.audit(r, data.PasswordResetSent, 1, 301, nil)
+	testServer.audit(r, data.RoleChanged, 1, 302, change("role", data.RoleSupport, data.RoleMember))
+
+	req := httptest.NewRequest(http.MethodGet, AdminAuditExportPath+"?target=301&action=user.role", nil)
+	w := httptest.NewRecorder()
+	testServer.AdminAuditExport(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected the header and one event; got %v", records)
+	}
+	event := records[1]
+	if event[2] != string(data.RoleChanged) || event[3] != "1" || event[4] != "301" {
+		t.Errorf("expected the role change of user 301; got %v", event)
+	}
+	if want := `{"role":{"from":"member","to":"support"}}`; event[7] != want {
+		t.Errorf("expected diff %s; got %s", want, event[7])
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+const (
+	BILLING_CHECK_INTERVAL   = 1 * time.Hour
+	TRIAL_REMINDER_LEAD_TIME = 3 * 24 * time.Hour // how long before the end of a trial the user is reminded
+	CHARGE_DATE_LAYOUT       = "January 2, 2006"
+)
+
+const (
+	ERROR_GET_DUE_SUBSCRIPTIONS_MSG    = "error getting subscriptions due for charge: %w"
+	ERROR_GET_ENDING_TRIALS_MSG        = "error getting subscriptions whose trial is ending: %w"
+	ERROR_ADVANCE_NEXT_CHARGE_MSG      = "error advancing next charge of subscription %d: %w"
+	ERROR_MARK_TRIAL_REMINDER_SENT_MSG = "error marking trial reminder as sent for subscription %d: %w"
+	ERROR_RECORD_INVOICE_MSG           = "error recording invoice of subscription %d: %w"
+)
+
+// listenForBilling periodically charges the subscriptions that are due
+// and reminds users whose trial is about to end, until it's told to stop.
+func (s *Server) listenForBilling() {
+	ticker := time.NewTicker(BILLING_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.runBilling(now)
+		case <-s.StopBilling:
+			s.InfoLog.Println("stopping billing...")
+			return
+		}
+	}
+}
+
+func (s *Server) runBilling(now time.Time) {
+	s.sendTrialEndingReminders(now)
+	s.chargeDueSubscriptions(now)
+}
+
+func (s *Server) sendTrialEndingReminders(now time.Time) {
+	subs, err := s.Models.Subscription.GetTrialsEndingBy(now.Add(TRIAL_REMINDER_LEAD_TIME))
+	if err != nil {
+		s.AsyncErr <- fmt.Errorf(ERROR_GET_ENDING_TRIALS_MSG, err)
+		return
+	}
+
+	for _, sub := range subs {
+		if err := s.Models.Subscription.MarkTrialReminderSent(*sub); err != nil {
+			s.AsyncErr <- fmt.Errorf(ERROR_MARK_TRIAL_REMINDER_SENT_MSG, sub.ID, err)
+			continue
+		}
+
+		msg := Message{
+			To:       sub.User.Email,
+			Subject:  "Your free trial is ending soon",
+			Template: TRIAL_ENDING,
+			DataMap: map[string]any{
+				"planName":  sub.Plan.PlanName,
+				"trialEnd":  sub.TrialEndsAt.Time.Format(CHARGE_DATE_LAYOUT),
+				"amount":    data.FormatAmount(sub.AmountDue(), sub.Currency, sub.User.Locale),
+				"interval":  sub.Plan.Interval,
+				"firstName": sub.User.FirstName,
+			},
+		}
+		s.sendEmail(msg)
+	}
+}
+
+func (s *Server) chargeDueSubscriptions(now time.Time) {
+	subs, err := s.Models.Subscription.GetDueForCharge(now)
+	if err != nil {
+		s.AsyncErr <- fmt.Errorf(ERROR_GET_DUE_SUBSCRIPTIONS_MSG, err)
+		return
+	}
+
+	for _, sub := range subs {
+		s.chargeSubscription(*sub)
+	}
+}
+
+// chargeSubscription charges the subscription for the interval that is due,
+// records the invoice and emails it to the user
+func (s *Server) chargeSubscription(sub data.Subscription) {
+	// move the next charge forward first, so that a subscription is never charged twice
+	charged, err := s.Models.Subscription.AdvanceNextCharge(sub)
+	if err != nil {
+		s.AsyncErr <- fmt.Errorf(ERROR_ADVANCE_NEXT_CHARGE_MSG, sub.ID, err)
+		return
+	}
+	if !charged {
+		return
+	}
+
+	// the user is charged anyway, so still email the invoice if it can't be recorded
+	if _, err := s.Models.Invoice.Insert(data.NewInvoice(sub)); err != nil {
+		s.AsyncErr <- fmt.Errorf(ERROR_RECORD_INVOICE_MSG, sub.ID, err)
+	}
+
+	invoice, err := s.getInvoice(*sub.User, &sub)
+	if err != nil {
+		s.AsyncErr <- err
+		return
+	}
+
+	msg := Message{
+		To:       sub.User.Email,
+		Subject:  "Your invoice",
+		Data:     invoice,
+		Template: "invoice",
+	}
+	s.sendEmail(msg)
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+	"gopkg.in/yaml.v3"
+)
+
+// XXX_ENV is the environment variable overriding a setting of the config file.
+// The ones of the identity provider and the signing keys are next to their code.
+const (
+	CONFIG_FILE_ENV         = "CONFIG_FILE" // the config file to read, unless the -config flag is given
+	WEB_PORT_ENV            = "WEB_PORT"
+	DSN_ENV                 = "DSN"
+	DB_CONNECT_RETRIES_ENV  = "DB_CONNECT_RETRIES"
+	DB_RETRY_INTERVAL_ENV   = "DB_RETRY_INTERVAL"
+	REDIS_ENV               = "REDIS"
+	SESSION_LIFETIME_ENV    = "SESSION_LIFETIME"
+	SESSION_SECURE_ENV      = "SESSION_SECURE_COOKIE"
+	MAIL_DOMAIN_ENV         = "MAIL_DOMAIN"
+	SMTP_HOST_ENV           = "SMTP_HOST"
+	SMTP_PORT_ENV           = "SMTP_PORT"
+	SMTP_USERNAME_ENV       = "SMTP_USERNAME"
+	SMTP_PASSWORD_ENV       = "SMTP_PASSWORD"
+	SMTP_ENCRYPTION_ENV     = "SMTP_ENCRYPTION"
+	MAIL_FROM_ADDRESS_ENV   = "MAIL_FROM_ADDRESS"
+	MAIL_FROM_NAME_ENV      = "MAIL_FROM_NAME"
+	HTML_TEMPLATE_PATH_ENV  = "HTML_TEMPLATE_PATH"
+	EMAIL_TEMPLATE_PATH_ENV = "EMAIL_TEMPLATE_PATH"
+	MANUAL_TEMPLATE_ENV     = "MANUAL_TEMPLATE"
+	EXPORT_DIR_ENV          = "EXPORT_DIR"
+	LOG_LEVEL_ENV           = "LOG_LEVEL"
+	DISABLED_FEATURES_ENV   = "DISABLED_FEATURES"
+)
+
+// XXX_LOG_LEVEL is the level of the logs to write. Errors are always written.
+const (
+	INFO_LOG_LEVEL  = "info"
+	ERROR_LOG_LEVEL = "error" // only errors
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	ERROR_LOAD_CONFIG_MSG = "error loading config file %s: %w"
+)
+
+// Config is the configuration of the application. It's read from a yaml file, if any, whose settings
+// are overridden by environment variables, whose settings are in turn overridden by command-line flags.
+type Config struct {
+	Port       int             `yaml:"port"`
+	DB         DBConfig        `yaml:"db"`
+	Redis      RedisConfig     `yaml:"redis"`
+	Secrets    SecretsConfig   `yaml:"secrets"`
+	Session    SessionConfig   `yaml:"session"`
+	Mail       MailConfig      `yaml:"mail"`
+	Templates  TemplatesConfig `yaml:"templates"`
+	Exports    ExportsConfig   `yaml:"exports"`
+	OIDC       OIDCConfig      `yaml:"oidc"`
+	RateLimits ThrottleLimits  `yaml:"rate_limits"`
+	Log        LogConfig       `yaml:"log"`
+	Features   FeaturesConfig  `yaml:"features"`
+}
+
+type DBConfig struct {
+	DSN            string        `yaml:"dsn"`
+	ConnectRetries int           `yaml:"connect_retries"` // how many more times to try to connect, while postgres starts
+	RetryInterval  time.Duration `yaml:"retry_interval"`
+}
+
+type RedisConfig struct {
+	Address string `yaml:"address"`
+}
+
+type SecretsConfig struct {
+	SigningKeys string `yaml:"signing_keys"` // as in SIGNING_KEYS_ENV
+}
+
+type SessionConfig struct {
+	Lifetime     time.Duration `yaml:"lifetime"`
+	SecureCookie bool          `yaml:"secure_cookie"` // only send the session cookie over https
+}
+
+type MailConfig struct {
+	Domain      string      `yaml:"domain"`
+	Host        string      `yaml:"host"`
+	Port        int         `yaml:"port"`
+	Username    string      `yaml:"username"`
+	Password    string      `yaml:"password"`
+	Encryption  EncryptType `yaml:"encryption"`
+	FromAddress string      `yaml:"from_address"`
+	FromName    string      `yaml:"from_name"`
+}
+
+type TemplatesConfig struct {
+	HTML   string `yaml:"html"`   // the directory of the templates of the pages
+	Email  string `yaml:"email"`  // the directory of the templates of the emails
+	Manual string `yaml:"manual"` // the pdf the manual is made from
+}
+
+type ExportsConfig struct {
+	Dir string `yaml:"dir"` // where the exports of account data are kept until their link expires
+}
+
+type LogConfig struct {
+	Level string `yaml:"level"`
+}
+
+type FeaturesConfig struct {
+	Disabled []data.Feature `yaml:"disabled"` // switched off for everyone, whatever their plan grants
+}
+
+type OIDCConfig struct {
+	Issuer       string `yaml:"issuer"` // no identity provider is used unless it's set
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RedirectURL  string `yaml:"redirect_url"`
+	Name         string `yaml:"name"`
+}
+
+// DefaultConfig returns the configuration used for whatever isn't set, which suits development
+func DefaultConfig() *Config {
+	return &Config{
+		Port: 80,
+		DB: DBConfig{
+			ConnectRetries: 10,
+			RetryInterval:  1 * time.Second,
+		},
+		Session: SessionConfig{
+			Lifetime:     24 * time.Hour,
+			SecureCookie: true,
+		},
+		Mail: MailConfig{
+			Domain:      "localhost",
+			Host:        "localhost",
+			Port:        1025,
+			Encryption:  NONE,
+			FromAddress: "info@mycompany.com",
+			FromName:    "Info",
+		},
+		Templates: TemplatesConfig{
+			HTML:   TEMPLATE_PATH,
+			Email:  TEMPLATE_PATH,
+			Manual: MANUAL_TMPL_PATH,
+		},
+		Exports: ExportsConfig{
+			Dir: EXPORT_DIR,
+		},
+		OIDC: OIDCConfig{
+			Name: DEFAULT_OIDC_NAME,
+		},
+		RateLimits: DefaultThrottleLimits(),
+		Log: LogConfig{
+			Level: INFO_LOG_LEVEL,
+		},
+	}
+}
+
+// ConfigError lists everything wrong with a configuration, so that it can be fixed in one go
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(e, "\n\t")
+}
+
+// setting is a setting which may be overridden by an environment variable and by a flag
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"port", WEB_PORT_ENV, "port to listen on", setInt(func(c *Config) *int { return &c.Port })},
+	{"dsn", DSN_ENV, "postgres connection string", setString(func(c *Config) *string { return &c.DB.DSN })},
+	{"db-connect-retries", DB_CONNECT_RETRIES_ENV, "times to retry connecting to postgres", setInt(func(c *Config) *int { return &c.DB.ConnectRetries })},
+	{"db-retry-interval", DB_RETRY_INTERVAL_ENV, "time to wait between connection attempts, e.g. 1s", setDuration(func(c *Config) *time.Duration { return &c.DB.RetryInterval })},
+	{"redis", REDIS_ENV, "redis address, e.g. 127.0.0.1:6379", setString(func(c *Config) *string { return &c.Redis.Address })},
+	{"signing-keys", SIGNING_KEYS_ENV, `keys to sign urls with, as "id:secret" pairs, newest first`, setString(func(c *Config) *string { return &c.Secrets.SigningKeys })},
+	{"session-lifetime", SESSION_LIFETIME_ENV, "how long sessions last, e.g. 24h", setDuration(func(c *Config) *time.Duration { return &c.Session.Lifetime })},
+	{"session-secure-cookie", SESSION_SECURE_ENV, "only send the session cookie over https", setBool(func(c *Config) *bool { return &c.Session.SecureCookie })},
+	{"mail-domain", MAIL_DOMAIN_ENV, "domain mails are sent from", setString(func(c *Config) *string { return &c.Mail.Domain })},
+	{"smtp-host", SMTP_HOST_ENV, "smtp server host", setString(func(c *Config) *string { return &c.Mail.Host })},
+	{"smtp-port", SMTP_PORT_ENV, "smtp server port", setInt(func(c *Config) *int { return &c.Mail.Port })},
+	{"smtp-username", SMTP_USERNAME_ENV, "smtp username", setString(func(c *Config) *string { return &c.Mail.Username })},
+	{"smtp-password", SMTP_PASSWORD_ENV, "smtp password", setString(func(c *Config) *string { return &c.Mail.Password })},
+	{"smtp-encryption", SMTP_ENCRYPTION_ENV, "smtp encryption: tls, ssl or none", func(c *Config, v string) error {
+		c.Mail.Encryption = EncryptType(v)
+		return nil
+	}},
+	{"mail-from-address", MAIL_FROM_ADDRESS_ENV, "address mails are sent from", setString(func(c *Config) *string { return &c.Mail.FromAddress })},
+	{"mail-from-name", MAIL_FROM_NAME_ENV, "name mails are sent from", setString(func(c *Config) *string { return &c.Mail.FromName })},
+	{"html-templates", HTML_TEMPLATE_PATH_ENV, "directory of the templates of the pages", setString(func(c *Config) *string { return &c.Templates.HTML })},
+	{"email-templates", EMAIL_TEMPLATE_PATH_ENV, "directory of the templates of the emails", setString(func(c *Config) *string { return &c.Templates.Email })},
+	{"manual-template", MANUAL_TEMPLATE_ENV, "pdf the manual is made from", setString(func(c *Config) *string { return &c.Templates.Manual })},
+	{"export-dir", EXPORT_DIR_ENV, "directory the exports of account data are kept in", setString(func(c *Config) *string { return &c.Exports.Dir })},
+	{"oidc-issuer", OIDC_ISSUER_ENV, "issuer of the identity provider users may log in with", setString(func(c *Config) *string { return &c.OIDC.Issuer })},
+	{"oidc-client-id", OIDC_CLIENT_ID_ENV, "client id at the identity provider", setString(func(c *Config) *string { return &c.OIDC.ClientID })},
+	{"oidc-client-secret", OIDC_CLIENT_SECRET_ENV, "client secret at the identity provider", setString(func(c *Config) *string { return &c.OIDC.ClientSecret })},
+	{"oidc-redirect-url", OIDC_REDIRECT_URL_ENV, "url the identity provider sends users back to", setString(func(c *Config) *string { return &c.OIDC.RedirectURL })},
+	{"oidc-name", OIDC_NAME_ENV, "name of the identity provider on the log in button", setString(func(c *Config) *string { return &c.OIDC.Name })},
+	{"log-level", LOG_LEVEL_ENV, "level of the logs to write: info or error", setString(func(c *Config) *string { return &c.Log.Level })},
+	{"disabled-features", DISABLED_FEATURES_ENV, "features switched off for everyone, comma separated", func(c *Config, v string) error {
+		c.Features.Disabled = nil
+		for _, feature := range strings.Split(v, ",") {
+			if feature = strings.TrimSpace(feature); feature != "" {
+				c.Features.Disabled = append(c.Features.Disabled, data.Feature(feature))
+			}
+		}
+		return nil
+	}},
+}
+
+func setString(field func(c *Config) *string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}
+}
+
+func setInt(field func(c *Config) *int) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%q isn't a whole number", v)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func setDuration(field func(c *Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%q isn't a duration, such as 30s or 24h", v)
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+func setBool(field func(c *Config) *bool) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q isn't true or false", v)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+// LoadConfig loads the configuration from the config file given by the -config flag or CONFIG_FILE_ENV, if any,
+// then from the environment, then from the rest of the flags, and validates it.
+// It returns flag.ErrHelp if the usage was asked for.
+func LoadConfig(args []string, getenv func(string) string) (*Config, error) {
+	c := DefaultConfig()
+
+	// flags are only applied once the file and the environment have been, as they override both
+	fs := flag.NewFlagSet("web", flag.ContinueOnError)
+	path := fs.String("config", "", fmt.Sprintf("yaml config file (env %s)", CONFIG_FILE_ENV))
+	flags := make(map[string]string)
+	for _, st := range settings {
+		st := st
+		fs.Func(st.flag, fmt.Sprintf("%s (env %s)", st.usage, st.env), func(v string) error {
+			flags[st.flag] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path == "" {
+		*path = getenv(CONFIG_FILE_ENV)
+	}
+	if *path != "" {
+		if err := c.loadFile(*path); err != nil {
+			return nil, fmt.Errorf(ERROR_LOAD_CONFIG_MSG, *path, err)
+		}
+	}
+
+	var problems ConfigError
+	for _, st := range settings {
+		if v := getenv(st.env); v != "" {
+			if err := st.set(c, v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", st.env, err))
+			}
+		}
+	}
+	for _, st := range settings {
+		if v, ok := flags[st.flag]; ok {
+			if err := st.set(c, v); err != nil {
+				problems = append(problems, fmt.Sprintf("-%s: %v", st.flag, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// loadFile overrides the configuration with the settings of the yaml file. Unknown settings are errors,
+// so that a typo doesn't go unnoticed.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) { // an empty file changes nothing
+		return err
+	}
+
+	return nil
+}
+
+// Validate reports everything wrong with the configuration as a ConfigError, or nil if nothing is
+func (c *Config) Validate() error {
+	var problems ConfigError
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		add("port: %d isn't a port", c.Port)
+	}
+
+	if c.DB.DSN == "" {
+		add("db.dsn: is required")
+	}
+	if c.DB.ConnectRetries < 0 {
+		add("db.connect_retries: can't be negative")
+	}
+	if c.DB.RetryInterval <= 0 {
+		add("db.retry_interval: must be longer than 0")
+	}
+
+	if c.Redis.Address == "" {
+		add("redis.address: is required")
+	}
+
+	if _, err := ParseKeyring(c.Secrets.SigningKeys); err != nil {
+		add("secrets.signing_keys: %v", err)
+	}
+
+	if c.Session.Lifetime <= 0 {
+		add("session.lifetime: must be longer than 0")
+	}
+
+	if c.Mail.Host == "" {
+		add("mail.host: is required")
+	}
+	if c.Mail.Port < 1 || c.Mail.Port > 65535 {
+		add("mail.port: %d isn't a port", c.Mail.Port)
+	}
+	switch c.Mail.Encryption {
+	case TLS, SSL, NONE:
+	default:
+		add("mail.encryption: %q isn't one of %s, %s or %s", c.Mail.Encryption, TLS, SSL, NONE)
+	}
+	if _, err := mail.ParseAddress(c.Mail.FromAddress); err != nil {
+		add("mail.from_address: %q isn't an email address", c.Mail.FromAddress)
+	}
+
+	if info, err := os.Stat(c.Templates.HTML); err != nil || !info.IsDir() {
+		add("templates.html: %q isn't a directory", c.Templates.HTML)
+	}
+	if info, err := os.Stat(c.Templates.Email); err != nil || !info.IsDir() {
+		add("templates.email: %q isn't a directory", c.Templates.Email)
+	}
+	if info, err := os.Stat(c.Templates.Manual); err != nil || info.IsDir() {
+		add("templates.manual: %q isn't a file", c.Templates.Manual)
+	}
+
+	if c.Exports.Dir == "" {
+		add("exports.dir: is required")
+	}
+
+	if c.OIDC.Issuer != "" {
+		if c.OIDC.ClientID == "" {
+			add("oidc.client_id: is required along with oidc.issuer")
+		}
+		if c.OIDC.ClientSecret == "" {
+			add("oidc.client_secret: is required along with oidc.issuer")
+		}
+		if c.OIDC.RedirectURL == "" {
+			add("oidc.redirect_url: is required along with oidc.issuer")
+		}
+	}
+
+	l := c.RateLimits
+	if l.LoginWindow <= 0 || l.MinLoginDelay <= 0 || l.MaxLoginDelay < l.MinLoginDelay || l.LockoutDuration <= 0 || l.ResendActivationWindow <= 0 {
+		add("rate_limits: durations must be longer than 0, and max_login_delay no shorter than min_login_delay")
+	}
+	if l.FreeLoginFailures < 0 || l.MaxAccountFailures < 1 || l.MaxIPFailures < 1 || l.ResendActivationLimit < 1 {
+		add("rate_limits: free_login_failures can't be negative, and the other limits must be at least 1")
+	}
+
+	if c.Log.Level != INFO_LOG_LEVEL && c.Log.Level != ERROR_LOG_LEVEL {
+		add("log.level: %q isn't one of %s or %s", c.Log.Level, INFO_LOG_LEVEL, ERROR_LOG_LEVEL)
+	}
+
+	for _, feature := range c.Features.Disabled {
+		if !isFeature(feature) {
+			add("features.disabled: %q isn't a feature", feature)
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
+
+// isFeature reports whether the feature is one a plan may grant
+func isFeature(feature data.Feature) bool {
+	for _, f := range data.AllFeatures {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
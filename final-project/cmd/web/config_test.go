@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfigYAML is a config file which is valid from this directory
+const validConfigYAML = `
+port: 8080
+db:
+  dsn: "host=db"
+  retry_interval: 2s
+redis:
+  address: "redis:6379"
+secrets:
+  signing_keys: "1:abc123abc123abc123"
+session:
+  lifetime: 12h
+templates:
+  html: ./templates
+  email: ./templates
+  manual: ./../../pdf/manual.pdf
+`
+
+// writeConfig writes the yaml to a config file, and returns its path
+func writeConfig(t *testing.T, yaml string) string {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// envOf returns a getenv reading from the map only
+func envOf(env map[string]string) func(string) string {
+	return func(key string) string { return env[key] }
+}
+
+func Test_LoadConfig_Precedence(t *testing.T) {
+	path := writeConfig(t, validConfigYAML)
+
+	tests := map[string]struct {
+		args            []string
+		env             map[string]string
+		expectedPort    int
+		expectedRetries int
+		expectedLife    time.Duration
+	}{
+		"file over defaults": {[]string{"-config", path}, nil, 8080, 10, 12 * time.Hour},
+		"file from env":      {nil, map[string]string{CONFIG_FILE_ENV: path}, 8080, 10, 12 * time.Hour},
+		"env over file":      {[]string{"-config", path}, map[string]string{WEB_PORT_ENV: "9090", SESSION_LIFETIME_ENV: "1h"}, 9090, 10, time.Hour},
+		"flags over env":     {[]string{"-config", path, "-port", "7070", "-db-connect-retries", "3"}, map[string]string{WEB_PORT_ENV: "9090"}, 7070, 3, 12 * time.Hour},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadConfig(tt.args, envOf(tt.env))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.Port != tt.expectedPort {
+				t.Errorf("expected port %d; got %d", tt.expectedPort, cfg.Port)
+			}
+			if cfg.DB.ConnectRetries != tt.expectedRetries {
+				t.Errorf("expected %d retries; got %d", tt.expectedRetries, cfg.DB.ConnectRetries)
+			}
+			if cfg.Session.Lifetime != tt.expectedLife {
+				t.Errorf("expected sessions to last %s; got %s", tt.expectedLife, cfg.Session.Lifetime)
+			}
+			if cfg.DB.RetryInterval != 2*time.Second || cfg.Mail.Host != "localhost" {
+				t.Errorf("expected the rest to come from the file and the defaults; got %+v", cfg)
+			}
+		})
+	}
+}
+
+func Test_LoadConfig_Errors(t *testing.T) {
+	valid := writeConfig(t, validConfigYAML)
+
+	tests := map[string]struct {
+		args     []string
+		env      map[string]string
+		expected []string
+	}{
+		"missing file":     {[]string{"-config", "missing.yml"}, nil, []string{"error loading config file missing.yml"}},
+		"unknown setting":  {[]string{"-config", writeConfig(t, "prot: 80\n")}, nil, []string{"field prot not found"}},
+		"malformed env":    {[]string{"-config", valid}, map[string]string{WEB_PORT_ENV: "eighty", SESSION_LIFETIME_ENV: "a day"}, []string{`WEB_PORT: "eighty" isn't a whole number`, `SESSION_LIFETIME: "a day" isn't a duration`}},
+		"malformed flag":   {[]string{"-config", valid, "-session-secure-cookie", "maybe"}, nil, []string{`-session-secure-cookie: "maybe" isn't true or false`}},
+		"nothing set":      {nil, nil, []string{"db.dsn: is required", "redis.address: is required", "secrets.signing_keys: no signing keys", `templates.html: "./cmd/web/templates" isn't a directory`}},
+		"invalid settings": {[]string{"-config", valid, "-port", "0", "-smtp-encryption", "starttls", "-mail-from-address", "info", "-signing-keys", "1:short"}, nil, []string{"port: 0 isn't a port", `mail.encryption: "starttls" isn't one of`, `mail.from_address: "info" isn't an email address`, "must be at least 16 characters long"}},
+		"unknown feature":  {[]string{"-config", valid, "-disabled-features", "user-manual, telepathy"}, nil, []string{`features.disabled: "telepathy" isn't a feature`}},
+		"partial oidc":     {[]string{"-config", valid, "-oidc-issuer", "https://idp.example.com", "-oidc-client-id", "client"}, nil, []string{"oidc.client_secret: is required along with oidc.issuer", "oidc.redirect_url: is required along with oidc.issuer"}},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadConfig(tt.args, envOf(tt.env))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tt.expected {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected %q to contain %q", err.Error(), want)
+				}
+			}
+		})
+	}
+}
+
+func Test_LoadConfig_Help(t *testing.T) {
+	_, err := LoadConfig([]string{"-h"}, envOf(nil))
+	if !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("expected flag.ErrHelp; got %v", err)
+	}
+}
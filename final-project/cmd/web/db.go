@@ -3,7 +3,6 @@ package main
 import (
 	"database/sql"
 	"log"
-	"os"
 	"time"
 
 	_ "github.com/jackc/pgconn"
@@ -11,21 +10,19 @@ import (
 	_ "github.com/jackc/pgx/v4/stdlib"
 )
 
-func initDB() *sql.DB {
-	conn := connectToDB()
+func initDB(cfg DBConfig) *sql.DB {
+	conn := connectToDB(cfg)
 	if conn == nil {
 		log.Panic("can't connect to database")
 	}
 	return conn
 }
 
-func connectToDB() *sql.DB {
-	var counts uint8
-
-	dsn := os.Getenv("DSN")
+func connectToDB(cfg DBConfig) *sql.DB {
+	var counts int
 
 	for {
-		conn, err := openDB(dsn)
+		conn, err := openDB(cfg.DSN)
 		if err != nil {
 			log.Println("postgres not yet ready...")
 		} else {
@@ -33,12 +30,12 @@ func connectToDB() *sql.DB {
 			return conn
 		}
 
-		if counts > 10 {
+		if counts >= cfg.ConnectRetries {
 			return nil
 		}
 
-		log.Println("Backing off for 1 second")
-		time.Sleep(1 * time.Second)
+		log.Printf("Backing off for %s\n", cfg.RetryInterval)
+		time.Sleep(cfg.RetryInterval)
 		counts++
 
 		continue
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+// FeatureFlags switches features off for everyone, whatever their plan grants, e.g. while one misbehaves.
+// It's read on every request needing a feature, and may be changed while requests are being served.
+type FeatureFlags struct {
+	disabled map[data.Feature]bool // read with Enabled and changed with Set
+	mutex    sync.RWMutex
+}
+
+// NewFeatureFlags returns the feature flags of the configuration
+func NewFeatureFlags(cfg FeaturesConfig) *FeatureFlags {
+	f := &FeatureFlags{}
+	f.Set(cfg)
+	return f
+}
+
+// Enabled reports whether the feature may be used by the users whose plan grants it
+func (f *FeatureFlags) Enabled(feature data.Feature) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return !f.disabled[feature]
+}
+
+// Set changes the features which are switched off to the ones of the configuration
+func (f *FeatureFlags) Set(cfg FeaturesConfig) {
+	disabled := make(map[data.Feature]bool, len(cfg.Disabled))
+	for _, feature := range cfg.Disabled {
+		disabled[feature] = true
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.disabled = disabled
+}
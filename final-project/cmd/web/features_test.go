@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+func Test_RequireFeature_Disabled(t *testing.T) {
+	testServer.Features.Set(FeaturesConfig{Disabled: []data.Feature{data.EmailSupport}})
+	defer testServer.Features.Set(testServer.Config.Features)
+
+	rawReq, _ := http.NewRequest(http.MethodGet, "/members/support", nil)
+	r := newReqWithSession(rawReq)
+	// every user is on the sample plan, which grants email support
+	testServer.Session.Put(r.Context(), USER_CTX, data.User{ID: 3, Email: "user@example.com", IsActive: data.Active})
+
+	w := httptest.NewRecorder()
+	called := false
+	testServer.RequireFeature(data.EmailSupport)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})).ServeHTTP(w, r)
+
+	if called || w.Code != http.StatusSeeOther {
+		t.Errorf("expected the request to be redirected; got status code %d", w.Code)
+	}
+	if msg := testServer.Session.GetString(r.Context(), ERROR_CTX); msg != FEATURE_DISABLED_MSG {
+		t.Errorf("expected error message %q; got %q", FEATURE_DISABLED_MSG, msg)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	REQUIRED_FIELD_MSG = "This field is required."
+	INVALID_EMAIL_MSG  = "Enter a valid email address."
+	WEAK_PASSWORD_MSG  = "Passwords must contain both letters and numbers."
+)
+
+// Form holds the values of a submitted form and the errors found validating them, by field
+type Form struct {
+	url.Values
+	Errors FormErrors
+}
+
+// FormErrors holds the validation errors of a form, by field
+type FormErrors map[string][]string
+
+// Add adds an error for the field
+func (e FormErrors) Add(field, msg string) {
+	e[field] = append(e[field], msg)
+}
+
+// Get returns the first error for the field, if any
+func (e FormErrors) Get(field string) string {
+	if msgs := e[field]; len(msgs) > 0 {
+		return msgs[0]
+	}
+	return ""
+}
+
+// First returns the first error of any of the fields, in the given order
+func (e FormErrors) First(fields ...string) string {
+	for _, field := range fields {
+		if msg := e.Get(field); msg != "" {
+			return msg
+		}
+	}
+	return ""
+}
+
+// NewForm returns an empty form to validate the values with
+func NewForm(values url.Values) *Form {
+	if values == nil {
+		values = url.Values{}
+	}
+
+	return &Form{
+		Values: values,
+		Errors: FormErrors{},
+	}
+}
+
+// Valid reports whether the form has no errors
+func (f *Form) Valid() bool {
+	return len(f.Errors) == 0
+}
+
+// Required checks that the fields aren't blank
+func (f *Form) Required(fields ...string) {
+	for _, field := range fields {
+		if strings.TrimSpace(f.Get(field)) == "" {
+			f.Errors.Add(field, REQUIRED_FIELD_MSG)
+		}
+	}
+}
+
+// IsEmail checks that the field, if filled in, is a bare email address
+func (f *Form) IsEmail(field string) {
+	value := strings.TrimSpace(f.Get(field))
+	if value == "" {
+		return
+	}
+
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value || !strings.Contains(addr.Address[strings.LastIndex(addr.Address, "@"):], ".") {
+		f.Errors.Add(field, INVALID_EMAIL_MSG)
+	}
+}
+
+// Password checks that the field, if filled in, is a strong enough password:
+// long enough, with both letters and numbers
+func (f *Form) Password(field string) {
+	value := f.Get(field)
+	if value == "" {
+		return
+	}
+
+	if len(value) < MIN_PASSWORD_LENGTH {
+		f.Errors.Add(field, fmt.Sprintf(PASSWORD_TOO_SHORT_MSG, MIN_PASSWORD_LENGTH))
+		return
+	}
+
+	var hasLetter, hasDigit bool
+	for _, r := range value {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+	if !hasLetter || !hasDigit {
+		f.Errors.Add(field, WEAK_PASSWORD_MSG)
+	}
+}
+
+// Matches checks that the field has the same value as the other one, e.g. a password confirmation
+func (f *Form) Matches(field, other string) {
+	if f.Get(field) != f.Get(other) {
+		f.Errors.Add(field, PASSWORDS_DO_NOT_MATCH_MSG)
+	}
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"html/template"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/MatsuoTakuro/final-project/data"
+	"github.com/pquerna/otp/totp"
 )
 
 type optAssert func(params optParams)
@@ -20,8 +24,6 @@ type optParams struct {
 }
 
 func Test_Handlers(t *testing.T) {
-	HTMLTmplPath = "./templates"
-	ManualTmplPath = "./../../pdf/manual.pdf"
 	ManualOutputTempPath = "./../../tmp/%d_manual.pdf"
 
 	tests := map[string]struct {
@@ -84,6 +86,28 @@ func Test_Handlers(t *testing.T) {
 				},
 			},
 		},
+		"login with wrong password": {
+			path:   LOGIN_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				EMAIL_ATTR:    {"2fa@example.com"},
+				PASSWORD_ATTR: {"not my password"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.Login,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if testServer.Session.Exists(params.ctx, USER_ID_CTX) || testServer.Session.Exists(params.ctx, PENDING_USER_ID_CTX) {
+						params.t.Error("expected the user not to be logged in")
+					}
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != INVALID_CREDS_MSG {
+						params.t.Errorf("expected error message %q; got %q", INVALID_CREDS_MSG, msg)
+					}
+				},
+			},
+		},
 		"subscribe to plan": {
 			path:    SUBSCRIBE_PATH,
 			method:  http.MethodGet,
@@ -92,19 +116,2044 @@ func Test_Handlers(t *testing.T) {
 				PLAN_ID_CTX: {"1"},
 			},
 			expectedStatusCode: http.StatusSeeOther,
-			handler:            testServer.SubcribeToPlan,
+			handler:            testServer.SubcribeToPlan,
+			sessionData: map[string]any{
+				USER_CTX: data.User{
+					ID:        1,
+					Email:     "admin@example.com",
+					FirstName: "Admin",
+					LastName:  "User",
+					IsActive:  data.Active,
+				},
+			},
+			expectedHTML: nil,
+			optAsserts:   nil,
+		},
+		"subscribe to plan with coupon": {
+			path:    SUBSCRIBE_PATH,
+			method:  http.MethodGet,
+			rawBody: nil,
+			queryParams: url.Values{
+				PLAN_ID_CTX: {"1"},
+				COUPON_ATTR: {"welcome10"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.SubcribeToPlan,
+			sessionData: map[string]any{
+				USER_CTX: data.User{
+					ID:       1,
+					Email:    "admin@example.com",
+					IsActive: data.Active,
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != SUCCESSFUL_SUBSCRIBE_MSG {
+						params.t.Errorf("expected flash message %q; got %q", SUCCESSFUL_SUBSCRIBE_MSG, msg)
+					}
+				},
+			},
+		},
+		"subscribe to plan with unknown coupon": {
+			path:    SUBSCRIBE_PATH,
+			method:  http.MethodGet,
+			rawBody: nil,
+			queryParams: url.Values{
+				PLAN_ID_CTX: {"1"},
+				COUPON_ATTR: {"NOPE"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.SubcribeToPlan,
+			sessionData: map[string]any{
+				USER_CTX: data.User{
+					ID:       1,
+					Email:    "admin@example.com",
+					IsActive: data.Active,
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != INVALID_COUPON_MSG {
+						params.t.Errorf("expected error message %q; got %q", INVALID_COUPON_MSG, msg)
+					}
+				},
+			},
+		},
+		"admin coupons page": {
+			path:               COUPONS_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.RequirePermission(data.ManageCoupons)(http.HandlerFunc(testServer.AdminCouponsPage)).ServeHTTP,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX: data.User{
+					ID:    1,
+					Email: "admin@example.com",
+					Role:  data.RoleAdmin,
+				},
+			},
+			expectedHTML: []string{`<h1 class="mt-5">Coupons</h1>`, `<td>WELCOME10</td>`},
+			optAsserts:   nil,
+		},
+		"admin coupons page for non admin": {
+			path:               COUPONS_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.RequirePermission(data.ManageCoupons)(http.HandlerFunc(testServer.AdminCouponsPage)).ServeHTTP,
+			sessionData: map[string]any{
+				USER_ID_CTX: 2,
+				USER_CTX: data.User{
+					ID:    2,
+					Email: "member@example.com",
+					Role:  data.RoleMember,
+				},
+			},
+			expectedHTML: nil,
+			optAsserts:   nil,
+		},
+		"create coupon": {
+			path:   COUPONS_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				CODE_ATTR:           {"summer"},
+				DISCOUNT_TYPE_ATTR:  {PERCENT_OFF},
+				DISCOUNT_VALUE_ATTR: {"20"},
+				DURATION_ATTR:       {string(data.Forever)},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.AdminCreateCoupon,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != COUPON_CREATED_MSG {
+						params.t.Errorf("expected flash message %q; got %q", COUPON_CREATED_MSG, msg)
+					}
+				},
+			},
+		},
+		"create repeating coupon without intervals": {
+			path:   COUPONS_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				CODE_ATTR:           {"summer"},
+				DISCOUNT_TYPE_ATTR:  {AMOUNT_OFF},
+				DISCOUNT_VALUE_ATTR: {"5"},
+				CURRENCY_ATTR:       {"USD"},
+				DURATION_ATTR:       {string(data.Repeating)},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.AdminCreateCoupon,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); !strings.HasPrefix(msg, "Invalid coupon:") {
+						params.t.Errorf("expected an invalid coupon message; got %q", msg)
+					}
+				},
+			},
+		},
+		"create coupon with markup in the code": {
+			path:   COUPONS_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				CODE_ATTR:           {"<script>alert(1)</script>"},
+				DISCOUNT_TYPE_ATTR:  {PERCENT_OFF},
+				DISCOUNT_VALUE_ATTR: {"20"},
+				DURATION_ATTR:       {string(data.Forever)},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.AdminCreateCoupon,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); !strings.HasPrefix(msg, "Invalid coupon:") {
+						params.t.Errorf("expected an invalid coupon message; got %q", msg)
+					}
+				},
+			},
+		},
+		"plans page": {
+			path:               PLANS_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.ListOfPlans,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX: data.User{
+					ID:        1,
+					Email:     "admin@example.com",
+					FirstName: "Admin",
+					LastName:  "User",
+					IsActive:  data.Active,
+				},
+			},
+			expectedHTML: []string{
+				`<th class="text-center">Bronze Plan</th>`,
+				`<td class="text-center">$ 10.00/month</td>`,
+				`<td>Free trial</td>`,
+				`<td>Email support</td>`,
+				`<td>Priority support</td>`,
+				`<td>Active sessions</td>`,
+			},
+			optAsserts: nil,
+		},
+		"plans page in preferred currency": {
+			path:               PLANS_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.ListOfPlans,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX: data.User{
+					ID:       1,
+					Email:    "admin@example.com",
+					IsActive: data.Active,
+					Currency: data.JPY,
+					Locale:   "ja-JP",
+				},
+			},
+			expectedHTML: []string{
+				`<td class="text-center">￥ 1,500/month</td>`,
+				`<option value="JPY" selected>JPY</option>`,
+			},
+			optAsserts: nil,
+		},
+		"update preferences": {
+			path:   PREFERENCES_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				CURRENCY_ATTR: {"EUR"},
+				LOCALE_ATTR:   {"de-DE"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.UpdatePreferences,
+			sessionData: map[string]any{
+				// stale, as if the email had been changed in another browser
+				USER_CTX: data.User{
+					ID:    1,
+					Email: "old@example.com",
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					user, _ := testServer.Session.Get(params.ctx, USER_CTX).(data.User)
+					if user.Currency != data.EUR || user.Locale != "de-DE" {
+						params.t.Errorf("expected preferences EUR/de-DE; got %s/%s", user.Currency, user.Locale)
+					}
+					if user.Email != "admin@example.com" || user.FirstName != "Admin" {
+						params.t.Errorf("expected the stored user to be updated, not the stale copy in the session; got %+v", user)
+					}
+				},
+			},
+		},
+		"update preferences with unsupported currency": {
+			path:   PREFERENCES_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				CURRENCY_ATTR: {"XYZ"},
+				LOCALE_ATTR:   {"de-DE"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.UpdatePreferences,
+			sessionData: map[string]any{
+				USER_CTX: data.User{
+					ID:    1,
+					Email: "admin@example.com",
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != UNSUPPORTED_PREFERENCES_MSG {
+						params.t.Errorf("expected error message %q; got %q", UNSUPPORTED_PREFERENCES_MSG, msg)
+					}
+				},
+			},
+		},
+		"download manual without the feature in plan": {
+			path:               MANUAL_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.RequireFeature(data.UserManual)(http.HandlerFunc(testServer.DownloadManual)).ServeHTTP,
+			sessionData: map[string]any{
+				USER_CTX: data.User{
+					ID:        1,
+					Email:     "admin@example.com",
+					FirstName: "Admin",
+					LastName:  "User",
+					IsActive:  data.Active,
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if loc := params.w.Header().Get("Location"); loc != MembersPlanPath {
+						params.t.Errorf("expected redirect to %s; got %s", MembersPlanPath, loc)
+					}
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != FEATURE_NOT_IN_PLAN_MSG {
+						params.t.Errorf("expected error message %q; got %q", FEATURE_NOT_IN_PLAN_MSG, msg)
+					}
+				},
+			},
+		},
+		"subscribe to team plan individually": {
+			path:    SUBSCRIBE_PATH,
+			method:  http.MethodGet,
+			rawBody: nil,
+			queryParams: url.Values{
+				PLAN_ID_CTX: {"5"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.SubcribeToPlan,
+			sessionData: map[string]any{
+				USER_CTX: data.User{
+					ID:       1,
+					Email:    "admin@example.com",
+					IsActive: data.Active,
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != TEAM_PLAN_ONLY_MSG {
+						params.t.Errorf("expected error message %q; got %q", TEAM_PLAN_ONLY_MSG, msg)
+					}
+				},
+			},
+		},
+		"organization page for owner": {
+			path:               ORGANIZATION_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.OrganizationPage,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX: data.User{
+					ID:    1,
+					Email: "admin@example.com",
+				},
+			},
+			expectedHTML: []string{
+				`<h2>Example Inc.</h2>`,
+				`<td>admin@example.com</td>`,
+				`Send Invitation`,
+				`Team Plan: $ 15.00/seat/month`,
+			},
+			optAsserts: nil,
+		},
+		"organization page without organization": {
+			path:               ORGANIZATION_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.OrganizationPage,
+			sessionData: map[string]any{
+				USER_ID_CTX: 2,
+				USER_CTX: data.User{
+					ID:    2,
+					Email: "member@example.com",
+				},
+			},
+			expectedHTML: []string{`Create Team`},
+			optAsserts:   nil,
+		},
+		"create organization when already a member": {
+			path:   ORGANIZATION_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				NAME_ATTR: {"Another Inc."},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.CreateOrganization,
+			sessionData: map[string]any{
+				USER_CTX: data.User{
+					ID:    1,
+					Email: "admin@example.com",
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != ALREADY_MEMBER_MSG {
+						params.t.Errorf("expected error message %q; got %q", ALREADY_MEMBER_MSG, msg)
+					}
+				},
+			},
+		},
+		"invite to organization": {
+			path:   ORGANIZATION_INVITE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				EMAIL_ATTR: {"member@example.com"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.InviteToOrganization,
+			sessionData: map[string]any{
+				USER_CTX: data.User{
+					ID:    1,
+					Email: "admin@example.com",
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != INVITATION_SENT_MSG {
+						params.t.Errorf("expected flash message %q; got %q", INVITATION_SENT_MSG, msg)
+					}
+				},
+			},
+		},
+		"invite to organization without organization": {
+			path:   ORGANIZATION_INVITE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				EMAIL_ATTR: {"someone@example.com"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.InviteToOrganization,
+			sessionData: map[string]any{
+				USER_CTX: data.User{
+					ID:    2,
+					Email: "member@example.com",
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != NOT_IN_ORGANIZATION_MSG {
+						params.t.Errorf("expected error message %q; got %q", NOT_IN_ORGANIZATION_MSG, msg)
+					}
+				},
+			},
+		},
+		"join organization": {
+			path:               signedLink(MembersOrganizationJoinPath, url.Values{INVITATION_ATTR: {"1"}}, INVITE_PURPOSE),
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.JoinOrganization,
+			sessionData: map[string]any{
+				USER_CTX: data.User{
+					ID:    2,
+					Email: "member@example.com",
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != JOINED_ORGANIZATION_MSG {
+						params.t.Errorf("expected flash message %q; got %q", JOINED_ORGANIZATION_MSG, msg)
+					}
+				},
+			},
+		},
+		"join organization with forged link": {
+			path:   MembersOrganizationJoinPath,
+			method: http.MethodGet,
+			queryParams: url.Values{
+				INVITATION_ATTR: {"1"},
+				"hash":          {"forged"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.JoinOrganization,
+			sessionData: map[string]any{
+				USER_CTX: data.User{
+					ID:    2,
+					Email: "member@example.com",
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != INVALID_TOKEN_MSG {
+						params.t.Errorf("expected error message %q; got %q", INVALID_TOKEN_MSG, msg)
+					}
+				},
+			},
+		},
+		"remove owner from organization": {
+			path:   ORGANIZATION_REMOVE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				MEMBER_ID_ATTR: {"1"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.RemoveFromOrganization,
+			sessionData: map[string]any{
+				USER_CTX: data.User{
+					ID:    1,
+					Email: "admin@example.com",
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != UNSUCCESSFUL_REMOVE_MEMBER_MSG {
+						params.t.Errorf("expected error message %q; got %q", UNSUCCESSFUL_REMOVE_MEMBER_MSG, msg)
+					}
+				},
+			},
+		},
+		"subscribe organization to team plan": {
+			path:   ORGANIZATION_SUBSCRIBE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				PLAN_ID_CTX: {"5"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.SubscribeOrganizationToPlan,
+			sessionData: map[string]any{
+				USER_CTX: data.User{
+					ID:    1,
+					Email: "admin@example.com",
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != SUCCESSFUL_SUBSCRIBE_MSG {
+						params.t.Errorf("expected flash message %q; got %q", SUCCESSFUL_SUBSCRIBE_MSG, msg)
+					}
+				},
+			},
+		},
+		"subscribe organization to individual plan": {
+			path:   ORGANIZATION_SUBSCRIBE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				PLAN_ID_CTX: {"1"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.SubscribeOrganizationToPlan,
+			sessionData: map[string]any{
+				USER_CTX: data.User{
+					ID:    1,
+					Email: "admin@example.com",
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != NOT_SEAT_BASED_MSG {
+						params.t.Errorf("expected error message %q; got %q", NOT_SEAT_BASED_MSG, msg)
+					}
+				},
+			},
+		},
+		"forgot password page": {
+			path:               FORGOT_PASSWORD_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.ForgotPasswordPage,
+			sessionData:        nil,
+			expectedHTML:       []string{`<h1 class="mt-5">Forgot Password</h1>`},
+			optAsserts:         nil,
+		},
+		"forgot password": {
+			path:   FORGOT_PASSWORD_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				EMAIL_ATTR: {"admin@example.com"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.ForgotPassword,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != RESET_EMAIL_SENT_MSG {
+						params.t.Errorf("expected flash message %q; got %q", RESET_EMAIL_SENT_MSG, msg)
+					}
+				},
+			},
+		},
+		"reset password page": {
+			path:               resetPasswordLink(storedUser("admin@example.com")),
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.ResetPasswordPage,
+			sessionData:        nil,
+			expectedHTML:       []string{`<h1 class="mt-5">Reset Password</h1>`},
+			optAsserts:         nil,
+		},
+		"reset password page after password change": {
+			path:               resetPasswordLink(data.User{Email: "admin@example.com", Password: "old password"}),
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.ResetPasswordPage,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != INVALID_RESET_LINK_MSG {
+						params.t.Errorf("expected error message %q; got %q", INVALID_RESET_LINK_MSG, msg)
+					}
+				},
+			},
+		},
+		"reset password": {
+			path:   resetPasswordLink(storedUser("admin@example.com")),
+			method: http.MethodPost,
+			rawBody: url.Values{
+				PASSWORD_ATTR:        {"new password 1"},
+				VERIFY_PASSWORD_ATTR: {"new password 1"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.ResetPassword,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != PASSWORD_RESET_MSG {
+						params.t.Errorf("expected flash message %q; got %q", PASSWORD_RESET_MSG, msg)
+					}
+				},
+			},
+		},
+		"reset password with mismatched passwords": {
+			path:   resetPasswordLink(storedUser("admin@example.com")),
+			method: http.MethodPost,
+			rawBody: url.Values{
+				PASSWORD_ATTR:        {"new password 1"},
+				VERIFY_PASSWORD_ATTR: {"another password 1"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.ResetPassword,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != PASSWORDS_DO_NOT_MATCH_MSG {
+						params.t.Errorf("expected error message %q; got %q", PASSWORDS_DO_NOT_MATCH_MSG, msg)
+					}
+				},
+			},
+		},
+		"activate account": {
+			path:               signedLink(ACTIVATE_PATH, url.Values{EMAIL_ATTR: {"admin@example.com"}}, ACTIVATE_PURPOSE),
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.ActivateUserAccount,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != ACCOUNT_ACTIVATED_MSG {
+						params.t.Errorf("expected flash message %q; got %q", ACCOUNT_ACTIVATED_MSG, msg)
+					}
+				},
+			},
+		},
+		"activate account with used link": {
+			path:               usedLink(ACTIVATE_PATH, url.Values{EMAIL_ATTR: {"admin@example.com"}}, ACTIVATE_PURPOSE),
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.ActivateUserAccount,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != USED_TOKEN_MSG {
+						params.t.Errorf("expected error message %q; got %q", USED_TOKEN_MSG, msg)
+					}
+				},
+			},
+		},
+		"activate account with link for another purpose": {
+			path:               signedLink(ACTIVATE_PATH, url.Values{EMAIL_ATTR: {"admin@example.com"}}, RESET_PURPOSE),
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.ActivateUserAccount,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != INVALID_TOKEN_MSG {
+						params.t.Errorf("expected error message %q; got %q", INVALID_TOKEN_MSG, msg)
+					}
+				},
+			},
+		},
+		"register page": {
+			path:               REGISTER_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.RegisterPage,
+			sessionData:        nil,
+			expectedHTML:       []string{`<h1 class="mt-5">Register</h1>`},
+			optAsserts:         nil,
+		},
+		"register": {
+			path:   REGISTER_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				EMAIL_ATTR:           {"new@example.com"},
+				PASSWORD_ATTR:        {"newpassword1"},
+				VERIFY_PASSWORD_ATTR: {"newpassword1"},
+				FIRST_NAME_ATTR:      {"New"},
+				LAST_NAME_ATTR:       {"User"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.RegisterUser,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if loc := params.w.Header().Get("Location"); loc != LOGIN_PATH {
+						params.t.Errorf("expected redirect to %s; got %s", LOGIN_PATH, loc)
+					}
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != CONFIRMATION_EMAIL_SENT_MSG {
+						params.t.Errorf("expected flash message %q; got %q", CONFIRMATION_EMAIL_SENT_MSG, msg)
+					}
+				},
+			},
+		},
+		"register with invalid form": {
+			path:   REGISTER_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				EMAIL_ATTR:           {"not-an-email"},
+				PASSWORD_ATTR:        {"onlyletters"},
+				VERIFY_PASSWORD_ATTR: {"otherletters"},
+				FIRST_NAME_ATTR:      {"<b>New</b>"},
+				LAST_NAME_ATTR:       {""},
+			},
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.RegisterUser,
+			sessionData:        nil,
+			expectedHTML: []string{
+				`<h1 class="mt-5">Register</h1>`,
+				`value="not-an-email"`,
+				`value="&lt;b&gt;New&lt;/b&gt;"`,
+				INVALID_EMAIL_MSG,
+				WEAK_PASSWORD_MSG,
+				PASSWORDS_DO_NOT_MATCH_MSG,
+				REQUIRED_FIELD_MSG,
+			},
+			optAsserts: nil,
+		},
+		"register with a taken email": {
+			path:   REGISTER_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				EMAIL_ATTR:           {"Admin@Example.com"},
+				PASSWORD_ATTR:        {"newpassword1"},
+				VERIFY_PASSWORD_ATTR: {"newpassword1"},
+				FIRST_NAME_ATTR:      {"New"},
+				LAST_NAME_ATTR:       {"User"},
+			},
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.RegisterUser,
+			sessionData:        nil,
+			expectedHTML:       []string{`value="Admin@Example.com"`, EMAIL_TAKEN_MSG},
+			optAsserts:         nil,
+		},
+		"unlock account": {
+			path:               signedLink(UNLOCK_ACCOUNT_PATH, url.Values{EMAIL_ATTR: {"admin@example.com"}}, UNLOCK_PURPOSE),
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.UnlockAccount,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != ACCOUNT_UNLOCKED_MSG {
+						params.t.Errorf("expected flash message %q; got %q", ACCOUNT_UNLOCKED_MSG, msg)
+					}
+				},
+			},
+		},
+		"unlock account with used link": {
+			path:               usedLink(UNLOCK_ACCOUNT_PATH, url.Values{EMAIL_ATTR: {"admin@example.com"}}, UNLOCK_PURPOSE),
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.UnlockAccount,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != USED_TOKEN_MSG {
+						params.t.Errorf("expected error message %q; got %q", USED_TOKEN_MSG, msg)
+					}
+				},
+			},
+		},
+		"admin locked accounts page": {
+			path:               LOCKED_ACCOUNTS_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.RequirePermission(data.UnlockAccounts)(http.HandlerFunc(testServer.AdminLockedAccountsPage)).ServeHTTP,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX: data.User{
+					ID:    1,
+					Email: "admin@example.com",
+					Role:  data.RoleAdmin,
+				},
+			},
+			expectedHTML: []string{`<h1 class="mt-5">Locked accounts</h1>`},
+			optAsserts:   nil,
+		},
+		"admin locked accounts page as non admin": {
+			path:               LOCKED_ACCOUNTS_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.RequirePermission(data.UnlockAccounts)(http.HandlerFunc(testServer.AdminLockedAccountsPage)).ServeHTTP,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX: data.User{
+					ID:    1,
+					Email: "admin@example.com",
+				},
+			},
+			expectedHTML: nil,
+			optAsserts:   nil,
+		},
+		"login with two-factor authentication": {
+			path:   LOGIN_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				EMAIL_ATTR:    {"2fa@example.com"},
+				PASSWORD_ATTR: {"abc123abc123abc123abc123"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.Login,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if loc := params.w.Header().Get("Location"); loc != LoginTwoFactorPath {
+						params.t.Errorf("expected redirect to %s; got %s", LoginTwoFactorPath, loc)
+					}
+					if testServer.Session.Exists(params.ctx, USER_ID_CTX) {
+						params.t.Error("expected the user not to be logged in before giving a code")
+					}
+					if id := testServer.Session.GetInt(params.ctx, PENDING_USER_ID_CTX); id != 2 {
+						params.t.Errorf("expected pending log in of user 2; got %d", id)
+					}
+				},
+			},
+		},
+		"login two-factor page": {
+			path:               LoginTwoFactorPath,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.LoginTwoFactorPage,
+			sessionData: map[string]any{
+				PENDING_USER_ID_CTX:  2,
+				PENDING_LOGIN_AT_CTX: time.Now().Unix(),
+			},
+			expectedHTML: []string{`<h1 class="mt-5">Two-factor authentication</h1>`, `name="totp-code"`},
+			optAsserts:   nil,
+		},
+		"login two-factor page without password": {
+			path:               LoginTwoFactorPath,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.LoginTwoFactorPage,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != TWO_FACTOR_LOGIN_EXPIRED_MSG {
+						params.t.Errorf("expected error message %q; got %q", TWO_FACTOR_LOGIN_EXPIRED_MSG, msg)
+					}
+				},
+			},
+		},
+		"login two-factor after the pending log in expired": {
+			path:   LoginTwoFactorPath,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				TOTP_CODE_ATTR: {totpCode()},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.LoginTwoFactor,
+			sessionData: map[string]any{
+				PENDING_USER_ID_CTX:  2,
+				PENDING_LOGIN_AT_CTX: time.Now().Add(-PENDING_LOGIN_MAX_AGE - time.Minute).Unix(),
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if testServer.Session.Exists(params.ctx, USER_ID_CTX) {
+						params.t.Error("expected the user not to be logged in")
+					}
+				},
+			},
+		},
+		"login two-factor": {
+			path:   LoginTwoFactorPath,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				TOTP_CODE_ATTR: {totpCode()},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.LoginTwoFactor,
+			sessionData: map[string]any{
+				PENDING_USER_ID_CTX:  2,
+				PENDING_LOGIN_AT_CTX: time.Now().Unix(),
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if id := testServer.Session.GetInt(params.ctx, USER_ID_CTX); id != 2 {
+						params.t.Errorf("expected user 2 to be logged in; got %d", id)
+					}
+					if testServer.Session.Exists(params.ctx, PENDING_USER_ID_CTX) {
+						params.t.Error("expected the pending log in to be over")
+					}
+				},
+			},
+		},
+		"login two-factor with a recovery code": {
+			path:   LoginTwoFactorPath,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				TOTP_CODE_ATTR: {data.TestRecoveryCode},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.LoginTwoFactor,
+			sessionData: map[string]any{
+				PENDING_USER_ID_CTX:  2,
+				PENDING_LOGIN_AT_CTX: time.Now().Unix(),
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if id := testServer.Session.GetInt(params.ctx, USER_ID_CTX); id != 2 {
+						params.t.Errorf("expected user 2 to be logged in; got %d", id)
+					}
+					if msg := testServer.Session.GetString(params.ctx, WARNING_CTX); msg != RECOVERY_CODE_USED_MSG {
+						params.t.Errorf("expected warning message %q; got %q", RECOVERY_CODE_USED_MSG, msg)
+					}
+				},
+			},
+		},
+		"login two-factor with an invalid code": {
+			path:   LoginTwoFactorPath,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				TOTP_CODE_ATTR: {"000000x"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.LoginTwoFactor,
+			sessionData: map[string]any{
+				PENDING_USER_ID_CTX:  2,
+				PENDING_LOGIN_AT_CTX: time.Now().Unix(),
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if testServer.Session.Exists(params.ctx, USER_ID_CTX) {
+						params.t.Error("expected the user not to be logged in")
+					}
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != INVALID_TWO_FACTOR_CODE_MSG {
+						params.t.Errorf("expected error message %q; got %q", INVALID_TWO_FACTOR_CODE_MSG, msg)
+					}
+				},
+			},
+		},
+		"two-factor page": {
+			path:               TWO_FACTOR_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.TwoFactorPage,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com"},
+			},
+			expectedHTML: []string{`<img src="data:image/png;base64,`, `<code>` + data.TestTOTPSecret + `</code>`},
+			optAsserts:   nil,
+		},
+		"two-factor page when enabled": {
+			path:               TWO_FACTOR_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.TwoFactorPage,
+			sessionData: map[string]any{
+				USER_ID_CTX: 2,
+				USER_CTX:    data.User{ID: 2, Email: "2fa@example.com"},
+			},
+			expectedHTML: []string{`<strong>enabled</strong>`, `action="/members/two-factor/disable"`},
+			optAsserts:   nil,
+		},
+		"enable two-factor": {
+			path:   TWO_FACTOR_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				TOTP_CODE_ATTR: {totpCode()},
+			},
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.EnableTwoFactor,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com"},
+			},
+			expectedHTML: []string{TWO_FACTOR_ENABLED_MSG, `Save these recovery codes`, `<li>`},
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if e := lastAuditEvent(params.t, data.AuditFilter{Action: data.TwoFactorEnabled}); e.TargetID.Int32 != 1 {
+						params.t.Errorf("expected enabling two-factor to be audited; got %+v", e)
+					}
+				},
+			},
+		},
+		"enable two-factor with an invalid code": {
+			path:   TWO_FACTOR_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				TOTP_CODE_ATTR: {"000000x"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.EnableTwoFactor,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com"},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != INVALID_TWO_FACTOR_CODE_MSG {
+						params.t.Errorf("expected error message %q; got %q", INVALID_TWO_FACTOR_CODE_MSG, msg)
+					}
+				},
+			},
+		},
+		"disable two-factor": {
+			path:   TWO_FACTOR_DISABLE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				TOTP_CODE_ATTR: {totpCode()},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.DisableTwoFactor,
+			sessionData: map[string]any{
+				USER_ID_CTX: 2,
+				USER_CTX:    data.User{ID: 2, Email: "2fa@example.com"},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != TWO_FACTOR_DISABLED_MSG {
+						params.t.Errorf("expected flash message %q; got %q", TWO_FACTOR_DISABLED_MSG, msg)
+					}
+					if e := lastAuditEvent(params.t, data.AuditFilter{Action: data.TwoFactorDisabled}); e.TargetID.Int32 != 2 {
+						params.t.Errorf("expected disabling two-factor to be audited; got %+v", e)
+					}
+				},
+			},
+		},
+		"login with an inactive account": {
+			path:   LOGIN_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				EMAIL_ATTR:    {"inactive@example.com"},
+				PASSWORD_ATTR: {"abc123abc123abc123abc123"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.Login,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if testServer.Session.Exists(params.ctx, USER_ID_CTX) {
+						params.t.Error("expected an inactive user not to be logged in")
+					}
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != ACCOUNT_NOT_ACTIVATED_MSG {
+						params.t.Errorf("expected error message %q; got %q", ACCOUNT_NOT_ACTIVATED_MSG, msg)
+					}
+				},
+			},
+		},
+		"login page after logging in with an inactive account": {
+			path:               LOGIN_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.LoginPage,
+			sessionData: map[string]any{
+				INACTIVE_EMAIL_CTX: "inactive@example.com",
+			},
+			expectedHTML: []string{`action="/resend-activation"`, `value="inactive@example.com"`},
+			optAsserts:   nil,
+		},
+		"resend activation": {
+			path:   RESEND_ACTIVATION_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				EMAIL_ATTR: {"inactive@example.com"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.ResendActivation,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != ACTIVATION_EMAIL_RESENT_MSG {
+						params.t.Errorf("expected flash message %q; got %q", ACTIVATION_EMAIL_RESENT_MSG, msg)
+					}
+				},
+			},
+		},
+		"profile page": {
+			path:               PROFILE_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.ProfilePage,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com", FirstName: "Admin", LastName: "Admin"},
+			},
+			expectedHTML: []string{`<h1 class="mt-5">Profile</h1>`, `value="Admin"`, `<strong>admin@example.com</strong>`},
+			optAsserts:   nil,
+		},
+		"update profile": {
+			path:   PROFILE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				FIRST_NAME_ATTR: {"New"},
+				LAST_NAME_ATTR:  {"Name"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.UpdateProfile,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com", FirstName: "Admin", LastName: "Admin"},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != PROFILE_UPDATED_MSG {
+						params.t.Errorf("expected flash message %q; got %q", PROFILE_UPDATED_MSG, msg)
+					}
+					if user, _ := testServer.Session.Get(params.ctx, USER_CTX).(data.User); user.FirstName != "New" {
+						params.t.Errorf("expected the user in the session to be renamed; got %q", user.FirstName)
+					}
+				},
+			},
+		},
+		"update profile without a name": {
+			path:   PROFILE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				FIRST_NAME_ATTR: {""},
+				LAST_NAME_ATTR:  {"Name"},
+			},
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.UpdateProfile,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com", FirstName: "Admin", LastName: "Admin"},
+			},
+			expectedHTML: []string{REQUIRED_FIELD_MSG, `value="Name"`},
+			optAsserts:   nil,
+		},
+		"request email change": {
+			path:   PROFILE_EMAIL_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				NEW_EMAIL_ATTR: {"new@example.com"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.RequestEmailChange,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com"},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					want := fmt.Sprintf(EMAIL_CHANGE_SENT_MSG, "new@example.com")
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != want {
+						params.t.Errorf("expected flash message %q; got %q", want, msg)
+					}
+				},
+			},
+		},
+		"request email change to the same email": {
+			path:   PROFILE_EMAIL_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				NEW_EMAIL_ATTR: {"Admin@example.com"},
+			},
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.RequestEmailChange,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com"},
+			},
+			expectedHTML: []string{SAME_EMAIL_MSG},
+			optAsserts:   nil,
+		},
+		"request email change to a taken email": {
+			path:   PROFILE_EMAIL_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				NEW_EMAIL_ATTR: {"2fa@example.com"},
+			},
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.RequestEmailChange,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com"},
+			},
+			expectedHTML: []string{EMAIL_TAKEN_MSG},
+			optAsserts:   nil,
+		},
+		"confirm email change": {
+			path:               signedLink(CONFIRM_EMAIL_CHANGE_PATH, url.Values{EMAIL_ATTR: {"admin@example.com"}, NEW_EMAIL_ATTR: {"new@example.com"}}, EMAIL_CHANGE_PURPOSE),
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.ConfirmEmailChange,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != EMAIL_CHANGED_MSG {
+						params.t.Errorf("expected flash message %q; got %q", EMAIL_CHANGED_MSG, msg)
+					}
+				},
+			},
+		},
+		"confirm email change after the email changed": {
+			path:               signedLink(CONFIRM_EMAIL_CHANGE_PATH, url.Values{EMAIL_ATTR: {"old@example.com"}, NEW_EMAIL_ATTR: {"new@example.com"}}, EMAIL_CHANGE_PURPOSE),
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.ConfirmEmailChange,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != INVALID_EMAIL_CHANGE_MSG {
+						params.t.Errorf("expected error message %q; got %q", INVALID_EMAIL_CHANGE_MSG, msg)
+					}
+				},
+			},
+		},
+		"confirm email change with used link": {
+			path:               usedLink(CONFIRM_EMAIL_CHANGE_PATH, url.Values{EMAIL_ATTR: {"admin@example.com"}, NEW_EMAIL_ATTR: {"new@example.com"}}, EMAIL_CHANGE_PURPOSE),
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.ConfirmEmailChange,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != USED_TOKEN_MSG {
+						params.t.Errorf("expected error message %q; got %q", USED_TOKEN_MSG, msg)
+					}
+				},
+			},
+		},
+		"sessions page": {
+			path:               SESSIONS_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.SessionsPage,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com"},
+			},
+			expectedHTML: []string{`<h1 class="mt-5">Your sessions</h1>`},
+			optAsserts:   nil,
+		},
+		"revoke current session": {
+			path:   SESSIONS_REVOKE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				SESSION_ID_ATTR: {"current"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.RevokeSession,
+			sessionData: map[string]any{
+				USER_ID_CTX:    1,
+				SESSION_ID_CTX: "current",
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != REVOKE_CURRENT_SESSION_MSG {
+						params.t.Errorf("expected error message %q; got %q", REVOKE_CURRENT_SESSION_MSG, msg)
+					}
+				},
+			},
+		},
+		"admin coupons page for billing": {
+			path:               COUPONS_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.RequirePermission(data.ManageCoupons)(http.HandlerFunc(testServer.AdminCouponsPage)).ServeHTTP,
+			sessionData: map[string]any{
+				USER_ID_CTX: 4,
+				USER_CTX: data.User{
+					ID:    4,
+					Email: "billing@example.com",
+					Role:  data.RoleBilling,
+				},
+			},
+			expectedHTML: []string{`<h1 class="mt-5">Coupons</h1>`, `href="/admin/coupons">Coupons</a>`},
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if strings.Contains(params.w.Body.String(), `href="/admin/locked-accounts"`) {
+						params.t.Error("expected no link to the locked accounts for billing")
+					}
+				},
+			},
+		},
+		"admin coupons page for support": {
+			path:               COUPONS_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.RequirePermission(data.ManageCoupons)(http.HandlerFunc(testServer.AdminCouponsPage)).ServeHTTP,
+			sessionData: map[string]any{
+				USER_ID_CTX: 5,
+				USER_CTX: data.User{
+					ID:    5,
+					Email: "support@example.com",
+					Role:  data.RoleSupport,
+				},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != PERMISSION_DENIED_MSG {
+						params.t.Errorf("expected error message %q; got %q", PERMISSION_DENIED_MSG, msg)
+					}
+				},
+			},
+		},
+		"admin locked accounts page for support": {
+			path:               LOCKED_ACCOUNTS_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.RequirePermission(data.UnlockAccounts)(http.HandlerFunc(testServer.AdminLockedAccountsPage)).ServeHTTP,
+			sessionData: map[string]any{
+				USER_ID_CTX: 5,
+				USER_CTX: data.User{
+					ID:    5,
+					Email: "support@example.com",
+					Role:  data.RoleSupport,
+				},
+			},
+			expectedHTML: []string{`<h1 class="mt-5">Locked accounts</h1>`, `href="/admin/locked-accounts">Locked accounts</a>`},
+			optAsserts:   nil,
+		},
+		"admin users page": {
+			path:               USERS_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.AdminUsersPage,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com", Role: data.RoleAdmin},
+			},
+			expectedHTML: []string{`<h1 class="mt-5">Users</h1>`, `<td>admin@example.com</td>`, `<td>2fa@example.com</td>`, `3 user(s), page 1 of 1`},
+			optAsserts:   nil,
+		},
+		"admin users page searched": {
+			path:               USERS_PATH + "?q=FACTOR",
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.AdminUsersPage,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com", Role: data.RoleAdmin},
+			},
+			expectedHTML: []string{`<td>2fa@example.com</td>`, `value="FACTOR"`, `1 user(s), page 1 of 1`},
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if strings.Contains(params.w.Body.String(), `<td>admin@example.com</td>`) {
+						params.t.Error("expected users not matching the search to be left out")
+					}
+				},
+			},
+		},
+		"admin user page": {
+			path:               USER_PATH + "?id=2",
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.AdminUserPage,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com", Role: data.RoleAdmin},
+			},
+			expectedHTML: []string{`<h1 class="mt-5">Two Factor</h1>`, `<tr><th>Two-factor authentication</th><td>Enabled</td></tr>`, `Deactivate</button>`, `Change plan</button>`},
+			optAsserts:   nil,
+		},
+		"admin user page for support": {
+			path:               USER_PATH + "?id=2",
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.AdminUserPage,
+			sessionData: map[string]any{
+				USER_ID_CTX: 5,
+				USER_CTX:    data.User{ID: 5, Email: "support@example.com", Role: data.RoleSupport},
+			},
+			expectedHTML: []string{`Send password reset email</button>`},
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if body := params.w.Body.String(); strings.Contains(body, `Delete user</button>`) || strings.Contains(body, `Change plan</button>`) {
+						params.t.Error("expected support not to be offered to delete users or change their plan")
+					}
+				},
+			},
+		},
+		"admin deactivate user": {
+			path:   USER_ACTIVE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				MEMBER_ID_ATTR: {"2"},
+				ACTIVE_ATTR:    {"0"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.AdminSetUserActive,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com", Role: data.RoleAdmin},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					want := fmt.Sprintf(USER_DEACTIVATED_MSG, "2fa@example.com")
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != want {
+						params.t.Errorf("expected flash message %q; got %q", want, msg)
+					}
+					if loc := params.w.Header().Get("Location"); loc != adminUserURL(2) {
+						params.t.Errorf("expected to be redirected to %s; got %s", adminUserURL(2), loc)
+					}
+				},
+			},
+		},
+		"admin deactivate own account": {
+			path:   USER_ACTIVE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				MEMBER_ID_ATTR: {"1"},
+				ACTIVE_ATTR:    {"0"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.AdminSetUserActive,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com", Role: data.RoleAdmin},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != NOT_ON_OWN_ACCOUNT_MSG {
+						params.t.Errorf("expected error message %q; got %q", NOT_ON_OWN_ACCOUNT_MSG, msg)
+					}
+				},
+			},
+		},
+		"admin change user role": {
+			path:   USER_ROLE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				MEMBER_ID_ATTR: {"2"},
+				ROLE_ATTR:      {string(data.RoleSupport)},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.AdminSetUserRole,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com", Role: data.RoleAdmin},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					want := fmt.Sprintf(ROLE_CHANGED_MSG, "2fa@example.com", "Support")
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != want {
+						params.t.Errorf("expected flash message %q; got %q", want, msg)
+					}
+				},
+			},
+		},
+		"admin change user to unknown role": {
+			path:   USER_ROLE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				MEMBER_ID_ATTR: {"2"},
+				ROLE_ATTR:      {"owner"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.AdminSetUserRole,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com", Role: data.RoleAdmin},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != INVALID_ROLE_MSG {
+						params.t.Errorf("expected error message %q; got %q", INVALID_ROLE_MSG, msg)
+					}
+				},
+			},
+		},
+		"admin send password reset": {
+			path:   USER_RESET_PASSWORD_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				MEMBER_ID_ATTR: {"2"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.AdminSendPasswordReset,
+			sessionData: map[string]any{
+				USER_ID_CTX: 5,
+				USER_CTX:    data.User{ID: 5, Email: "support@example.com", Role: data.RoleSupport},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					want := fmt.Sprintf(RESET_EMAIL_SENT_TO_MSG, "2fa@example.com")
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != want {
+						params.t.Errorf("expected flash message %q; got %q", want, msg)
+					}
+				},
+			},
+		},
+		"admin change user plan": {
+			path:   USER_PLAN_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				MEMBER_ID_ATTR: {"2"},
+				PLAN_ID_CTX:    {"1"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.AdminChangeUserPlan,
+			sessionData: map[string]any{
+				USER_ID_CTX: 4,
+				USER_CTX:    data.User{ID: 4, Email: "billing@example.com", Role: data.RoleBilling},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); !strings.HasPrefix(msg, "2fa@example.com is now subscribed to the ") {
+						params.t.Errorf("expected the plan to be changed; got %q", msg)
+					}
+				},
+			},
+		},
+		"admin delete user": {
+			path:   USER_DELETE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				MEMBER_ID_ATTR: {"3"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.AdminDeleteUser,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com", Role: data.RoleAdmin},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					want := fmt.Sprintf(USER_DELETED_MSG, "inactive@example.com")
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != want {
+						params.t.Errorf("expected flash message %q; got %q", want, msg)
+					}
+					if loc := params.w.Header().Get("Location"); loc != AdminUsersPath {
+						params.t.Errorf("expected to be redirected to %s; got %s", AdminUsersPath, loc)
+					}
+				},
+			},
+		},
+		"admin impersonate user": {
+			path:   USER_IMPERSONATE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				MEMBER_ID_ATTR: {"2"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.AdminImpersonateUser,
+			sessionData: map[string]any{
+				USER_ID_CTX: 5,
+				USER_CTX:    data.User{ID: 5, Email: "support@example.com", Role: data.RoleSupport},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					want := fmt.Sprintf(IMPERSONATION_STARTED_MSG, "2fa@example.com")
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != want {
+						params.t.Errorf("expected flash message %q; got %q", want, msg)
+					}
+					if id := testServer.Session.GetInt(params.ctx, USER_ID_CTX); id != 2 {
+						params.t.Errorf("expected to be logged in as user 2; got %d", id)
+					}
+					if id := testServer.Session.GetInt(params.ctx, IMPERSONATOR_ID_CTX); id != 5 {
+						params.t.Errorf("expected the impersonator to be user 5; got %d", id)
+					}
+					events := testServer.Models.Audit.(*data.AuditTest).Events()
+					if e := events[len(events)-1]; e.Action != data.ImpersonationStarted || e.ActorID.Int32 != 5 || e.TargetID.Int32 != 2 {
+						params.t.Errorf("expected the start of the impersonation to be audited; got %+v", e)
+					}
+				},
+			},
+		},
+		"admin impersonate admin": {
+			path:   USER_IMPERSONATE_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				MEMBER_ID_ATTR: {"1"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.AdminImpersonateUser,
+			sessionData: map[string]any{
+				USER_ID_CTX: 5,
+				USER_CTX:    data.User{ID: 5, Email: "support@example.com", Role: data.RoleSupport},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != MEMBERS_ONLY_IMPERSONATION_MSG {
+						params.t.Errorf("expected error message %q; got %q", MEMBERS_ONLY_IMPERSONATION_MSG, msg)
+					}
+					if id := testServer.Session.GetInt(params.ctx, USER_ID_CTX); id != 5 {
+						params.t.Errorf("expected to stay logged in as user 5; got %d", id)
+					}
+				},
+			},
+		},
+		"stop impersonating": {
+			path:               STOP_IMPERSONATING_PATH,
+			method:             http.MethodPost,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.StopImpersonating,
 			sessionData: map[string]any{
-				USER_CTX: data.User{
-					ID:        1,
-					Email:     "admin@example.com",
-					FirstName: "Admin",
-					LastName:  "User",
-					IsActive:  data.Active,
+				USER_ID_CTX:         2,
+				USER_CTX:            data.User{ID: 2, Email: "2fa@example.com", Role: data.RoleMember},
+				IMPERSONATOR_ID_CTX: 5,
+				IMPERSONATOR_CTX:    data.User{ID: 5, Email: "support@example.com", Role: data.RoleSupport},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if id := testServer.Session.GetInt(params.ctx, USER_ID_CTX); id != 5 {
+						params.t.Errorf("expected to be logged in as user 5 again; got %d", id)
+					}
+					if testServer.Session.Exists(params.ctx, IMPERSONATOR_ID_CTX) {
+						params.t.Error("expected the impersonator to be removed from the session")
+					}
+					if loc := params.w.Header().Get("Location"); loc != adminUserURL(2) {
+						params.t.Errorf("expected to be redirected to %s; got %s", adminUserURL(2), loc)
+					}
+					events := testServer.Models.Audit.(*data.AuditTest).Events()
+					if e := events[len(events)-1]; e.Action != data.ImpersonationStopped || e.ActorID.Int32 != 5 || e.TargetID.Int32 != 2 {
+						params.t.Errorf("expected the end of the impersonation to be audited; got %+v", e)
+					}
+				},
+			},
+		},
+		"stop impersonating without impersonating": {
+			path:               STOP_IMPERSONATING_PATH,
+			method:             http.MethodPost,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.StopImpersonating,
+			sessionData: map[string]any{
+				USER_ID_CTX: 2,
+				USER_CTX:    data.User{ID: 2, Email: "2fa@example.com", Role: data.RoleMember},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != NOT_IMPERSONATING_MSG {
+						params.t.Errorf("expected error message %q; got %q", NOT_IMPERSONATING_MSG, msg)
+					}
+				},
+			},
+		},
+		"home page while impersonating": {
+			path:               HOME_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.HomePage,
+			sessionData: map[string]any{
+				USER_ID_CTX:         2,
+				USER_CTX:            data.User{ID: 2, Email: "2fa@example.com", Role: data.RoleMember},
+				IMPERSONATOR_ID_CTX: 5,
+				IMPERSONATOR_CTX:    data.User{ID: 5, Email: "support@example.com", Role: data.RoleSupport},
+			},
+			expectedHTML: []string{`<span>You (support@example.com) are logged in as 2fa@example.com.</span>`, `Stop impersonating</button>`},
+			optAsserts:   nil,
+		},
+		"request email change while impersonating": {
+			path:   PROFILE_EMAIL_PATH,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				NEW_EMAIL_ATTR: {"new@example.com"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.NoImpersonation(http.HandlerFunc(testServer.RequestEmailChange)).ServeHTTP,
+			sessionData: map[string]any{
+				USER_ID_CTX:         2,
+				USER_CTX:            data.User{ID: 2, Email: "2fa@example.com", Role: data.RoleMember},
+				IMPERSONATOR_ID_CTX: 5,
+				IMPERSONATOR_CTX:    data.User{ID: 5, Email: "support@example.com", Role: data.RoleSupport},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != BLOCKED_WHILE_IMPERSONATING_MSG {
+						params.t.Errorf("expected error message %q; got %q", BLOCKED_WHILE_IMPERSONATING_MSG, msg)
+					}
+				},
+			},
+		},
+		"admin audit page": {
+			path:               AUDIT_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.RequirePermission(data.ViewAuditLog)(http.HandlerFunc(testServer.AdminAuditPage)).ServeHTTP,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com", Role: data.RoleAdmin},
+			},
+			expectedHTML: []string{`<h1 class="mt-5">Audit log</h1>`, `<option value="login.failure" >login.failure</option>`, `href="/admin/audit/export">Export CSV</a>`},
+			optAsserts:   nil,
+		},
+		"admin audit page for support": {
+			path:               AUDIT_PATH,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.RequirePermission(data.ViewAuditLog)(http.HandlerFunc(testServer.AdminAuditPage)).ServeHTTP,
+			sessionData: map[string]any{
+				USER_ID_CTX: 5,
+				USER_CTX:    data.User{ID: 5, Email: "support@example.com", Role: data.RoleSupport},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != PERMISSION_DENIED_MSG {
+						params.t.Errorf("expected error message %q; got %q", PERMISSION_DENIED_MSG, msg)
+					}
+				},
+			},
+		},
+		"admin audit export": {
+			path:               AUDIT_EXPORT_PATH + "?action=login.success",
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.AdminAuditExport,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+				USER_CTX:    data.User{ID: 1, Email: "admin@example.com", Role: data.RoleAdmin},
+			},
+			expectedHTML: []string{"id,created_at,action,actor_id,target_id,ip,request_id,diff\n"},
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if ct := params.w.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+						params.t.Errorf("expected a csv; got %s", ct)
+					}
+					if strings.Contains(params.w.Body.String(), ",login.failure,") {
+						params.t.Error("expected only the events matching the filter to be exported")
+					}
+				},
+			},
+		},
+		"set password without one": {
+			path:   MembersProfilePasswordPath,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				PASSWORD_ATTR:        {"new password 1"},
+				VERIFY_PASSWORD_ATTR: {"new password 1"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.SetPassword,
+			sessionData: map[string]any{
+				USER_CTX: data.User{ID: 6, Email: "sso@example.com"},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != PASSWORD_SET_MSG {
+						params.t.Errorf("expected flash message %q; got %q", PASSWORD_SET_MSG, msg)
+					}
+					if e := lastAuditEvent(params.t, data.AuditFilter{Action: data.PasswordSet}); e.TargetID.Int32 != 6 {
+						params.t.Errorf("expected the password to be audited for user 6; got %+v", e)
+					}
+				},
+			},
+		},
+		"set password with one already": {
+			path:   MembersProfilePasswordPath,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				PASSWORD_ATTR:        {"new password 1"},
+				VERIFY_PASSWORD_ATTR: {"new password 1"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.SetPassword,
+			sessionData: map[string]any{
+				USER_CTX: data.User{ID: 1, Email: "admin@example.com"},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != PASSWORD_ALREADY_SET_MSG {
+						params.t.Errorf("expected error message %q; got %q", PASSWORD_ALREADY_SET_MSG, msg)
+					}
+				},
+			},
+		},
+		"remove the only way to log in": {
+			path:               MembersProfilePasswordRemovePath,
+			method:             http.MethodPost,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.RemovePassword,
+			sessionData: map[string]any{
+				USER_CTX: data.User{ID: 2, Email: "2fa@example.com"},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != LAST_LOGIN_METHOD_MSG {
+						params.t.Errorf("expected error message %q; got %q", LAST_LOGIN_METHOD_MSG, msg)
+					}
+				},
+			},
+		},
+		"log in with disabled identity provider": {
+			path:               LoginOIDCPath,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.OIDCLogin,
+			sessionData:        nil,
+			expectedHTML:       nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != OIDC_DISABLED_MSG {
+						params.t.Errorf("expected error message %q; got %q", OIDC_DISABLED_MSG, msg)
+					}
+				},
+			},
+		},
+		"create api token": {
+			path:   MembersProfileTokensPath,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				TOKEN_NAME_ATTR: {"billing script"},
+				SCOPE_ATTR:      {string(data.ReadPlans), string(data.ReadSubscription)},
+				EXPIRES_IN_ATTR: {"90"},
+			},
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.CreateAPIToken,
+			sessionData: map[string]any{
+				USER_CTX: data.User{ID: 2, Email: "2fa@example.com"},
+			},
+			expectedHTML: []string{template.HTMLEscapeString(API_TOKEN_CREATED_MSG), `<code>` + data.APITokenPrefix, `<td>billing script</td>`},
+			optAsserts: []optAssert{
+				func(params optParams) {
+					tokens, _ := testServer.Models.APIToken.GetByUserID(2)
+					if len(tokens) != 1 || len(tokens[0].Scopes) != 2 || !tokens[0].ExpiresAt.Valid {
+						params.t.Errorf("expected a token with 2 scopes and an expiry; got %+v", tokens)
+					}
+					if e := lastAuditEvent(params.t, data.AuditFilter{Action: data.APITokenCreated}); e.TargetID.Int32 != 2 {
+						params.t.Errorf("expected the token to be audited for user 2; got %+v", e)
+					}
 				},
 			},
+		},
+		"create api token without scope": {
+			path:   MembersProfileTokensPath,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				TOKEN_NAME_ATTR: {"no scope"},
+				SCOPE_ATTR:      {"users:delete"},
+				EXPIRES_IN_ATTR: {"7"},
+			},
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.CreateAPIToken,
+			sessionData: map[string]any{
+				USER_CTX: data.User{ID: 1, Email: "admin@example.com"},
+			},
+			expectedHTML: []string{NO_SCOPE_MSG, INVALID_EXPIRY_MSG},
+			optAsserts:   nil,
+		},
+		"revoke unknown api token": {
+			path:   MembersProfileTokensRevokePath,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				TOKEN_ID_ATTR: {"999"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.RevokeAPIToken,
+			sessionData: map[string]any{
+				USER_ID_CTX: 1,
+			},
 			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != UNKNOWN_API_TOKEN_MSG {
+						params.t.Errorf("expected error message %q; got %q", UNKNOWN_API_TOKEN_MSG, msg)
+					}
+				},
+			},
+		},
+		"api docs page": {
+			path:               APIDocsPath,
+			method:             http.MethodGet,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.APIDocsPage,
+			sessionData:        nil,
+			expectedHTML: []string{
+				`<a href="/api/openapi.json">`,
+				`<td><code>/api/v1/me/subscription</code></td>`,
+				`<td><code>subscription:write</code></td>`,
+			},
+			optAsserts: nil,
+		},
+		"delete account with wrong password": {
+			path:   MembersAccountDeletePath,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				DELETE_CONFIRM_ATTR: {"not my password"},
+			},
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.RequestAccountDeletion,
+			sessionData: map[string]any{
+				USER_CTX: data.User{ID: 2, Email: "2fa@example.com"},
+			},
+			expectedHTML: []string{template.HTMLEscapeString(WRONG_PASSWORD_MSG), "Delete my account"},
 			optAsserts:   nil,
 		},
+		"delete account owning a team with members": {
+			path:   MembersAccountDeletePath,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				DELETE_CONFIRM_ATTR: {data.TestPassword},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.RequestAccountDeletion,
+			sessionData: map[string]any{
+				USER_CTX: data.User{ID: 1, Email: "admin@example.com"},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg, want := testServer.Session.GetString(params.ctx, ERROR_CTX), fmt.Sprintf(OWNS_ORGANIZATION_MSG, "Example Inc."); msg != want {
+						params.t.Errorf("expected error message %q; got %q", want, msg)
+					}
+					if _, err := testServer.Models.AccountDeletion.GetByUserID(1); err == nil {
+						params.t.Error("expected the deletion not to be scheduled")
+					}
+				},
+			},
+		},
+		"delete account without password": {
+			path:   MembersAccountDeletePath,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				DELETE_CONFIRM_ATTR: {"SSO@example.com"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.RequestAccountDeletion,
+			sessionData: map[string]any{
+				USER_CTX: data.User{ID: 6, Email: "sso@example.com"},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); !strings.HasPrefix(msg, "Your account will be deleted on") {
+						params.t.Errorf("expected flash message %q; got %q", DELETION_SCHEDULED_MSG, msg)
+					}
+					if _, err := testServer.Models.AccountDeletion.GetByUserID(6); err != nil {
+						params.t.Errorf("expected the deletion to be scheduled; got %v", err)
+					}
+					if e := lastAuditEvent(params.t, data.AuditFilter{Action: data.AccountDeletionScheduled}); e.TargetID.Int32 != 6 {
+						params.t.Errorf("expected the deletion to be audited for user 6; got %+v", e)
+					}
+				},
+			},
+		},
+		"delete account with wrong email": {
+			path:   MembersAccountDeletePath,
+			method: http.MethodPost,
+			rawBody: url.Values{
+				DELETE_CONFIRM_ATTR: {"admin@example.com"},
+			},
+			expectedStatusCode: http.StatusOK,
+			handler:            testServer.RequestAccountDeletion,
+			sessionData: map[string]any{
+				USER_CTX: data.User{ID: 6, Email: "sso@example.com"},
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, FLASH_CTX); msg != "" {
+						params.t.Errorf("expected the deletion not to be scheduled; got flash message %q", msg)
+					}
+				},
+			},
+		},
+		"cancel account deletion never asked for": {
+			path:               MembersAccountDeleteCancelPath,
+			method:             http.MethodPost,
+			rawBody:            nil,
+			expectedStatusCode: http.StatusSeeOther,
+			handler:            testServer.CancelAccountDeletion,
+			sessionData: map[string]any{
+				USER_ID_CTX: 2,
+			},
+			expectedHTML: nil,
+			optAsserts: []optAssert{
+				func(params optParams) {
+					if msg := testServer.Session.GetString(params.ctx, ERROR_CTX); msg != NO_DELETION_MSG {
+						params.t.Errorf("expected error message %q; got %q", NO_DELETION_MSG, msg)
+					}
+				},
+			},
+		},
 	}
 
 	for name, tt := range tests {
@@ -119,6 +2168,9 @@ func Test_Handlers(t *testing.T) {
 				reqBody = strings.NewReader(tt.rawBody.Encode())
 			}
 			rawReq, _ := http.NewRequest(tt.method, tt.path, reqBody)
+			if tt.rawBody != nil {
+				rawReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
 			r := newReqWithSession(rawReq)
 
 			if len(tt.sessionData) > 0 {
@@ -153,3 +2205,50 @@ func Test_Handlers(t *testing.T) {
 		})
 	}
 }
+
+// storedUser returns the user as the test models store it, password hash included
+func storedUser(email string) data.User {
+	u, err := testServer.Models.User.GetByEmail(email)
+	if err != nil {
+		panic(err)
+	}
+	return *u
+}
+
+// resetPasswordLink returns a signed link to reset the password of the user, as sent by email
+func resetPasswordLink(u data.User) string {
+	q := url.Values{}
+	q.Set(EMAIL_ATTR, u.Email)
+	q.Set(FINGERPRINT_ATTR, u.PasswordFingerprint())
+
+	return signedLink(RESET_PASSWORD_PATH, q, RESET_PURPOSE)
+}
+
+// signedLink returns a link to the path signed for the purpose, as sent by email
+func signedLink(path string, q url.Values, purpose TokenPurpose) string {
+	link, err := testServer.signURL(&url.URL{Scheme: "http", Path: path, RawQuery: q.Encode()}, purpose, time.Hour)
+	if err != nil {
+		panic(err)
+	}
+
+	return link
+}
+
+// usedLink returns a link to the path signed for the purpose whose token has already been used
+func usedLink(path string, q url.Values, purpose TokenPurpose) string {
+	q.Set(PURPOSE_PARAM, string(purpose))
+	q.Set(MAX_AGE_PARAM, "3600")
+	q.Set(NONCE_PARAM, data.UsedTokenNonce)
+
+	return testServer.Keyring.GenerateTokenFromString("http://" + path + "?" + q.Encode())
+}
+
+// totpCode returns the current code of the authenticator of the sample two-factor user
+func totpCode() string {
+	code, err := totp.GenerateCode(data.TestTOTPSecret, time.Now())
+	if err != nil {
+		panic(err)
+	}
+
+	return code
+}
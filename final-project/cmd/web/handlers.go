@@ -1,14 +1,17 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/MatsuoTakuro/final-project/data"
-	mail "github.com/xhit/go-simple-mail/v2"
 )
 
 // XXX_PAGE is the name of the template gohtml file to render for the page
@@ -17,6 +20,9 @@ const (
 	LOGIN_PAGE    = "login.page.gohtml"
 	REGISTER_PAGE = "register.page.gohtml"
 	PLANS_PAGE    = "plans.page.gohtml"
+
+	FORGOT_PASSWORD_PAGE = "forgot-password.page.gohtml"
+	RESET_PASSWORD_PAGE  = "reset-password.page.gohtml"
 )
 
 // XXX_MSG is the message to display to the user or to log for you
@@ -26,6 +32,8 @@ const (
 	UNSUCCESSFUL_CREATE_USER_MSG = "Unable to create user."
 	CONFIRMATION_EMAIL_SENT_MSG  = "Confirmation email sent. Check your email."
 	INVALID_TOKEN_MSG            = "Invalid token."
+	EXPIRED_TOKEN_MSG            = "This link has expired."
+	USED_TOKEN_MSG               = "This link has already been used."
 	NOT_FOUND_USER_BY_EMAIL_MSG  = "No user found with that email."
 	NOT_FOUND_USER_BY_ID_MSG     = "No user found with that id."
 	UNSUCCESSFUL_UPDATE_USER_MSG = "Unable to update user."
@@ -38,14 +46,58 @@ const (
 	UNSUCCESSFUL_FIND_PLAN_MSG   = "Unable to find plan."
 	SUCCESSFUL_SUBSCRIBE_MSG     = "Subscribed!"
 	UNSUCCESSFUL_SUBSCRIBE_MSG   = "Unable to subscribe."
+	FEATURE_NOT_IN_PLAN_MSG      = "Your plan does not include this feature. Upgrade your plan to use it."
+	FEATURE_DISABLED_MSG         = "This feature is unavailable for the time being. Please try again later."
+	ERROR_CHECK_ENTITLEMENT_MSG  = "error checking entitlement: %w"
+	ERROR_OUTPUT_MANUAL_MSG      = "error writing manual: %w"
+	UNSUPPORTED_PREFERENCES_MSG  = "Unsupported currency or locale."
+	PREFERENCES_UPDATED_MSG      = "Preferences updated."
+	INVALID_COUPON_MSG           = "Invalid coupon code."
+	EXPIRED_COUPON_MSG           = "This coupon has expired."
+	USED_UP_COUPON_MSG           = "This coupon can no longer be redeemed."
+	COUPON_REDEEMED_MSG          = "You have already redeemed this coupon."
+	COUPON_CURRENCY_MSG          = "This coupon can't be used with the currency of your plan."
+	TEAM_PLAN_ONLY_MSG           = "This plan is for teams. Subscribe to it from your team page."
+	RESET_EMAIL_SENT_MSG         = "If an account exists for that email, we sent a link to reset its password."
+	INVALID_RESET_LINK_MSG       = "Your password has changed since this link was sent. Request a new one."
+	PASSWORDS_DO_NOT_MATCH_MSG   = "Passwords do not match."
+	PASSWORD_TOO_SHORT_MSG       = "Passwords must be at least %d characters long."
+	UNSUCCESSFUL_RESET_MSG       = "Unable to reset password."
+	PASSWORD_RESET_MSG           = "Password reset. You can now log in."
+	UNSUCCESSFUL_LOGIN_MSG       = "Unable to log in. Try again later."
+	ACCOUNT_NOT_ACTIVATED_MSG    = "Your account hasn't been activated yet. Click the link in the email we sent you, or have it sent again."
+	ACTIVATION_EMAIL_RESENT_MSG  = "If that account still needs to be activated, we sent a new activation link. Check your email."
+	ACTIVATION_RATE_LIMITED_MSG  = "Too many activation emails requested. Try again later."
+	EMAIL_TAKEN_MSG              = "An account with this email already exists. Log in, or reset your password if you forgot it."
+)
+
+const (
+	ACTIVATION_LINK_MAX_AGE = 24 * time.Hour
+	RESET_LINK_MAX_AGE      = 1 * time.Hour
+	MIN_PASSWORD_LENGTH     = 8
+
+	RESEND_ACTIVATION_LIMIT  = 3 // activation emails per address per window
+	RESEND_ACTIVATION_WINDOW = 1 * time.Hour
 )
 
+// errPasswordChanged is returned for a password reset link sent before the password last changed
+var errPasswordChanged = errors.New("password has changed since the link was sent")
+
 func (s *Server) HomePage(w http.ResponseWriter, r *http.Request) {
 	s.render(w, r, HOME_PAGE, nil)
 }
 
 func (s *Server) LoginPage(w http.ResponseWriter, r *http.Request) {
-	s.render(w, r, LOGIN_PAGE, nil)
+	stringMap := map[string]string{
+		INACTIVE_EMAIL_ATTR: s.Session.PopString(r.Context(), INACTIVE_EMAIL_CTX),
+	}
+	if s.OIDC != nil {
+		stringMap[OIDC_NAME_ATTR] = s.OIDC.Name
+	}
+
+	s.render(w, r, LOGIN_PAGE, &TemplateData{
+		StringMap: stringMap,
+	})
 }
 
 func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
@@ -61,16 +113,26 @@ func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
 
 	email := r.Form.Get(EMAIL_ATTR)
 	password := r.Form.Get(PASSWORD_ATTR)
+	ip := clientIP(r)
+
+	// slow down anyone guessing passwords, and lock them out if they keep at it
+	if msg := s.loginThrottled(email, ip); msg != "" {
+		s.Session.Put(r.Context(), ERROR_CTX, msg)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
 
 	user, err := s.Models.User.GetByEmail(email)
 	if err != nil {
+		s.loginFailed(r, email, ip, nil)
 		s.Session.Put(r.Context(), ERROR_CTX, INVALID_CREDS_MSG)
 		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
 		return
 	}
 
-	isValidPassword, err := s.Models.User.PasswordMatches(password)
+	isValidPassword, err := user.PasswordMatches(password)
 	if err != nil {
+		s.loginFailed(r, email, ip, user)
 		s.Session.Put(r.Context(), ERROR_CTX, INVALID_CREDS_MSG)
 		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
 		return
@@ -84,21 +146,74 @@ func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
 		}
 		s.sendEmail(msg)
 
+		s.loginFailed(r, email, ip, user)
 		s.Session.Put(r.Context(), ERROR_CTX, INVALID_CREDS_MSG)
 		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
 		return
 	}
 
+	s.finishLogin(w, r, user)
+}
+
+// finishLogin logs in the user who has proved who they are, unless their account isn't active yet,
+// or they have yet to give a two-factor code
+func (s *Server) finishLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	// the email must have been confirmed first; offer to send the link again
+	if user.IsActive == data.Inactive {
+		s.Session.Put(r.Context(), INACTIVE_EMAIL_CTX, user.Email)
+		s.Session.Put(r.Context(), ERROR_CTX, ACCOUNT_NOT_ACTIVATED_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	// with two-factor authentication, the password or the identity provider is only the first step
+	tf, err := s.Models.TwoFactor.GetByUserID(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_TWO_FACTOR_MSG, user.ID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_LOGIN_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+	if tf != nil && tf.Enabled() {
+		s.startPendingLogin(r, user)
+		http.Redirect(w, r, LoginTwoFactorPath, http.StatusSeeOther)
+		return
+	}
+
 	// log user in
-	s.Session.Put(r.Context(), USER_ID_CTX, user.ID)
-	s.Session.Put(r.Context(), USER_CTX, user)
-	s.Session.Put(r.Context(), FLASH_CTX, SUCCESSFUL_LOGIN_MSG)
+	s.logIn(r, user)
 
 	// redirect the user to the home page
 	http.Redirect(w, r, HOME_PATH, http.StatusSeeOther)
 }
 
+// logIn logs the user in, who has been fully authenticated
+func (s *Server) logIn(r *http.Request, user *data.User) {
+	if err := s.Throttle.Succeed(user.Email); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_THROTTLE_LOGIN_MSG, err))
+	}
+
+	s.Session.Put(r.Context(), USER_ID_CTX, user.ID)
+	s.Session.Put(r.Context(), USER_CTX, user)
+	s.recordSession(r, user.ID)
+	s.limitSessions(r, *user)
+	s.audit(r, data.LoginSucceeded, user.ID, user.ID, nil)
+	s.Session.Put(r.Context(), FLASH_CTX, SUCCESSFUL_LOGIN_MSG)
+}
+
 func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	// forget the session in the registry, before its id goes with the session. While impersonating,
+	// the session is registered to the admin rather than to the user they are logged in as.
+	userID := s.Session.GetInt(r.Context(), USER_ID_CTX)
+	if impersonatorID := s.Session.GetInt(r.Context(), IMPERSONATOR_ID_CTX); impersonatorID != 0 {
+		userID = impersonatorID
+	}
+	if id := s.Session.GetString(r.Context(), SESSION_ID_CTX); id != "" {
+		if err := s.Sessions.Remove(userID, id); err != nil {
+			s.ErrorLog.Println(fmt.Errorf(ERROR_UNREGISTER_SESSION_MSG, err))
+		}
+	}
+
 	// clean up session
 	_ = s.Session.Destroy(r.Context())
 	_ = s.Session.RenewToken(r.Context()) // renew the session token every time the user logs out
@@ -118,95 +233,286 @@ func (s *Server) RegisterUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// validate data
-	// NOTE: - originally, here should validate the data by checking if the user already exists or not and other stuff
+	form := NewForm(r.PostForm)
+	form.Required(EMAIL_ATTR, PASSWORD_ATTR, VERIFY_PASSWORD_ATTR, FIRST_NAME_ATTR, LAST_NAME_ATTR)
+	form.IsEmail(EMAIL_ATTR)
+	form.Password(PASSWORD_ATTR)
+	form.Matches(VERIFY_PASSWORD_ATTR, PASSWORD_ATTR)
+	if !form.Valid() {
+		s.render(w, r, REGISTER_PAGE, &TemplateData{Form: form})
+		return
+	}
 
-	// send an activation email
 	u := data.User{
-		Email:     r.Form.Get(EMAIL_ATTR),
-		FirstName: r.Form.Get(FIRST_NAME_ATTR),
-		LastName:  r.Form.Get(LAST_NAME_ATTR),
-		Password:  r.Form.Get(PASSWORD_ATTR),
+		Email:     strings.TrimSpace(form.Get(EMAIL_ATTR)),
+		FirstName: strings.TrimSpace(form.Get(FIRST_NAME_ATTR)),
+		LastName:  strings.TrimSpace(form.Get(LAST_NAME_ATTR)),
+		Password:  form.Get(PASSWORD_ATTR),
 		IsActive:  data.Inactive,
-		IsAdmin:   data.NotAdmin,
+		Role:      data.RoleMember,
 	}
 
-	_, err = s.Models.User.Insert(u)
+	id, err := s.Models.User.Insert(u)
+	if errors.Is(err, data.ErrDuplicateEmail) {
+		form.Errors.Add(EMAIL_ATTR, EMAIL_TAKEN_MSG)
+		s.render(w, r, REGISTER_PAGE, &TemplateData{Form: form})
+		return
+	}
 	if err != nil {
+		s.ErrorLog.Println(err)
 		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_CREATE_USER_MSG)
 		http.Redirect(w, r, REGISTER_PATH, http.StatusSeeOther)
 		return
 	}
+	s.audit(r, data.AccountCreated, id, id, nil)
 
 	// send an activation email
+	if err := s.sendActivationEmail(r, u.Email); err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_CREATE_USER_MSG)
+		http.Redirect(w, r, REGISTER_PATH, http.StatusSeeOther)
+		return
+	}
+
+	s.Session.Put(r.Context(), FLASH_CTX, CONFIRMATION_EMAIL_SENT_MSG)
+	http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+}
+
+func (s *Server) ActivateUserAccount(w http.ResponseWriter, r *http.Request) {
+	// validate url, which can only be used once
+	q, err := s.consumeSignedURL(r, ACTIVATE_PURPOSE)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, tokenErrorMessage(err))
+		http.Redirect(w, r, HOME_PATH, http.StatusSeeOther)
+		return
+	}
+
+	u, err := s.Models.User.GetByEmail(q.Get(EMAIL_ATTR))
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, NOT_FOUND_USER_BY_EMAIL_MSG)
+		http.Redirect(w, r, HOME_PATH, http.StatusSeeOther)
+		return
+	}
+
+	u.IsActive = data.Active
+	if err := s.Models.User.Update(*u); err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_UPDATE_USER_MSG)
+		http.Redirect(w, r, HOME_PATH, http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.AccountActivated, u.ID, u.ID, nil)
+
+	s.Session.Put(r.Context(), FLASH_CTX, ACCOUNT_ACTIVATED_MSG)
+	http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+}
+
+// ResendActivation sends a fresh activation link to an account which hasn't been activated yet.
+// It tells the same thing whether such an account exists or not, and is rate limited per address.
+func (s *Server) ResendActivation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	email := normalizeEmail(r.Form.Get(EMAIL_ATTR))
+
+	limits := s.Throttle.Limits()
+	allowed, err := s.Throttle.Allow(RESEND_ACTIVATION_KEY+email, limits.ResendActivationLimit, limits.ResendActivationWindow)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_THROTTLE_LOGIN_MSG, err))
+	}
+	if !allowed {
+		s.Session.Put(r.Context(), ERROR_CTX, ACTIVATION_RATE_LIMITED_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	u, err := s.Models.User.GetByEmail(email)
+	if err == nil && u.IsActive == data.Inactive {
+		if err := s.sendActivationEmail(r, u.Email); err != nil {
+			s.ErrorLog.Println(err)
+		}
+	}
+
+	s.Session.Put(r.Context(), FLASH_CTX, ACTIVATION_EMAIL_RESENT_MSG)
+	http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+}
+
+// sendActivationEmail sends a link to activate the account with the email, which can only be used once
+func (s *Server) sendActivationEmail(r *http.Request, email string) error {
 	q := url.Values{}
-	q.Set(EMAIL_ATTR, u.Email)
+	q.Set(EMAIL_ATTR, email)
 	activateURL := &url.URL{
 		Scheme:   "http",
 		Host:     r.Host,
 		Path:     ACTIVATE_PATH,
 		RawQuery: q.Encode(),
 	}
-	signedURL := GenerateTokenFromString(activateURL.String())
+	signedURL, err := s.signURL(activateURL, ACTIVATE_PURPOSE, ACTIVATION_LINK_MAX_AGE)
+	if err != nil {
+		return err
+	}
 	s.InfoLog.Println(signedURL)
 
 	msg := Message{
-		To:       u.Email,
+		To:       email,
 		Subject:  "Activate your account",
 		Template: CONFIRM_EMAIL,
 		Data:     template.HTML(signedURL),
 	}
 	s.sendEmail(msg)
 
-	s.Session.Put(r.Context(), FLASH_CTX, CONFIRMATION_EMAIL_SENT_MSG)
+	return nil
+}
+
+func (s *Server) ForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	s.render(w, r, FORGOT_PASSWORD_PAGE, nil)
+}
+
+func (s *Server) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	// tell the same thing whether the user exists or not, so that this can't be used to find out
+	u, err := s.Models.User.GetByEmail(r.Form.Get(EMAIL_ATTR))
+	if err == nil {
+		if err := s.sendPasswordResetEmail(r, u); err != nil {
+			s.ErrorLog.Println(err)
+			s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_RESET_MSG)
+			http.Redirect(w, r, FORGOT_PASSWORD_PATH, http.StatusSeeOther)
+			return
+		}
+	}
+
+	s.Session.Put(r.Context(), FLASH_CTX, RESET_EMAIL_SENT_MSG)
 	http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
 }
 
-func (s *Server) ActivateUserAccount(w http.ResponseWriter, r *http.Request) {
-	// validate url
-	gotURL := &url.URL{
+// sendPasswordResetEmail emails the user a link to reset their password
+func (s *Server) sendPasswordResetEmail(r *http.Request, u *data.User) error {
+	// the fingerprint of the current password makes the link stop working once the password has changed
+	q := url.Values{}
+	q.Set(EMAIL_ATTR, u.Email)
+	q.Set(FINGERPRINT_ATTR, u.PasswordFingerprint())
+	resetURL := &url.URL{
 		Scheme:   "http",
 		Host:     r.Host,
-		Path:     r.URL.Path,
-		RawQuery: r.URL.RawQuery,
+		Path:     RESET_PASSWORD_PATH,
+		RawQuery: q.Encode(),
+	}
+	signedURL, err := s.signURL(resetURL, RESET_PURPOSE, RESET_LINK_MAX_AGE)
+	if err != nil {
+		return err
 	}
 
-	if ok := VerifyToken(gotURL.String()); !ok {
-		s.Session.Put(r.Context(), ERROR_CTX, INVALID_TOKEN_MSG)
-		http.Redirect(w, r, HOME_PATH, http.StatusSeeOther)
+	msg := Message{
+		To:       u.Email,
+		Subject:  "Reset your password",
+		Template: RESET_PASSWORD,
+		Data:     template.HTML(signedURL),
+	}
+	s.sendEmail(msg)
+
+	return nil
+}
+
+func (s *Server) ResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.userFromResetLink(r); err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, resetLinkErrorMessage(err))
+		http.Redirect(w, r, FORGOT_PASSWORD_PATH, http.StatusSeeOther)
 		return
 	}
 
-	u, err := s.Models.User.GetByEmail(r.URL.Query().Get(EMAIL_ATTR))
+	s.render(w, r, RESET_PASSWORD_PAGE, &TemplateData{
+		StringMap: map[string]string{
+			RESET_URL_ATTR: r.URL.RequestURI(),
+		},
+	})
+}
+
+func (s *Server) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
 	if err != nil {
-		s.Session.Put(r.Context(), ERROR_CTX, NOT_FOUND_USER_BY_EMAIL_MSG)
-		http.Redirect(w, r, HOME_PATH, http.StatusSeeOther)
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	u, err := s.userFromResetLink(r)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, resetLinkErrorMessage(err))
+		http.Redirect(w, r, FORGOT_PASSWORD_PATH, http.StatusSeeOther)
 		return
 	}
 
-	u.IsActive = data.Active
-	if err := s.Models.User.Update(*u); err != nil {
-		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_UPDATE_USER_MSG)
-		http.Redirect(w, r, HOME_PATH, http.StatusSeeOther)
+	form := NewForm(r.PostForm)
+	form.Required(PASSWORD_ATTR)
+	form.Password(PASSWORD_ATTR)
+	form.Matches(VERIFY_PASSWORD_ATTR, PASSWORD_ATTR)
+	if !form.Valid() {
+		s.Session.Put(r.Context(), ERROR_CTX, form.Errors.First(PASSWORD_ATTR, VERIFY_PASSWORD_ATTR))
+		http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
 		return
 	}
+	password := form.Get(PASSWORD_ATTR)
 
-	s.Session.Put(r.Context(), FLASH_CTX, ACCOUNT_ACTIVATED_MSG)
+	// use up the link only once the new password is acceptable
+	if _, err := s.consumeSignedURL(r, RESET_PURPOSE); err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, resetLinkErrorMessage(err))
+		http.Redirect(w, r, FORGOT_PASSWORD_PATH, http.StatusSeeOther)
+		return
+	}
+
+	// changing the password also changes its fingerprint, so other links sent before stop working
+	if err := s.Models.User.ResetPassword(*u, password); err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_RESET_MSG)
+		http.Redirect(w, r, FORGOT_PASSWORD_PATH, http.StatusSeeOther)
+		return
+	}
+
+	// whoever knew the old password may still be logged in
+	if err := s.revokeSessions(r, u.ID, false); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_REVOKE_SESSION_MSG, u.ID, err))
+	}
+
+	s.Session.Put(r.Context(), FLASH_CTX, PASSWORD_RESET_MSG)
 	http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
 }
 
+// userFromResetLink returns the user a password reset link was sent to,
+// if the link is genuine, hasn't expired and the password hasn't changed since it was sent
+func (s *Server) userFromResetLink(r *http.Request) (*data.User, error) {
+	q, err := s.verifySignedURL(r, RESET_PURPOSE)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := s.Models.User.GetByEmail(q.Get(EMAIL_ATTR))
+	if err != nil {
+		return nil, ErrTokenTampered
+	}
+
+	if u.PasswordFingerprint() != q.Get(FINGERPRINT_ATTR) {
+		return nil, errPasswordChanged
+	}
+
+	return u, nil
+}
+
+// resetLinkErrorMessage returns the message to display to the user when a password reset link can't be used
+func resetLinkErrorMessage(err error) string {
+	if errors.Is(err, errPasswordChanged) {
+		return INVALID_RESET_LINK_MSG
+	}
+	return tokenErrorMessage(err)
+}
+
 func (s *Server) SubcribeToPlan(w http.ResponseWriter, r *http.Request) {
 	// get the id of the plan that is chosen
 	id := r.URL.Query().Get(PLAN_ID_CTX)
 	planID, _ := strconv.Atoi(id)
 
-	// get the plan from the database
-	plan, err := s.Models.Plan.GetOne(planID)
-	if err != nil {
-		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_FIND_PLAN_MSG)
-		http.Redirect(w, r, MembersPlanPath, http.StatusSeeOther)
-		return
-	}
-
 	// get the user from the session
 	user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
 	if !ok {
@@ -215,57 +521,9 @@ func (s *Server) SubcribeToPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// generate an invoice and email it
-	s.AsyncJob.Add(1) // increment counter every time a new invoice is generated
-	go func() {
-		defer s.AsyncJob.Done() // decrement counter every time an invoice is generated and passed to the mailer to send
-
-		invoice, err := s.getInvoice(user, plan)
-		if err != nil {
-			s.AsyncErr <- err
-		}
-
-		msg := Message{
-			To:       user.Email,
-			Subject:  "Your invoice",
-			Data:     invoice,
-			Template: "invoice",
-		}
-		s.sendEmail(msg)
-	}()
-
-	// generate a manual
-	s.AsyncJob.Add(1) // increment counter every time a new manual is generated
-	go func() {
-		defer s.AsyncJob.Done() // decrement counter every time a manual is generated and passed to the mailer to send
-
-		pdf := s.generateManual(user, plan)
-		filePath := fmt.Sprintf(ManualOutputTempPath, user.ID)
-		err := pdf.OutputFileAndClose(filePath)
-		if err != nil {
-			s.AsyncErr <- err
-			return
-		}
-
-		msg := Message{
-			To:      user.Email,
-			Subject: "Your manual",
-			Data:    "Your user manual is attached",
-			Attachments: []*mail.File{
-				{
-					Name:     MANUAL_ATTCH_NAME,
-					FilePath: filePath,
-				},
-			},
-		}
-
-		s.sendEmail(msg)
-	}()
-
 	// subscribe the user to a plan
-	err = s.Models.Plan.SubscribeUserToPlan(user, *plan)
-	if err != nil {
-		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_SUBSCRIBE_MSG)
+	if _, err := s.subscribeUser(r, user, planID, r.URL.Query().Get(COUPON_ATTR)); err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, subscribeErrorMessage(err))
 		http.Redirect(w, r, MembersPlanPath, http.StatusSeeOther)
 		return
 	}
@@ -293,8 +551,110 @@ func (s *Server) ListOfPlans(w http.ResponseWriter, r *http.Request) {
 
 	dataMap := make(map[string]any)
 	dataMap[PLANS_ATTR] = plans
+	dataMap[FEATURES_ATTR] = data.AllFeatures
+	dataMap[LIMITS_ATTR] = data.AllLimits
+	dataMap[CURRENCIES_ATTR] = data.SupportedCurrencies
+	dataMap[LOCALES_ATTR] = data.SupportedLocales
+
+	if user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User); ok {
+		// show the prices in the currency and the format the user prefers
+		for _, plan := range plans {
+			plan.Localize(user.Currency, user.Locale)
+		}
+
+		// the subscription of the user, if any, to show the trial status
+		if sub, err := s.Models.Subscription.GetByUserID(user.ID); err == nil {
+			dataMap[SUBSCRIPTION_ATTR] = sub
+		}
+	}
 
 	s.render(w, r, PLANS_PAGE, &TemplateData{
 		Data: dataMap,
 	})
 }
+
+func (s *Server) DownloadManual(w http.ResponseWriter, r *http.Request) {
+	// get the user from the session
+	user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	// get the current plan of the user from the database
+	u, err := s.Models.User.GetOne(user.ID)
+	if err != nil || u.Plan == nil {
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_FIND_PLAN_MSG)
+		http.Redirect(w, r, MembersPlanPath, http.StatusSeeOther)
+		return
+	}
+
+	pdf := s.generateManual(*u, u.Plan)
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", MANUAL_ATTCH_NAME))
+	if err := pdf.Output(w); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_OUTPUT_MANUAL_MSG, err))
+	}
+}
+
+func (s *Server) UpdatePreferences(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	// get the user from the session
+	sessionUser, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	currency := data.Currency(r.Form.Get(CURRENCY_ATTR))
+	locale := r.Form.Get(LOCALE_ATTR)
+	if !data.IsSupportedCurrency(currency) || !data.IsSupportedLocale(locale) {
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUPPORTED_PREFERENCES_MSG)
+		http.Redirect(w, r, MembersPlanPath, http.StatusSeeOther)
+		return
+	}
+
+	// update the stored user rather than the copy in the session, which may be stale
+	user, err := s.Models.User.GetOne(sessionUser.ID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SESSION_USER_MSG, sessionUser.ID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_UPDATE_USER_MSG)
+		http.Redirect(w, r, MembersPlanPath, http.StatusSeeOther)
+		return
+	}
+
+	user.Currency = currency
+	user.Locale = locale
+	if err := s.Models.User.Update(*user); err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_UPDATE_USER_MSG)
+		http.Redirect(w, r, MembersPlanPath, http.StatusSeeOther)
+		return
+	}
+
+	s.Session.Put(r.Context(), USER_CTX, *user)
+	s.Session.Put(r.Context(), FLASH_CTX, PREFERENCES_UPDATED_MSG)
+	http.Redirect(w, r, MembersPlanPath, http.StatusSeeOther)
+}
+
+// couponErrorMessage returns the message to display to the user when a coupon can't be applied
+func couponErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, data.ErrCouponExpired):
+		return EXPIRED_COUPON_MSG
+	case errors.Is(err, data.ErrCouponNotRedeemable):
+		return USED_UP_COUPON_MSG
+	case errors.Is(err, data.ErrCouponRedeemed):
+		return COUPON_REDEEMED_MSG
+	case errors.Is(err, data.ErrCouponCurrency):
+		return COUPON_CURRENCY_MSG
+	default:
+		return INVALID_COUPON_MSG
+	}
+}
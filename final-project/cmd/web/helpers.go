@@ -1,5 +1,10 @@
 package main
 
+import (
+	"net"
+	"net/http"
+)
+
 // sendEmail sends a message to the Mailer's channel
 func (s *Server) sendEmail(msg Message) {
 	if !s.Mailer.canAcceptMessage() {
@@ -9,3 +14,12 @@ func (s *Server) sendEmail(msg Message) {
 	s.Mailer.AsyncMail.Add(1) // increment counter every time a new message is sent
 	s.Mailer.Msg <- msg
 }
+
+// clientIP returns the ip address the request was made from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	IMPERSONATION_STARTED_MSG       = "You are now logged in as %s."
+	IMPERSONATION_STOPPED_MSG       = "You are back to your own account."
+	MEMBERS_ONLY_IMPERSONATION_MSG  = "Only members can be impersonated."
+	NOT_IMPERSONATING_MSG           = "You are not impersonating anyone."
+	BLOCKED_WHILE_IMPERSONATING_MSG = "This can't be done while impersonating a user."
+)
+
+// AdminImpersonateUser logs the admin in as a member, to see exactly what they see.
+// The admin is kept in the session, to go back to once they stop impersonating.
+func (s *Server) AdminImpersonateUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	// impersonating anyone with more permissions than a member would grant them to the admin
+	if u.Role != data.RoleMember {
+		s.Session.Put(r.Context(), ERROR_CTX, MEMBERS_ONLY_IMPERSONATION_MSG)
+		http.Redirect(w, r, adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+
+	admin, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	// the session stays registered to the admin, who can sign it out
+	s.renewToken(r, admin.ID)
+
+	s.Session.Put(r.Context(), IMPERSONATOR_ID_CTX, admin.ID)
+	s.Session.Put(r.Context(), IMPERSONATOR_CTX, admin)
+	s.Session.Put(r.Context(), USER_ID_CTX, u.ID)
+	s.Session.Put(r.Context(), USER_CTX, *u)
+	s.audit(r, data.ImpersonationStarted, admin.ID, u.ID, nil)
+
+	s.Session.Put(r.Context(), FLASH_CTX, fmt.Sprintf(IMPERSONATION_STARTED_MSG, u.Email))
+	http.Redirect(w, r, HOME_PATH, http.StatusSeeOther)
+}
+
+// StopImpersonating logs the admin back in as themselves
+func (s *Server) StopImpersonating(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.Session.Get(r.Context(), IMPERSONATOR_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, NOT_IMPERSONATING_MSG)
+		http.Redirect(w, r, HOME_PATH, http.StatusSeeOther)
+		return
+	}
+	userID := s.Session.GetInt(r.Context(), USER_ID_CTX)
+
+	s.renewToken(r, admin.ID)
+
+	s.Session.Remove(r.Context(), IMPERSONATOR_ID_CTX)
+	s.Session.Remove(r.Context(), IMPERSONATOR_CTX)
+	s.Session.Put(r.Context(), USER_ID_CTX, admin.ID)
+	s.Session.Put(r.Context(), USER_CTX, admin)
+	s.audit(r, data.ImpersonationStopped, admin.ID, userID, nil)
+
+	s.Session.Put(r.Context(), FLASH_CTX, IMPERSONATION_STOPPED_MSG)
+	http.Redirect(w, r, adminUserURL(userID), http.StatusSeeOther)
+}
+
+// isImpersonating reports whether an admin is logged in as someone else
+func (s *Server) isImpersonating(r *http.Request) bool {
+	return s.Session.Exists(r.Context(), IMPERSONATOR_ID_CTX)
+}
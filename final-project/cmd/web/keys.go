@@ -8,13 +8,45 @@ const (
 	USER_ID_CTX = "user_id"
 	USER_CTX    = "user"
 	PLAN_ID_CTX = "id"
+
+	PENDING_USER_ID_CTX  = "pending_user_id"  // the user who has passed the first step of logging in
+	PENDING_LOGIN_AT_CTX = "pending_login_at" // when they did, in unix seconds
+	INACTIVE_EMAIL_CTX   = "inactive_email"   // the email of an account which has yet to be activated
+	SESSION_ID_CTX       = "session_id"       // the id of the session in the session registry
+	IMPERSONATOR_ID_CTX  = "impersonator_id"  // the admin logged in as the user, if any
+	IMPERSONATOR_CTX     = "impersonator"     // and the admin themselves
+
+	OIDC_STATE_CTX    = "oidc_state"    // the state sent to the identity provider, which must come back
+	OIDC_NONCE_CTX    = "oidc_nonce"    // the nonce sent to the identity provider, which must be in the id token
+	OIDC_VERIFIER_CTX = "oidc_verifier" // the pkce code verifier of the authorization code
+)
+
+// apiContextKey is the type of the context keys of the api, which has no session
+type apiContextKey string
+
+const (
+	API_USER_CTX  apiContextKey = "api_user"  // the user the api token of the request belongs to
+	API_TOKEN_CTX apiContextKey = "api_token" // and the token itself
 )
 
 // XXX_ATTR is an attribute or element's name embedded in html.
 const (
-	EMAIL_ATTR      = "email"
-	PASSWORD_ATTR   = "password"
-	FIRST_NAME_ATTR = "first-name"
-	LAST_NAME_ATTR  = "last-name"
-	PLANS_ATTR      = "plans"
+	EMAIL_ATTR        = "email"
+	PASSWORD_ATTR     = "password"
+	FIRST_NAME_ATTR   = "first-name"
+	LAST_NAME_ATTR    = "last-name"
+	PLANS_ATTR        = "plans"
+	FEATURES_ATTR     = "features"
+	LIMITS_ATTR       = "limits"
+	SUBSCRIPTION_ATTR = "subscription"
+	CURRENCIES_ATTR   = "currencies"
+	LOCALES_ATTR      = "locales"
+	CURRENCY_ATTR     = "currency"
+	LOCALE_ATTR       = "locale"
+	COUPON_ATTR       = "coupon"
+
+	VERIFY_PASSWORD_ATTR = "verify-password"
+	FINGERPRINT_ATTR     = "fp"
+	RESET_URL_ATTR       = "reset-url"
+	INACTIVE_EMAIL_ATTR  = "inactive-email"
 )
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+// XXX_PAGE is the name of the template gohtml file to render for the page
+const (
+	LOCKED_ACCOUNTS_PAGE = "locked-accounts.page.gohtml"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	TOO_MANY_ATTEMPTS_MSG         = "Too many failed log in attempts. Try again in %d seconds."
+	ACCOUNT_LOCKED_MSG            = "Too many failed log in attempts. Log in is locked for a while; check your email to unlock it now."
+	ACCOUNT_UNLOCKED_MSG          = "Account unlocked. You can now log in."
+	UNSUCCESSFUL_UNLOCK_MSG       = "Unable to unlock account."
+	ERROR_THROTTLE_LOGIN_MSG      = "error throttling log in attempts: %w"
+	ERROR_GET_LOCKED_ACCOUNTS_MSG = "error getting locked accounts: %w"
+)
+
+// XXX_ATTR is an attribute or element's name embedded in html.
+const (
+	LOCKED_ACCOUNTS_ATTR = "locked-accounts"
+)
+
+const (
+	UNLOCK_LINK_MAX_AGE = 24 * time.Hour
+)
+
+// loginThrottled returns the message to display when a log in attempt to the account from the ip
+// has to wait, or "" when it may go ahead. The attempt goes ahead when the throttle fails.
+func (s *Server) loginThrottled(email, ip string) string {
+	wait, locked, err := s.Throttle.Check(email, ip)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_THROTTLE_LOGIN_MSG, err))
+		return ""
+	}
+
+	switch {
+	case wait <= 0:
+		return ""
+	case locked:
+		return ACCOUNT_LOCKED_MSG
+	default:
+		return fmt.Sprintf(TOO_MANY_ATTEMPTS_MSG, int(math.Ceil(wait.Seconds())))
+	}
+}
+
+// loginFailed records a failed log in attempt to the account from the ip, and when that locks
+// the account out, emails its user, if any, a link to unlock it
+func (s *Server) loginFailed(r *http.Request, email, ip string, user *data.User) {
+	targetID := 0
+	if user != nil {
+		targetID = user.ID
+	}
+	s.audit(r, data.LoginFailed, 0, targetID, change("email_hash", nil, emailHash(email)))
+
+	locked, err := s.Throttle.Fail(email, ip)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_THROTTLE_LOGIN_MSG, err))
+		return
+	}
+	if !locked || user == nil {
+		return
+	}
+
+	q := url.Values{}
+	q.Set(EMAIL_ATTR, user.Email)
+	unlockURL := &url.URL{
+		Scheme:   "http",
+		Host:     r.Host,
+		Path:     UNLOCK_ACCOUNT_PATH,
+		RawQuery: q.Encode(),
+	}
+	signedURL, err := s.signURL(unlockURL, UNLOCK_PURPOSE, UNLOCK_LINK_MAX_AGE)
+	if err != nil {
+		s.ErrorLog.Println(err)
+		return
+	}
+
+	msg := Message{
+		To:       user.Email,
+		Subject:  "Your account has been locked",
+		Template: UNLOCK_ACCOUNT,
+		Data:     template.HTML(signedURL),
+	}
+	s.sendEmail(msg)
+}
+
+func (s *Server) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	q, err := s.consumeSignedURL(r, UNLOCK_PURPOSE)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, tokenErrorMessage(err))
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	if err := s.Throttle.Unlock(q.Get(EMAIL_ATTR)); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_THROTTLE_LOGIN_MSG, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_UNLOCK_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.AccountUnlocked, 0, 0, change("email_hash", nil, emailHash(q.Get(EMAIL_ATTR))))
+
+	s.Session.Put(r.Context(), FLASH_CTX, ACCOUNT_UNLOCKED_MSG)
+	http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+}
+
+func (s *Server) AdminLockedAccountsPage(w http.ResponseWriter, r *http.Request) {
+	accounts, err := s.Throttle.Locked()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_LOCKED_ACCOUNTS_MSG, err))
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap[LOCKED_ACCOUNTS_ATTR] = accounts
+
+	s.render(w, r, LOCKED_ACCOUNTS_PAGE, &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (s *Server) AdminUnlockAccount(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	if err := s.Throttle.Unlock(r.Form.Get(EMAIL_ATTR)); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_THROTTLE_LOGIN_MSG, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_UNLOCK_MSG)
+		http.Redirect(w, r, AdminLockedAccountsPath, http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.AccountUnlocked, s.Session.GetInt(r.Context(), USER_ID_CTX), 0, change("email_hash", nil, emailHash(r.Form.Get(EMAIL_ATTR))))
+
+	s.Session.Put(r.Context(), FLASH_CTX, ACCOUNT_UNLOCKED_MSG)
+	http.Redirect(w, r, AdminLockedAccountsPath, http.StatusSeeOther)
+}
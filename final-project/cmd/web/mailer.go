@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -23,8 +24,17 @@ const (
 type Template string
 
 const (
-	MAIL          Template = "mail"
-	CONFIRM_EMAIL Template = "confirmation-email"
+	MAIL           Template = "mail"
+	CONFIRM_EMAIL  Template = "confirmation-email"
+	TRIAL_ENDING   Template = "trial-ending"
+	INVITATION     Template = "invitation"
+	RESET_PASSWORD Template = "reset-password"
+	UNLOCK_ACCOUNT Template = "unlock-account"
+
+	CONFIRM_EMAIL_CHANGE Template = "confirm-email-change"
+	EMAIL_CHANGED        Template = "email-changed"
+
+	ACCOUNT_EXPORT Template = "account-export"
 )
 
 type EncryptType string
@@ -35,17 +45,38 @@ const (
 	NONE EncryptType = "none"
 )
 
-var EmailBaseTemplate = "./cmd/web/templates/%s.html.gohtml"
+const EMAIL_TEMPLATE_FILE = "%s.html.gohtml" // %s is a placeholder for the template
+
+// MailTransport is how mails are sent. It may be changed while the mailer is running,
+// and every mail is sent with the transport it started with.
+type MailTransport struct {
+	Domain      string
+	Host        string
+	Port        uint
+	Username    string
+	Password    string
+	Encrypt     EncryptType
+	FromAddress string
+	FromName    string
+}
+
+// newMailTransport returns the transport of the mail configuration
+func newMailTransport(cfg MailConfig) MailTransport {
+	return MailTransport{
+		Domain:      cfg.Domain,
+		Host:        cfg.Host,
+		Port:        uint(cfg.Port),
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		Encrypt:     cfg.Encryption,
+		FromAddress: cfg.FromAddress,
+		FromName:    cfg.FromName,
+	}
+}
 
 type Mailer struct {
-	Domain        string
-	Host          string
-	Port          uint
-	Username      string
-	Password      string
-	Encrypt       EncryptType
-	FromAddress   string
-	FromName      string
+	transport     MailTransport // read with Transport and changed with SetTransport
+	Templates     string        // the directory of the templates
 	AsyncMail     *sync.WaitGroup
 	Msg           chan Message
 	MailErr       chan error
@@ -71,12 +102,14 @@ func (m *Mailer) sendMail(
 ) {
 	defer m.AsyncMail.Done() // decrement counter every time a message is sent
 
+	t := m.Transport()
+
 	if msg.Template == "" {
 		msg.Template = MAIL
 	}
 
 	if msg.From == "" {
-		msg.From = m.FromAddress
+		msg.From = t.FromAddress
 	}
 
 	if len(msg.DataMap) == 0 {
@@ -96,11 +129,11 @@ func (m *Mailer) sendMail(
 	}
 
 	smtpServ := mail.NewSMTPClient()
-	smtpServ.Host = m.Host
-	smtpServ.Port = int(m.Port)
-	smtpServ.Username = m.Username
-	smtpServ.Password = m.Password
-	smtpServ.Encryption = m.getEncryption()
+	smtpServ.Host = t.Host
+	smtpServ.Port = int(t.Port)
+	smtpServ.Username = t.Username
+	smtpServ.Password = t.Password
+	smtpServ.Encryption = t.getEncryption()
 	// close the connection after sending the email bacause we don't need to keep it open.
 	// It also means we don't need to call Disconnect() later.
 	smtpServ.KeepAlive = false
@@ -133,7 +166,7 @@ func (m *Mailer) sendMail(
 }
 
 func (m *Mailer) buildHTMLMessage(msg Message) (string, error) {
-	baseTmpl := fmt.Sprintf(EmailBaseTemplate, msg.Template)
+	baseTmpl := filepath.Join(m.Templates, fmt.Sprintf(EMAIL_TEMPLATE_FILE, msg.Template))
 
 	htmlTmpl, err := template.New(EMAIL_HTML_TPML_NAME).ParseFiles(baseTmpl)
 	if err != nil {
@@ -155,7 +188,7 @@ func (m *Mailer) buildHTMLMessage(msg Message) (string, error) {
 }
 
 func (m *Mailer) buildPlainTextMessage(msg Message) (string, error) {
-	baseTmpl := fmt.Sprintf(EmailBaseTemplate, msg.Template)
+	baseTmpl := filepath.Join(m.Templates, fmt.Sprintf(EMAIL_TEMPLATE_FILE, msg.Template))
 
 	plainTmpl, err := template.New(EMAIL_PLAIN_TPML_NAME).ParseFiles(baseTmpl)
 	if err != nil {
@@ -222,8 +255,8 @@ func (m *Mailer) inlineCSS(html string) (string, error) {
 	return htmlCSS, nil
 }
 
-func (m *Mailer) getEncryption() mail.Encryption {
-	switch m.Encrypt {
+func (t MailTransport) getEncryption() mail.Encryption {
+	switch t.Encrypt {
 	case TLS:
 		return mail.EncryptionSTARTTLS
 	case SSL:
@@ -278,6 +311,23 @@ func (m *Mailer) canAcceptMessage() bool {
 	return m.AcceptMessage
 }
 
+// Transport returns the transport mails are being sent with
+func (m *Mailer) Transport() MailTransport {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.transport
+}
+
+// SetTransport changes the transport mails are sent with, from the next mail on.
+// The mails being sent keep the transport they started with.
+func (m *Mailer) SetTransport(t MailTransport) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.transport = t
+}
+
 func (m *Mailer) terminate() {
 	close(m.MailErr)
 	close(m.StopMail)
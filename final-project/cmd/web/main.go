@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"log"
 	"os"
 	"sync"
@@ -8,15 +10,33 @@ import (
 	"github.com/MatsuoTakuro/final-project/data"
 )
 
-// NOTE: of course, originally, this should be in an environment variable or config file.
-const WEB_PORT = "80"
-
 func main() {
+	// load the configuration from the config file, the environment and the flags
+	cfg, err := LoadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// connect to the database
-	db := initDB()
+	db := initDB(cfg.DB)
+
+	// connect to redis, shared by the sessions, their registry and the log in throttle
+	redisPool := initRedis(cfg.Redis)
 
 	// create sessions
-	session := initSession()
+	session := initSession(redisPool, cfg.Session)
+
+	// load the keys to sign urls with
+	keyring, err := ParseKeyring(cfg.Secrets.SigningKeys)
+	if err != nil {
+		log.Fatalf("error loading signing keys: %v", err)
+	}
+
+	// connect to the identity provider users can log in with, if any
+	oidcProvider := initOIDC(cfg.OIDC)
 
 	// create loggers
 	infoLogger := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
@@ -29,16 +49,29 @@ func main() {
 
 	// set up the server
 	srv := Server{
-		Session:   session,
-		DB:        db,
-		InfoLog:   infoLogger,
-		ErrorLog:  errLogger,
-		Models:    data.New(db),
-		AsyncJob:  &asyncJob,
-		AsyncErr:  make(chan error),
-		StopAsync: make(chan bool),
+		Config:      cfg,
+		Session:     session,
+		DB:          db,
+		InfoLog:     infoLogger,
+		ErrorLog:    errLogger,
+		Models:      data.New(db),
+		AsyncJob:    &asyncJob,
+		AsyncErr:    make(chan error),
+		StopAsync:   make(chan bool),
+		StopBilling: make(chan bool),
+		Throttle:    NewLoginThrottle(NewRedisThrottleStore(redisPool)),
+		Sessions:    NewRedisSessionRegistry(redisPool),
+		OIDC:        oidcProvider,
+		Keyring:     keyring,
+		Features:    NewFeatureFlags(cfg.Features),
+
+		StopAccountDeletion: make(chan bool),
 	}
 
+	// apply the settings which may be reloaded on SIGHUP
+	srv.Throttle.SetLimits(cfg.RateLimits)
+	srv.setLogLevel(cfg.Log.Level)
+
 	// set up mail
 	srv.initMailer()
 	go srv.listenForMail()
@@ -49,6 +82,12 @@ func main() {
 	// listen for errors
 	go srv.listenForAsyncJobErrors()
 
+	// charge subscriptions and remind users of ending trials
+	go srv.listenForBilling()
+
+	// delete the accounts whose grace period is over, and remove expired exports
+	go srv.listenForAccountDeletions()
+
 	// listen for web connections
 	srv.serve()
 }
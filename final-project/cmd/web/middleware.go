@@ -1,6 +1,16 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
 
 func (s *Server) SessionLoad(next http.Handler) http.Handler {
 
@@ -11,7 +21,16 @@ func (s *Server) SessionLoad(next http.Handler) http.Handler {
 	4, check the session status in the context
 	5, save the session cookie to the response if the session has been modified or destroyed.
 	*/
-	return s.Session.LoadAndSave(next)
+	withSession := s.Session.LoadAndSave(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the api authenticates every request with a token instead, see APIAuth, and its spec is public
+		if strings.HasPrefix(r.URL.Path, API_V1_PATH+"/") || r.URL.Path == APISpecPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		withSession.ServeHTTP(w, r)
+	})
 }
 
 func (s *Server) Auth(next http.Handler) http.Handler {
@@ -32,3 +51,144 @@ func (s *Server) Auth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequirePermission only lets the request through when the role of the logged in user grants the permission.
+// It must be used after the Auth middleware.
+func (s *Server) RequirePermission(perm data.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+			if !ok || !user.Can(perm) {
+				s.Session.Put(r.Context(), ERROR_CTX, PERMISSION_DENIED_MSG)
+				http.Redirect(w, r, HOME_PATH, http.StatusSeeOther)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NoImpersonation doesn't let the request through while an admin is impersonating the user,
+// for actions only the user themselves may take
+func (s *Server) NoImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.isImpersonating(r) {
+			s.Session.Put(r.Context(), ERROR_CTX, BLOCKED_WHILE_IMPERSONATING_MSG)
+			http.Redirect(w, r, HOME_PATH, http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireFeature only lets the request through when the plan of the logged in user grants the feature,
+// and it hasn't been switched off for everyone. It must be used after the Auth middleware.
+func (s *Server) RequireFeature(feature data.Feature) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+			if !ok {
+				s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+				http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+				return
+			}
+
+			if !s.Features.Enabled(feature) {
+				s.Session.Put(r.Context(), ERROR_CTX, FEATURE_DISABLED_MSG)
+				http.Redirect(w, r, HOME_PATH, http.StatusSeeOther)
+				return
+			}
+
+			canUse, err := s.Models.Entitlement.CanUse(user, feature)
+			if err != nil {
+				s.ErrorLog.Println(fmt.Errorf(ERROR_CHECK_ENTITLEMENT_MSG, err))
+			}
+
+			if !canUse {
+				s.Session.Put(r.Context(), ERROR_CTX, FEATURE_NOT_IN_PLAN_MSG)
+				http.Redirect(w, r, MembersPlanPath, http.StatusSeeOther)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// APIAuth only lets the request through with an "Authorization: Bearer" header holding an api token
+// which is still valid, and whose user is active with a plan granting api access, while the api hasn't been
+// switched off for everyone. It puts the user and the token in the context of the request.
+func (s *Server) APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		token = strings.TrimSpace(token)
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			s.apiError(w, http.StatusUnauthorized, MISSING_TOKEN_CODE, API_MISSING_TOKEN_MSG)
+			return
+		}
+
+		apiToken, err := s.Models.APIToken.GetByToken(token)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			s.ErrorLog.Println(fmt.Errorf(ERROR_GET_API_TOKEN_MSG, err))
+			s.apiError(w, http.StatusInternalServerError, INTERNAL_ERROR_CODE, API_INTERNAL_ERROR_MSG)
+			return
+		}
+		if err != nil || apiToken.Expired(time.Now()) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			s.apiError(w, http.StatusUnauthorized, INVALID_TOKEN_CODE, API_INVALID_TOKEN_MSG)
+			return
+		}
+
+		user, err := s.Models.User.GetOne(apiToken.UserID)
+		if err != nil {
+			s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SESSION_USER_MSG, apiToken.UserID, err))
+			s.apiError(w, http.StatusInternalServerError, INTERNAL_ERROR_CODE, API_INTERNAL_ERROR_MSG)
+			return
+		}
+		if user.IsActive != data.Active {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			s.apiError(w, http.StatusUnauthorized, INACTIVE_USER_CODE, API_INACTIVE_USER_MSG)
+			return
+		}
+
+		if !s.Features.Enabled(data.APIAccess) {
+			s.apiError(w, http.StatusServiceUnavailable, FEATURE_DISABLED_CODE, API_FEATURE_DISABLED_MSG)
+			return
+		}
+
+		canUse, err := s.Models.Entitlement.CanUse(*user, data.APIAccess)
+		if err != nil {
+			s.ErrorLog.Println(fmt.Errorf(ERROR_CHECK_ENTITLEMENT_MSG, err))
+			s.apiError(w, http.StatusInternalServerError, INTERNAL_ERROR_CODE, API_INTERNAL_ERROR_MSG)
+			return
+		}
+		if !canUse {
+			s.apiError(w, http.StatusForbidden, FEATURE_NOT_IN_PLAN_CODE, API_FEATURE_NOT_IN_PLAN_MSG)
+			return
+		}
+
+		if err := s.Models.APIToken.Touch(apiToken.ID); err != nil {
+			s.ErrorLog.Println(fmt.Errorf(ERROR_TOUCH_API_TOKEN_MSG, apiToken.ID, err))
+		}
+
+		ctx := context.WithValue(r.Context(), API_USER_CTX, *user)
+		ctx = context.WithValue(ctx, API_TOKEN_CTX, *apiToken)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireScope only lets the request through when its api token has been granted the scope.
+// It must be used after the APIAuth middleware.
+func (s *Server) RequireScope(scope data.APIScope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiToken, ok := r.Context().Value(API_TOKEN_CTX).(data.APIToken)
+			if !ok || !apiToken.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+				s.apiError(w, http.StatusForbidden, INSUFFICIENT_SCOPE_CODE, fmt.Sprintf(API_INSUFFICIENT_SCOPE_MSG, scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// XXX_ENV is the environment variable configuring the OpenID Connect identity provider.
+// Logging in with an identity provider is disabled unless the issuer is set.
+const (
+	OIDC_ISSUER_ENV        = "OIDC_ISSUER"
+	OIDC_CLIENT_ID_ENV     = "OIDC_CLIENT_ID"
+	OIDC_CLIENT_SECRET_ENV = "OIDC_CLIENT_SECRET"
+	OIDC_REDIRECT_URL_ENV  = "OIDC_REDIRECT_URL" // e.g. http://localhost/login/oidc/callback
+	OIDC_NAME_ENV          = "OIDC_NAME"         // shown on the log in button
+)
+
+const DEFAULT_OIDC_NAME = "single sign-on"
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	OIDC_DISABLED_MSG         = "Logging in with an identity provider is not available."
+	OIDC_FAILED_MSG           = "Unable to log in with the identity provider. Try again."
+	OIDC_UNVERIFIED_EMAIL_MSG = "The identity provider hasn't verified your email address."
+	ERROR_OIDC_MSG            = "error logging in with the identity provider: %w"
+	ERROR_OIDC_PROVIDER_MSG   = "error responded by the identity provider: %s: %s"
+)
+
+// XXX_ATTR is an attribute or element's name embedded in html.
+const (
+	OIDC_NAME_ATTR = "oidc-name"
+)
+
+var (
+	ErrOIDCState           = errors.New("state doesn't match the one sent to the identity provider")
+	ErrOIDCNonce           = errors.New("nonce doesn't match the one sent to the identity provider")
+	ErrOIDCNoIDToken       = errors.New("no id token in the token response")
+	ErrOIDCUnverifiedEmail = errors.New("email is not verified by the identity provider")
+)
+
+// OIDCProvider is an external OpenID Connect identity provider users can log in with
+type OIDCProvider struct {
+	Name     string
+	config   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// OIDCClaims are the claims of an id token the users are identified with
+type OIDCClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+}
+
+// NewOIDCProvider discovers the endpoints and the keys of the issuer
+func NewOIDCProvider(ctx context.Context, name, issuer, clientID, clientSecret, redirectURL string) (*OIDCProvider, error) {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCProvider{
+		Name: name,
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+	}, nil
+}
+
+// initOIDC connects to the identity provider of the configuration, if any
+func initOIDC(cfg OIDCConfig) *OIDCProvider {
+	if cfg.Issuer == "" {
+		return nil
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = DEFAULT_OIDC_NAME
+	}
+
+	provider, err := NewOIDCProvider(context.Background(), name, cfg.Issuer, cfg.ClientID, cfg.ClientSecret, cfg.RedirectURL)
+	if err != nil {
+		log.Fatalf("error connecting to the identity provider %s: %v", cfg.Issuer, err)
+	}
+
+	return provider
+}
+
+// OIDCLogin sends the user to the identity provider to log in. The state, the nonce and the code verifier
+// are kept in the session, to check that what comes back to OIDCCallback is the answer to this request.
+func (s *Server) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if s.OIDC == nil {
+		s.Session.Put(r.Context(), ERROR_CTX, OIDC_DISABLED_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	state, err := randomHex()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_OIDC_MSG, err))
+		s.Session.Put(r.Context(), ERROR_CTX, OIDC_FAILED_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+	nonce, err := randomHex()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_OIDC_MSG, err))
+		s.Session.Put(r.Context(), ERROR_CTX, OIDC_FAILED_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	s.Session.Put(r.Context(), OIDC_STATE_CTX, state)
+	s.Session.Put(r.Context(), OIDC_NONCE_CTX, nonce)
+	s.Session.Put(r.Context(), OIDC_VERIFIER_CTX, verifier)
+
+	authURL := s.OIDC.config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback logs in the user the identity provider has identified, linking the identity to the user
+// with the same verified email, or to a new active account if there is none
+func (s *Server) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if s.OIDC == nil {
+		s.Session.Put(r.Context(), ERROR_CTX, OIDC_DISABLED_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	// whatever happens, the state can only be used once
+	state := s.Session.PopString(r.Context(), OIDC_STATE_CTX)
+	nonce := s.Session.PopString(r.Context(), OIDC_NONCE_CTX)
+	verifier := s.Session.PopString(r.Context(), OIDC_VERIFIER_CTX)
+
+	q := r.URL.Query()
+	if errCode := q.Get("error"); errCode != "" {
+		s.ErrorLog.Println(fmt.Sprintf(ERROR_OIDC_PROVIDER_MSG, errCode, q.Get("error_description")))
+		s.Session.Put(r.Context(), ERROR_CTX, OIDC_FAILED_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	idToken, claims, err := s.OIDC.exchange(r.Context(), q.Get("state"), q.Get("code"), state, nonce, verifier)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_OIDC_MSG, err))
+		s.Session.Put(r.Context(), ERROR_CTX, OIDC_FAILED_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	user, err := s.userForIdentity(r, idToken.Issuer, idToken.Subject, claims)
+	if errors.Is(err, ErrOIDCUnverifiedEmail) {
+		s.Session.Put(r.Context(), ERROR_CTX, OIDC_UNVERIFIED_EMAIL_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_OIDC_MSG, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_LOGIN_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	err = s.Session.RenewToken(r.Context()) // renew the session token every time the user logs in
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_RENEW_TOKEN_MSG, err))
+	}
+
+	s.finishLogin(w, r, user)
+}
+
+// exchange trades the authorization code for the tokens, after checking the state,
+// and returns the verified id token along with its claims
+func (p *OIDCProvider) exchange(ctx context.Context, gotState, code, state, nonce, verifier string) (*oidc.IDToken, *OIDCClaims, error) {
+	if state == "" || gotState != state {
+		return nil, nil, ErrOIDCState
+	}
+
+	token, err := p.config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, nil, ErrOIDCNoIDToken
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	if idToken.Nonce != nonce {
+		return nil, nil, ErrOIDCNonce
+	}
+
+	var claims OIDCClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, nil, err
+	}
+
+	return idToken, &claims, nil
+}
+
+// userForIdentity returns the user the identity is linked to. The first time, the identity is linked
+// to the user with the same email, who is created if there is none. Only verified emails are trusted,
+// so that nobody can take over an account with an identity provider which lets anyone claim any email.
+func (s *Server) userForIdentity(r *http.Request, issuer, subject string, claims *OIDCClaims) (*data.User, error) {
+	identity, err := s.Models.Identity.GetBySubject(issuer, subject)
+	if err == nil {
+		return s.Models.User.GetOne(identity.UserID)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if !claims.EmailVerified || claims.Email == "" {
+		return nil, ErrOIDCUnverifiedEmail
+	}
+
+	user, err := s.Models.User.GetByEmail(claims.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		user, err = s.createOIDCUser(r, claims)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.Models.Identity.Insert(data.Identity{
+		UserID:  user.ID,
+		Issuer:  issuer,
+		Subject: subject,
+		Email:   claims.Email,
+	})
+	if errors.Is(err, data.ErrIdentityLinked) {
+		// linked by a concurrent log in in the meantime
+		return s.userForIdentity(r, issuer, subject, claims)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.audit(r, data.IdentityLinked, user.ID, user.ID, change("issuer", nil, issuer))
+
+	return user, nil
+}
+
+// createOIDCUser creates an active account without a password for the identity.
+// The identity provider has verified the email already.
+func (s *Server) createOIDCUser(r *http.Request, claims *OIDCClaims) (*data.User, error) {
+	firstName, lastName := claims.GivenName, claims.FamilyName
+	if firstName == "" && lastName == "" {
+		firstName, lastName, _ = strings.Cut(strings.TrimSpace(claims.Name), " ")
+	}
+
+	u := data.User{
+		Email:     strings.TrimSpace(claims.Email),
+		FirstName: strings.TrimSpace(firstName),
+		LastName:  strings.TrimSpace(lastName),
+		IsActive:  data.Active,
+		Role:      data.RoleMember,
+		Currency:  data.DefaultCurrency,
+		Locale:    data.DefaultLocale,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	id, err := s.Models.User.Insert(u)
+	if err != nil {
+		return nil, err
+	}
+	u.ID = id
+	s.audit(r, data.AccountCreated, id, id, nil)
+
+	return &u, nil
+}
+
+// randomHex returns 16 random bytes, hex encoded
+func randomHex() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+// stubIdP is a minimal OpenID Connect identity provider, which authorizes whoever its claims are about
+// without asking, and signs their id tokens with a key of its own
+type stubIdP struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]any
+
+	mutex sync.Mutex
+	codes map[string]stubAuthorization
+}
+
+// stubAuthorization is what the stub has been asked to authorize a code for
+type stubAuthorization struct {
+	nonce     string
+	challenge string
+	claims    map[string]any
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &stubIdP{key: key, codes: make(map[string]stubAuthorization)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+func (idp *stubIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                idp.URL,
+		"authorization_endpoint":                idp.URL + "/authorize",
+		"token_endpoint":                        idp.URL + "/token",
+		"jwks_uri":                              idp.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *stubIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "stub",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize sends the user straight back with a code, as if they had logged in
+func (idp *stubIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	code, _ := randomHex()
+
+	idp.mutex.Lock()
+	idp.codes[code] = stubAuthorization{nonce: q.Get("nonce"), challenge: q.Get("code_challenge"), claims: idp.claims}
+	idp.mutex.Unlock()
+
+	back := url.Values{"code": {code}, "state": {q.Get("state")}}
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+}
+
+// token trades a code for an id token, once, and only with the verifier of the challenge
+func (idp *stubIdP) token(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+
+	idp.mutex.Lock()
+	auth, ok := idp.codes[r.Form.Get("code")]
+	delete(idp.codes, r.Form.Get("code"))
+	idp.mutex.Unlock()
+
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	claims := map[string]any{
+		"iss":   idp.URL,
+		"aud":   "client",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": auth.nonce,
+	}
+	for k, v := range auth.claims {
+		claims[k] = v
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idp.sign(claims),
+	})
+}
+
+// sign returns the claims as a jwt signed with RS256
+func (idp *stubIdP) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "stub", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	sum := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// oidcLogin goes through the whole log in with the identity provider, and returns the request
+// of the callback, whose context holds the session
+func oidcLogin(t *testing.T, idp *stubIdP, claims map[string]any, tamperState bool) (*http.Request, *httptest.ResponseRecorder) {
+	idp.claims = claims
+
+	r := newReqWithSession(httptest.NewRequest(http.MethodGet, LoginOIDCPath, nil))
+	w := httptest.NewRecorder()
+	testServer.OIDCLogin(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected to be sent to the identity provider; got status %d", w.Code)
+	}
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tamperState {
+		q := callback.Query()
+		q.Set("state", "forged")
+		callback.RawQuery = q.Encode()
+	}
+
+	req := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil).WithContext(r.Context())
+	w = httptest.NewRecorder()
+	testServer.OIDCCallback(w, req)
+
+	return req, w
+}
+
+func Test_OIDC(t *testing.T) {
+	idp := newStubIdP(t)
+	provider, err := NewOIDCProvider(context.Background(), "Stub", idp.URL, "client", "secret", "http://localhost"+LoginOIDCCallbackPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer.OIDC = provider
+	defer func() { testServer.OIDC = nil }()
+
+	t.Run("existing user", func(t *testing.T) {
+		r, w := oidcLogin(t, idp, map[string]any{"sub": "admin-sub", "email": "admin@example.com", "email_verified": true}, false)
+
+		if loc := w.Header().Get("Location"); loc != HOME_PATH {
+			t.Fatalf("expected to be logged in; got redirected to %s with %q", loc, testServer.Session.GetString(r.Context(), ERROR_CTX))
+		}
+		if id := testServer.Session.GetInt(r.Context(), USER_ID_CTX); id != 1 {
+			t.Errorf("expected to be logged in as user 1; got %d", id)
+		}
+		identity, err := testServer.Models.Identity.GetBySubject(idp.URL, "admin-sub")
+		if err != nil || identity.UserID != 1 {
+			t.Errorf("expected the identity to be linked to user 1; got %+v, %v", identity, err)
+		}
+	})
+
+	t.Run("linked identity", func(t *testing.T) {
+		// the identity is found by its subject, whatever the email is now
+		r, _ := oidcLogin(t, idp, map[string]any{"sub": "admin-sub", "email": "renamed@example.com", "email_verified": false}, false)
+
+		if id := testServer.Session.GetInt(r.Context(), USER_ID_CTX); id != 1 {
+			t.Errorf("expected to be logged in as user 1; got %d", id)
+		}
+	})
+
+	t.Run("new user", func(t *testing.T) {
+		email := "new@" + data.TestUnregisteredDomain
+		r, _ := oidcLogin(t, idp, map[string]any{
+			"sub": "new-sub", "email": email, "email_verified": true, "given_name": "New", "family_name": "User",
+		}, false)
+
+		user, ok := testServer.Session.Get(r.Context(), USER_CTX).(*data.User)
+		if !ok || user.ID != data.TestNewUserID || user.Email != email || user.FirstName != "New" || user.IsActive != data.Active {
+			t.Errorf("expected to be logged in as a new active user; got %+v", user)
+		}
+		if user.HasPassword() {
+			t.Error("expected the new user to have no password")
+		}
+		e := lastAuditEvent(t, data.AuditFilter{Action: data.AccountCreated, TargetID: data.TestNewUserID})
+		if e.ActorID.Int32 != data.TestNewUserID {
+			t.Errorf("expected the account creation to be audited; got %+v", e)
+		}
+	})
+
+	t.Run("two-factor authentication", func(t *testing.T) {
+		r, w := oidcLogin(t, idp, map[string]any{"sub": "2fa-sub", "email": "2fa@example.com", "email_verified": true}, false)
+
+		if loc := w.Header().Get("Location"); loc != LoginTwoFactorPath {
+			t.Errorf("expected to be asked for a code; got redirected to %s", loc)
+		}
+		if testServer.Session.Exists(r.Context(), USER_ID_CTX) {
+			t.Error("expected not to be logged in yet")
+		}
+	})
+
+	t.Run("unverified email", func(t *testing.T) {
+		r, _ := oidcLogin(t, idp, map[string]any{"sub": "unverified-sub", "email": "admin@example.com", "email_verified": false}, false)
+
+		if msg := testServer.Session.GetString(r.Context(), ERROR_CTX); msg != OIDC_UNVERIFIED_EMAIL_MSG {
+			t.Errorf("expected error message %q; got %q", OIDC_UNVERIFIED_EMAIL_MSG, msg)
+		}
+		if _, err := testServer.Models.Identity.GetBySubject(idp.URL, "unverified-sub"); err == nil {
+			t.Error("expected the identity not to be linked")
+		}
+	})
+
+	t.Run("forged state", func(t *testing.T) {
+		r, _ := oidcLogin(t, idp, map[string]any{"sub": "admin-sub", "email": "admin@example.com", "email_verified": true}, true)
+
+		if msg := testServer.Session.GetString(r.Context(), ERROR_CTX); msg != OIDC_FAILED_MSG {
+			t.Errorf("expected error message %q; got %q", OIDC_FAILED_MSG, msg)
+		}
+		if testServer.Session.Exists(r.Context(), USER_ID_CTX) {
+			t.Error("expected not to be logged in")
+		}
+	})
+
+	t.Run("login page", func(t *testing.T) {
+		r := newReqWithSession(httptest.NewRequest(http.MethodGet, LOGIN_PATH, nil))
+		w := httptest.NewRecorder()
+		testServer.LoginPage(w, r)
+
+		if !strings.Contains(w.Body.String(), `<a class="btn btn-outline-primary" href="/login/oidc">Log in with Stub</a>`) {
+			t.Error("expected a button to log in with the identity provider")
+		}
+	})
+
+	t.Run("remove password", func(t *testing.T) {
+		// user 1 has linked an identity above, so they can do without a password
+		r := newReqWithSession(httptest.NewRequest(http.MethodPost, MembersProfilePasswordRemovePath, nil))
+		testServer.Session.Put(r.Context(), USER_ID_CTX, 1)
+		testServer.Session.Put(r.Context(), USER_CTX, data.User{ID: 1, Email: "admin@example.com", Role: data.RoleAdmin})
+		testServer.RemovePassword(httptest.NewRecorder(), r)
+
+		if msg := testServer.Session.GetString(r.Context(), FLASH_CTX); msg != PASSWORD_REMOVED_MSG {
+			t.Errorf("expected flash message %q; got %q", PASSWORD_REMOVED_MSG, msg)
+		}
+	})
+}
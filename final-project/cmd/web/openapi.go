@@ -0,0 +1,487 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+const (
+	API_DOCS_PAGE = "api-docs.page.gohtml"
+)
+
+// XXX_ATTR is an attribute or element's name embedded in html.
+const (
+	API_OPERATIONS_ATTR = "api-operations"
+	API_SPEC_PATH_ATTR  = "api-spec-path"
+)
+
+const (
+	OPENAPI_VERSION     = "3.0.3"
+	API_VERSION         = "1"
+	BEARER_AUTH_SCHEME  = "bearerAuth"
+	JSON_CONTENT_TYPE   = "application/json"
+	SCHEMA_REF_PREFIX   = "#/components/schemas/"
+	REQUIRED_SCOPE_NOTE = "Requires a token with the %s scope."
+)
+
+// apiErrorCodes lists every code an error of the api may have, see XXX_CODE
+var apiErrorCodes = []string{
+	MISSING_TOKEN_CODE,
+	INVALID_TOKEN_CODE,
+	INACTIVE_USER_CODE,
+	INSUFFICIENT_SCOPE_CODE,
+	FEATURE_NOT_IN_PLAN_CODE,
+	FEATURE_DISABLED_CODE,
+	NOT_FOUND_CODE,
+	METHOD_NOT_ALLOWED_CODE,
+	INVALID_PARAMETER_CODE,
+	INVALID_BODY_CODE,
+	PRECONDITION_FAILED_CODE,
+	PLAN_NOT_FOUND_CODE,
+	TEAM_PLAN_ONLY_CODE,
+	INVALID_COUPON_CODE,
+	NO_SUBSCRIPTION_CODE,
+	INTERNAL_ERROR_CODE,
+}
+
+// openAPIDocument is the OpenAPI 3 description of the api, as much of it as the api needs
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Servers    []openAPIServer                         `json:"servers"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"` // by path, then by lower case method
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+type openAPIOperation struct {
+	OperationID   string                      `json:"operationId"`
+	Summary       string                      `json:"summary"`
+	Description   string                      `json:"description"`
+	RequiredScope data.APIScope               `json:"x-required-scope"`
+	Security      []map[string][]string       `json:"security"`
+	Parameters    []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody   *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses     map[string]*openAPIResponse `json:"responses"` // by status code
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description"`
+	Required    bool           `json:"required"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Headers     map[string]openAPIHeader    `json:"headers,omitempty"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIHeader struct {
+	Description string         `json:"description"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema        `json:"schemas"`
+	SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPISecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme"`
+	Description string `json:"description"`
+}
+
+// openAPISchema is the subset of the OpenAPI schema object the api is described with.
+// AdditionalProperties is either false, for objects with no other properties, or the schema of their values.
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+	Enum                 []any                     `json:"enum,omitempty"`
+	Minimum              *int                      `json:"minimum,omitempty"`
+	Maximum              *int                      `json:"maximum,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	AdditionalProperties any                       `json:"additionalProperties,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	AllOf                []*openAPISchema          `json:"allOf,omitempty"`
+}
+
+// apiSpec is the description of the api served at /api/openapi.json. The tests check that it
+// describes every route of apiRouter, and that every response of the api matches it.
+var apiSpec = newAPISpec()
+
+func newAPISpec() *openAPIDocument {
+	spec := &openAPIDocument{
+		OpenAPI: OPENAPI_VERSION,
+		Info: openAPIInfo{
+			Title:   "Final Project API",
+			Version: API_VERSION,
+			Description: "Read your plan, subscription and invoices, and change your subscription, from scripts. " +
+				"Create a token on your profile page, and send it as a bearer token while your plan includes API access. " +
+				"Successful responses are wrapped in data, lists come with their pagination in meta, " +
+				"and errors are wrapped in error.",
+		},
+		Servers: []openAPIServer{{URL: API_V1_PATH}},
+		Paths:   map[string]map[string]*openAPIOperation{},
+		Components: openAPIComponents{
+			Schemas: apiSchemas(),
+			SecuritySchemes: map[string]openAPISecurityScheme{
+				BEARER_AUTH_SCHEME: {
+					Type:        "http",
+					Scheme:      "bearer",
+					Description: "A personal API token, which starts with " + data.APITokenPrefix,
+				},
+			},
+		},
+	}
+
+	pagination := []openAPIParameter{
+		{Name: PAGE_ATTR, In: "query", Description: "The page to return, from 1", Schema: minimum(integerSchema(), 1)},
+		{Name: PER_PAGE_ATTR, In: "query", Description: "How many items a page has", Schema: maximum(minimum(integerSchema(), 1), API_MAX_PER_PAGE)},
+	}
+	ifMatch := []openAPIParameter{
+		{Name: "If-Match", In: "header", Description: "The etag of the subscription as last read, to change it only if nobody else has since", Schema: stringSchema()},
+	}
+
+	spec.add(http.MethodGet, ME_PATH, &openAPIOperation{
+		OperationID:   "getProfile",
+		Summary:       "Get the user of the token",
+		RequiredScope: data.ReadProfile,
+		Responses:     okResponses(http.StatusOK, "ProfileResponse"),
+	})
+
+	spec.add(http.MethodGet, PLANS_PATH, &openAPIOperation{
+		OperationID:   "listPlans",
+		Summary:       "List the plans, priced in the currency of the user",
+		RequiredScope: data.ReadPlans,
+		Parameters:    pagination,
+		Responses:     okResponses(http.StatusOK, "PlanList", http.StatusBadRequest),
+	})
+
+	spec.add(http.MethodGet, ME_SUBSCRIPTION_PATH, &openAPIOperation{
+		OperationID:   "getSubscription",
+		Summary:       "Get the subscription of the user, along with its plan",
+		RequiredScope: data.ReadSubscription,
+		Responses:     okResponses(http.StatusOK, "SubscriptionResponse", http.StatusNotFound),
+	})
+
+	spec.add(http.MethodPut, ME_SUBSCRIPTION_PATH, &openAPIOperation{
+		OperationID:   "updateSubscription",
+		Summary:       "Subscribe the user to a plan, with a coupon if any",
+		RequiredScope: data.WriteSubscription,
+		Parameters:    ifMatch,
+		RequestBody: &openAPIRequestBody{
+			Required: true,
+			Content:  map[string]openAPIMediaType{JSON_CONTENT_TYPE: {Schema: schemaRef("SubscriptionRequest")}},
+		},
+		Responses: okResponses(http.StatusOK, "SubscriptionResponse",
+			http.StatusBadRequest, http.StatusPreconditionFailed, http.StatusUnprocessableEntity),
+	})
+
+	spec.add(http.MethodDelete, ME_SUBSCRIPTION_PATH, &openAPIOperation{
+		OperationID:   "cancelSubscription",
+		Summary:       "End the subscription of the user at once",
+		RequiredScope: data.WriteSubscription,
+		Parameters:    ifMatch,
+		Responses:     okResponses(http.StatusNoContent, "", http.StatusNotFound, http.StatusPreconditionFailed),
+	})
+
+	spec.add(http.MethodGet, ME_INVOICES_PATH, &openAPIOperation{
+		OperationID:   "listInvoices",
+		Summary:       "List the invoices the user has paid, newest first",
+		RequiredScope: data.ReadInvoices,
+		Parameters:    pagination,
+		Responses:     okResponses(http.StatusOK, "InvoiceList", http.StatusBadRequest),
+	})
+
+	return spec
+}
+
+// add describes one operation of the api. Every operation needs a token with its scope.
+func (d *openAPIDocument) add(method, path string, op *openAPIOperation) {
+	op.Description = fmt.Sprintf(REQUIRED_SCOPE_NOTE, op.RequiredScope)
+	op.Security = []map[string][]string{{BEARER_AUTH_SCHEME: {}}}
+
+	// GET requests may tell the etag they already have
+	if method == http.MethodGet {
+		op.Parameters = append(op.Parameters, openAPIParameter{
+			Name: "If-None-Match", In: "header", Description: "The etag of the response as last read", Schema: stringSchema(),
+		})
+		op.Responses["304"] = &openAPIResponse{Description: "Not modified since the etag of If-None-Match"}
+	}
+
+	if d.Paths[path] == nil {
+		d.Paths[path] = map[string]*openAPIOperation{}
+	}
+	d.Paths[path][strings.ToLower(method)] = op
+}
+
+// operation returns the operation of the method on the path, or nil if the api has none
+func (d *openAPIDocument) operation(method, path string) *openAPIOperation {
+	return d.Paths[path][strings.ToLower(method)]
+}
+
+// schema returns the schema a reference points to, or the schema itself if it isn't a reference
+func (d *openAPIDocument) schema(s *openAPISchema) *openAPISchema {
+	if s.Ref == "" {
+		return s
+	}
+	return d.Components.Schemas[strings.TrimPrefix(s.Ref, SCHEMA_REF_PREFIX)]
+}
+
+// okResponses returns the successful response of an operation, with the schema of its body if it has one,
+// along with the errors every operation may answer with and those of the operation
+func okResponses(status int, schema string, errStatuses ...int) map[string]*openAPIResponse {
+	ok := &openAPIResponse{Description: http.StatusText(status)}
+	if schema != "" {
+		ok.Content = map[string]openAPIMediaType{JSON_CONTENT_TYPE: {Schema: schemaRef(schema)}}
+		ok.Headers = map[string]openAPIHeader{
+			"ETag": {Description: "The etag of the response, for If-None-Match and If-Match", Schema: stringSchema()},
+		}
+	}
+	responses := map[string]*openAPIResponse{statusKey(status): ok}
+
+	errStatuses = append(errStatuses, http.StatusUnauthorized, http.StatusForbidden, http.StatusInternalServerError, http.StatusServiceUnavailable)
+	for _, status := range errStatuses {
+		responses[statusKey(status)] = &openAPIResponse{
+			Description: http.StatusText(status),
+			Content:     map[string]openAPIMediaType{JSON_CONTENT_TYPE: {Schema: schemaRef("ErrorResponse")}},
+		}
+	}
+
+	return responses
+}
+
+// apiSchemas returns the schemas of the bodies of the api, which mirror apiProfile, apiPlan and the like
+func apiSchemas() map[string]*openAPISchema {
+	return map[string]*openAPISchema{
+		"Profile": objectSchema(map[string]*openAPISchema{
+			"id":         integerSchema(),
+			"email":      stringSchema(),
+			"first_name": stringSchema(),
+			"last_name":  stringSchema(),
+			"role":       enumSchema(data.AllRoles),
+			"currency":   enumSchema(data.SupportedCurrencies),
+			"locale":     stringSchema(),
+			"created_at": dateTimeSchema(),
+		}),
+		"Plan": objectSchema(map[string]*openAPISchema{
+			"id":         integerSchema(),
+			"name":       stringSchema(),
+			"amount":     integerSchema(),
+			"currency":   enumSchema(data.SupportedCurrencies),
+			"interval":   enumSchema([]data.Interval{data.Monthly, data.Yearly}),
+			"trial_days": integerSchema(),
+			"seat_based": booleanSchema(),
+			"features":   nullable(arrayOf(enumSchema(data.AllFeatures))),
+			"limits":     nullable(mapOf(integerSchema())),
+		}),
+		"Subscription": objectSchema(map[string]*openAPISchema{
+			"id":              integerSchema(),
+			"plan":            nullable(schemaRef("Plan")),
+			"seats":           integerSchema(),
+			"currency":        enumSchema(data.SupportedCurrencies),
+			"amount":          integerSchema(),
+			"discount_amount": integerSchema(),
+			"trial_ends_at":   nullable(dateTimeSchema()),
+			"next_charge_at":  dateTimeSchema(),
+			"created_at":      dateTimeSchema(),
+		}),
+		"Invoice": objectSchema(map[string]*openAPISchema{
+			"id":              integerSchema(),
+			"plan_id":         integerSchema(),
+			"plan_name":       stringSchema(),
+			"organization_id": nullable(integerSchema()),
+			"seats":           integerSchema(),
+			"currency":        enumSchema(data.SupportedCurrencies),
+			"amount":          integerSchema(),
+			"discount_amount": integerSchema(),
+			"period_start":    dateTimeSchema(),
+			"period_end":      dateTimeSchema(),
+			"created_at":      dateTimeSchema(),
+		}),
+		"SubscriptionRequest": {
+			Type: "object",
+			Properties: map[string]*openAPISchema{
+				"plan_id": minimum(integerSchema(), 1),
+				"coupon":  stringSchema(),
+			},
+			Required:             []string{"plan_id"},
+			AdditionalProperties: false,
+		},
+		"Meta": objectSchema(map[string]*openAPISchema{
+			"page":     integerSchema(),
+			"per_page": integerSchema(),
+			"total":    integerSchema(),
+			"pages":    integerSchema(),
+		}),
+		"Error": objectSchema(map[string]*openAPISchema{
+			"status":  integerSchema(),
+			"code":    enumSchema(apiErrorCodes),
+			"message": stringSchema(),
+		}),
+		"ProfileResponse":      objectSchema(map[string]*openAPISchema{"data": schemaRef("Profile")}),
+		"SubscriptionResponse": objectSchema(map[string]*openAPISchema{"data": schemaRef("Subscription")}),
+		"PlanList":             objectSchema(map[string]*openAPISchema{"data": arrayOf(schemaRef("Plan")), "meta": schemaRef("Meta")}),
+		"InvoiceList":          objectSchema(map[string]*openAPISchema{"data": arrayOf(schemaRef("Invoice")), "meta": schemaRef("Meta")}),
+		"ErrorResponse":        objectSchema(map[string]*openAPISchema{"error": schemaRef("Error")}),
+	}
+}
+
+// objectSchema returns the schema of an object which always has all of the properties, and no other
+func objectSchema(properties map[string]*openAPISchema) *openAPISchema {
+	required := make([]string, 0, len(properties))
+	for name := range properties {
+		required = append(required, name)
+	}
+	sort.Strings(required)
+
+	return &openAPISchema{Type: "object", Properties: properties, Required: required, AdditionalProperties: false}
+}
+
+func schemaRef(name string) *openAPISchema {
+	return &openAPISchema{Ref: SCHEMA_REF_PREFIX + name}
+}
+
+func stringSchema() *openAPISchema {
+	return &openAPISchema{Type: "string"}
+}
+
+func integerSchema() *openAPISchema {
+	return &openAPISchema{Type: "integer"}
+}
+
+func booleanSchema() *openAPISchema {
+	return &openAPISchema{Type: "boolean"}
+}
+
+func dateTimeSchema() *openAPISchema {
+	return &openAPISchema{Type: "string", Format: "date-time"}
+}
+
+func arrayOf(items *openAPISchema) *openAPISchema {
+	return &openAPISchema{Type: "array", Items: items}
+}
+
+func mapOf(values *openAPISchema) *openAPISchema {
+	return &openAPISchema{Type: "object", AdditionalProperties: values}
+}
+
+// enumSchema returns the schema of a string which is one of the values
+func enumSchema[T ~string](values []T) *openAPISchema {
+	s := &openAPISchema{Type: "string"}
+	for _, v := range values {
+		s.Enum = append(s.Enum, string(v))
+	}
+	return s
+}
+
+// nullable returns the schema, which may also be null. A reference can't be nullable itself in OpenAPI 3.0,
+// so it's wrapped.
+func nullable(s *openAPISchema) *openAPISchema {
+	if s.Ref != "" {
+		return &openAPISchema{Nullable: true, AllOf: []*openAPISchema{s}}
+	}
+	s.Nullable = true
+	return s
+}
+
+func minimum(s *openAPISchema, min int) *openAPISchema {
+	s.Minimum = &min
+	return s
+}
+
+func maximum(s *openAPISchema, max int) *openAPISchema {
+	s.Maximum = &max
+	return s
+}
+
+func statusKey(status int) string {
+	return strconv.Itoa(status)
+}
+
+// apiDocsOperation is one operation of the api, as the docs page lists it
+type apiDocsOperation struct {
+	Method  string
+	Path    string
+	Summary string
+	Scope   data.APIScope
+}
+
+// operations lists the operations of the api, by path, then by method
+func (d *openAPIDocument) operations() []apiDocsOperation {
+	var ops []apiDocsOperation
+	for path, methods := range d.Paths {
+		for method, op := range methods {
+			ops = append(ops, apiDocsOperation{
+				Method:  strings.ToUpper(method),
+				Path:    API_V1_PATH + path,
+				Summary: op.Summary,
+				Scope:   op.RequiredScope,
+			})
+		}
+	}
+
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Path != ops[j].Path {
+			return ops[i].Path < ops[j].Path
+		}
+		return methodOrder(ops[i].Method) < methodOrder(ops[j].Method)
+	})
+
+	return ops
+}
+
+// methodOrder ranks the methods in the order they are listed, reads first
+func methodOrder(method string) int {
+	for i, m := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete} {
+		if m == method {
+			return i
+		}
+	}
+	return len(method)
+}
+
+// APISpec serves the OpenAPI description of the api, which anyone may read
+func (s *Server) APISpec(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, r, http.StatusOK, apiSpec)
+}
+
+// APIDocsPage lists the operations of the api, along with the scopes they need
+func (s *Server) APIDocsPage(w http.ResponseWriter, r *http.Request) {
+	s.render(w, r, API_DOCS_PAGE, &TemplateData{
+		StringMap: map[string]string{API_SPEC_PATH_ATTR: APISpecPath},
+		Data: map[string]any{
+			API_OPERATIONS_ATTR: apiSpec.operations(),
+		},
+	})
+}
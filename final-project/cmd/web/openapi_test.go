@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func Test_APISpec_Routes(t *testing.T) {
+	routed := map[string]bool{}
+	err := chi.Walk(testServer.apiRouter().(chi.Router), func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		routed[method+" "+route] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	documented := map[string]bool{}
+	for path, methods := range apiSpec.Paths {
+		for method := range methods {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	for route := range routed {
+		if !documented[route] {
+			t.Errorf("expected %s to be in the spec", route)
+		}
+	}
+	for route := range documented {
+		if !routed[route] {
+			t.Errorf("expected %s of the spec to be routed", route)
+		}
+	}
+}
+
+func Test_APISpec_Served(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, APISpecPath, nil)
+	w := httptest.NewRecorder()
+	testServer.routes().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d; got %d", http.StatusOK, w.Code)
+	}
+	if cookie := w.Header().Get("Set-Cookie"); cookie != "" {
+		t.Errorf("expected the spec not to use the session; got cookie %s", cookie)
+	}
+
+	var spec map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec["openapi"] != OPENAPI_VERSION {
+		t.Errorf("expected an OpenAPI %s document; got %v", OPENAPI_VERSION, spec["openapi"])
+	}
+
+	// every reference points to a schema of the document
+	var refs []string
+	collectRefs(spec, &refs)
+	sort.Strings(refs)
+	for _, ref := range refs {
+		if _, ok := apiSpec.Components.Schemas[strings.TrimPrefix(ref, SCHEMA_REF_PREFIX)]; !ok {
+			t.Errorf("expected %s to be a schema of the spec", ref)
+		}
+	}
+	if len(refs) == 0 {
+		t.Error("expected the spec to refer to its schemas")
+	}
+}
+
+// collectRefs appends every $ref of the decoded json to refs
+func collectRefs(v any, refs *[]string) {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if ref, ok := value.(string); ok && key == "$ref" {
+				*refs = append(*refs, ref)
+			}
+			collectRefs(value, refs)
+		}
+	case []any:
+		for _, value := range v {
+			collectRefs(value, refs)
+		}
+	}
+}
+
+func Test_ValidateAPI(t *testing.T) {
+	tests := map[string]struct {
+		method            string
+		path              string
+		reqBody           string
+		status            int
+		body              string
+		expectedViolation string
+	}{
+		"matching":               {http.MethodGet, ME_PATH, "", http.StatusOK, `{"data":{"id":1,"email":"a@example.com","first_name":"A","last_name":"B","role":"member","currency":"USD","locale":"en-US","created_at":"2023-01-01T00:00:00Z"}}`, ""},
+		"wrong type":             {http.MethodGet, ME_PATH, "", http.StatusOK, `{"data":{"id":"1","email":"a@example.com","first_name":"A","last_name":"B","role":"member","currency":"USD","locale":"en-US","created_at":"2023-01-01T00:00:00Z"}}`, "$.data.id: expected an integer"},
+		"undocumented field":     {http.MethodGet, ME_PATH, "", http.StatusOK, `{"data":{"id":1,"email":"a@example.com","first_name":"A","last_name":"B","role":"member","currency":"USD","locale":"en-US","created_at":"2023-01-01T00:00:00Z","password":"x"}}`, "$.data: unexpected password"},
+		"missing field":          {http.MethodGet, ME_PATH, "", http.StatusOK, `{"data":{"id":1}}`, "$.data: missing created_at"},
+		"unknown role":           {http.MethodGet, ME_PATH, "", http.StatusOK, `{"data":{"id":1,"email":"a@example.com","first_name":"A","last_name":"B","role":"owner","currency":"USD","locale":"en-US","created_at":"2023-01-01T00:00:00Z"}}`, "$.data.role: owner isn't one of"},
+		"undocumented status":    {http.MethodGet, ME_PATH, "", http.StatusTeapot, `{}`, "answered 418, which the spec doesn't document"},
+		"unknown error code":     {http.MethodGet, PLANS_PATH, "", http.StatusBadRequest, `{"error":{"status":400,"code":"oops","message":"oops"}}`, "$.error.code: oops isn't one of"},
+		"body of no content":     {http.MethodDelete, ME_SUBSCRIPTION_PATH, "", http.StatusNoContent, `{}`, "with a body, which the spec doesn't document"},
+		"not modified":           {http.MethodGet, PLANS_PATH, "", http.StatusNotModified, "", ""},
+		"unknown route":          {http.MethodGet, "/unknown", "", http.StatusNotFound, `{"error":{"status":404,"code":"not_found","message":"not found"}}`, ""},
+		"accepted invalid body":  {http.MethodPut, ME_SUBSCRIPTION_PATH, `{"plan_id":0}`, http.StatusOK, `{"data":{"id":1,"plan":null,"seats":1,"currency":"USD","amount":1000,"discount_amount":0,"trial_ends_at":null,"next_charge_at":"2023-01-01T00:00:00Z","created_at":"2023-01-01T00:00:00Z"}}`, "accepted a request body not matching the spec: $.plan_id: 0 is less than 1"},
+		"rejected invalid body":  {http.MethodPut, ME_SUBSCRIPTION_PATH, `{"plan":1}`, http.StatusBadRequest, `{"error":{"status":400,"code":"invalid_body","message":"invalid"}}`, ""},
+		"nullable plan":          {http.MethodGet, ME_SUBSCRIPTION_PATH, "", http.StatusOK, `{"data":{"id":1,"plan":null,"seats":1,"currency":"USD","amount":1000,"discount_amount":0,"trial_ends_at":null,"next_charge_at":"2023-01-01T00:00:00Z","created_at":"2023-01-01T00:00:00Z"}}`, ""},
+		"limits of another type": {http.MethodGet, PLANS_PATH, "", http.StatusOK, `{"data":[{"id":1,"name":"A","amount":1,"currency":"USD","interval":"month","trial_days":0,"seat_based":false,"features":null,"limits":{"max-seats":"ten"}}],"meta":{"page":1,"per_page":20,"total":1,"pages":1}}`, "$.data[0].limits.max-seats: expected an integer"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var violation error
+			server := &Server{
+				ErrorLog:         testServer.ErrorLog,
+				APISpecViolation: func(err error) { violation = err },
+			}
+
+			handler := server.ValidateAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+
+			req := httptest.NewRequest(tt.method, API_V1_PATH+tt.path, strings.NewReader(tt.reqBody))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.status || w.Body.String() != tt.body {
+				t.Errorf("expected the response to be sent as is; got %d %s", w.Code, w.Body.String())
+			}
+			if tt.expectedViolation == "" && violation != nil {
+				t.Errorf("expected no violation; got %v", violation)
+			}
+			if tt.expectedViolation != "" && (violation == nil || !strings.Contains(violation.Error(), tt.expectedViolation)) {
+				t.Errorf("expected violation %q; got %v", tt.expectedViolation, violation)
+			}
+		})
+	}
+}
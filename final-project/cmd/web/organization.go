@@ -0,0 +1,373 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+// XXX_PAGE is the name of the template gohtml file to render for the page
+const (
+	ORGANIZATION_PAGE = "organization.page.gohtml"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	ORGANIZATION_CREATED_MSG             = "Team created."
+	UNSUCCESSFUL_CREATE_ORGANIZATION_MSG = "Unable to create team."
+	ORGANIZATION_NAME_REQUIRED_MSG       = "A team name is required."
+	ALREADY_MEMBER_MSG                   = "You are already a member of a team."
+	NOT_IN_ORGANIZATION_MSG              = "You are not a member of a team."
+	OWNER_ONLY_MSG                       = "Only the owner of the team can do this."
+	INVITATION_SENT_MSG                  = "Invitation sent."
+	UNSUCCESSFUL_INVITE_MSG              = "Unable to send the invitation."
+	INVALID_INVITATION_MSG               = "Invalid invitation."
+	INVITATION_ACCEPTED_MSG              = "This invitation has already been accepted."
+	INVITATION_EMAIL_MSG                 = "This invitation was sent to another email. Log in with that email to join."
+	JOINED_ORGANIZATION_MSG              = "You have joined the team."
+	UNSUCCESSFUL_JOIN_MSG                = "Unable to join the team."
+	MEMBER_REMOVED_MSG                   = "Member removed."
+	UNSUCCESSFUL_REMOVE_MEMBER_MSG       = "Unable to remove the member."
+	NOT_SEAT_BASED_MSG                   = "Teams can only subscribe to team plans."
+	ERROR_GET_ORGANIZATION_MSG           = "error getting organization of user %d: %w"
+)
+
+// XXX_ATTR is an attribute or element's name embedded in html.
+const (
+	ORGANIZATION_ATTR = "organization"
+	TEAM_PLANS_ATTR   = "team-plans"
+	NAME_ATTR         = "name"
+	MEMBER_ID_ATTR    = "user-id"
+	INVITATION_ATTR   = "invitation"
+)
+
+const (
+	INVITATION_LINK_MAX_AGE = 7 * 24 * time.Hour
+)
+
+func (s *Server) OrganizationPage(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	dataMap := make(map[string]any)
+
+	org, err := s.Models.Organization.GetByUserID(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_ORGANIZATION_MSG, user.ID, err))
+		return
+	}
+
+	if org != nil {
+		dataMap[ORGANIZATION_ATTR] = org
+
+		// the subscription of the organization, if any, to show what the team is paying for
+		if sub, err := s.Models.Subscription.GetByOrganizationID(org.ID); err == nil {
+			dataMap[SUBSCRIPTION_ATTR] = sub
+		}
+
+		if org.IsOwner(user.ID) {
+			plans, err := s.Models.Plan.GetAll()
+			if err != nil {
+				s.ErrorLog.Println(fmt.Errorf(ERROR_GET_ALL_PLANS_MSG, err))
+				return
+			}
+
+			var teamPlans []*data.Plan
+			for _, plan := range plans {
+				if plan.SeatBased {
+					plan.Localize(user.Currency, user.Locale)
+					teamPlans = append(teamPlans, plan)
+				}
+			}
+			dataMap[TEAM_PLANS_ATTR] = teamPlans
+		}
+	}
+
+	s.render(w, r, ORGANIZATION_PAGE, &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (s *Server) CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	name := strings.TrimSpace(r.Form.Get(NAME_ATTR))
+	if name == "" {
+		s.Session.Put(r.Context(), ERROR_CTX, ORGANIZATION_NAME_REQUIRED_MSG)
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return
+	}
+
+	org := data.Organization{
+		Name:    name,
+		OwnerID: user.ID,
+	}
+
+	if _, err := s.Models.Organization.Insert(org); err != nil {
+		msg := UNSUCCESSFUL_CREATE_ORGANIZATION_MSG
+		if errors.Is(err, data.ErrAlreadyMember) {
+			msg = ALREADY_MEMBER_MSG
+		} else {
+			s.ErrorLog.Println(err)
+		}
+		s.Session.Put(r.Context(), ERROR_CTX, msg)
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return
+	}
+
+	s.Session.Put(r.Context(), FLASH_CTX, ORGANIZATION_CREATED_MSG)
+	http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+}
+
+func (s *Server) InviteToOrganization(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	user, org, ok := s.ownOrganization(w, r)
+	if !ok {
+		return
+	}
+
+	inv, err := s.Models.Organization.Invite(*org, r.Form.Get(EMAIL_ATTR), user)
+	if err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_INVITE_MSG)
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return
+	}
+
+	// send an invitation email with a signed link to join
+	q := url.Values{}
+	q.Set(INVITATION_ATTR, strconv.Itoa(inv.ID))
+	joinURL := &url.URL{
+		Scheme:   "http",
+		Host:     r.Host,
+		Path:     MembersOrganizationJoinPath,
+		RawQuery: q.Encode(),
+	}
+	signedURL, err := s.signURL(joinURL, INVITE_PURPOSE, INVITATION_LINK_MAX_AGE)
+	if err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_INVITE_MSG)
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return
+	}
+
+	msg := Message{
+		To:       inv.Email,
+		Subject:  fmt.Sprintf("Join %s", org.Name),
+		Template: INVITATION,
+		Data:     template.HTML(signedURL),
+		DataMap: map[string]any{
+			"organizationName": org.Name,
+			"inviterName":      fmt.Sprintf("%s %s", user.FirstName, user.LastName),
+		},
+	}
+	s.sendEmail(msg)
+
+	s.Session.Put(r.Context(), FLASH_CTX, INVITATION_SENT_MSG)
+	http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+}
+
+func (s *Server) JoinOrganization(w http.ResponseWriter, r *http.Request) {
+	// validate url
+	q, err := s.verifySignedURL(r, INVITE_PURPOSE)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, tokenErrorMessage(err))
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return
+	}
+
+	user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	invID, _ := strconv.Atoi(q.Get(INVITATION_ATTR))
+	inv, err := s.Models.Organization.GetInvitation(invID)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, INVALID_INVITATION_MSG)
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return
+	}
+
+	// don't use up the link when the user is logged in with another account
+	if !strings.EqualFold(inv.Email, user.Email) {
+		s.Session.Put(r.Context(), ERROR_CTX, INVITATION_EMAIL_MSG)
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return
+	}
+
+	// the link can only be used once, and is only used up once the user has joined
+	if err := s.Models.Organization.AcceptInvitation(*inv, user, signedToken(q, INVITE_PURPOSE)); err != nil {
+		var msg string
+		switch {
+		case errors.Is(err, data.ErrTokenUsed):
+			msg = tokenErrorMessage(err)
+		case errors.Is(err, data.ErrInvitationAccepted):
+			msg = INVITATION_ACCEPTED_MSG
+		case errors.Is(err, data.ErrInvitationEmail):
+			msg = INVITATION_EMAIL_MSG
+		case errors.Is(err, data.ErrAlreadyMember):
+			msg = ALREADY_MEMBER_MSG
+		default:
+			s.ErrorLog.Println(err)
+			msg = UNSUCCESSFUL_JOIN_MSG
+		}
+		s.Session.Put(r.Context(), ERROR_CTX, msg)
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return
+	}
+	s.auditTokenUsed(r, INVITE_PURPOSE)
+
+	// the user may now be covered by the plan of the organization
+	u, err := s.Models.User.GetOne(user.ID)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, NOT_FOUND_USER_BY_ID_MSG)
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return
+	}
+
+	s.Session.Put(r.Context(), USER_CTX, u)
+	s.Session.Put(r.Context(), FLASH_CTX, JOINED_ORGANIZATION_MSG)
+	http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+}
+
+func (s *Server) RemoveFromOrganization(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	_, org, ok := s.ownOrganization(w, r)
+	if !ok {
+		return
+	}
+
+	memberID, _ := strconv.Atoi(r.Form.Get(MEMBER_ID_ATTR))
+	if err := s.Models.Organization.RemoveMember(*org, memberID); err != nil {
+		if !errors.Is(err, data.ErrRemoveOwner) {
+			s.ErrorLog.Println(err)
+		}
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_REMOVE_MEMBER_MSG)
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return
+	}
+
+	s.Session.Put(r.Context(), FLASH_CTX, MEMBER_REMOVED_MSG)
+	http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+}
+
+func (s *Server) SubscribeOrganizationToPlan(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	user, org, ok := s.ownOrganization(w, r)
+	if !ok {
+		return
+	}
+
+	planID, _ := strconv.Atoi(r.Form.Get(PLAN_ID_CTX))
+	plan, err := s.Models.Plan.GetOne(planID)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_FIND_PLAN_MSG)
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return
+	}
+
+	// charge the owner in the currency they prefer, if the plan is priced in it
+	plan.Localize(user.Currency, user.Locale)
+
+	sub, err := s.Models.Plan.SubscribeOrganizationToPlan(*org, user, *plan)
+	if err != nil {
+		msg := UNSUCCESSFUL_SUBSCRIBE_MSG
+		if errors.Is(err, data.ErrNotSeatBased) {
+			msg = NOT_SEAT_BASED_MSG
+		} else {
+			s.ErrorLog.Println(err)
+		}
+		s.Session.Put(r.Context(), ERROR_CTX, msg)
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.PlanChanged, user.ID, user.ID, data.AuditDiff{
+		"organization": {To: org.Name},
+		"plan":         {To: plan.PlanName},
+	})
+
+	if !sub.InTrial(time.Now()) {
+		// charge the first interval for every seat, generate an invoice and email it to the owner
+		s.AsyncJob.Add(1)
+		go func() {
+			defer s.AsyncJob.Done()
+
+			s.chargeSubscription(*sub)
+		}()
+	}
+
+	// the owner is now covered by the plan of the organization, unless they have one of their own
+	u, err := s.Models.User.GetOne(user.ID)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, NOT_FOUND_USER_BY_ID_MSG)
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return
+	}
+
+	s.Session.Put(r.Context(), USER_CTX, u)
+	s.Session.Put(r.Context(), FLASH_CTX, SUCCESSFUL_SUBSCRIBE_MSG)
+	http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+}
+
+// ownOrganization returns the user from the session and the organization they own.
+// If there's none, it redirects with a message and reports false.
+func (s *Server) ownOrganization(w http.ResponseWriter, r *http.Request) (data.User, *data.Organization, bool) {
+	user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return user, nil, false
+	}
+
+	org, err := s.Models.Organization.GetByUserID(user.ID)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, NOT_IN_ORGANIZATION_MSG)
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return user, nil, false
+	}
+
+	if !org.IsOwner(user.ID) {
+		s.Session.Put(r.Context(), ERROR_CTX, OWNER_ONLY_MSG)
+		http.Redirect(w, r, MembersOrganizationPath, http.StatusSeeOther)
+		return user, nil, false
+	}
+
+	return user, org, true
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+func Test_JoinOrganization_LinkUsedUpOnJoining(t *testing.T) {
+	link := signedLink(MembersOrganizationJoinPath, url.Values{INVITATION_ATTR: {"1"}}, INVITE_PURPOSE)
+
+	join := func(user data.User) *http.Request {
+		rawReq, _ := http.NewRequest(http.MethodGet, link, nil)
+		r := newReqWithSession(rawReq)
+		testServer.Session.Put(r.Context(), USER_ID_CTX, user.ID)
+		testServer.Session.Put(r.Context(), USER_CTX, user)
+		testServer.JoinOrganization(httptest.NewRecorder(), r)
+		return r
+	}
+
+	// the invitation can't be accepted by a member of the team already, which leaves the link unused
+	r := join(data.User{ID: 4, Email: "member@example.com"})
+	if msg := testServer.Session.GetString(r.Context(), ERROR_CTX); msg != ALREADY_MEMBER_MSG {
+		t.Fatalf("expected error message %q; got %q", ALREADY_MEMBER_MSG, msg)
+	}
+
+	r = join(data.User{ID: 5, Email: "member@example.com"})
+	if msg := testServer.Session.GetString(r.Context(), FLASH_CTX); msg != JOINED_ORGANIZATION_MSG {
+		t.Fatalf("expected flash message %q; got %q", JOINED_ORGANIZATION_MSG, msg)
+	}
+
+	// but joining uses it up
+	r = join(data.User{ID: 5, Email: "member@example.com"})
+	if msg := testServer.Session.GetString(r.Context(), ERROR_CTX); msg != USED_TOKEN_MSG {
+		t.Errorf("expected error message %q; got %q", USED_TOKEN_MSG, msg)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+// XXX_PAGE is the name of the template gohtml file to render for the page
+const (
+	PROFILE_PAGE = "profile.page.gohtml"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	PROFILE_UPDATED_MSG        = "Profile updated."
+	EMAIL_CHANGE_SENT_MSG      = "We sent a link to %s. Click it to confirm your new email address."
+	SAME_EMAIL_MSG             = "This is already your email address."
+	UNSUCCESSFUL_EMAIL_MSG     = "Unable to change your email address."
+	INVALID_EMAIL_CHANGE_MSG   = "Your email address has changed since this link was sent."
+	EMAIL_CHANGED_MSG          = "Your email address has been changed."
+	ERROR_GET_SESSION_USER_MSG = "error getting user %d: %w"
+)
+
+const (
+	PASSWORD_SET_MSG          = "Your password has been set. You can now log in with it too."
+	PASSWORD_REMOVED_MSG      = "Your password has been removed. You now log in with your identity provider only."
+	PASSWORD_ALREADY_SET_MSG  = "You already have a password."
+	NO_PASSWORD_MSG           = "You have no password to remove."
+	LAST_LOGIN_METHOD_MSG     = "Link an identity provider first, or you couldn't log in anymore."
+	UNSUCCESSFUL_PASSWORD_MSG = "Unable to change your password."
+	ERROR_GET_IDENTITIES_MSG  = "error getting identities of user %d: %w"
+)
+
+// XXX_ATTR is an attribute or element's name embedded in html.
+const (
+	NEW_EMAIL_ATTR    = "new-email"
+	IDENTITIES_ATTR   = "identities"
+	HAS_PASSWORD_ATTR = "has-password"
+)
+
+const (
+	EMAIL_CHANGE_LINK_MAX_AGE = 24 * time.Hour
+)
+
+func (s *Server) ProfilePage(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	form := NewForm(url.Values{
+		FIRST_NAME_ATTR: {user.FirstName},
+		LAST_NAME_ATTR:  {user.LastName},
+	})
+	s.renderProfile(w, r, user, form, "")
+}
+
+// renderProfile renders the profile page with the form, along with how the user logs in and their api tokens.
+// newToken is the api token which has just been created, if any, to be shown this once.
+func (s *Server) renderProfile(w http.ResponseWriter, r *http.Request, user data.User, form *Form, newToken string) {
+	dataMap := make(map[string]any)
+
+	// the password in the session may be stale
+	if u, err := s.Models.User.GetOne(user.ID); err == nil {
+		dataMap[HAS_PASSWORD_ATTR] = u.HasPassword()
+	} else {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SESSION_USER_MSG, user.ID, err))
+	}
+
+	identities, err := s.Models.Identity.GetByUserID(user.ID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_IDENTITIES_MSG, user.ID, err))
+	}
+	dataMap[IDENTITIES_ATTR] = identities
+
+	tokens, err := s.Models.APIToken.GetByUserID(user.ID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_API_TOKENS_MSG, user.ID, err))
+	}
+	dataMap[API_TOKENS_ATTR] = tokens
+	dataMap[API_SCOPES_ATTR] = data.AllAPIScopes
+	dataMap[EXPIRES_IN_ATTR] = apiTokenExpiries
+
+	limit, err := s.Models.Entitlement.Limit(user, data.MaxAPITokens)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_CHECK_ENTITLEMENT_MSG, err))
+	}
+
+	deletion, err := s.Models.AccountDeletion.GetByUserID(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_DELETION_MSG, user.ID, err))
+	}
+	if deletion != nil {
+		dataMap[ACCOUNT_DELETION_ATTR] = deletion
+	}
+
+	s.render(w, r, PROFILE_PAGE, &TemplateData{
+		StringMap: map[string]string{
+			NEW_API_TOKEN_ATTR: newToken,
+		},
+		IntMap: map[string]int{
+			API_TOKEN_LIMIT_ATTR: limit,
+		},
+		Form: form,
+		Data: dataMap,
+	})
+}
+
+// UpdateProfile changes the name of the user. The email is changed by RequestEmailChange.
+func (s *Server) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	sessionUser, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required(FIRST_NAME_ATTR, LAST_NAME_ATTR)
+	if !form.Valid() {
+		s.renderProfile(w, r, sessionUser, form, "")
+		return
+	}
+
+	// update the stored user rather than the copy in the session, which may be stale
+	user, err := s.Models.User.GetOne(sessionUser.ID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SESSION_USER_MSG, sessionUser.ID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_UPDATE_USER_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+
+	user.FirstName = strings.TrimSpace(form.Get(FIRST_NAME_ATTR))
+	user.LastName = strings.TrimSpace(form.Get(LAST_NAME_ATTR))
+	if err := s.Models.User.Update(*user); err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_UPDATE_USER_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+
+	s.Session.Put(r.Context(), USER_CTX, *user)
+	s.Session.Put(r.Context(), FLASH_CTX, PROFILE_UPDATED_MSG)
+	http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+}
+
+// RequestEmailChange sends a link to the new email address, which changes the email of the user
+// once it's clicked, proving that the address is theirs
+func (s *Server) RequestEmailChange(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required(NEW_EMAIL_ATTR)
+	form.IsEmail(NEW_EMAIL_ATTR)
+	newEmail := strings.TrimSpace(form.Get(NEW_EMAIL_ATTR))
+	if form.Valid() {
+		if strings.EqualFold(newEmail, user.Email) {
+			form.Errors.Add(NEW_EMAIL_ATTR, SAME_EMAIL_MSG)
+		} else if other, err := s.Models.User.GetByEmail(newEmail); err == nil && other.ID != user.ID {
+			form.Errors.Add(NEW_EMAIL_ATTR, EMAIL_TAKEN_MSG)
+		}
+	}
+	if !form.Valid() {
+		form.Set(FIRST_NAME_ATTR, user.FirstName)
+		form.Set(LAST_NAME_ATTR, user.LastName)
+		s.renderProfile(w, r, user, form, "")
+		return
+	}
+
+	// the current email makes the link stop working once the email has changed
+	q := url.Values{}
+	q.Set(EMAIL_ATTR, user.Email)
+	q.Set(NEW_EMAIL_ATTR, newEmail)
+	confirmURL := &url.URL{
+		Scheme:   "http",
+		Host:     r.Host,
+		Path:     CONFIRM_EMAIL_CHANGE_PATH,
+		RawQuery: q.Encode(),
+	}
+	signedURL, err := s.signURL(confirmURL, EMAIL_CHANGE_PURPOSE, EMAIL_CHANGE_LINK_MAX_AGE)
+	if err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_EMAIL_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+
+	msg := Message{
+		To:       newEmail,
+		Subject:  "Confirm your new email address",
+		Template: CONFIRM_EMAIL_CHANGE,
+		Data:     template.HTML(signedURL),
+	}
+	s.sendEmail(msg)
+
+	s.Session.Put(r.Context(), FLASH_CTX, fmt.Sprintf(EMAIL_CHANGE_SENT_MSG, newEmail))
+	http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+}
+
+// ConfirmEmailChange changes the email of the user to the address the link was sent to,
+// and lets the old address know
+func (s *Server) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	// the link may be followed from any browser, logged in or not
+	redirectTo := LOGIN_PATH
+	if s.IsAuthenticated(r) {
+		redirectTo = MembersProfilePath
+	}
+
+	q, err := s.verifySignedURL(r, EMAIL_CHANGE_PURPOSE)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, tokenErrorMessage(err))
+		http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+		return
+	}
+
+	oldEmail, newEmail := q.Get(EMAIL_ATTR), q.Get(NEW_EMAIL_ATTR)
+	user, err := s.Models.User.GetByEmail(oldEmail)
+	if err != nil || !strings.EqualFold(user.Email, oldEmail) {
+		s.Session.Put(r.Context(), ERROR_CTX, INVALID_EMAIL_CHANGE_MSG)
+		http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+		return
+	}
+
+	if _, err := s.consumeSignedURL(r, EMAIL_CHANGE_PURPOSE); err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, tokenErrorMessage(err))
+		http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+		return
+	}
+
+	user.Email = newEmail
+	err = s.Models.User.Update(*user)
+	if errors.Is(err, data.ErrDuplicateEmail) {
+		s.Session.Put(r.Context(), ERROR_CTX, EMAIL_TAKEN_MSG)
+		http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_EMAIL_MSG)
+		http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+		return
+	}
+
+	msg := Message{
+		To:       oldEmail,
+		Subject:  "Your email address has been changed",
+		Template: EMAIL_CHANGED,
+		Data:     newEmail,
+	}
+	s.sendEmail(msg)
+
+	if s.Session.GetInt(r.Context(), USER_ID_CTX) == user.ID {
+		s.Session.Put(r.Context(), USER_CTX, *user)
+	}
+
+	s.Session.Put(r.Context(), FLASH_CTX, EMAIL_CHANGED_MSG)
+	http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+}
+
+// SetPassword adds a password to the account of a user who has only logged in with an identity provider.
+// Those who have one already change it with the forgot password link.
+func (s *Server) SetPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	sessionUser, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	user, err := s.Models.User.GetOne(sessionUser.ID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SESSION_USER_MSG, sessionUser.ID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_PASSWORD_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	if user.HasPassword() {
+		s.Session.Put(r.Context(), ERROR_CTX, PASSWORD_ALREADY_SET_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required(PASSWORD_ATTR, VERIFY_PASSWORD_ATTR)
+	form.Password(PASSWORD_ATTR)
+	form.Matches(VERIFY_PASSWORD_ATTR, PASSWORD_ATTR)
+	if !form.Valid() {
+		form.Set(FIRST_NAME_ATTR, user.FirstName)
+		form.Set(LAST_NAME_ATTR, user.LastName)
+		s.renderProfile(w, r, *user, form, "")
+		return
+	}
+
+	if err := s.Models.User.ResetPassword(*user, form.Get(PASSWORD_ATTR)); err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_PASSWORD_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.PasswordSet, user.ID, user.ID, nil)
+
+	s.Session.Put(r.Context(), FLASH_CTX, PASSWORD_SET_MSG)
+	http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+}
+
+// RemovePassword removes the password of a user, who then only logs in with an identity provider.
+// The user must have linked one, or they couldn't log in anymore.
+func (s *Server) RemovePassword(w http.ResponseWriter, r *http.Request) {
+	sessionUser, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	user, err := s.Models.User.GetOne(sessionUser.ID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SESSION_USER_MSG, sessionUser.ID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_PASSWORD_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	if !user.HasPassword() {
+		s.Session.Put(r.Context(), ERROR_CTX, NO_PASSWORD_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+
+	identities, err := s.Models.Identity.GetByUserID(user.ID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_IDENTITIES_MSG, user.ID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_PASSWORD_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	if len(identities) == 0 {
+		s.Session.Put(r.Context(), ERROR_CTX, LAST_LOGIN_METHOD_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+
+	if err := s.Models.User.RemovePassword(user.ID); err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_PASSWORD_MSG)
+		http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.PasswordRemoved, user.ID, user.ID, nil)
+
+	s.Session.Put(r.Context(), FLASH_CTX, PASSWORD_REMOVED_MSG)
+	http.Redirect(w, r, MembersProfilePath, http.StatusSeeOther)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// XXX_KEY is the prefix of the keys the registry stores the sessions of each user under
+const (
+	USER_SESSIONS_KEY = "sessions:user:"
+)
+
+// ActiveSession is a logged in session of a user, on one device
+type ActiveSession struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"token"` // the session token, never to be displayed
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Device returns a short description of the browser and the system of the session
+func (a ActiveSession) Device() string {
+	return deviceName(a.UserAgent)
+}
+
+// SessionRegistry keeps track of the logged in sessions of each user
+type SessionRegistry interface {
+	// Add records a session of the user
+	Add(userID int, sess ActiveSession) error
+	// List returns the sessions of the user which haven't expired, newest first
+	List(userID int) ([]ActiveSession, error)
+	// Remove forgets sessions of the user
+	Remove(userID int, ids ...string) error
+}
+
+// sortSessions sorts the sessions which haven't expired, newest first
+func sortSessions(sessions []ActiveSession, now time.Time) []ActiveSession {
+	var live []ActiveSession
+	for _, sess := range sessions {
+		if now.Before(sess.ExpiresAt) {
+			live = append(live, sess)
+		}
+	}
+
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].CreatedAt.After(live[j].CreatedAt)
+	})
+
+	return live
+}
+
+// RedisSessionRegistry keeps the sessions of each user in a redis hash, next to the sessions themselves
+type RedisSessionRegistry struct {
+	Pool *redis.Pool
+}
+
+// NewRedisSessionRegistry returns a registry using the connections of the pool
+func NewRedisSessionRegistry(pool *redis.Pool) *RedisSessionRegistry {
+	return &RedisSessionRegistry{Pool: pool}
+}
+
+func (s *RedisSessionRegistry) key(userID int) string {
+	return USER_SESSIONS_KEY + strconv.Itoa(userID)
+}
+
+func (s *RedisSessionRegistry) Add(userID int, sess ActiveSession) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	b, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+
+	key := s.key(userID)
+	if _, err := conn.Do("HSET", key, sess.ID, b); err != nil {
+		return err
+	}
+
+	// the hash lives as long as the newest session, which makes expired sessions go away eventually
+	_, err = conn.Do("PEXPIREAT", key, sess.ExpiresAt.UnixMilli())
+	return err
+}
+
+func (s *RedisSessionRegistry) List(userID int) ([]ActiveSession, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(conn.Do("HVALS", s.key(userID)))
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]ActiveSession, 0, len(values))
+	for _, b := range values {
+		var sess ActiveSession
+		if err := json.Unmarshal(b, &sess); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+
+	return sortSessions(sessions, time.Now()), nil
+}
+
+func (s *RedisSessionRegistry) Remove(userID int, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	args := []any{s.key(userID)}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	_, err := conn.Do("HDEL", args...)
+	return err
+}
+
+// MemorySessionRegistry keeps the sessions in memory, and is used for testing
+type MemorySessionRegistry struct {
+	mutex    sync.Mutex
+	sessions map[int]map[string]ActiveSession
+}
+
+// NewMemorySessionRegistry returns an empty registry
+func NewMemorySessionRegistry() *MemorySessionRegistry {
+	return &MemorySessionRegistry{
+		sessions: make(map[int]map[string]ActiveSession),
+	}
+}
+
+func (s *MemorySessionRegistry) Add(userID int, sess ActiveSession) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.sessions[userID] == nil {
+		s.sessions[userID] = make(map[string]ActiveSession)
+	}
+	s.sessions[userID][sess.ID] = sess
+	return nil
+}
+
+func (s *MemorySessionRegistry) List(userID int) ([]ActiveSession, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var sessions []ActiveSession
+	for _, sess := range s.sessions[userID] {
+		sessions = append(sessions, sess)
+	}
+	return sortSessions(sessions, time.Now()), nil
+}
+
+func (s *MemorySessionRegistry) Remove(userID int, ids ...string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, id := range ids {
+		delete(s.sessions[userID], id)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	CONFIG_RELOADED_MSG     = "reloaded configuration: %s"
+	CONFIG_UNCHANGED_MSG    = "reloaded configuration: nothing has changed"
+	RESTART_REQUIRED_MSG    = "these settings have changed, but only take effect after a restart: %s"
+	ERROR_RELOAD_CONFIG_MSG = "error reloading configuration, so keeping the current one: %w"
+)
+
+// reloadableSettings are the sections of the configuration which are applied on SIGHUP, without a restart.
+// The mail transport, the rate limits, the log level and the feature flags are only ever read through the mailer,
+// the throttle, the logger and the feature flags of the server, which are safe to change while requests are being served.
+var reloadableSettings = []string{"mail", "rate_limits", "log", "features"}
+
+// reloadConfig loads the configuration again, and applies its reloadable settings. Either all of them
+// are applied or, if the configuration is invalid, none. It returns the settings which have been reloaded,
+// and the ones which have changed but require a restart, by their name in the config file.
+func (s *Server) reloadConfig(load func() (*Config, error)) (reloaded, restart []string, err error) {
+	cfg, err := load()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_RELOAD_CONFIG_MSG, err))
+		return nil, nil, err
+	}
+
+	for _, name := range changedSettings(s.Config, cfg) {
+		if isReloadable(name) {
+			reloaded = append(reloaded, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+
+	s.Mailer.SetTransport(newMailTransport(cfg.Mail))
+	s.Throttle.SetLimits(cfg.RateLimits)
+	s.setLogLevel(cfg.Log.Level)
+	s.Features.Set(cfg.Features)
+
+	// the rest of the configuration keeps what the server has been started with
+	s.Config.Mail = cfg.Mail
+	s.Config.RateLimits = cfg.RateLimits
+	s.Config.Log = cfg.Log
+	s.Config.Features = cfg.Features
+
+	if len(reloaded) == 0 {
+		s.InfoLog.Println(CONFIG_UNCHANGED_MSG)
+	} else {
+		s.InfoLog.Printf(CONFIG_RELOADED_MSG+"\n", strings.Join(reloaded, ", "))
+	}
+	if len(restart) > 0 {
+		// logged as an error so that it's seen whatever the log level
+		s.ErrorLog.Printf(RESTART_REQUIRED_MSG+"\n", strings.Join(restart, ", "))
+	}
+
+	return reloaded, restart, nil
+}
+
+// setLogLevel writes the info logs or not, depending on the level. The error logs are always written.
+func (s *Server) setLogLevel(level string) {
+	if level == ERROR_LOG_LEVEL {
+		s.InfoLog.SetOutput(io.Discard)
+		return
+	}
+	if s.InfoLog.Writer() == io.Discard {
+		s.InfoLog.SetOutput(os.Stdout)
+	}
+}
+
+// isReloadable reports whether the setting, by its name in the config file, is applied without a restart
+func isReloadable(name string) bool {
+	section, _, _ := strings.Cut(name, ".")
+	for _, reloadable := range reloadableSettings {
+		if section == reloadable {
+			return true
+		}
+	}
+	return false
+}
+
+// changedSettings returns the names in the config file of the settings which differ between the configurations.
+// Secrets are named, but their values are never shown.
+func changedSettings(from, to *Config) []string {
+	var changed []string
+	diffSettings(reflect.ValueOf(*from), reflect.ValueOf(*to), "", &changed)
+	return changed
+}
+
+func diffSettings(from, to reflect.Value, prefix string, changed *[]string) {
+	for i := 0; i < from.NumField(); i++ {
+		field := from.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			diffSettings(from.Field(i), to.Field(i), name, changed)
+			continue
+		}
+		if !reflect.DeepEqual(from.Field(i).Interface(), to.Field(i).Interface()) {
+			*changed = append(*changed, name)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+// newReloadServer returns a server of its own, so that reloading doesn't change the test server
+func newReloadServer(cfg *Config, infoLog *bytes.Buffer) *Server {
+	s := &Server{
+		Config:   cfg,
+		InfoLog:  log.New(infoLog, "INFO\t", 0),
+		ErrorLog: log.New(infoLog, "ERROR\t", 0),
+		Throttle: NewLoginThrottle(NewMemoryThrottleStore()),
+		Features: NewFeatureFlags(cfg.Features),
+	}
+	s.Mailer.SetTransport(newMailTransport(cfg.Mail))
+	return s
+}
+
+func Test_reloadConfig(t *testing.T) {
+	var logs bytes.Buffer
+	s := newReloadServer(DefaultConfig(), &logs)
+
+	next := DefaultConfig()
+	next.Mail.Host = "smtp.example.com"
+	next.RateLimits.MaxAccountFailures = 2
+	next.Features.Disabled = []data.Feature{data.UserManual}
+	next.Port = 8080
+	next.DB.DSN = "host=elsewhere"
+
+	reloaded, restart, err := s.reloadConfig(func() (*Config, error) { return next, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"mail.host", "rate_limits.max_account_failures", "features.disabled"}; !reflect.DeepEqual(reloaded, want) {
+		t.Errorf("expected %v to be reloaded; got %v", want, reloaded)
+	}
+	if want := []string{"port", "db.dsn"}; !reflect.DeepEqual(restart, want) {
+		t.Errorf("expected %v to require a restart; got %v", want, restart)
+	}
+	if !bytes.Contains(logs.Bytes(), []byte("only take effect after a restart: port, db.dsn")) {
+		t.Errorf("expected the settings requiring a restart to be logged; got %s", logs.String())
+	}
+
+	if host := s.Mailer.Transport().Host; host != "smtp.example.com" {
+		t.Errorf("expected mails to be sent through the new host; got %s", host)
+	}
+	if s.Features.Enabled(data.UserManual) || !s.Features.Enabled(data.EmailSupport) {
+		t.Error("expected only the manual to be switched off")
+	}
+	if s.Config.Port != 80 || s.Config.DB.DSN != "" {
+		t.Errorf("expected the settings requiring a restart to be kept; got %+v", s.Config)
+	}
+
+	// the new limits are enforced right away
+	for i := 1; i <= 2; i++ {
+		locked, err := s.Throttle.Fail("reload@example.com", "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked != (i == 2) {
+			t.Errorf("failure %d: expected locked to be %t; got %t", i, i == 2, locked)
+		}
+	}
+}
+
+func Test_reloadConfig_Invalid(t *testing.T) {
+	var logs bytes.Buffer
+	s := newReloadServer(DefaultConfig(), &logs)
+
+	_, _, err := s.reloadConfig(func() (*Config, error) { return nil, ConfigError{"mail.port: 0 isn't a port"} })
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	var cfgErr ConfigError
+	if !errors.As(err, &cfgErr) || !bytes.Contains(logs.Bytes(), []byte("keeping the current one")) {
+		t.Errorf("expected the invalid configuration to be logged; got %s", logs.String())
+	}
+	if s.Mailer.Transport() != newMailTransport(DefaultConfig().Mail) || s.Throttle.Limits() != DefaultThrottleLimits() {
+		t.Error("expected nothing to be applied")
+	}
+}
+
+func Test_reloadConfig_LogLevel(t *testing.T) {
+	var logs bytes.Buffer
+	s := newReloadServer(DefaultConfig(), &logs)
+
+	next := DefaultConfig()
+	next.Log.Level = ERROR_LOG_LEVEL
+	if _, _, err := s.reloadConfig(func() (*Config, error) { return next, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	logs.Reset()
+	s.InfoLog.Println("hidden")
+	s.ErrorLog.Println("shown")
+	if bytes.Contains(logs.Bytes(), []byte("hidden")) || !bytes.Contains(logs.Bytes(), []byte("shown")) {
+		t.Errorf("expected only errors to be logged; got %s", logs.String())
+	}
+}
+
+// reloadTestServer reloads the test server with the features switched off, for the tests needing its models
+// and session, and returns a function reloading the configuration it had
+func reloadTestServer(t *testing.T, disabled ...data.Feature) func() {
+	current := *testServer.Config
+	next := current
+	next.Features.Disabled = disabled
+	if _, _, err := testServer.reloadConfig(func() (*Config, error) { return &next, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		_, _, _ = testServer.reloadConfig(func() (*Config, error) { return &current, nil })
+	}
+}
+
+func Test_reloadConfig_APIAccessSwitchedOff(t *testing.T) {
+	token := newTestAPIToken(t, 1, sql.NullTime{}, data.ReadPlans)
+	handler := testServer.routes()
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, APIPlansPath, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	restore := reloadTestServer(t, data.APIAccess)
+	w := get()
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d; got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), FEATURE_DISABLED_CODE) {
+		t.Errorf("expected %s in the body; got %s", FEATURE_DISABLED_CODE, w.Body.String())
+	}
+
+	// switching it on again lets the same token through
+	restore()
+	if w := get(); w.Code != http.StatusOK {
+		t.Errorf("expected status code %d; got %d", http.StatusOK, w.Code)
+	}
+}
+
+// manualPlans are the plans of the test models, all of which include the manual
+type manualPlans struct {
+	data.PlanInterface
+}
+
+func (p manualPlans) GetOne(id int) (*data.Plan, error) {
+	plan, err := p.PlanInterface.GetOne(id)
+	if err != nil {
+		return nil, err
+	}
+	plan.Features = append([]data.Feature{data.UserManual}, plan.Features...)
+	return plan, nil
+}
+
+func Test_reloadConfig_UserManualSwitchedOff(t *testing.T) {
+	plans := testServer.Models.Plan
+	testServer.Models.Plan = manualPlans{plans}
+	defer func() { testServer.Models.Plan = plans }()
+	if plan, _ := testServer.Models.Plan.GetOne(1); !plan.HasFeature(data.UserManual) {
+		t.Fatal("expected the plan to include the manual")
+	}
+
+	outputPath := ManualOutputTempPath
+	ManualOutputTempPath = filepath.Join(t.TempDir(), "%d_manual.pdf")
+	defer func() { ManualOutputTempPath = outputPath }()
+
+	restore := reloadTestServer(t, data.UserManual)
+	defer restore()
+
+	user := data.User{ID: 46, Email: "manual@example.com", IsActive: data.Active}
+	r := newReqWithSession(httptest.NewRequest(http.MethodGet, SUBSCRIBE_PATH, nil))
+	if _, err := testServer.subscribeUser(r, user, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+	testServer.AsyncJob.Wait()
+
+	// the manual is made right before it's emailed, so there is none to email while it's switched off
+	if _, err := os.Stat(fmt.Sprintf(ManualOutputTempPath, user.ID)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no manual to be sent; got %v", err)
+	}
+}
@@ -2,17 +2,14 @@ package main
 
 import (
 	"fmt"
+	"html/template"
 	"net/http"
 	"path/filepath"
-	"text/template"
 	"time"
 
 	"github.com/MatsuoTakuro/final-project/data"
 )
 
-// HTMLTmplPath is the path to the templates and can be switched out for testing
-var HTMLTmplPath = TEMPLATE_PATH
-
 const (
 	TEMPLATE_PATH = "./cmd/web/templates"
 )
@@ -43,6 +40,8 @@ type TemplateData struct {
 	Authenticated bool
 	Now           time.Time
 	User          *data.User
+	Impersonator  *data.User
+	Form          *Form // the submitted form and its errors, to render again when it's invalid
 }
 
 func (s *Server) render(
@@ -53,12 +52,15 @@ func (s *Server) render(
 ) {
 
 	var baseTmpls []string
-	baseTmpls = append(baseTmpls, filepath.Join(HTMLTmplPath, targetHTML))
-	baseTmpls = append(baseTmpls, getPartials(HTMLTmplPath)...)
+	baseTmpls = append(baseTmpls, filepath.Join(s.Config.Templates.HTML, targetHTML))
+	baseTmpls = append(baseTmpls, getPartials(s.Config.Templates.HTML)...)
 
 	if td == nil {
 		td = &TemplateData{}
 	}
+	if td.Form == nil {
+		td.Form = NewForm(nil)
+	}
 
 	// parse the template files
 	tmpl, err := template.ParseFiles(baseTmpls...)
@@ -76,6 +78,12 @@ func (s *Server) render(
 	}
 }
 
+// Can reports whether the logged in user may take the action, so that templates only show what they may use,
+// e.g. {{if .Can "coupons:manage"}}
+func (td *TemplateData) Can(perm string) bool {
+	return td.User != nil && td.User.Can(data.Permission(perm))
+}
+
 func getPartials(tmplPath string) []string {
 	return []string{
 		filepath.Join(tmplPath, BASE_LAYOUT),
@@ -98,6 +106,9 @@ func (s *Server) UpdateDefaultData(td *TemplateData, r *http.Request) *TemplateD
 		} else {
 			td.User = &u
 		}
+		if admin, ok := s.Session.Get(r.Context(), IMPERSONATOR_CTX).(data.User); ok {
+			td.Impersonator = &admin
+		}
 	}
 	td.Now = time.Now()
 
@@ -49,8 +49,6 @@ func TestServer_IsAuthenticated(t *testing.T) {
 }
 
 func TestServer_render(t *testing.T) {
-	HTMLTmplPath = "./templates"
-
 	w := httptest.NewRecorder()
 	rawReq, _ := http.NewRequest("GET", "/", nil)
 	r := newReqWithSession(rawReq)
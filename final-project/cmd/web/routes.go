@@ -3,28 +3,139 @@ package main
 import (
 	"net/http"
 
+	"github.com/MatsuoTakuro/final-project/data"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
 const (
-	HOME_PATH      = "/"
-	LOGIN_PATH     = "/login"
-	LOGOUT_PATH    = "/logout"
-	REGISTER_PATH  = "/register"
-	ACTIVATE_PATH  = "/activate"
-	MEMBERS_PATH   = "/members"
-	PLANS_PATH     = "/plans"
-	SUBSCRIBE_PATH = "/subscribe"
+	HOME_PATH        = "/"
+	LOGIN_PATH       = "/login"
+	LOGOUT_PATH      = "/logout"
+	REGISTER_PATH    = "/register"
+	ACTIVATE_PATH    = "/activate"
+	MEMBERS_PATH     = "/members"
+	PLANS_PATH       = "/plans"
+	SUBSCRIBE_PATH   = "/subscribe"
+	MANUAL_PATH      = "/manual"
+	PREFERENCES_PATH = "/preferences"
+	ADMIN_PATH       = "/admin"
+	COUPONS_PATH     = "/coupons"
+
+	ORGANIZATION_PATH           = "/organization"
+	ORGANIZATION_INVITE_PATH    = ORGANIZATION_PATH + "/invite"
+	ORGANIZATION_JOIN_PATH      = ORGANIZATION_PATH + "/join"
+	ORGANIZATION_REMOVE_PATH    = ORGANIZATION_PATH + "/remove"
+	ORGANIZATION_SUBSCRIBE_PATH = ORGANIZATION_PATH + SUBSCRIBE_PATH
+
+	FORGOT_PASSWORD_PATH = "/forgot-password"
+	RESET_PASSWORD_PATH  = "/reset-password"
+
+	UNLOCK_ACCOUNT_PATH  = "/unlock-account"
+	LOCKED_ACCOUNTS_PATH = "/locked-accounts"
+
+	TWO_FACTOR_PATH         = "/two-factor"
+	TWO_FACTOR_DISABLE_PATH = TWO_FACTOR_PATH + "/disable"
+
+	RESEND_ACTIVATION_PATH = "/resend-activation"
+
+	PROFILE_PATH              = "/profile"
+	PROFILE_EMAIL_PATH        = PROFILE_PATH + "/email"
+	CONFIRM_EMAIL_CHANGE_PATH = "/confirm-email"
+
+	SESSIONS_PATH        = "/sessions"
+	SESSIONS_REVOKE_PATH = SESSIONS_PATH + "/revoke"
+	SESSIONS_OTHERS_PATH = SESSIONS_PATH + "/revoke-others"
+
+	USERS_PATH               = "/users"
+	USER_PATH                = "/user"
+	USER_ACTIVE_PATH         = USER_PATH + "/active"
+	USER_ROLE_PATH           = USER_PATH + "/role"
+	USER_RESET_PASSWORD_PATH = USER_PATH + RESET_PASSWORD_PATH
+	USER_PLAN_PATH           = USER_PATH + "/plan"
+	USER_DELETE_PATH         = USER_PATH + "/delete"
+	USER_IMPERSONATE_PATH    = USER_PATH + "/impersonate"
+
+	STOP_IMPERSONATING_PATH = "/stop-impersonating"
+
+	AUDIT_PATH        = "/audit"
+	AUDIT_EXPORT_PATH = AUDIT_PATH + "/export"
+
+	OIDC_PATH          = "/oidc"
+	OIDC_CALLBACK_PATH = OIDC_PATH + "/callback"
+
+	PROFILE_PASSWORD_PATH        = PROFILE_PATH + "/password"
+	PROFILE_PASSWORD_REMOVE_PATH = PROFILE_PASSWORD_PATH + "/remove"
+
+	PROFILE_TOKENS_PATH        = PROFILE_PATH + "/tokens"
+	PROFILE_TOKENS_REVOKE_PATH = PROFILE_TOKENS_PATH + "/revoke"
+
+	API_PATH             = "/api"
+	API_V1_PATH          = API_PATH + "/v1"
+	ME_PATH              = "/me"
+	ME_SUBSCRIPTION_PATH = ME_PATH + "/subscription"
+	ME_INVOICES_PATH     = ME_PATH + "/invoices"
+	OPENAPI_PATH         = "/openapi.json"
+	DOCS_PATH            = "/docs"
+
+	ACCOUNT_PATH                 = "/account"
+	ACCOUNT_EXPORT_PATH          = ACCOUNT_PATH + "/export"
+	ACCOUNT_EXPORT_DOWNLOAD_PATH = ACCOUNT_EXPORT_PATH + "/download"
+	ACCOUNT_DELETE_PATH          = ACCOUNT_PATH + "/delete"
+	ACCOUNT_DELETE_CANCEL_PATH   = ACCOUNT_DELETE_PATH + "/cancel"
 )
 
 var MembersPlanPath string = MEMBERS_PATH + PLANS_PATH
 var MembersSubscribePath string = MEMBERS_PATH + SUBSCRIBE_PATH
+var MembersManualPath string = MEMBERS_PATH + MANUAL_PATH
+var MembersPreferencesPath string = MEMBERS_PATH + PREFERENCES_PATH
+var MembersOrganizationPath string = MEMBERS_PATH + ORGANIZATION_PATH
+var MembersOrganizationInvitePath string = MEMBERS_PATH + ORGANIZATION_INVITE_PATH
+var MembersOrganizationJoinPath string = MEMBERS_PATH + ORGANIZATION_JOIN_PATH
+var MembersOrganizationRemovePath string = MEMBERS_PATH + ORGANIZATION_REMOVE_PATH
+var MembersOrganizationSubscribePath string = MEMBERS_PATH + ORGANIZATION_SUBSCRIBE_PATH
+var MembersTwoFactorPath string = MEMBERS_PATH + TWO_FACTOR_PATH
+var MembersTwoFactorDisablePath string = MEMBERS_PATH + TWO_FACTOR_DISABLE_PATH
+var MembersProfilePath string = MEMBERS_PATH + PROFILE_PATH
+var MembersProfileEmailPath string = MEMBERS_PATH + PROFILE_EMAIL_PATH
+var MembersProfilePasswordPath string = MEMBERS_PATH + PROFILE_PASSWORD_PATH
+var MembersProfilePasswordRemovePath string = MEMBERS_PATH + PROFILE_PASSWORD_REMOVE_PATH
+var MembersProfileTokensPath string = MEMBERS_PATH + PROFILE_TOKENS_PATH
+var MembersProfileTokensRevokePath string = MEMBERS_PATH + PROFILE_TOKENS_REVOKE_PATH
+var MembersAccountExportPath string = MEMBERS_PATH + ACCOUNT_EXPORT_PATH
+var MembersAccountExportDownloadPath string = MEMBERS_PATH + ACCOUNT_EXPORT_DOWNLOAD_PATH
+var MembersAccountDeletePath string = MEMBERS_PATH + ACCOUNT_DELETE_PATH
+var MembersAccountDeleteCancelPath string = MEMBERS_PATH + ACCOUNT_DELETE_CANCEL_PATH
+var MembersSessionsPath string = MEMBERS_PATH + SESSIONS_PATH
+var MembersSessionsRevokePath string = MEMBERS_PATH + SESSIONS_REVOKE_PATH
+var MembersSessionsOthersPath string = MEMBERS_PATH + SESSIONS_OTHERS_PATH
+var LoginTwoFactorPath string = LOGIN_PATH + TWO_FACTOR_PATH
+var LoginOIDCPath string = LOGIN_PATH + OIDC_PATH
+var LoginOIDCCallbackPath string = LOGIN_PATH + OIDC_CALLBACK_PATH
+var AdminCouponsPath string = ADMIN_PATH + COUPONS_PATH
+var AdminLockedAccountsPath string = ADMIN_PATH + LOCKED_ACCOUNTS_PATH
+var AdminUsersPath string = ADMIN_PATH + USERS_PATH
+var AdminUserPath string = ADMIN_PATH + USER_PATH
+var AdminUserActivePath string = ADMIN_PATH + USER_ACTIVE_PATH
+var AdminUserRolePath string = ADMIN_PATH + USER_ROLE_PATH
+var AdminUserResetPasswordPath string = ADMIN_PATH + USER_RESET_PASSWORD_PATH
+var AdminUserPlanPath string = ADMIN_PATH + USER_PLAN_PATH
+var AdminUserDeletePath string = ADMIN_PATH + USER_DELETE_PATH
+var AdminUserImpersonatePath string = ADMIN_PATH + USER_IMPERSONATE_PATH
+var AdminAuditPath string = ADMIN_PATH + AUDIT_PATH
+var AdminAuditExportPath string = ADMIN_PATH + AUDIT_EXPORT_PATH
+var APISpecPath string = API_PATH + OPENAPI_PATH
+var APIDocsPath string = API_PATH + DOCS_PATH
+var APIPlansPath string = API_V1_PATH + PLANS_PATH
+var APIMePath string = API_V1_PATH + ME_PATH
+var APISubscriptionPath string = API_V1_PATH + ME_SUBSCRIPTION_PATH
+var APIInvoicesPath string = API_V1_PATH + ME_INVOICES_PATH
 
 func (s *Server) routes() http.Handler {
 
 	mux := chi.NewRouter()
 
+	mux.Use(middleware.RequestID) // give every request an id, which the audit log records
 	mux.Use(middleware.Recoverer) // recover from panic, log the panic error and return a 500 response
 	mux.Use(s.SessionLoad)
 
@@ -35,10 +146,30 @@ func (s *Server) routes() http.Handler {
 	mux.Get(REGISTER_PATH, s.RegisterPage)
 	mux.Post(REGISTER_PATH, s.RegisterUser)
 	mux.Get(ACTIVATE_PATH, s.ActivateUserAccount)
+	mux.Post(RESEND_ACTIVATION_PATH, s.ResendActivation)
+	mux.Get(CONFIRM_EMAIL_CHANGE_PATH, s.ConfirmEmailChange)
+	mux.Get(FORGOT_PASSWORD_PATH, s.ForgotPasswordPage)
+	mux.Post(FORGOT_PASSWORD_PATH, s.ForgotPassword)
+	mux.Get(RESET_PASSWORD_PATH, s.ResetPasswordPage)
+	mux.With(s.NoImpersonation).Post(RESET_PASSWORD_PATH, s.ResetPassword)
+	mux.Get(UNLOCK_ACCOUNT_PATH, s.UnlockAccount)
+	mux.Get(LoginTwoFactorPath, s.LoginTwoFactorPage)
+	mux.Post(LoginTwoFactorPath, s.LoginTwoFactor)
+	mux.Get(LoginOIDCPath, s.OIDCLogin)
+	mux.Get(LoginOIDCCallbackPath, s.OIDCCallback)
+	mux.Post(STOP_IMPERSONATING_PATH, s.StopImpersonating)
+	mux.Get(APISpecPath, s.APISpec)
+	mux.Get(APIDocsPath, s.APIDocsPage)
 
 	// attach membershipRouter as a subrouter to root router
 	mux.Mount(MEMBERS_PATH, s.membershipRouter())
 
+	// attach adminRouter as a subrouter to root router
+	mux.Mount(ADMIN_PATH, s.adminRouter())
+
+	// attach apiRouter as a subrouter to root router
+	mux.Mount(API_V1_PATH, s.apiRouter())
+
 	return mux
 }
 
@@ -47,7 +178,80 @@ func (s *Server) membershipRouter() http.Handler {
 	mux.Use(s.Auth)
 
 	mux.Get(PLANS_PATH, s.ListOfPlans)
-	mux.Get(SUBSCRIBE_PATH, s.SubcribeToPlan)
+	mux.With(s.NoImpersonation).Get(SUBSCRIBE_PATH, s.SubcribeToPlan)
+	mux.With(s.RequireFeature(data.UserManual)).Get(MANUAL_PATH, s.DownloadManual)
+	mux.Post(PREFERENCES_PATH, s.UpdatePreferences)
+	mux.Get(ORGANIZATION_PATH, s.OrganizationPage)
+	mux.Post(ORGANIZATION_PATH, s.CreateOrganization)
+	mux.Post(ORGANIZATION_INVITE_PATH, s.InviteToOrganization)
+	mux.Get(ORGANIZATION_JOIN_PATH, s.JoinOrganization)
+	mux.Post(ORGANIZATION_REMOVE_PATH, s.RemoveFromOrganization)
+	mux.With(s.NoImpersonation).Post(ORGANIZATION_SUBSCRIBE_PATH, s.SubscribeOrganizationToPlan)
+	mux.Get(TWO_FACTOR_PATH, s.TwoFactorPage)
+	mux.With(s.NoImpersonation).Post(TWO_FACTOR_PATH, s.EnableTwoFactor)
+	mux.With(s.NoImpersonation).Post(TWO_FACTOR_DISABLE_PATH, s.DisableTwoFactor)
+	mux.Get(PROFILE_PATH, s.ProfilePage)
+	mux.Post(PROFILE_PATH, s.UpdateProfile)
+	mux.With(s.NoImpersonation).Post(PROFILE_EMAIL_PATH, s.RequestEmailChange)
+	mux.With(s.NoImpersonation).Post(PROFILE_PASSWORD_PATH, s.SetPassword)
+	mux.With(s.NoImpersonation).Post(PROFILE_PASSWORD_REMOVE_PATH, s.RemovePassword)
+	mux.With(s.NoImpersonation).Post(PROFILE_TOKENS_PATH, s.CreateAPIToken)
+	mux.With(s.NoImpersonation).Post(PROFILE_TOKENS_REVOKE_PATH, s.RevokeAPIToken)
+	mux.With(s.NoImpersonation).Post(ACCOUNT_EXPORT_PATH, s.ExportAccount)
+	mux.With(s.NoImpersonation).Get(ACCOUNT_EXPORT_DOWNLOAD_PATH, s.DownloadAccountExport)
+	mux.With(s.NoImpersonation).Post(ACCOUNT_DELETE_PATH, s.RequestAccountDeletion)
+	mux.With(s.NoImpersonation).Post(ACCOUNT_DELETE_CANCEL_PATH, s.CancelAccountDeletion)
+	mux.Get(SESSIONS_PATH, s.SessionsPage)
+	mux.With(s.NoImpersonation).Post(SESSIONS_REVOKE_PATH, s.RevokeSession)
+	mux.With(s.NoImpersonation).Post(SESSIONS_OTHERS_PATH, s.RevokeOtherSessions)
+
+	return mux
+}
+
+func (s *Server) adminRouter() http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(s.Auth)
+	mux.Use(s.RequirePermission(data.ViewAdmin))
+
+	mux.With(s.RequirePermission(data.ManageCoupons)).Get(COUPONS_PATH, s.AdminCouponsPage)
+	mux.With(s.RequirePermission(data.ManageCoupons)).Post(COUPONS_PATH, s.AdminCreateCoupon)
+	mux.With(s.RequirePermission(data.UnlockAccounts)).Get(LOCKED_ACCOUNTS_PATH, s.AdminLockedAccountsPage)
+	mux.With(s.RequirePermission(data.UnlockAccounts)).Post(LOCKED_ACCOUNTS_PATH, s.AdminUnlockAccount)
+	mux.With(s.RequirePermission(data.ViewUsers)).Get(USERS_PATH, s.AdminUsersPage)
+	mux.With(s.RequirePermission(data.ViewUsers)).Get(USER_PATH, s.AdminUserPage)
+	mux.With(s.RequirePermission(data.ManageUsers)).Post(USER_ACTIVE_PATH, s.AdminSetUserActive)
+	mux.With(s.RequirePermission(data.ManageUsers)).Post(USER_ROLE_PATH, s.AdminSetUserRole)
+	mux.With(s.RequirePermission(data.ResetPasswords)).Post(USER_RESET_PASSWORD_PATH, s.AdminSendPasswordReset)
+	mux.With(s.RequirePermission(data.ManageBilling)).Post(USER_PLAN_PATH, s.AdminChangeUserPlan)
+	mux.With(s.RequirePermission(data.ManageUsers)).Post(USER_DELETE_PATH, s.AdminDeleteUser)
+	mux.With(s.RequirePermission(data.ImpersonateUsers)).Post(USER_IMPERSONATE_PATH, s.AdminImpersonateUser)
+	mux.With(s.RequirePermission(data.ViewAuditLog)).Get(AUDIT_PATH, s.AdminAuditPage)
+	mux.With(s.RequirePermission(data.ViewAuditLog)).Get(AUDIT_EXPORT_PATH, s.AdminAuditExport)
+
+	return mux
+}
+
+// apiRouter serves the json api to scripts, which authenticate with an api token rather than a session
+func (s *Server) apiRouter() http.Handler {
+	mux := chi.NewRouter()
+	if s.APISpecViolation != nil {
+		mux.Use(s.ValidateAPI)
+	}
+	mux.Use(s.APIAuth)
+
+	mux.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		s.apiError(w, http.StatusNotFound, NOT_FOUND_CODE, API_NOT_FOUND_MSG)
+	})
+	mux.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		s.apiError(w, http.StatusMethodNotAllowed, METHOD_NOT_ALLOWED_CODE, API_METHOD_NOT_ALLOWED_MSG)
+	})
+
+	mux.With(s.RequireScope(data.ReadProfile)).Get(ME_PATH, s.APIMe)
+	mux.With(s.RequireScope(data.ReadPlans)).Get(PLANS_PATH, s.APIPlans)
+	mux.With(s.RequireScope(data.ReadSubscription)).Get(ME_SUBSCRIPTION_PATH, s.APISubscription)
+	mux.With(s.RequireScope(data.WriteSubscription)).Put(ME_SUBSCRIPTION_PATH, s.APIUpdateSubscription)
+	mux.With(s.RequireScope(data.WriteSubscription)).Delete(ME_SUBSCRIPTION_PATH, s.APICancelSubscription)
+	mux.With(s.RequireScope(data.ReadInvoices)).Get(ME_INVOICES_PATH, s.APIInvoices)
 
 	return mux
 }
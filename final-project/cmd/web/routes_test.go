@@ -13,8 +13,57 @@ var routes = []string{
 	LOGOUT_PATH,
 	REGISTER_PATH,
 	ACTIVATE_PATH,
+	RESEND_ACTIVATION_PATH,
+	CONFIRM_EMAIL_CHANGE_PATH,
+	FORGOT_PASSWORD_PATH,
+	RESET_PASSWORD_PATH,
+	UNLOCK_ACCOUNT_PATH,
+	LoginTwoFactorPath,
+	LoginOIDCPath,
+	LoginOIDCCallbackPath,
+	STOP_IMPERSONATING_PATH,
 	MembersPlanPath,
 	MembersSubscribePath,
+	MembersManualPath,
+	MembersPreferencesPath,
+	MembersOrganizationPath,
+	MembersOrganizationInvitePath,
+	MembersOrganizationJoinPath,
+	MembersOrganizationRemovePath,
+	MembersOrganizationSubscribePath,
+	MembersTwoFactorPath,
+	MembersTwoFactorDisablePath,
+	MembersProfilePath,
+	MembersProfileEmailPath,
+	MembersProfilePasswordPath,
+	MembersProfilePasswordRemovePath,
+	MembersProfileTokensPath,
+	MembersProfileTokensRevokePath,
+	MembersAccountExportPath,
+	MembersAccountExportDownloadPath,
+	MembersAccountDeletePath,
+	MembersAccountDeleteCancelPath,
+	MembersSessionsPath,
+	MembersSessionsRevokePath,
+	MembersSessionsOthersPath,
+	AdminCouponsPath,
+	AdminLockedAccountsPath,
+	AdminUsersPath,
+	AdminUserPath,
+	AdminUserActivePath,
+	AdminUserRolePath,
+	AdminUserResetPasswordPath,
+	AdminUserPlanPath,
+	AdminUserDeletePath,
+	AdminUserImpersonatePath,
+	AdminAuditPath,
+	AdminAuditExportPath,
+	APISpecPath,
+	APIDocsPath,
+	APIMePath,
+	APIPlansPath,
+	APISubscriptionPath,
+	APIInvoicesPath,
 }
 
 var _ http.Handler = (chi.Router)(nil)
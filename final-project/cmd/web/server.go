@@ -23,7 +23,6 @@ const (
 	ERROR_ASYNC_JOB_MSG    = "error asynchronously processing job: %w"
 )
 
-var ManualTmplPath = MANUAL_TMPL_PATH
 var ManualOutputTempPath = MANUAL_OUTPUT_TEMP_PATH
 
 const (
@@ -33,24 +32,37 @@ const (
 )
 
 type Server struct {
-	Session   *scs.SessionManager
-	DB        *sql.DB
-	InfoLog   *log.Logger
-	ErrorLog  *log.Logger
-	Models    data.Models
-	Mailer    Mailer
-	AsyncJob  *sync.WaitGroup
-	AsyncErr  chan error
-	StopAsync chan bool
+	Config      *Config
+	Session     *scs.SessionManager
+	DB          *sql.DB
+	InfoLog     *log.Logger
+	ErrorLog    *log.Logger
+	Models      data.Models
+	Mailer      Mailer
+	AsyncJob    *sync.WaitGroup
+	AsyncErr    chan error
+	StopAsync   chan bool
+	StopBilling chan bool
+	Throttle    *LoginThrottle
+	Sessions    SessionRegistry
+	OIDC        *OIDCProvider // nil unless an identity provider is configured
+	Keyring     *Keyring      // the keys urls are signed with
+	Features    *FeatureFlags // the features switched off whatever the plan
+
+	StopAccountDeletion chan bool
+
+	// APISpecViolation is told of every exchange with the api which doesn't match its spec.
+	// It's nil, and the api isn't checked, but in tests.
+	APISpecViolation func(err error)
 }
 
 func (s *Server) serve() {
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%s", WEB_PORT),
+		Addr:    fmt.Sprintf(":%d", s.Config.Port),
 		Handler: s.routes(),
 	}
 
-	s.InfoLog.Printf("Starting web server... at http://localhost:%s\n", WEB_PORT)
+	s.InfoLog.Printf("Starting web server... at http://localhost:%d\n", s.Config.Port)
 	if err := srv.ListenAndServe(); err != nil {
 		log.Panic(err)
 	}
@@ -61,16 +73,9 @@ func (s *Server) initMailer() {
 	msg := make(chan Message, 100)
 	stopMail := make(chan bool)
 
-	// NOTE: of course, originally, domain, host or port should be in an environment variable or config file.
 	s.Mailer = Mailer{
-		Domain:        "localhost",
-		Host:          "localhost",
-		Port:          1025,
-		Username:      "",
-		Password:      "",
-		Encrypt:       NONE,
-		FromAddress:   "info@mycompany.com",
-		FromName:      "Info",
+		transport:     newMailTransport(s.Config.Mail),
+		Templates:     s.Config.Templates.Email,
 		AsyncMail:     s.AsyncJob, // pass the same waitgroup to the mailer
 		Msg:           msg,
 		MailErr:       mailErr,
@@ -78,7 +83,7 @@ func (s *Server) initMailer() {
 		AcceptMessage: true,
 		mutex:         sync.RWMutex{},
 	}
-	s.InfoLog.Printf("You may see sent mails at http://%s:%d\n", s.Mailer.Host, 8025)
+	s.InfoLog.Printf("You may see sent mails at http://%s:%d\n", s.Config.Mail.Host, 8025)
 }
 
 func (s *Server) listenForMail() {
@@ -134,8 +139,16 @@ func (s *Server) listenForAsyncJobErrors() {
 
 func (s *Server) listenForShutdown() {
 	quit := make(chan os.Signal, 1) // create a channel to receive signals
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit // block until a signal is received
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range quit { // block until a signal is received
+		if sig != syscall.SIGHUP {
+			break
+		}
+		// reload what can be without a restart, and keep serving
+		_, _, _ = s.reloadConfig(func() (*Config, error) {
+			return LoadConfig(os.Args[1:], os.Getenv)
+		})
+	}
 	s.shutdown()
 	/* WARN: Use signal.NotifyContext along with context.Context in production instead!
 		This way can be considered better than using signal.Notify with a manually created channel for several reasons:
@@ -169,8 +182,21 @@ func (s *Server) listenForShutdown() {
 	os.Exit(0)
 }
 
-func (s *Server) getInvoice(u data.User, plan *data.Plan) (string, error) {
-	return plan.PlanAmountFormatted, nil
+func (s *Server) getInvoice(u data.User, sub *data.Subscription) (string, error) {
+	amountDue := data.FormatAmount(sub.AmountDue(), sub.Currency, u.Locale)
+	if sub.Seats > 1 {
+		amountDue = fmt.Sprintf("%s for %d seats at %s each",
+			amountDue, sub.Seats, data.FormatAmount(sub.Amount, sub.Currency, u.Locale))
+	}
+	if !sub.HasDiscount() {
+		return amountDue, nil
+	}
+
+	return fmt.Sprintf("%s (%s less a discount of %s)",
+		amountDue,
+		data.FormatAmount(sub.Total(), sub.Currency, u.Locale),
+		data.FormatAmount(sub.DiscountAmount, sub.Currency, u.Locale),
+	), nil
 }
 
 func (s *Server) generateManual(u data.User, plan *data.Plan) *gofpdf.Fpdf {
@@ -183,7 +209,7 @@ func (s *Server) generateManual(u data.User, plan *data.Plan) *gofpdf.Fpdf {
 
 	time.Sleep(5 * time.Second) // simulate a long time to create a PDF
 
-	tmplID := importer.ImportPage(pdf, ManualTmplPath, 1, "/MediaBox") // import page 1 of the manual.pdf
+	tmplID := importer.ImportPage(pdf, s.Config.Templates.Manual, 1, "/MediaBox") // import page 1 of the manual.pdf
 	pdf.AddPage()
 
 	importer.UseImportedTemplate(pdf, tmplID, 0, 0, 215.9, 0) // x, y, width, height
@@ -206,6 +232,10 @@ func (s *Server) shutdown() {
 	// perform any cleanup tasks
 	s.InfoLog.Println("would run cleanup tasks...")
 
+	// stop billing before the mailer, because billing sends mails
+	s.StopBilling <- true
+	s.StopAccountDeletion <- true // it sends mails too
+
 	// stop accepting mails
 	s.InfoLog.Println("stopping accepting new message to send...")
 	s.Mailer.stopAcceptingMessage()
@@ -225,6 +255,8 @@ func (s *Server) shutdown() {
 
 	close(s.AsyncErr)
 	close(s.StopAsync)
+	close(s.StopBilling)
+	close(s.StopAccountDeletion)
 
 	s.InfoLog.Println("shutting down application...")
 }
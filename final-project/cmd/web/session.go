@@ -3,8 +3,6 @@ package main
 import (
 	"encoding/gob"
 	"net/http"
-	"os"
-	"time"
 
 	"github.com/MatsuoTakuro/final-project/data"
 	"github.com/alexedwards/scs/redisstore"
@@ -12,13 +10,13 @@ import (
 	"github.com/gomodule/redigo/redis"
 )
 
-func initSession() *scs.SessionManager {
+func initSession(redisPool *redis.Pool, cfg SessionConfig) *scs.SessionManager {
 	// WARN: need to register the User struct for session to work because it's a custom type
 	gob.Register(data.User{}) // TODO: check if it's really necessary to initialize the redis every time new custom type is added or edited to data.
 
 	session := scs.New()
-	session.Store = redisstore.New(initRedis())    // set redis as the session store
-	session.Lifetime = 24 * time.Hour              // set the session lifetime to 24 hours
+	session.Store = redisstore.New(redisPool)      // set redis as the session store
+	session.Lifetime = cfg.Lifetime                // set how long the session lasts, 24 hours by default
 	session.Cookie.Persist = true                  // set the session cookie to persist across browser sessions, even if the browser is closed
 	session.Cookie.SameSite = http.SameSiteLaxMode // set the session cookie to be sent for same-site requests
 	/*
@@ -48,16 +46,16 @@ func initSession() *scs.SessionManager {
 		Conversely, for a banking application where strict isolation is required, SameSite=Strict would be more appropriate.
 		In the context of the code snippet you provided, setting SameSite to http.SameSiteLaxMode ensures that the session cookie adheres to the Lax behavior, providing a good balance between security and usability for most web applications.
 	*/
-	session.Cookie.Secure = true // set the session cookie to be sent only over HTTPS connections
+	session.Cookie.Secure = cfg.SecureCookie // set the session cookie to be sent only over HTTPS connections
 
 	return session
 }
 
-func initRedis() *redis.Pool {
+func initRedis(cfg RedisConfig) *redis.Pool {
 	redisPool := &redis.Pool{
 		MaxIdle: 10, // maximum number of idle connections in the pool
 		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", os.Getenv("REDIS"))
+			return redis.Dial("tcp", cfg.Address)
 		},
 	}
 
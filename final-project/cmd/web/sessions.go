@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+// XXX_PAGE is the name of the template gohtml file to render for the page
+const (
+	SESSIONS_PAGE = "sessions.page.gohtml"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	SESSION_REVOKED_MSG          = "The session has been signed out."
+	OTHER_SESSIONS_REVOKED_MSG   = "All your other sessions have been signed out."
+	REVOKE_CURRENT_SESSION_MSG   = "This is the session you're using. Log out instead."
+	UNKNOWN_SESSION_MSG          = "The session has already been signed out."
+	UNSUCCESSFUL_REVOKE_MSG      = "Unable to sign out the session."
+	SESSIONS_LIMITED_MSG         = "Your plan allows %d active sessions, so your oldest sessions have been signed out."
+	ERROR_RECORD_SESSION_MSG     = "error recording session of user %d: %w"
+	ERROR_GET_SESSIONS_MSG       = "error getting sessions of user %d: %w"
+	ERROR_REVOKE_SESSION_MSG     = "error revoking session of user %d: %w"
+	ERROR_GENERATE_SESSION_MSG   = "error generating session id: %w"
+	ERROR_DESTROY_SESSION_MSG    = "error destroying session: %w"
+	ERROR_DELETE_SESSION_MSG     = "error deleting session data: %w"
+	ERROR_UNREGISTER_SESSION_MSG = "error unregistering session: %w"
+)
+
+// XXX_ATTR is an attribute or element's name embedded in html.
+const (
+	SESSIONS_ATTR   = "sessions"
+	SESSION_ID_ATTR = "session-id"
+)
+
+// recordSession records the session the user has just logged in with, along with where from
+func (s *Server) recordSession(r *http.Request, userID int) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GENERATE_SESSION_MSG, err))
+		return
+	}
+
+	sess := ActiveSession{
+		ID:        hex.EncodeToString(b),
+		Token:     s.Session.Token(r.Context()),
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		CreatedAt: time.Now(),
+		ExpiresAt: s.Session.Deadline(r.Context()),
+	}
+	if err := s.Sessions.Add(userID, sess); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_RECORD_SESSION_MSG, userID, err))
+		return
+	}
+
+	s.Session.Put(r.Context(), SESSION_ID_CTX, sess.ID)
+}
+
+// limitSessions signs out the oldest sessions of the user beyond the number their plan allows, keeping
+// the current one. A limit of 0, as when the user has no plan, leaves them all.
+func (s *Server) limitSessions(r *http.Request, user data.User) {
+	limit, err := s.Models.Entitlement.Limit(user, data.MaxSessions)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_CHECK_ENTITLEMENT_MSG, err))
+		return
+	}
+	if limit <= 0 {
+		return
+	}
+
+	sessions, err := s.Sessions.List(user.ID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SESSIONS_MSG, user.ID, err))
+		return
+	}
+	if len(sessions) <= limit {
+		return
+	}
+
+	// the sessions are newest first, and the current one is the newest
+	var oldest []string
+	for _, sess := range sessions[limit:] {
+		oldest = append(oldest, sess.ID)
+	}
+	if err := s.revokeSessions(r, user.ID, true, oldest...); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_REVOKE_SESSION_MSG, user.ID, err))
+		return
+	}
+	s.Session.Put(r.Context(), WARNING_CTX, fmt.Sprintf(SESSIONS_LIMITED_MSG, limit))
+}
+
+// renewToken renews the token of the session, as when who is logged in with it changes, and records the new
+// token in the registry, so that the session can still be signed out. The session is registered to the user.
+func (s *Server) renewToken(r *http.Request, userID int) {
+	if err := s.Session.RenewToken(r.Context()); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_RENEW_TOKEN_MSG, err))
+		return
+	}
+
+	id := s.Session.GetString(r.Context(), SESSION_ID_CTX)
+	if id == "" {
+		return
+	}
+
+	sessions, err := s.Sessions.List(userID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SESSIONS_MSG, userID, err))
+		return
+	}
+	for _, sess := range sessions {
+		if sess.ID != id {
+			continue
+		}
+		sess.Token = s.Session.Token(r.Context())
+		if err := s.Sessions.Add(userID, sess); err != nil {
+			s.ErrorLog.Println(fmt.Errorf(ERROR_RECORD_SESSION_MSG, userID, err))
+		}
+		return
+	}
+}
+
+// revokeSessions signs out the sessions of the user, by deleting their data from the session store.
+// The current session is kept when keepCurrent is true, or destroyed otherwise if it's one of them.
+func (s *Server) revokeSessions(r *http.Request, userID int, keepCurrent bool, ids ...string) error {
+	sessions, err := s.Sessions.List(userID)
+	if err != nil {
+		return err
+	}
+
+	only := make(map[string]bool)
+	for _, id := range ids {
+		only[id] = true
+	}
+
+	current := s.Session.GetString(r.Context(), SESSION_ID_CTX)
+	var revoked []string
+	for _, sess := range sessions {
+		if len(ids) > 0 && !only[sess.ID] {
+			continue
+		}
+
+		if sess.ID == current {
+			if keepCurrent {
+				continue
+			}
+			// the data of the current session would be saved again at the end of the request
+			if err := s.Session.Destroy(r.Context()); err != nil {
+				return fmt.Errorf(ERROR_DESTROY_SESSION_MSG, err)
+			}
+		} else if err := s.Session.Store.Delete(sess.Token); err != nil {
+			return fmt.Errorf(ERROR_DELETE_SESSION_MSG, err)
+		}
+		revoked = append(revoked, sess.ID)
+	}
+
+	return s.Sessions.Remove(userID, revoked...)
+}
+
+func (s *Server) SessionsPage(w http.ResponseWriter, r *http.Request) {
+	userID := s.Session.GetInt(r.Context(), USER_ID_CTX)
+
+	sessions, err := s.Sessions.List(userID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SESSIONS_MSG, userID, err))
+	}
+
+	dataMap := make(map[string]any)
+	dataMap[SESSIONS_ATTR] = sessions
+
+	s.render(w, r, SESSIONS_PAGE, &TemplateData{
+		StringMap: map[string]string{
+			SESSION_ID_ATTR: s.Session.GetString(r.Context(), SESSION_ID_CTX),
+		},
+		Data: dataMap,
+	})
+}
+
+// RevokeSession signs out one of the other sessions of the user
+func (s *Server) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	userID := s.Session.GetInt(r.Context(), USER_ID_CTX)
+	id := r.Form.Get(SESSION_ID_ATTR)
+	if id == s.Session.GetString(r.Context(), SESSION_ID_CTX) {
+		s.Session.Put(r.Context(), ERROR_CTX, REVOKE_CURRENT_SESSION_MSG)
+		http.Redirect(w, r, MembersSessionsPath, http.StatusSeeOther)
+		return
+	}
+
+	sessions, err := s.Sessions.List(userID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_SESSIONS_MSG, userID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_REVOKE_MSG)
+		http.Redirect(w, r, MembersSessionsPath, http.StatusSeeOther)
+		return
+	}
+
+	found := false
+	for _, sess := range sessions {
+		found = found || sess.ID == id
+	}
+	if !found {
+		s.Session.Put(r.Context(), ERROR_CTX, UNKNOWN_SESSION_MSG)
+		http.Redirect(w, r, MembersSessionsPath, http.StatusSeeOther)
+		return
+	}
+
+	if err := s.revokeSessions(r, userID, true, id); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_REVOKE_SESSION_MSG, userID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_REVOKE_MSG)
+		http.Redirect(w, r, MembersSessionsPath, http.StatusSeeOther)
+		return
+	}
+
+	s.Session.Put(r.Context(), FLASH_CTX, SESSION_REVOKED_MSG)
+	http.Redirect(w, r, MembersSessionsPath, http.StatusSeeOther)
+}
+
+// RevokeOtherSessions signs out all the sessions of the user but the current one
+func (s *Server) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID := s.Session.GetInt(r.Context(), USER_ID_CTX)
+
+	if err := s.revokeSessions(r, userID, true); err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_REVOKE_SESSION_MSG, userID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_REVOKE_MSG)
+		http.Redirect(w, r, MembersSessionsPath, http.StatusSeeOther)
+		return
+	}
+
+	s.Session.Put(r.Context(), FLASH_CTX, OTHER_SESSIONS_REVOKED_MSG)
+	http.Redirect(w, r, MembersSessionsPath, http.StatusSeeOther)
+}
+
+// deviceName returns a short description of the browser and the system of the user agent,
+// such as "Firefox on Windows"
+func deviceName(userAgent string) string {
+	var browser string
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	default:
+		browser = "Unknown browser"
+	}
+
+	var system string
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		system = "Android"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		system = "iOS"
+	case strings.Contains(userAgent, "Windows"):
+		system = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		system = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		system = "Linux"
+	default:
+		return browser
+	}
+
+	return browser + " on " + system
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+func Test_deviceName(t *testing.T) {
+	tests := map[string]struct {
+		userAgent string
+		want      string
+	}{
+		"chrome on windows": {
+			userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36",
+			want:      "Chrome on Windows",
+		},
+		"safari on ios": {
+			userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1",
+			want:      "Safari on iOS",
+		},
+		"edge on macos": {
+			userAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36 Edg/118.0.2088.46",
+			want:      "Edge on macOS",
+		},
+		"firefox on linux": {
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/118.0",
+			want:      "Firefox on Linux",
+		},
+		"unknown": {
+			userAgent: "curl/8.4.0",
+			want:      "Unknown browser",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := deviceName(tt.userAgent); got != tt.want {
+				t.Errorf("expected %q; got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// addTestSession records a session of the user whose data is in the session store
+func addTestSession(t *testing.T, userID int, id string) ActiveSession {
+	sess := ActiveSession{
+		ID:        id,
+		Token:     "token-" + id,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	if err := testServer.Session.Store.Commit(sess.Token, []byte("data"), sess.ExpiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := testServer.Sessions.Add(userID, sess); err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+// sessionExists reports whether the data of the session is still in the session store
+func sessionExists(t *testing.T, sess ActiveSession) bool {
+	_, found, err := testServer.Session.Store.Find(sess.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func Test_RevokeSessions(t *testing.T) {
+	userID := 101
+	current := addTestSession(t, userID, "current")
+	other := addTestSession(t, userID, "other")
+	another := addTestSession(t, userID, "another")
+	expired := ActiveSession{ID: "expired", CreatedAt: time.Now().Add(-2 * time.Hour), ExpiresAt: time.Now().Add(-time.Hour)}
+	if err := testServer.Sessions.Add(userID, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := testServer.Sessions.List(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 3 || sessions[0].ID != another.ID {
+		t.Errorf("expected 3 sessions, newest first; got %v", sessions)
+	}
+
+	newRequest := func(path string, body url.Values) *http.Request {
+		rawReq, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(body.Encode()))
+		rawReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r := newReqWithSession(rawReq)
+		testServer.Session.Put(r.Context(), USER_ID_CTX, userID)
+		testServer.Session.Put(r.Context(), SESSION_ID_CTX, current.ID)
+		return r
+	}
+
+	r := newRequest(MembersSessionsRevokePath, url.Values{SESSION_ID_ATTR: {other.ID}})
+	testServer.RevokeSession(httptest.NewRecorder(), r)
+	if msg := testServer.Session.GetString(r.Context(), FLASH_CTX); msg != SESSION_REVOKED_MSG {
+		t.Errorf("expected flash message %q; got %q", SESSION_REVOKED_MSG, msg)
+	}
+	if sessionExists(t, other) {
+		t.Error("expected the revoked session to be deleted")
+	}
+	if !sessionExists(t, another) || !sessionExists(t, current) {
+		t.Error("expected the other sessions to be kept")
+	}
+
+	r = newRequest(MembersSessionsRevokePath, url.Values{SESSION_ID_ATTR: {other.ID}})
+	testServer.RevokeSession(httptest.NewRecorder(), r)
+	if msg := testServer.Session.GetString(r.Context(), ERROR_CTX); msg != UNKNOWN_SESSION_MSG {
+		t.Errorf("expected error message %q; got %q", UNKNOWN_SESSION_MSG, msg)
+	}
+
+	r = newRequest(MembersSessionsOthersPath, nil)
+	testServer.RevokeOtherSessions(httptest.NewRecorder(), r)
+	if msg := testServer.Session.GetString(r.Context(), FLASH_CTX); msg != OTHER_SESSIONS_REVOKED_MSG {
+		t.Errorf("expected flash message %q; got %q", OTHER_SESSIONS_REVOKED_MSG, msg)
+	}
+	if sessionExists(t, another) {
+		t.Error("expected the other session to be deleted")
+	}
+	if !sessionExists(t, current) {
+		t.Error("expected the current session to be kept")
+	}
+
+	sessions, _ = testServer.Sessions.List(userID)
+	if len(sessions) != 1 || sessions[0].ID != current.ID {
+		t.Errorf("expected only the current session to be left; got %v", sessions)
+	}
+}
+
+func Test_ResetPassword_RevokesSessions(t *testing.T) {
+	sess := addTestSession(t, 1, "before-reset")
+
+	body := url.Values{PASSWORD_ATTR: {"new password 1"}, VERIFY_PASSWORD_ATTR: {"new password 1"}}
+	link := resetPasswordLink(storedUser("admin@example.com"))
+	rawReq, _ := http.NewRequest(http.MethodPost, link, strings.NewReader(body.Encode()))
+	rawReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r := newReqWithSession(rawReq)
+
+	testServer.ResetPassword(httptest.NewRecorder(), r)
+
+	if msg := testServer.Session.GetString(r.Context(), FLASH_CTX); msg != PASSWORD_RESET_MSG {
+		t.Fatalf("expected flash message %q; got %q", PASSWORD_RESET_MSG, msg)
+	}
+	if sessionExists(t, sess) {
+		t.Error("expected the sessions of the user to be signed out")
+	}
+	if sessions, _ := testServer.Sessions.List(1); len(sessions) != 0 {
+		t.Errorf("expected no session left; got %v", sessions)
+	}
+}
+
+func Test_RevokeSessions_AfterImpersonation(t *testing.T) {
+	adminID := 102
+	admin := data.User{ID: adminID, Email: "support@example.com", Role: data.RoleAdmin}
+
+	// the session of the admin, saved at the end of every request as the session middleware does
+	rawReq, _ := http.NewRequest(http.MethodPost, "/", nil)
+	ctx := newReqWithSession(rawReq).Context()
+	request := func(body url.Values) *http.Request {
+		rawReq, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(body.Encode()))
+		rawReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return rawReq.WithContext(ctx)
+	}
+	commit := func() string {
+		token, _, err := testServer.Session.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	r := request(nil)
+	if err := testServer.Session.RenewToken(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testServer.Session.Put(ctx, USER_ID_CTX, adminID)
+	testServer.Session.Put(ctx, USER_CTX, admin)
+	testServer.recordSession(r, adminID)
+	commit()
+
+	testServer.AdminImpersonateUser(httptest.NewRecorder(), request(url.Values{MEMBER_ID_ATTR: {"2"}}))
+	commit()
+	testServer.StopImpersonating(httptest.NewRecorder(), request(nil))
+	token := commit()
+
+	// the admin is then deactivated, say, from the session of another admin
+	rawReq, _ = http.NewRequest(http.MethodPost, "/", nil)
+	if err := testServer.revokeSessions(newReqWithSession(rawReq), adminID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if sessionExists(t, ActiveSession{Token: token}) {
+		t.Error("expected the session the admin has impersonated with to be signed out")
+	}
+	if sessions, _ := testServer.Sessions.List(adminID); len(sessions) != 0 {
+		t.Errorf("expected no session left; got %v", sessions)
+	}
+}
+
+func Test_Logout_WhileImpersonating(t *testing.T) {
+	adminID := 106
+	admin := data.User{ID: adminID, Email: "support2@example.com", Role: data.RoleAdmin}
+
+	rawReq, _ := http.NewRequest(http.MethodPost, "/", nil)
+	ctx := newReqWithSession(rawReq).Context()
+	request := func(body url.Values) *http.Request {
+		rawReq, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(body.Encode()))
+		rawReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return rawReq.WithContext(ctx)
+	}
+
+	testServer.Session.Put(ctx, USER_ID_CTX, adminID)
+	testServer.Session.Put(ctx, USER_CTX, admin)
+	testServer.recordSession(request(nil), adminID)
+	testServer.AdminImpersonateUser(httptest.NewRecorder(), request(url.Values{MEMBER_ID_ATTR: {"2"}}))
+	if id := testServer.Session.GetInt(ctx, IMPERSONATOR_ID_CTX); id != adminID {
+		t.Fatalf("expected the admin to be impersonating; got impersonator %d", id)
+	}
+
+	testServer.Logout(httptest.NewRecorder(), request(nil))
+
+	if sessions, _ := testServer.Sessions.List(adminID); len(sessions) != 0 {
+		t.Errorf("expected the session to be forgotten; got %v", sessions)
+	}
+}
+
+func Test_logIn_MaxSessions(t *testing.T) {
+	tests := map[string]struct {
+		userID          int
+		limit           int
+		expectedLeft    int
+		expectedWarning string
+	}{
+		"over the limit":   {103, 1, 1, fmt.Sprintf(SESSIONS_LIMITED_MSG, 1)},
+		"within the limit": {104, 3, 3, ""},
+		"no limit":         {105, 0, 3, ""},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			user := data.User{ID: tt.userID, Email: fmt.Sprintf("sessions%d@example.com", tt.userID), IsActive: data.Active}
+			plan := data.Plan{ID: 1, PlanName: "Bronze Plan", Limits: map[data.LimitKey]int{data.MaxSessions: tt.limit}}
+			if _, err := testServer.Models.Plan.SubscribeUserToPlan(user, plan, nil); err != nil {
+				t.Fatal(err)
+			}
+			older := addTestSession(t, tt.userID, "older")
+			old := addTestSession(t, tt.userID, "old")
+
+			rawReq, _ := http.NewRequest(http.MethodPost, LOGIN_PATH, nil)
+			r := newReqWithSession(rawReq)
+			testServer.logIn(r, &user)
+
+			sessions, _ := testServer.Sessions.List(tt.userID)
+			if len(sessions) != tt.expectedLeft || sessions[0].ID != testServer.Session.GetString(r.Context(), SESSION_ID_CTX) {
+				t.Errorf("expected %d sessions left, the new one first; got %v", tt.expectedLeft, sessions)
+			}
+			if kept := tt.expectedLeft > 1; sessionExists(t, older) != kept || sessionExists(t, old) != kept {
+				t.Errorf("expected the older sessions to be kept %t", kept)
+			}
+			if msg := testServer.Session.GetString(r.Context(), WARNING_CTX); msg != tt.expectedWarning {
+				t.Errorf("expected warning %q; got %q", tt.expectedWarning, msg)
+			}
+		})
+	}
+}
@@ -16,23 +16,55 @@ import (
 
 var testServer Server
 
+// apiSpecViolations collects the exchanges with the api which don't match its spec, any of which fails the tests
+var apiSpecViolations struct {
+	sync.Mutex
+	errs []error
+}
+
+func recordAPISpecViolation(err error) {
+	apiSpecViolations.Lock()
+	defer apiSpecViolations.Unlock()
+	apiSpecViolations.errs = append(apiSpecViolations.errs, err)
+}
+
 func TestMain(m *testing.M) {
 	gob.Register(data.User{})
 
+	keyring, err := ParseKeyring("test:abc123abc123abc123")
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	testSession := scs.New()
 	testSession.Lifetime = 24 * time.Hour
 	testSession.Cookie.Persist = true
 	testSession.Cookie.SameSite = http.SameSiteLaxMode
 	testSession.Cookie.Secure = true
 
+	// the defaults, but for the paths, which are relative to this directory
+	testConfig := DefaultConfig()
+	testConfig.Templates.HTML = "./templates"
+	testConfig.Templates.Email = "./templates"
+	testConfig.Templates.Manual = "./../../pdf/manual.pdf"
+
 	testServer = Server{
-		Session:   testSession,
-		InfoLog:   log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime),
-		ErrorLog:  log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile),
-		AsyncJob:  &sync.WaitGroup{},
-		Models:    data.TestNew(nil),
-		AsyncErr:  make(chan error),
-		StopAsync: make(chan bool),
+		Config:      testConfig,
+		Session:     testSession,
+		InfoLog:     log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime),
+		ErrorLog:    log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile),
+		AsyncJob:    &sync.WaitGroup{},
+		Models:      data.TestNew(nil),
+		AsyncErr:    make(chan error),
+		StopAsync:   make(chan bool),
+		StopBilling: make(chan bool),
+		Throttle:    NewLoginThrottle(NewMemoryThrottleStore()),
+		Sessions:    NewMemorySessionRegistry(),
+		Keyring:     keyring,
+		Features:    NewFeatureFlags(testConfig.Features),
+
+		StopAccountDeletion: make(chan bool),
+		APISpecViolation:    recordAPISpecViolation,
 	}
 
 	// create a dummy mailer
@@ -80,7 +112,13 @@ func TestMain(m *testing.M) {
 		}
 	}()
 
-	os.Exit(m.Run())
+	code := m.Run()
+	for _, err := range apiSpecViolations.errs {
+		fmt.Println("FAIL: api spec violation:", err)
+		code = 1
+	}
+
+	os.Exit(code)
 }
 
 // newReqWithSession return a request with loaded session in the context
@@ -1,32 +1,124 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/MatsuoTakuro/final-project/data"
 	goalone "github.com/bwmarrin/go-alone"
 )
 
-// NOTE: of course, originally, this should be in an environment variable or config file.
-const SECRET = "abc123abc123abc123"
+// SIGNING_KEYS_ENV is the environment variable holding the keyring, as comma separated
+// "id:secret" pairs, newest first. To rotate, put a new key in front; tokens signed with
+// the older keys stay valid until those keys are removed, i.e. retired.
+const SIGNING_KEYS_ENV = "SIGNING_KEYS"
 
-var secretKey []byte
+const MIN_SECRET_LENGTH = 16
 
-// NewURLSigner creates a new signer
-func NewURLSigner() {
-	secretKey = []byte(SECRET)
+// SigningKey is one key of the keyring. Its ID is embedded in the tokens it signs.
+type SigningKey struct {
+	ID     string
+	Secret []byte
 }
 
-// GenerateTokenFromString generates a signed token
-func GenerateTokenFromString(data string) string {
+// Keyring holds the active signing keys, newest first
+type Keyring struct {
+	keys []SigningKey
+}
+
+// ParseKeyring parses a keyring from comma separated "id:secret" pairs, newest first
+func ParseKeyring(config string) (*Keyring, error) {
+	var k Keyring
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("signing key %q is not in the form id:secret", entry)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("signing key id %q is used more than once", id)
+		}
+		if len(secret) < MIN_SECRET_LENGTH {
+			return nil, fmt.Errorf("signing key %q must be at least %d characters long", id, MIN_SECRET_LENGTH)
+		}
+
+		seen[id] = true
+		k.keys = append(k.keys, SigningKey{ID: id, Secret: []byte(secret)})
+	}
+
+	if len(k.keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+
+	return &k, nil
+}
+
+// Newest returns the key new tokens are signed with
+func (k *Keyring) Newest() SigningKey {
+	return k.keys[0]
+}
+
+// Get returns the active key with the id, if any
+func (k *Keyring) Get(id string) (SigningKey, bool) {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+// TokenPurpose is what a signed token may be used for. A token signed for one purpose
+// is rejected for any other.
+type TokenPurpose string
+
+const (
+	ACTIVATE_PURPOSE TokenPurpose = "activate"
+	RESET_PURPOSE    TokenPurpose = "reset"
+	INVITE_PURPOSE   TokenPurpose = "invite"
+	DOWNLOAD_PURPOSE TokenPurpose = "download"
+	UNLOCK_PURPOSE   TokenPurpose = "unlock"
+
+	EMAIL_CHANGE_PURPOSE TokenPurpose = "email-change"
+)
+
+// XXX_PARAM is a query parameter added to a url when it's signed.
+const (
+	PURPOSE_PARAM = "purpose"
+	MAX_AGE_PARAM = "max-age" // in seconds
+	NONCE_PARAM   = "nonce"
+	KEY_ID_PARAM  = "kid"
+)
+
+var (
+	ErrTokenTampered = errors.New("token is invalid")
+	ErrTokenPurpose  = errors.New("token was signed for another purpose")
+	ErrTokenExpired  = errors.New("token has expired")
+)
+
+// GenerateTokenFromString generates a signed token with the newest key, whose id it embeds
+func (k *Keyring) GenerateTokenFromString(data string) string {
 	var urlToSign string
 
-	s := goalone.New(secretKey, goalone.Timestamp)
+	key := k.Newest()
+	s := goalone.New(key.Secret, goalone.Timestamp)
 	if strings.Contains(data, "?") {
-		urlToSign = fmt.Sprintf("%s&hash=", data)
+		urlToSign = fmt.Sprintf("%s&%s=%s&hash=", data, KEY_ID_PARAM, url.QueryEscape(key.ID))
 	} else {
-		urlToSign = fmt.Sprintf("%s?hash=", data)
+		urlToSign = fmt.Sprintf("%s?%s=%s&hash=", data, KEY_ID_PARAM, url.QueryEscape(key.ID))
 	}
 
 	tokenBytes := s.Sign([]byte(urlToSign))
@@ -36,9 +128,12 @@ func GenerateTokenFromString(data string) string {
 }
 
 // VerifyToken verifies a signed token
-func VerifyToken(token string) bool {
-	s := goalone.New(secretKey, goalone.Timestamp)
-	_, err := s.Unsign([]byte(token)) // validate a signature (token)
+func (k *Keyring) VerifyToken(token string) bool {
+	s, err := k.signerFor(token)
+	if err != nil {
+		return false
+	}
+	_, err = s.Unsign([]byte(token)) // validate a signature (token)
 
 	return err == nil
 	// if return value is false, it means signature is not valid. Token was tampered with, forged,
@@ -47,10 +142,138 @@ func VerifyToken(token string) bool {
 }
 
 // Expired checks to see if a token has expired
-func Expired(token string, minutesUntilExpire int) bool {
-	s := goalone.New(secretKey, goalone.Timestamp)
+func (k *Keyring) Expired(token string, minutesUntilExpire int) bool {
+	s := goalone.New(k.Newest().Secret, goalone.Timestamp) // parsing doesn't depend on the key
 	ts := s.Parse([]byte(token))
 
 	// time.Duration(seconds)*time.Second
 	return time.Since(ts.Timestamp) > time.Duration(minutesUntilExpire)*time.Minute
 }
+
+// signerFor returns a signer with the key the token was signed with, if that key is still active
+func (k *Keyring) signerFor(token string) (*goalone.Sword, error) {
+	u, err := url.Parse(token)
+	if err != nil {
+		return nil, ErrTokenTampered
+	}
+
+	key, ok := k.Get(u.Query().Get(KEY_ID_PARAM))
+	if !ok {
+		return nil, ErrTokenTampered
+	}
+
+	return goalone.New(key.Secret, goalone.Timestamp), nil
+}
+
+// VerifyTokenFor verifies a signed token and checks that it was signed for the purpose
+// and is younger than the max age it was signed with. It returns the query of the signed url.
+func (k *Keyring) VerifyTokenFor(token string, purpose TokenPurpose) (url.Values, error) {
+	s, err := k.signerFor(token)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.Unsign([]byte(token)); err != nil {
+		return nil, ErrTokenTampered
+	}
+
+	u, err := url.Parse(token)
+	if err != nil {
+		return nil, ErrTokenTampered
+	}
+	q := u.Query()
+
+	if TokenPurpose(q.Get(PURPOSE_PARAM)) != purpose {
+		return nil, ErrTokenPurpose
+	}
+
+	maxAge, err := strconv.Atoi(q.Get(MAX_AGE_PARAM))
+	if err != nil {
+		return nil, ErrTokenTampered
+	}
+
+	ts := s.Parse([]byte(token))
+	if time.Since(ts.Timestamp) > time.Duration(maxAge)*time.Second {
+		return nil, ErrTokenExpired
+	}
+
+	return q, nil
+}
+
+// signURL signs the url so that it can be used once, for the purpose and within maxAge.
+// The nonce of the token is recorded so that it can be consumed later.
+func (s *Server) signURL(u *url.URL, purpose TokenPurpose, maxAge time.Duration) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	token := data.Token{
+		Nonce:     hex.EncodeToString(nonce),
+		Purpose:   string(purpose),
+		ExpiresAt: time.Now().Add(maxAge),
+	}
+	if err := s.Models.Token.Insert(token); err != nil {
+		return "", err
+	}
+
+	signed := *u
+	q := signed.Query()
+	q.Set(PURPOSE_PARAM, string(purpose))
+	q.Set(MAX_AGE_PARAM, strconv.Itoa(int(maxAge.Seconds())))
+	q.Set(NONCE_PARAM, token.Nonce)
+	signed.RawQuery = q.Encode()
+
+	return s.Keyring.GenerateTokenFromString(signed.String()), nil
+}
+
+// verifySignedURL checks that the request was made with a url signed for the purpose
+// which hasn't expired, without consuming it, and returns the query of the url
+func (s *Server) verifySignedURL(r *http.Request, purpose TokenPurpose) (url.Values, error) {
+	gotURL := &url.URL{
+		Scheme:   "http",
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+
+	return s.Keyring.VerifyTokenFor(gotURL.String(), purpose)
+}
+
+// consumeSignedURL is like verifySignedURL, but also consumes the url, so that it can't be used again.
+// It returns data.ErrTokenUsed if it has been used already.
+func (s *Server) consumeSignedURL(r *http.Request, purpose TokenPurpose) (url.Values, error) {
+	q, err := s.verifySignedURL(r, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Models.Token.Consume(q.Get(NONCE_PARAM), string(purpose)); err != nil {
+		return nil, err
+	}
+	s.auditTokenUsed(r, purpose)
+
+	return q, nil
+}
+
+// signedToken returns the record of the token of the signed url with the query, to be consumed
+// along with what it's used for
+func signedToken(q url.Values, purpose TokenPurpose) data.Token {
+	return data.Token{Nonce: q.Get(NONCE_PARAM), Purpose: string(purpose)}
+}
+
+// auditTokenUsed records the use of the token of a signed url for the purpose
+func (s *Server) auditTokenUsed(r *http.Request, purpose TokenPurpose) {
+	s.audit(r, data.TokenUsed, s.Session.GetInt(r.Context(), USER_ID_CTX), 0, change("purpose", nil, purpose))
+}
+
+// tokenErrorMessage returns the message to display to the user when a signed url can't be used
+func tokenErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		return EXPIRED_TOKEN_MSG
+	case errors.Is(err, data.ErrTokenUsed):
+		return USED_TOKEN_MSG
+	default:
+		return INVALID_TOKEN_MSG
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func Test_KeyRotation(t *testing.T) {
+	mustParse := func(config string) *Keyring {
+		k, err := ParseKeyring(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	old := mustParse("old:0ld-secret-0ld-secret")
+	token := old.GenerateTokenFromString("http://example.com/activate?email=me%40example.com")
+
+	// a new key is put in front of the old one
+	rotated := mustParse("new:n3w-secret-n3w-secret,old:0ld-secret-0ld-secret")
+	if !rotated.VerifyToken(token) {
+		t.Error("expected token signed with an older active key to be valid")
+	}
+	if newToken := rotated.GenerateTokenFromString("http://example.com/activate"); !rotated.VerifyToken(newToken) {
+		t.Error("expected token signed with the newest key to be valid")
+	}
+
+	// the old key is retired
+	retired := mustParse("new:n3w-secret-n3w-secret")
+	if retired.VerifyToken(token) {
+		t.Error("expected token signed with a retired key to be invalid")
+	}
+}
+
+func Test_ParseKeyring(t *testing.T) {
+	tests := map[string]struct {
+		config  string
+		wantErr bool
+	}{
+		"one key":         {config: "1:abc123abc123abc123", wantErr: false},
+		"two keys":        {config: "2:def456def456def456, 1:abc123abc123abc123", wantErr: false},
+		"empty":           {config: "", wantErr: true},
+		"missing id":      {config: ":abc123abc123abc123", wantErr: true},
+		"short secret":    {config: "1:abc", wantErr: true},
+		"duplicate id":    {config: "1:abc123abc123abc123,1:def456def456def456", wantErr: true},
+		"missing secrets": {config: "1", wantErr: true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseKeyring(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
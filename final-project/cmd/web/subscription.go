@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+var (
+	ErrPlanNotFound  = errors.New("plan not found")
+	ErrTeamPlanOnly  = errors.New("plan is seat based, and only organizations subscribe to it")
+	ErrUnknownCoupon = errors.New("coupon not found")
+)
+
+// subscribeUser subscribes the user to the plan, with the coupon if the code isn't empty, in the currency they prefer.
+// The first interval is charged and the manual is sent, if the plan includes it and it isn't switched off,
+// in the background.
+// Both the plans page and the api subscribe users this way.
+func (s *Server) subscribeUser(r *http.Request, user data.User, planID int, code string) (*data.Subscription, error) {
+	plan, err := s.Models.Plan.GetOne(planID)
+	if err != nil {
+		return nil, ErrPlanNotFound
+	}
+
+	// seat based plans are paid for by organizations
+	if plan.SeatBased {
+		return nil, ErrTeamPlanOnly
+	}
+
+	// charge the user in the currency they prefer, if the plan is priced in it
+	plan.Localize(user.Currency, user.Locale)
+
+	// apply a coupon, if the user entered one
+	var coupon *data.Coupon
+	if code != "" {
+		coupon, err = s.Models.Coupon.GetByCode(code)
+		if err != nil {
+			return nil, ErrUnknownCoupon
+		}
+
+		if err := coupon.Validate(*plan, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	// subscribe the user to a plan
+	sub, err := s.Models.Plan.SubscribeUserToPlan(user, *plan, coupon)
+	if err != nil {
+		return nil, err
+	}
+	s.audit(r, data.PlanChanged, user.ID, user.ID, change("plan", planName(user.Plan), plan.PlanName))
+
+	if sub.InTrial(time.Now()) {
+		// nothing is charged until the trial ends, so just tell the user when the first charge is
+		msg := Message{
+			To:      user.Email,
+			Subject: "Your free trial has started",
+			Data: fmt.Sprintf("Your %d-day free trial of the %s has started. Your first charge of %s is on %s.",
+				plan.TrialDays, plan.PlanName, data.FormatAmount(sub.AmountDue(), sub.Currency, user.Locale),
+				sub.NextChargeAt.Format(CHARGE_DATE_LAYOUT)),
+		}
+		s.sendEmail(msg)
+	} else {
+		// charge the first interval, generate an invoice and email it
+		s.AsyncJob.Add(1) // increment counter every time a new invoice is generated
+		go func() {
+			defer s.AsyncJob.Done() // decrement counter every time an invoice is generated and passed to the mailer to send
+
+			s.chargeSubscription(*sub)
+		}()
+	}
+
+	// generate a manual, only for plans that include it, and unless it has been switched off for everyone
+	if plan.HasFeature(data.UserManual) && s.Features.Enabled(data.UserManual) {
+		s.AsyncJob.Add(1) // increment counter every time a new manual is generated
+		go func() {
+			defer s.AsyncJob.Done() // decrement counter every time a manual is generated and passed to the mailer to send
+
+			pdf := s.generateManual(user, plan)
+			filePath := fmt.Sprintf(ManualOutputTempPath, user.ID)
+			err := pdf.OutputFileAndClose(filePath)
+			if err != nil {
+				s.AsyncErr <- err
+				return
+			}
+
+			msg := Message{
+				To:      user.Email,
+				Subject: "Your manual",
+				Data:    "Your user manual is attached",
+				Attachments: []*mail.File{
+					{
+						Name:     MANUAL_ATTCH_NAME,
+						FilePath: filePath,
+					},
+				},
+			}
+
+			s.sendEmail(msg)
+		}()
+	}
+
+	return sub, nil
+}
+
+// cancelSubscription ends the own subscription of the user at once. It returns sql.ErrNoRows
+// if they have none.
+func (s *Server) cancelSubscription(r *http.Request, user data.User) error {
+	if err := s.Models.Subscription.CancelByUserID(user.ID); err != nil {
+		return err
+	}
+	s.audit(r, data.PlanChanged, user.ID, user.ID, change("plan", planName(user.Plan), nil))
+
+	return nil
+}
+
+// subscribeErrorMessage returns the message to display to the user when they can't be subscribed
+func subscribeErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrPlanNotFound):
+		return UNSUCCESSFUL_FIND_PLAN_MSG
+	case errors.Is(err, ErrTeamPlanOnly):
+		return TEAM_PLAN_ONLY_MSG
+	case errors.Is(err, ErrUnknownCoupon),
+		errors.Is(err, data.ErrCouponExpired),
+		errors.Is(err, data.ErrCouponNotRedeemable),
+		errors.Is(err, data.ErrCouponRedeemed),
+		errors.Is(err, data.ErrCouponCurrency):
+		return couponErrorMessage(err)
+	default:
+		return UNSUCCESSFUL_SUBSCRIBE_MSG
+	}
+}
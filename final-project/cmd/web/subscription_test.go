@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+)
+
+func Test_SubscribeToPlan_OneTrial(t *testing.T) {
+	trialPlan := data.Plan{ID: 1, PlanName: "Bronze Plan", PlanAmount: 1000, TrialDays: 14}
+	otherPlan := trialPlan
+	otherPlan.ID, otherPlan.PlanName = 2, "Silver Plan"
+
+	user := data.User{ID: 42, Email: "trial@example.com"}
+	org := data.Organization{ID: 42, Name: "Trial"}
+
+	subscribe := map[string]func(plan data.Plan) (*data.Subscription, error){
+		"user": func(plan data.Plan) (*data.Subscription, error) {
+			return testServer.Models.Plan.SubscribeUserToPlan(user, plan, nil)
+		},
+		"organization": func(plan data.Plan) (*data.Subscription, error) {
+			plan.SeatBased = true
+			return testServer.Models.Plan.SubscribeOrganizationToPlan(org, user, plan)
+		},
+	}
+
+	for name, subscribe := range subscribe {
+		t.Run(name, func(t *testing.T) {
+			first, err := subscribe(trialPlan)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !first.InTrial(time.Now()) {
+				t.Fatal("expected the first subscription to start a trial")
+			}
+
+			// switching plans, even back to the first one, doesn't start another trial
+			for _, plan := range []data.Plan{otherPlan, trialPlan} {
+				sub, err := subscribe(plan)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sub.InTrial(time.Now()) || sub.TrialStartsAt.Valid {
+					t.Errorf("expected no second trial on the %s; got one ending %s", plan.PlanName, sub.TrialEndsAt.Time)
+				}
+			}
+		})
+	}
+}
+
+func Test_subscribeUser_CouponOncePerUser(t *testing.T) {
+	user := data.User{ID: 43, Email: "coupon@example.com", IsActive: data.Active}
+	rawReq, _ := http.NewRequest(http.MethodGet, SUBSCRIBE_PATH, nil)
+	r := newReqWithSession(rawReq)
+
+	if _, err := testServer.subscribeUser(r, user, 1, "welcome10"); err != nil {
+		t.Fatal(err)
+	}
+
+	// resubscribing with the same coupon doesn't discount another period
+	_, err := testServer.subscribeUser(r, user, 1, "welcome10")
+	if !errors.Is(err, data.ErrCouponRedeemed) {
+		t.Fatalf("expected %v; got %v", data.ErrCouponRedeemed, err)
+	}
+	if msg := subscribeErrorMessage(err); msg != COUPON_REDEEMED_MSG {
+		t.Errorf("expected error message %q; got %q", COUPON_REDEEMED_MSG, msg)
+	}
+
+	// but resubscribing without it does
+	if _, err := testServer.subscribeUser(r, user, 1, ""); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Failed log in attempts are counted per account and per ip over THROTTLE_WINDOW.
+// After FREE_LOGIN_FAILURES, every failure of an account makes it wait twice as long
+// before the next attempt, up to MAX_LOGIN_DELAY. After MAX_ACCOUNT_FAILURES the account,
+// and after MAX_IP_FAILURES the ip, is locked for LOCKOUT_DURATION.
+// These are the defaults of ThrottleLimits, which the configuration may change.
+const (
+	THROTTLE_WINDOW      = 15 * time.Minute
+	FREE_LOGIN_FAILURES  = 3
+	MIN_LOGIN_DELAY      = 1 * time.Second
+	MAX_LOGIN_DELAY      = 30 * time.Second
+	MAX_ACCOUNT_FAILURES = 10
+	MAX_IP_FAILURES      = 50
+	LOCKOUT_DURATION     = 15 * time.Minute
+)
+
+// XXX_KEY is the prefix of the keys the throttle stores its counters and blocks under
+const (
+	ACCOUNT_FAILURES_KEY = "login:failures:account:"
+	IP_FAILURES_KEY      = "login:failures:ip:"
+	ACCOUNT_DELAY_KEY    = "login:delay:account:"
+	ACCOUNT_LOCK_KEY     = "login:lock:account:"
+	IP_LOCK_KEY          = "login:lock:ip:"
+
+	RESEND_ACTIVATION_KEY = "activation:resend:"
+)
+
+// ThrottleStore keeps counters and blocks which expire by themselves
+type ThrottleStore interface {
+	// Incr increments the counter, which expires window after its first increment, and returns its value
+	Incr(key string, window time.Duration) (int, error)
+	// Block blocks the key for the duration
+	Block(key string, d time.Duration) error
+	// BlockedFor returns how long the key is still blocked for, or 0
+	BlockedFor(key string) (time.Duration, error)
+	// Clear removes the counters and blocks
+	Clear(keys ...string) error
+	// Blocked returns the keys with the prefix which are still blocked, and for how long
+	Blocked(prefix string) (map[string]time.Duration, error)
+}
+
+// LockedAccount is an account locked after too many failed log in attempts
+type LockedAccount struct {
+	Email       string
+	LockedUntil time.Time
+}
+
+// ThrottleLimits are the limits the throttle enforces
+type ThrottleLimits struct {
+	LoginWindow            time.Duration `yaml:"login_window"`
+	FreeLoginFailures      int           `yaml:"free_login_failures"`
+	MinLoginDelay          time.Duration `yaml:"min_login_delay"`
+	MaxLoginDelay          time.Duration `yaml:"max_login_delay"`
+	MaxAccountFailures     int           `yaml:"max_account_failures"`
+	MaxIPFailures          int           `yaml:"max_ip_failures"`
+	LockoutDuration        time.Duration `yaml:"lockout_duration"`
+	ResendActivationLimit  int           `yaml:"resend_activation_limit"`
+	ResendActivationWindow time.Duration `yaml:"resend_activation_window"`
+}
+
+// DefaultThrottleLimits returns the limits a throttle starts with
+func DefaultThrottleLimits() ThrottleLimits {
+	return ThrottleLimits{
+		LoginWindow:            THROTTLE_WINDOW,
+		FreeLoginFailures:      FREE_LOGIN_FAILURES,
+		MinLoginDelay:          MIN_LOGIN_DELAY,
+		MaxLoginDelay:          MAX_LOGIN_DELAY,
+		MaxAccountFailures:     MAX_ACCOUNT_FAILURES,
+		MaxIPFailures:          MAX_IP_FAILURES,
+		LockoutDuration:        LOCKOUT_DURATION,
+		ResendActivationLimit:  RESEND_ACTIVATION_LIMIT,
+		ResendActivationWindow: RESEND_ACTIVATION_WINDOW,
+	}
+}
+
+// LoginThrottle slows down and eventually locks out repeated failed log in attempts
+type LoginThrottle struct {
+	Store  ThrottleStore
+	limits ThrottleLimits // read with Limits and changed with SetLimits
+	mutex  sync.RWMutex
+}
+
+// NewLoginThrottle returns a throttle keeping its counters in the store, with the default limits
+func NewLoginThrottle(store ThrottleStore) *LoginThrottle {
+	return &LoginThrottle{Store: store, limits: DefaultThrottleLimits()}
+}
+
+// Limits returns the limits the throttle enforces
+func (t *LoginThrottle) Limits() ThrottleLimits {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.limits
+}
+
+// SetLimits changes the limits the throttle enforces. The counters and blocks are kept,
+// e.g. an account locked out keeps being locked out for as long as it was.
+func (t *LoginThrottle) SetLimits(l ThrottleLimits) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.limits = l
+}
+
+// Check returns how long a log in attempt to the account from the ip must wait for,
+// and whether that's because the account or the ip is locked out
+func (t *LoginThrottle) Check(email, ip string) (time.Duration, bool, error) {
+	email = normalizeEmail(email)
+
+	var wait time.Duration
+	var locked bool
+	for _, key := range []string{ACCOUNT_LOCK_KEY + email, IP_LOCK_KEY + ip, ACCOUNT_DELAY_KEY + email} {
+		d, err := t.Store.BlockedFor(key)
+		if err != nil {
+			return 0, false, err
+		}
+		if d > wait {
+			wait = d
+			locked = !strings.HasPrefix(key, ACCOUNT_DELAY_KEY)
+		}
+	}
+
+	return wait, locked, nil
+}
+
+// Fail records a failed log in attempt to the account from the ip.
+// It reports whether the account has just been locked out by it.
+func (t *LoginThrottle) Fail(email, ip string) (bool, error) {
+	email = normalizeEmail(email)
+	l := t.Limits()
+
+	ipFailures, err := t.Store.Incr(IP_FAILURES_KEY+ip, l.LoginWindow)
+	if err != nil {
+		return false, err
+	}
+	if ipFailures >= l.MaxIPFailures {
+		if err := t.Store.Block(IP_LOCK_KEY+ip, l.LockoutDuration); err != nil {
+			return false, err
+		}
+	}
+
+	failures, err := t.Store.Incr(ACCOUNT_FAILURES_KEY+email, l.LoginWindow)
+	if err != nil {
+		return false, err
+	}
+
+	if failures >= l.MaxAccountFailures {
+		if err := t.Store.Block(ACCOUNT_LOCK_KEY+email, l.LockoutDuration); err != nil {
+			return false, err
+		}
+		// start counting again once the lockout is over
+		return true, t.Store.Clear(ACCOUNT_FAILURES_KEY+email, ACCOUNT_DELAY_KEY+email)
+	}
+
+	if d := loginDelay(failures, l); d > 0 {
+		if err := t.Store.Block(ACCOUNT_DELAY_KEY+email, d); err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// Succeed forgets the failed log in attempts to the account
+func (t *LoginThrottle) Succeed(email string) error {
+	email = normalizeEmail(email)
+	return t.Store.Clear(ACCOUNT_FAILURES_KEY+email, ACCOUNT_DELAY_KEY+email)
+}
+
+// Unlock lifts the lockout of the account and forgets its failed log in attempts
+func (t *LoginThrottle) Unlock(email string) error {
+	email = normalizeEmail(email)
+	return t.Store.Clear(ACCOUNT_LOCK_KEY+email, ACCOUNT_FAILURES_KEY+email, ACCOUNT_DELAY_KEY+email)
+}
+
+// Locked returns the accounts which are locked out, soonest unlocked first
+func (t *LoginThrottle) Locked() ([]LockedAccount, error) {
+	blocked, err := t.Store.Blocked(ACCOUNT_LOCK_KEY)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var accounts []LockedAccount
+	for key, d := range blocked {
+		accounts = append(accounts, LockedAccount{
+			Email:       strings.TrimPrefix(key, ACCOUNT_LOCK_KEY),
+			LockedUntil: now.Add(d),
+		})
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].LockedUntil.Before(accounts[j].LockedUntil)
+	})
+
+	return accounts, nil
+}
+
+// Allow counts an action under the key, such as sending an email to an address, and reports
+// whether it's allowed, i.e. whether it's one of the first limit ones within the window.
+// The action is allowed when the store fails.
+func (t *LoginThrottle) Allow(key string, limit int, window time.Duration) (bool, error) {
+	n, err := t.Store.Incr(key, window)
+	if err != nil {
+		return true, err
+	}
+	return n <= limit, nil
+}
+
+// loginDelay returns how long to wait for after the number of failures of an account
+func loginDelay(failures int, l ThrottleLimits) time.Duration {
+	if failures <= l.FreeLoginFailures {
+		return 0
+	}
+
+	d := l.MinLoginDelay
+	for i := l.FreeLoginFailures + 1; i < failures && d < l.MaxLoginDelay; i++ {
+		d *= 2
+	}
+	if d > l.MaxLoginDelay {
+		return l.MaxLoginDelay
+	}
+	return d
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// RedisThrottleStore keeps the counters and blocks in redis, so that they are shared by
+// all the instances of the app and expire by themselves
+type RedisThrottleStore struct {
+	Pool *redis.Pool
+}
+
+// NewRedisThrottleStore returns a store using the connections of the pool
+func NewRedisThrottleStore(pool *redis.Pool) *RedisThrottleStore {
+	return &RedisThrottleStore{Pool: pool}
+}
+
+// incrScript increments the counter and, if it doesn't expire yet, makes it expire after the window.
+// Both happen at once, so that a counter is never left without an expiry, which would throttle for good.
+var incrScript = redis.NewScript(1, `
+local n = redis.call("INCR", KEYS[1])
+if redis.call("PTTL", KEYS[1]) == -1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n
+`)
+
+func (s *RedisThrottleStore) Incr(key string, window time.Duration) (int, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	return redis.Int(incrScript.Do(conn, key, window.Milliseconds()))
+}
+
+func (s *RedisThrottleStore) Block(key string, d time.Duration) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", key, 1, "PX", d.Milliseconds())
+	return err
+}
+
+func (s *RedisThrottleStore) BlockedFor(key string) (time.Duration, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	ms, err := redis.Int64(conn.Do("PTTL", key))
+	if err != nil {
+		return 0, err
+	}
+	// negative when the key doesn't exist or doesn't expire
+	if ms < 0 {
+		return 0, nil
+	}
+
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func (s *RedisThrottleStore) Clear(keys ...string) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	args := make([]any, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+
+	_, err := conn.Do("DEL", args...)
+	return err
+}
+
+func (s *RedisThrottleStore) Blocked(prefix string) (map[string]time.Duration, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	blocked := make(map[string]time.Duration)
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != 2 {
+			return nil, errors.New("unexpected reply to SCAN")
+		}
+
+		cursor, err = redis.Int(values[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			ms, err := redis.Int64(conn.Do("PTTL", key))
+			if err != nil {
+				return nil, err
+			}
+			if ms > 0 {
+				blocked[key] = time.Duration(ms) * time.Millisecond
+			}
+		}
+
+		if cursor == 0 {
+			return blocked, nil
+		}
+	}
+}
+
+// MemoryThrottleStore keeps the counters and blocks in memory, and is used for testing
+type MemoryThrottleStore struct {
+	mutex   sync.Mutex
+	expires map[string]time.Time
+	counts  map[string]int
+}
+
+// NewMemoryThrottleStore returns an empty store
+func NewMemoryThrottleStore() *MemoryThrottleStore {
+	return &MemoryThrottleStore{
+		expires: make(map[string]time.Time),
+		counts:  make(map[string]int),
+	}
+}
+
+// live drops the key if it has expired, and reports whether it's still there
+func (s *MemoryThrottleStore) live(key string, now time.Time) bool {
+	exp, ok := s.expires[key]
+	if ok && !now.Before(exp) {
+		delete(s.expires, key)
+		delete(s.counts, key)
+		return false
+	}
+	return ok
+}
+
+func (s *MemoryThrottleStore) Incr(key string, window time.Duration) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if !s.live(key, now) {
+		s.expires[key] = now.Add(window)
+	}
+	s.counts[key]++
+
+	return s.counts[key], nil
+}
+
+func (s *MemoryThrottleStore) Block(key string, d time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expires[key] = time.Now().Add(d)
+	return nil
+}
+
+func (s *MemoryThrottleStore) BlockedFor(key string) (time.Duration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if !s.live(key, now) {
+		return 0, nil
+	}
+	return s.expires[key].Sub(now), nil
+}
+
+func (s *MemoryThrottleStore) Clear(keys ...string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, key := range keys {
+		delete(s.expires, key)
+		delete(s.counts, key)
+	}
+	return nil
+}
+
+func (s *MemoryThrottleStore) Blocked(prefix string) (map[string]time.Duration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	blocked := make(map[string]time.Duration)
+	for key := range s.expires {
+		if strings.HasPrefix(key, prefix) && s.live(key, now) {
+			blocked[key] = s.expires[key].Sub(now)
+		}
+	}
+	return blocked, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_LoginThrottle(t *testing.T) {
+	throttle := NewLoginThrottle(NewMemoryThrottleStore())
+	email, ip := "me@example.com", "192.0.2.1"
+
+	for i := 1; i <= FREE_LOGIN_FAILURES; i++ {
+		if _, err := throttle.Fail(email, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wait, _, _ := throttle.Check(email, ip); wait != 0 {
+		t.Errorf("expected no wait after %d failures; got %s", FREE_LOGIN_FAILURES, wait)
+	}
+
+	if _, err := throttle.Fail(email, ip); err != nil {
+		t.Fatal(err)
+	}
+	if wait, locked, _ := throttle.Check("ME@example.com", ip); wait <= 0 || locked {
+		t.Errorf("expected a delay without lockout; got wait %s, locked %t", wait, locked)
+	}
+
+	if err := throttle.Succeed(email); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _, _ := throttle.Check(email, ip); wait != 0 {
+		t.Errorf("expected no wait after a successful log in; got %s", wait)
+	}
+
+	var locked bool
+	for i := 1; i <= MAX_ACCOUNT_FAILURES; i++ {
+		var err error
+		if locked, err = throttle.Fail(email, ip); err != nil {
+			t.Fatal(err)
+		}
+		if locked != (i == MAX_ACCOUNT_FAILURES) {
+			t.Errorf("failure %d: expected locked to be %t; got %t", i, i == MAX_ACCOUNT_FAILURES, locked)
+		}
+	}
+	if wait, locked, _ := throttle.Check(email, ip); wait <= LOCKOUT_DURATION-time.Minute || !locked {
+		t.Errorf("expected the account to be locked out; got wait %s, locked %t", wait, locked)
+	}
+
+	accounts, err := throttle.Locked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 || accounts[0].Email != email {
+		t.Errorf("expected %s to be the only locked account; got %v", email, accounts)
+	}
+
+	if err := throttle.Unlock(email); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _, _ := throttle.Check(email, ip); wait != 0 {
+		t.Errorf("expected no wait once unlocked; got %s", wait)
+	}
+
+	// spread over many accounts, failures still lock out the ip
+	for i := 0; i < MAX_IP_FAILURES; i++ {
+		if _, err := throttle.Fail(fmt.Sprintf("user%d@example.com", i), ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wait, locked, _ := throttle.Check("someone@example.com", ip); wait <= 0 || !locked {
+		t.Errorf("expected the ip to be locked out; got wait %s, locked %t", wait, locked)
+	}
+	if wait, _, _ := throttle.Check("someone@example.com", "192.0.2.2"); wait != 0 {
+		t.Errorf("expected another ip not to wait; got %s", wait)
+	}
+}
+
+func Test_loginDelay(t *testing.T) {
+	tests := map[string]struct {
+		failures int
+		want     time.Duration
+	}{
+		"free":          {failures: FREE_LOGIN_FAILURES, want: 0},
+		"first delayed": {failures: FREE_LOGIN_FAILURES + 1, want: MIN_LOGIN_DELAY},
+		"doubled":       {failures: FREE_LOGIN_FAILURES + 3, want: 4 * MIN_LOGIN_DELAY},
+		"capped":        {failures: FREE_LOGIN_FAILURES + 100, want: MAX_LOGIN_DELAY},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := loginDelay(tt.failures, DefaultThrottleLimits()); got != tt.want {
+				t.Errorf("expected %s; got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_Login_Throttled(t *testing.T) {
+	tests := map[string]struct {
+		email    string
+		blockKey string
+		want     string
+	}{
+		"delayed": {email: "delayed@example.com", blockKey: ACCOUNT_DELAY_KEY, want: fmt.Sprintf(TOO_MANY_ATTEMPTS_MSG, 5)},
+		"locked":  {email: "locked@example.com", blockKey: ACCOUNT_LOCK_KEY, want: ACCOUNT_LOCKED_MSG},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := testServer.Throttle.Store.Block(tt.blockKey+tt.email, 5*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			defer testServer.Throttle.Unlock(tt.email)
+
+			body := url.Values{EMAIL_ATTR: {tt.email}, PASSWORD_ATTR: {"abc123abc123abc123abc123"}}
+			rawReq, _ := http.NewRequest(http.MethodPost, LOGIN_PATH, strings.NewReader(body.Encode()))
+			rawReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r := newReqWithSession(rawReq)
+			w := httptest.NewRecorder()
+
+			testServer.Login(w, r)
+
+			if w.Code != http.StatusSeeOther {
+				t.Errorf("expected status code %d; got %d", http.StatusSeeOther, w.Code)
+			}
+			if msg := testServer.Session.GetString(r.Context(), ERROR_CTX); msg != tt.want {
+				t.Errorf("expected error message %q; got %q", tt.want, msg)
+			}
+			if testServer.Session.Exists(r.Context(), USER_ID_CTX) {
+				t.Error("expected the user not to be logged in")
+			}
+		})
+	}
+}
+
+func Test_ResendActivation_RateLimited(t *testing.T) {
+	email := "resend@example.com"
+	defer testServer.Throttle.Store.Clear(RESEND_ACTIVATION_KEY + email)
+
+	for i := 1; i <= RESEND_ACTIVATION_LIMIT+1; i++ {
+		body := url.Values{EMAIL_ATTR: {email}}
+		rawReq, _ := http.NewRequest(http.MethodPost, RESEND_ACTIVATION_PATH, strings.NewReader(body.Encode()))
+		rawReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r := newReqWithSession(rawReq)
+		w := httptest.NewRecorder()
+
+		testServer.ResendActivation(w, r)
+		testServer.AsyncJob.Wait()
+
+		limited := testServer.Session.GetString(r.Context(), ERROR_CTX) == ACTIVATION_RATE_LIMITED_MSG
+		if limited != (i > RESEND_ACTIVATION_LIMIT) {
+			t.Errorf("request %d: expected rate limited to be %t; got %t", i, i > RESEND_ACTIVATION_LIMIT, limited)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// XXX_PAGE is the name of the template gohtml file to render for the page
+const (
+	TWO_FACTOR_PAGE       = "two-factor.page.gohtml"
+	LOGIN_TWO_FACTOR_PAGE = "login-two-factor.page.gohtml"
+)
+
+// XXX_MSG is the message to display to the user or to log for you
+const (
+	TWO_FACTOR_ENABLED_MSG           = "Two-factor authentication enabled."
+	TWO_FACTOR_DISABLED_MSG          = "Two-factor authentication disabled."
+	TWO_FACTOR_ALREADY_ENABLED_MSG   = "Two-factor authentication is already enabled."
+	TWO_FACTOR_NOT_ENROLLED_MSG      = "Scan the QR code with your authenticator app first."
+	UNSUCCESSFUL_ENABLE_2FA_MSG      = "Unable to enable two-factor authentication."
+	UNSUCCESSFUL_DISABLE_2FA_MSG     = "Unable to disable two-factor authentication."
+	INVALID_TWO_FACTOR_CODE_MSG      = "Invalid authentication code."
+	TWO_FACTOR_LOGIN_EXPIRED_MSG     = "Your log in has expired. Log in again."
+	RECOVERY_CODE_USED_MSG           = "You logged in with a recovery code, which can't be used again."
+	ERROR_GET_TWO_FACTOR_MSG         = "error getting two-factor authentication of user %d: %w"
+	ERROR_GENERATE_RECOVERY_CODE_MSG = "error generating recovery codes: %w"
+)
+
+// XXX_ATTR is an attribute or element's name embedded in html.
+const (
+	TWO_FACTOR_ATTR     = "two-factor"
+	QR_CODE_ATTR        = "qr-code"
+	SECRET_ATTR         = "secret"
+	RECOVERY_CODES_ATTR = "recovery-codes"
+	TOTP_CODE_ATTR      = "totp-code"
+)
+
+const (
+	TOTP_ISSUER           = "Final Project"
+	TOTP_PERIOD           = 30 // seconds of a time step, the default of authenticators
+	TOTP_QR_CODE_SIZE     = 200
+	RECOVERY_CODES_COUNT  = 10
+	PENDING_LOGIN_MAX_AGE = 5 * time.Minute
+)
+
+// TwoFactorPage shows whether two-factor authentication is enabled, and if not,
+// the QR code of a new authenticator to enroll
+func (s *Server) TwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	tf, err := s.Models.TwoFactor.GetByUserID(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_TWO_FACTOR_MSG, user.ID, err))
+		return
+	}
+
+	dataMap := make(map[string]any)
+	if tf != nil && tf.Enabled() {
+		dataMap[TWO_FACTOR_ATTR] = tf
+		s.render(w, r, TWO_FACTOR_PAGE, &TemplateData{Data: dataMap})
+		return
+	}
+
+	// keep showing the pending authenticator, which may have been scanned already
+	var secret string
+	if tf != nil {
+		secret = tf.Secret
+	} else {
+		key, err := totp.Generate(totp.GenerateOpts{Issuer: TOTP_ISSUER, AccountName: user.Email})
+		if err != nil {
+			s.ErrorLog.Println(err)
+			return
+		}
+		secret = key.Secret()
+
+		if err := s.Models.TwoFactor.Enroll(user.ID, secret); err != nil {
+			s.ErrorLog.Println(err)
+			return
+		}
+	}
+
+	qrCode, err := totpQRCode(user, secret)
+	if err != nil {
+		s.ErrorLog.Println(err)
+		return
+	}
+
+	dataMap[QR_CODE_ATTR] = qrCode
+	s.render(w, r, TWO_FACTOR_PAGE, &TemplateData{
+		StringMap: map[string]string{SECRET_ATTR: secret},
+		Data:      dataMap,
+	})
+}
+
+// EnableTwoFactor enables the pending authenticator once the user has verified a first code,
+// and shows the recovery codes, which are only shown this once
+func (s *Server) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	tf, err := s.Models.TwoFactor.GetByUserID(user.ID)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, TWO_FACTOR_NOT_ENROLLED_MSG)
+		http.Redirect(w, r, MembersTwoFactorPath, http.StatusSeeOther)
+		return
+	}
+	if tf.Enabled() {
+		s.Session.Put(r.Context(), ERROR_CTX, TWO_FACTOR_ALREADY_ENABLED_MSG)
+		http.Redirect(w, r, MembersTwoFactorPath, http.StatusSeeOther)
+		return
+	}
+
+	step, ok := totpStep(strings.TrimSpace(r.Form.Get(TOTP_CODE_ATTR)), tf.Secret, time.Now())
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, INVALID_TWO_FACTOR_CODE_MSG)
+		http.Redirect(w, r, MembersTwoFactorPath, http.StatusSeeOther)
+		return
+	}
+	tf.LastUsedStep = step // so that the code can't be used again to log in
+
+	codes, err := generateRecoveryCodes(RECOVERY_CODES_COUNT)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GENERATE_RECOVERY_CODE_MSG, err))
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_ENABLE_2FA_MSG)
+		http.Redirect(w, r, MembersTwoFactorPath, http.StatusSeeOther)
+		return
+	}
+
+	if err := s.Models.TwoFactor.Enable(*tf, codes); err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_ENABLE_2FA_MSG)
+		http.Redirect(w, r, MembersTwoFactorPath, http.StatusSeeOther)
+		return
+	}
+
+	s.audit(r, data.TwoFactorEnabled, user.ID, user.ID, nil)
+
+	// render rather than redirect, so that the recovery codes are never stored anywhere in clear
+	tf.EnabledAt = sql.NullTime{Time: time.Now(), Valid: true}
+	dataMap := make(map[string]any)
+	dataMap[TWO_FACTOR_ATTR] = tf
+	dataMap[RECOVERY_CODES_ATTR] = codes
+
+	s.Session.Put(r.Context(), FLASH_CTX, TWO_FACTOR_ENABLED_MSG)
+	s.render(w, r, TWO_FACTOR_PAGE, &TemplateData{Data: dataMap})
+}
+
+// DisableTwoFactor removes the authenticator, after checking a code from it or a recovery code
+func (s *Server) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	user, ok := s.Session.Get(r.Context(), USER_CTX).(data.User)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, LOGIN_FIRST_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	tf, err := s.Models.TwoFactor.GetByUserID(user.ID)
+	if err != nil || !tf.Enabled() {
+		http.Redirect(w, r, MembersTwoFactorPath, http.StatusSeeOther)
+		return
+	}
+
+	// codes are throttled as when logging in, or they could be guessed with a hijacked session
+	ip := clientIP(r)
+	if msg := s.loginThrottled(user.Email, ip); msg != "" {
+		s.Session.Put(r.Context(), ERROR_CTX, msg)
+		http.Redirect(w, r, MembersTwoFactorPath, http.StatusSeeOther)
+		return
+	}
+
+	if ok, _ := s.checkTwoFactorCode(*tf, r.Form.Get(TOTP_CODE_ATTR)); !ok {
+		s.loginFailed(r, user.Email, ip, &user)
+		s.Session.Put(r.Context(), ERROR_CTX, INVALID_TWO_FACTOR_CODE_MSG)
+		http.Redirect(w, r, MembersTwoFactorPath, http.StatusSeeOther)
+		return
+	}
+
+	if err := s.Models.TwoFactor.Disable(user.ID); err != nil {
+		s.ErrorLog.Println(err)
+		s.Session.Put(r.Context(), ERROR_CTX, UNSUCCESSFUL_DISABLE_2FA_MSG)
+		http.Redirect(w, r, MembersTwoFactorPath, http.StatusSeeOther)
+		return
+	}
+	s.audit(r, data.TwoFactorDisabled, user.ID, user.ID, nil)
+
+	s.Session.Put(r.Context(), FLASH_CTX, TWO_FACTOR_DISABLED_MSG)
+	http.Redirect(w, r, MembersTwoFactorPath, http.StatusSeeOther)
+}
+
+func (s *Server) LoginTwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.pendingLogin(r); !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, TWO_FACTOR_LOGIN_EXPIRED_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	s.render(w, r, LOGIN_TWO_FACTOR_PAGE, nil)
+}
+
+// LoginTwoFactor is the second step of logging in with two-factor authentication:
+// it logs in the user who passed the first step once they give a valid code
+func (s *Server) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_PARSE_FORM_MSG, err))
+	}
+
+	userID, ok := s.pendingLogin(r)
+	if !ok {
+		s.Session.Put(r.Context(), ERROR_CTX, TWO_FACTOR_LOGIN_EXPIRED_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	user, err := s.Models.User.GetOne(userID)
+	if err != nil {
+		s.Session.Put(r.Context(), ERROR_CTX, INVALID_CREDS_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	tf, err := s.Models.TwoFactor.GetByUserID(userID)
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_GET_TWO_FACTOR_MSG, userID, err))
+		s.Session.Put(r.Context(), ERROR_CTX, INVALID_CREDS_MSG)
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+
+	// codes are throttled like passwords, or they could be guessed
+	ip := clientIP(r)
+	if msg := s.loginThrottled(user.Email, ip); msg != "" {
+		s.Session.Put(r.Context(), ERROR_CTX, msg)
+		http.Redirect(w, r, LoginTwoFactorPath, http.StatusSeeOther)
+		return
+	}
+
+	valid, recovery := s.checkTwoFactorCode(*tf, r.Form.Get(TOTP_CODE_ATTR))
+	if !valid {
+		s.loginFailed(r, user.Email, ip, user)
+		s.Session.Put(r.Context(), ERROR_CTX, INVALID_TWO_FACTOR_CODE_MSG)
+		http.Redirect(w, r, LoginTwoFactorPath, http.StatusSeeOther)
+		return
+	}
+
+	err = s.Session.RenewToken(r.Context())
+	if err != nil {
+		s.ErrorLog.Println(fmt.Errorf(ERROR_RENEW_TOKEN_MSG, err))
+	}
+	s.Session.Remove(r.Context(), PENDING_USER_ID_CTX)
+	s.Session.Remove(r.Context(), PENDING_LOGIN_AT_CTX)
+
+	s.logIn(r, user)
+	if recovery {
+		s.Session.Put(r.Context(), WARNING_CTX, RECOVERY_CODE_USED_MSG)
+	}
+
+	http.Redirect(w, r, HOME_PATH, http.StatusSeeOther)
+}
+
+// startPendingLogin records that the user has passed the first step of logging in,
+// and has yet to give a code
+func (s *Server) startPendingLogin(r *http.Request, user *data.User) {
+	s.Session.Put(r.Context(), PENDING_USER_ID_CTX, user.ID)
+	s.Session.Put(r.Context(), PENDING_LOGIN_AT_CTX, time.Now().Unix())
+}
+
+// pendingLogin returns the user who has passed the first step of logging in, if they did so recently
+func (s *Server) pendingLogin(r *http.Request) (int, bool) {
+	userID := s.Session.GetInt(r.Context(), PENDING_USER_ID_CTX)
+	startedAt := time.Unix(s.Session.GetInt64(r.Context(), PENDING_LOGIN_AT_CTX), 0)
+	if userID == 0 || time.Since(startedAt) > PENDING_LOGIN_MAX_AGE {
+		return 0, false
+	}
+
+	return userID, true
+}
+
+// checkTwoFactorCode reports whether the code is valid, either from the authenticator
+// or as a recovery code, which it uses up, and whether it was a recovery code.
+// A code from the authenticator is only valid once, and only if it's later than the last one used.
+func (s *Server) checkTwoFactorCode(tf data.TwoFactor, code string) (bool, bool) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, false
+	}
+
+	if step, ok := totpStep(code, tf.Secret, time.Now()); ok {
+		if step <= tf.LastUsedStep {
+			return false, false
+		}
+
+		used, err := s.Models.TwoFactor.UseTimeStep(tf.UserID, step)
+		if err != nil {
+			s.ErrorLog.Println(err)
+			return false, false
+		}
+		return used, false
+	}
+
+	ok, err := s.Models.TwoFactor.UseRecoveryCode(tf.UserID, code)
+	if err != nil {
+		s.ErrorLog.Println(err)
+		return false, false
+	}
+
+	return ok, ok
+}
+
+// totpStep returns the time step the code of the authenticator is for, if it's valid around now,
+// allowing for one step of clock drift either way as totp.Validate does
+func totpStep(code, secret string, now time.Time) (int64, bool) {
+	opts := totp.ValidateOpts{Period: TOTP_PERIOD, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+
+	current := now.Unix() / TOTP_PERIOD
+	for _, step := range []int64{current - 1, current, current + 1} {
+		if ok, _ := totp.ValidateCustom(code, secret, time.Unix(step*TOTP_PERIOD, 0), opts); ok {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// totpQRCode returns the QR code to enroll the authenticator with, as a data url of a png image,
+// which html/template would otherwise refuse to put in a src attribute
+func totpQRCode(user data.User, secret string) (template.URL, error) {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", TOTP_ISSUER)
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + TOTP_ISSUER + ":" + user.Email,
+		RawQuery: q.Encode(),
+	}
+
+	key, err := otp.NewKeyFromURL(u.String())
+	if err != nil {
+		return "", err
+	}
+
+	img, err := key.Image(TOTP_QR_CODE_SIZE, TOTP_QR_CODE_SIZE)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// generateRecoveryCodes returns n random recovery codes, such as "abcd-efgh"
+func generateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+	}
+
+	return codes, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MatsuoTakuro/final-project/data"
+	"github.com/pquerna/otp/totp"
+)
+
+func Test_checkTwoFactorCode_Replay(t *testing.T) {
+	now := time.Now()
+	current := now.Unix() / TOTP_PERIOD
+
+	codeAt := func(step int64) string {
+		code, err := totp.GenerateCode(data.TestTOTPSecret, time.Unix(step*TOTP_PERIOD, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := map[string]struct {
+		code         string
+		lastUsedStep int64
+		expected     bool
+	}{
+		"never used":              {codeAt(current), 0, true},
+		"later than the last one": {codeAt(current), current - 1, true},
+		"used already":            {codeAt(current), current, false},
+		"older than the last one": {codeAt(current - 1), current, false},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			tf := data.TwoFactor{UserID: 2, Secret: data.TestTOTPSecret, LastUsedStep: tt.lastUsedStep}
+
+			valid, recovery := testServer.checkTwoFactorCode(tf, tt.code)
+			if valid != tt.expected || recovery {
+				t.Errorf("expected the code to be valid %t, and not a recovery code; got %t, %t", tt.expected, valid, recovery)
+			}
+		})
+	}
+}
+
+func Test_DisableTwoFactor_Throttled(t *testing.T) {
+	user := data.User{ID: 2, Email: "guess-2fa@example.com"}
+
+	disable := func(code string) *http.Request {
+		body := url.Values{TOTP_CODE_ATTR: {code}}
+		rawReq, _ := http.NewRequest(http.MethodPost, TWO_FACTOR_DISABLE_PATH, strings.NewReader(body.Encode()))
+		rawReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rawReq.RemoteAddr = "192.0.2.36:1234"
+		r := newReqWithSession(rawReq)
+		testServer.Session.Put(r.Context(), USER_ID_CTX, user.ID)
+		testServer.Session.Put(r.Context(), USER_CTX, user)
+		testServer.DisableTwoFactor(httptest.NewRecorder(), r)
+		return r
+	}
+
+	// codes are guessed until the account has to wait between attempts
+	for i := 0; i <= testServer.Throttle.Limits().FreeLoginFailures; i++ {
+		r := disable("000000")
+		if msg := testServer.Session.GetString(r.Context(), ERROR_CTX); msg != INVALID_TWO_FACTOR_CODE_MSG {
+			t.Fatalf("attempt %d: expected error message %q; got %q", i+1, INVALID_TWO_FACTOR_CODE_MSG, msg)
+		}
+	}
+
+	// after which even a valid code isn't checked
+	r := disable(totpCode())
+	if msg := testServer.Session.GetString(r.Context(), ERROR_CTX); !strings.HasPrefix(msg, "Too many failed log in attempts") {
+		t.Errorf("expected the attempt to be throttled; got error message %q", msg)
+	}
+	if msg := testServer.Session.GetString(r.Context(), FLASH_CTX); msg == TWO_FACTOR_DISABLED_MSG {
+		t.Error("expected two-factor authentication to be kept")
+	}
+}
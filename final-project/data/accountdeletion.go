@@ -0,0 +1,121 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// AccountDeletion is the structure which holds the deletion a user has asked for of their account.
+// The account is only deleted once the grace period is over, until when the user may change their mind.
+type AccountDeletion struct {
+	UserID      int
+	DeleteAfter time.Time
+	CreatedAt   time.Time
+	User        *User // only set by GetDue
+}
+
+// Schedule schedules the deletion of the account of the user, or moves it if it's been scheduled already
+func (d *AccountDeletion) Schedule(userID int, deleteAfter time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into account_deletions (user_id, delete_after, created_at) values ($1, $2, $3)
+			on conflict (user_id) do update set delete_after = excluded.delete_after`
+
+	_, err := db.ExecContext(ctx, stmt, userID, deleteAfter, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetByUserID returns the scheduled deletion of the account of the user, or sql.ErrNoRows if there is none
+func (d *AccountDeletion) GetByUserID(userID int) (*AccountDeletion, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select user_id, delete_after, created_at from account_deletions where user_id = $1`
+
+	var deletion AccountDeletion
+	err := db.QueryRowContext(ctx, query, userID).Scan(
+		&deletion.UserID,
+		&deletion.DeleteAfter,
+		&deletion.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deletion, nil
+}
+
+// Cancel cancels the scheduled deletion of the account of the user. It returns sql.ErrNoRows if there is none.
+func (d *AccountDeletion) Cancel(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from account_deletions where user_id = $1`
+
+	res, err := db.ExecContext(ctx, stmt, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// GetDue returns the deletions whose grace period is over by now, along with the users to delete
+func (d *AccountDeletion) GetDue(now time.Time) ([]*AccountDeletion, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select d.user_id, d.delete_after, d.created_at, u.email, u.first_name, u.last_name, u.locale
+			from account_deletions d
+			join users u on (u.id = d.user_id)
+			where d.delete_after <= $1
+			order by d.delete_after`
+
+	rows, err := db.QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deletions []*AccountDeletion
+	for rows.Next() {
+		var deletion AccountDeletion
+		var user User
+		err := rows.Scan(
+			&deletion.UserID,
+			&deletion.DeleteAfter,
+			&deletion.CreatedAt,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Locale,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		user.ID = deletion.UserID
+		deletion.User = &user
+		deletions = append(deletions, &deletion)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deletions, nil
+}
@@ -0,0 +1,251 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// APIScope is what an api token may be used for
+type APIScope string
+
+const (
+	ReadProfile       APIScope = "profile:read"
+	ReadPlans         APIScope = "plans:read"
+	ReadSubscription  APIScope = "subscription:read"
+	WriteSubscription APIScope = "subscription:write"
+	ReadInvoices      APIScope = "invoices:read"
+)
+
+// AllAPIScopes lists every scope an api token may be granted
+var AllAPIScopes = []APIScope{
+	ReadProfile,
+	ReadPlans,
+	ReadSubscription,
+	WriteSubscription,
+	ReadInvoices,
+}
+
+// Valid reports whether the scope is one of AllAPIScopes
+func (s APIScope) Valid() bool {
+	for _, scope := range AllAPIScopes {
+		if scope == s {
+			return true
+		}
+	}
+	return false
+}
+
+// APITokenPrefix starts every api token, so that they are easy to recognize, in a leaked file for instance
+const APITokenPrefix = "fp_"
+
+// APIToken is the structure which holds one personal api token of a user. The token itself is
+// only shown once, when it's created, and only its hash is stored.
+type APIToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	Prefix     string // the first characters of the token, to tell the tokens apart
+	Scopes     []APIScope
+	ExpiresAt  sql.NullTime // null means never
+	LastUsedAt sql.NullTime
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// Expired reports whether the token can't be used anymore at the given time
+func (t *APIToken) Expired(now time.Time) bool {
+	return t.ExpiresAt.Valid && !now.Before(t.ExpiresAt.Time)
+}
+
+// HasScope reports whether the token has been granted the scope
+func (t *APIToken) HasScope(scope APIScope) bool {
+	for _, granted := range t.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NewAPIToken returns a new random token, to be given to the user and inserted along with its record
+func NewAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return APITokenPrefix + hex.EncodeToString(b), nil
+}
+
+// hashAPIToken hashes the token. Tokens are random, so a fast hash is enough.
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiTokenPrefix returns the first characters of the token, which are shown to tell the tokens apart
+func apiTokenPrefix(token string) string {
+	if len(token) < len(APITokenPrefix)+8 {
+		return token
+	}
+	return token[:len(APITokenPrefix)+8]
+}
+
+// joinScopes returns the scopes as stored in the database, separated by spaces
+func joinScopes(scopes []APIScope) string {
+	s := make([]string, len(scopes))
+	for i, scope := range scopes {
+		s[i] = string(scope)
+	}
+	return strings.Join(s, " ")
+}
+
+// splitScopes returns the scopes as stored in the database
+func splitScopes(s string) []APIScope {
+	var scopes []APIScope
+	for _, scope := range strings.Fields(s) {
+		scopes = append(scopes, APIScope(scope))
+	}
+	return scopes
+}
+
+// GetByUserID returns the api tokens of the user, newest first
+func (t *APIToken) GetByUserID(userID int) ([]*APIToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at, updated_at
+			from api_tokens where user_id = $1 order by created_at desc, id desc`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*APIToken
+	for rows.Next() {
+		var token APIToken
+		var scopes string
+		err := rows.Scan(
+			&token.ID,
+			&token.UserID,
+			&token.Name,
+			&token.Prefix,
+			&scopes,
+			&token.ExpiresAt,
+			&token.LastUsedAt,
+			&token.CreatedAt,
+			&token.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		token.Scopes = splitScopes(scopes)
+
+		tokens = append(tokens, &token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// GetByToken returns the record of the token, whether it has expired or not
+func (t *APIToken) GetByToken(token string) (*APIToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at, updated_at
+			from api_tokens where token_hash = $1`
+
+	var apiToken APIToken
+	var scopes string
+	err := db.QueryRowContext(ctx, query, hashAPIToken(token)).Scan(
+		&apiToken.ID,
+		&apiToken.UserID,
+		&apiToken.Name,
+		&apiToken.Prefix,
+		&scopes,
+		&apiToken.ExpiresAt,
+		&apiToken.LastUsedAt,
+		&apiToken.CreatedAt,
+		&apiToken.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	apiToken.Scopes = splitScopes(scopes)
+
+	return &apiToken, nil
+}
+
+// Insert records the token, which NewAPIToken has returned, and returns the ID of the newly inserted row
+func (t *APIToken) Insert(apiToken APIToken, token string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into api_tokens (user_id, name, prefix, token_hash, scopes, expires_at, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		apiToken.UserID,
+		apiToken.Name,
+		apiTokenPrefix(token),
+		hashAPIToken(token),
+		joinScopes(apiToken.Scopes),
+		apiToken.ExpiresAt,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Touch records that the token has just been used
+func (t *APIToken) Touch(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update api_tokens set last_used_at = $1 where id = $2`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Revoke deletes one api token of the user. It returns sql.ErrNoRows if the user has no such token.
+func (t *APIToken) Revoke(userID, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from api_tokens where id = $1 and user_id = $2`
+
+	res, err := db.ExecContext(ctx, stmt, id, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
@@ -0,0 +1,276 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditAction is the kind of event recorded in the audit log
+type AuditAction string
+
+const (
+	ImpersonationStarted AuditAction = "impersonation.start"
+	ImpersonationStopped AuditAction = "impersonation.stop"
+
+	LoginSucceeded    AuditAction = "login.success"
+	LoginFailed       AuditAction = "login.failure"
+	AccountActivated  AuditAction = "account.activate"
+	AccountUnlocked   AuditAction = "account.unlock"
+	PlanChanged       AuditAction = "plan.change"
+	TokenUsed         AuditAction = "token.use"
+	UserActivated     AuditAction = "user.activate"
+	UserDeactivated   AuditAction = "user.deactivate"
+	RoleChanged       AuditAction = "user.role"
+	PasswordResetSent AuditAction = "user.password_reset"
+	UserDeleted       AuditAction = "user.delete"
+	CouponCreated     AuditAction = "coupon.create"
+
+	AccountCreated  AuditAction = "account.create"
+	IdentityLinked  AuditAction = "identity.link"
+	PasswordSet     AuditAction = "password.set"
+	PasswordRemoved AuditAction = "password.remove"
+
+	TwoFactorEnabled  AuditAction = "two_factor.enable"
+	TwoFactorDisabled AuditAction = "two_factor.disable"
+
+	APITokenCreated AuditAction = "api_token.create"
+	APITokenRevoked AuditAction = "api_token.revoke"
+
+	AccountExported          AuditAction = "account.export"
+	AccountDeletionScheduled AuditAction = "account.delete_schedule"
+	AccountDeletionCancelled AuditAction = "account.delete_cancel"
+	AccountDeleted           AuditAction = "account.delete"
+)
+
+// AllAuditActions lists every action which is recorded in the audit log
+var AllAuditActions = []AuditAction{
+	LoginSucceeded,
+	LoginFailed,
+	AccountActivated,
+	AccountUnlocked,
+	PlanChanged,
+	TokenUsed,
+	UserActivated,
+	UserDeactivated,
+	RoleChanged,
+	PasswordResetSent,
+	UserDeleted,
+	CouponCreated,
+	ImpersonationStarted,
+	ImpersonationStopped,
+	AccountCreated,
+	IdentityLinked,
+	PasswordSet,
+	PasswordRemoved,
+	TwoFactorEnabled,
+	TwoFactorDisabled,
+	APITokenCreated,
+	APITokenRevoked,
+	AccountExported,
+	AccountDeletionScheduled,
+	AccountDeletionCancelled,
+	AccountDeleted,
+}
+
+// AuditChange is the value of a field before and after an event. Either is nil when there is none.
+type AuditChange struct {
+	From any `json:"from,omitempty"`
+	To   any `json:"to,omitempty"`
+}
+
+// AuditDiff is what an event changed, by field. It's stored as json.
+type AuditDiff map[string]AuditChange
+
+// Value implements driver.Valuer, so that the diff can be stored as json
+func (d AuditDiff) Value() (driver.Value, error) {
+	if len(d) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner, so that the diff can be read back from json
+func (d *AuditDiff) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*d = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, d)
+	case string:
+		return json.Unmarshal([]byte(v), d)
+	default:
+		return fmt.Errorf("unable to scan %T into an audit diff", src)
+	}
+}
+
+// String returns the diff as json, or an empty string if there is none
+func (d AuditDiff) String() string {
+	v, err := d.Value()
+	if err != nil || v == nil {
+		return ""
+	}
+	return v.(string)
+}
+
+// AuditEvent is the structure which holds one entry of the audit log: who did what to whom, and from where.
+// The actor and the target are null when there is none, or when the user has been deleted since.
+type AuditEvent struct {
+	ID        int
+	Action    AuditAction
+	ActorID   sql.NullInt32
+	TargetID  sql.NullInt32
+	IP        string
+	RequestID string
+	Diff      AuditDiff
+	CreatedAt time.Time
+}
+
+// AuditFilter narrows down the events of the audit log. Zero fields match every event.
+type AuditFilter struct {
+	Action   AuditAction
+	ActorID  int
+	TargetID int
+	Since    time.Time
+	Until    time.Time
+}
+
+// matches reports whether the event is one of those the filter narrows down to
+func (f AuditFilter) matches(e AuditEvent) bool {
+	return (f.Action == "" || e.Action == f.Action) &&
+		(f.ActorID == 0 || int(e.ActorID.Int32) == f.ActorID && e.ActorID.Valid) &&
+		(f.TargetID == 0 || int(e.TargetID.Int32) == f.TargetID && e.TargetID.Valid) &&
+		(f.Since.IsZero() || !e.CreatedAt.Before(f.Since)) &&
+		(f.Until.IsZero() || e.CreatedAt.Before(f.Until))
+}
+
+// where returns the where clause of the filter, along with its arguments
+func (f AuditFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.Action != "" {
+		add("action = $%d", f.Action)
+	}
+	if f.ActorID != 0 {
+		add("actor_id = $%d", f.ActorID)
+	}
+	if f.TargetID != 0 {
+		add("target_id = $%d", f.TargetID)
+	}
+	if !f.Since.IsZero() {
+		add("created_at >= $%d", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("created_at < $%d", f.Until)
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "where " + strings.Join(conds, " and "), args
+}
+
+// Audit is the type for the audit log, which is only ever appended to
+type Audit struct{}
+
+// Insert appends one event to the audit log
+func (a *Audit) Insert(event AuditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into audit_log (action, actor_id, target_id, ip, request_id, diff, created_at)
+			values ($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err := db.ExecContext(ctx, stmt,
+		event.Action,
+		event.ActorID,
+		event.TargetID,
+		event.IP,
+		event.RequestID,
+		event.Diff,
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Find returns the events matching the filter, newest first, along with how many there are in all.
+// A limit of 0 returns all of them.
+func (a *Audit) Find(filter AuditFilter, limit, offset int) ([]*AuditEvent, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	where, args := filter.where()
+
+	// limit null is no limit
+	var limitArg any
+	if limit > 0 {
+		limitArg = limit
+	}
+
+	query := fmt.Sprintf(`select id, action, actor_id, target_id, coalesce(ip, ''), coalesce(request_id, ''), diff,
+			created_at, count(*) over ()
+			from audit_log
+			%s
+			order by created_at desc, id desc
+			limit $%d offset $%d`, where, len(args)+1, len(args)+2)
+
+	rows, err := db.QueryContext(ctx, query, append(args, limitArg, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var events []*AuditEvent
+	var total int
+	for rows.Next() {
+		var event AuditEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.Action,
+			&event.ActorID,
+			&event.TargetID,
+			&event.IP,
+			&event.RequestID,
+			&event.Diff,
+			&event.CreatedAt,
+			&total,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		events = append(events, &event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// past the last page, there is no row to count the matching events with
+	if len(events) == 0 && offset > 0 {
+		query = `select count(*) from audit_log ` + where
+		if err := db.QueryRowContext(ctx, query, args...).Scan(&total); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return events, total, nil
+}
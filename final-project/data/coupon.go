@@ -0,0 +1,247 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	ErrCouponExpired       = errors.New("coupon has expired")
+	ErrCouponNotRedeemable = errors.New("coupon can no longer be redeemed")
+	ErrCouponCurrency      = errors.New("coupon is not valid for the currency of the plan")
+	ErrCouponRedeemed      = errors.New("coupon has already been redeemed by the user")
+)
+
+// CouponDuration is how many charges of a subscription a coupon applies to
+type CouponDuration string
+
+const (
+	Once      CouponDuration = "once"      // only the first charge
+	Repeating CouponDuration = "repeating" // the first DurationInIntervals charges
+	Forever   CouponDuration = "forever"   // every charge
+)
+
+// Coupon is the structure which holds one coupon from the database.
+// A coupon takes either PercentOff or AmountOff (in minor units of Currency) off a plan.
+type Coupon struct {
+	ID                  int
+	Code                string
+	PercentOff          int
+	AmountOff           int
+	Currency            Currency
+	Duration            CouponDuration
+	DurationInIntervals int
+	MaxRedemptions      int // 0 means no limit
+	TimesRedeemed       int
+	ExpiresAt           sql.NullTime
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+}
+
+// NormalizeCouponCode returns the form coupon codes are stored in
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// GetAll returns a slice of all coupons, newest first
+func (c *Coupon) GetAll() ([]*Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, code, percent_off, amount_off, currency, duration, duration_in_intervals,
+			max_redemptions, times_redeemed, expires_at, created_at, updated_at
+			from coupons order by id desc`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var coupons []*Coupon
+
+	for rows.Next() {
+		var coupon Coupon
+		err := rows.Scan(
+			&coupon.ID,
+			&coupon.Code,
+			&coupon.PercentOff,
+			&coupon.AmountOff,
+			&coupon.Currency,
+			&coupon.Duration,
+			&coupon.DurationInIntervals,
+			&coupon.MaxRedemptions,
+			&coupon.TimesRedeemed,
+			&coupon.ExpiresAt,
+			&coupon.CreatedAt,
+			&coupon.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		coupons = append(coupons, &coupon)
+	}
+
+	return coupons, nil
+}
+
+// GetByCode returns one coupon by code
+func (c *Coupon) GetByCode(code string) (*Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, code, percent_off, amount_off, currency, duration, duration_in_intervals,
+			max_redemptions, times_redeemed, expires_at, created_at, updated_at
+			from coupons where code = $1`
+
+	var coupon Coupon
+	row := db.QueryRowContext(ctx, query, NormalizeCouponCode(code))
+
+	err := row.Scan(
+		&coupon.ID,
+		&coupon.Code,
+		&coupon.PercentOff,
+		&coupon.AmountOff,
+		&coupon.Currency,
+		&coupon.Duration,
+		&coupon.DurationInIntervals,
+		&coupon.MaxRedemptions,
+		&coupon.TimesRedeemed,
+		&coupon.ExpiresAt,
+		&coupon.CreatedAt,
+		&coupon.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &coupon, nil
+}
+
+// Insert inserts a new coupon into the database, and returns the ID of the newly inserted row
+func (c *Coupon) Insert(coupon Coupon) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into coupons (code, percent_off, amount_off, currency, duration, duration_in_intervals,
+			max_redemptions, expires_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		NormalizeCouponCode(coupon.Code),
+		coupon.PercentOff,
+		coupon.AmountOff,
+		coupon.Currency,
+		coupon.Duration,
+		coupon.DurationInIntervals,
+		coupon.MaxRedemptions,
+		coupon.ExpiresAt,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Validate checks that the coupon can be applied to the plan at the given time.
+// Whether it has redemptions left is checked again when it's redeemed.
+func (c *Coupon) Validate(plan Plan, now time.Time) error {
+	if c.ExpiresAt.Valid && !now.Before(c.ExpiresAt.Time) {
+		return ErrCouponExpired
+	}
+
+	if c.MaxRedemptions > 0 && c.TimesRedeemed >= c.MaxRedemptions {
+		return ErrCouponNotRedeemable
+	}
+
+	if c.AmountOff > 0 && c.Currency != plan.Currency {
+		return ErrCouponCurrency
+	}
+
+	return nil
+}
+
+// DiscountFor returns how much the coupon takes off the given amount, in the same minor units
+func (c *Coupon) DiscountFor(amount int) int {
+	discount := c.AmountOff
+	if c.PercentOff > 0 {
+		discount = amount * c.PercentOff / 100
+	}
+
+	if discount > amount {
+		return amount
+	}
+	return discount
+}
+
+// AmountOffForDisplay formats the fixed amount the coupon takes off as a currency string
+func (c *Coupon) AmountOffForDisplay() string {
+	return FormatAmount(c.AmountOff, c.Currency, DefaultLocale)
+}
+
+// Intervals returns how many charges the coupon applies to, or -1 if it applies forever
+func (c *Coupon) Intervals() int {
+	switch c.Duration {
+	case Once:
+		return 1
+	case Repeating:
+		return c.DurationInIntervals
+	default:
+		return -1
+	}
+}
+
+// redeem records one redemption of the coupon for the subscription within the transaction.
+// The redemption counter is only incremented while the coupon is still redeemable, and the
+// row stays locked until the transaction ends, so concurrent subscriptions can't redeem it
+// more often than allowed. A user only redeems a coupon once: ErrCouponRedeemed is returned
+// if the payer of the subscription already has.
+func (c *Coupon) redeem(ctx context.Context, tx *sql.Tx, sub Subscription, now time.Time) error {
+	stmt := `update coupons set times_redeemed = times_redeemed + 1, updated_at = $1
+			where id = $2
+			and (max_redemptions = 0 or times_redeemed < max_redemptions)
+			and (expires_at is null or expires_at > $1)`
+
+	res, err := tx.ExecContext(ctx, stmt, now, c.ID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCouponNotRedeemable
+	}
+
+	// checked once the coupon is locked, so that the same user can't redeem it twice concurrently
+	var redeemed bool
+	query := `select exists(select 1 from coupon_redemptions where coupon_id = $1 and user_id = $2)`
+	if err := tx.QueryRowContext(ctx, query, c.ID, sub.UserID).Scan(&redeemed); err != nil {
+		return err
+	}
+	if redeemed {
+		return ErrCouponRedeemed
+	}
+
+	stmt = `insert into coupon_redemptions (coupon_id, user_id, user_plan_id, discount_amount, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6)`
+
+	_, err = tx.ExecContext(ctx, stmt, c.ID, sub.UserID, sub.ID, sub.DiscountAmount, now, now)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
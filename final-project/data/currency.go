@@ -0,0 +1,80 @@
+package data
+
+import (
+	"math"
+
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// Currency is an ISO 4217 currency code. Amounts in a currency are always stored
+// as integers in its minor units (e.g. cents for USD, yen for JPY which has none).
+type Currency string
+
+const (
+	USD Currency = "USD"
+	EUR Currency = "EUR"
+	JPY Currency = "JPY"
+)
+
+const (
+	DefaultCurrency = USD
+	DefaultLocale   = "en-US"
+)
+
+// SupportedCurrencies lists the currencies plans can be priced in
+var SupportedCurrencies = []Currency{USD, EUR, JPY}
+
+// SupportedLocales lists the locales amounts can be formatted for
+var SupportedLocales = []string{"en-US", "en-GB", "de-DE", "fr-FR", "ja-JP"}
+
+// IsSupportedCurrency reports whether c is one of the supported currencies
+func IsSupportedCurrency(c Currency) bool {
+	for _, supported := range SupportedCurrencies {
+		if c == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSupportedLocale reports whether locale is one of the supported locales
+func IsSupportedLocale(locale string) bool {
+	for _, supported := range SupportedLocales {
+		if locale == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// MinorUnits returns the number of decimal places of the currency, e.g. 2 for USD and 0 for JPY
+func (c Currency) MinorUnits() int {
+	unit, err := currency.ParseISO(string(c))
+	if err != nil {
+		return 2
+	}
+
+	scale, _ := currency.Standard.Rounding(unit)
+	return scale
+}
+
+// FormatAmount formats an amount given in minor units of the currency
+// according to the conventions of the locale, e.g. "€ 1.234,50" for de-DE
+func FormatAmount(amount int, c Currency, locale string) string {
+	unit, err := currency.ParseISO(string(c))
+	if err != nil {
+		unit = currency.MustParseISO(string(DefaultCurrency))
+		c = DefaultCurrency
+	}
+
+	tag, err := language.Parse(locale)
+	if err != nil {
+		tag = language.MustParse(DefaultLocale)
+	}
+
+	major := float64(amount) / math.Pow10(c.MinorUnits())
+
+	return message.NewPrinter(tag).Sprint(currency.Symbol(unit.Amount(major)))
+}
@@ -0,0 +1,112 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// Feature is a named capability that a plan grants to its subscribers
+type Feature string
+
+const (
+	EmailSupport    Feature = "email-support"
+	UserManual      Feature = "user-manual"
+	PrioritySupport Feature = "priority-support"
+	APIAccess       Feature = "api-access"
+)
+
+// AllFeatures lists every feature in the order they are shown to users
+var AllFeatures = []Feature{
+	EmailSupport,
+	UserManual,
+	PrioritySupport,
+	APIAccess,
+}
+
+// Name returns a human readable name for the feature
+func (f Feature) Name() string {
+	switch f {
+	case EmailSupport:
+		return "Email support"
+	case UserManual:
+		return "User manual"
+	case PrioritySupport:
+		return "Priority support"
+	case APIAccess:
+		return "API access"
+	default:
+		return string(f)
+	}
+}
+
+// LimitKey is the name of a numeric limit that a plan puts on its subscribers
+type LimitKey string
+
+const (
+	MaxSessions  LimitKey = "max-sessions"
+	MaxAPITokens LimitKey = "max-api-tokens"
+)
+
+// AllLimits lists every limit in the order they are shown to users
+var AllLimits = []LimitKey{
+	MaxSessions,
+	MaxAPITokens,
+}
+
+// Name returns a human readable name for the limit
+func (k LimitKey) Name() string {
+	switch k {
+	case MaxSessions:
+		return "Active sessions"
+	case MaxAPITokens:
+		return "API tokens"
+	default:
+		return string(k)
+	}
+}
+
+// Entitlement answers what a user is allowed to do, based on the plans covering them:
+// their own plan and the plans of the organizations they are members of
+type Entitlement struct{}
+
+// CanUse reports whether any plan covering the user grants the feature.
+// A user without a plan can't use any feature.
+func (e *Entitlement) CanUse(user User, feature Feature) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select count(pf.id) from user_plans up
+			join plan_features pf on (pf.plan_id = up.plan_id)
+			where ` + coveredByPlan + ` and pf.feature = $2`
+
+	var count int
+	if err := db.QueryRowContext(ctx, query, user.ID, feature).Scan(&count); err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// Limit returns the highest value of the limit set by the plans covering the user.
+// It returns 0 when the user has no plan or the plans don't set the limit.
+func (e *Entitlement) Limit(user User, key LimitKey) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select pl.limit_value from user_plans up
+			join plan_limits pl on (pl.plan_id = up.plan_id)
+			where ` + coveredByPlan + ` and pl.limit_key = $2
+			order by pl.limit_value desc limit 1`
+
+	var limit int
+	err := db.QueryRowContext(ctx, query, user.ID, key).Scan(&limit)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return limit, nil
+}
@@ -0,0 +1,118 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+var ErrIdentityLinked = errors.New("identity is already linked to a user")
+
+// Identity is the structure which holds the link between a user and their account at an external
+// OpenID Connect identity provider. The account is identified by the issuer and the subject.
+type Identity struct {
+	ID        int
+	UserID    int
+	Issuer    string
+	Subject   string
+	Email     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// GetBySubject returns the identity of the subject at the issuer
+func (i *Identity) GetBySubject(issuer, subject string) (*Identity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, issuer, subject, email, created_at, updated_at
+			from user_identities where issuer = $1 and subject = $2`
+
+	var identity Identity
+	err := db.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&identity.ID,
+		&identity.UserID,
+		&identity.Issuer,
+		&identity.Subject,
+		&identity.Email,
+		&identity.CreatedAt,
+		&identity.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+// GetByUserID returns the identities linked to the user, oldest first
+func (i *Identity) GetByUserID(userID int) ([]*Identity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, issuer, subject, email, created_at, updated_at
+			from user_identities where user_id = $1 order by created_at, id`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []*Identity
+	for rows.Next() {
+		var identity Identity
+		err := rows.Scan(
+			&identity.ID,
+			&identity.UserID,
+			&identity.Issuer,
+			&identity.Subject,
+			&identity.Email,
+			&identity.CreatedAt,
+			&identity.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, &identity)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+// Insert links an identity to a user, and returns the ID of the newly inserted row.
+// It returns ErrIdentityLinked if the identity is linked to a user already.
+func (i *Identity) Insert(identity Identity) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into user_identities (user_id, issuer, subject, email, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		identity.UserID,
+		identity.Issuer,
+		identity.Subject,
+		identity.Email,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return 0, ErrIdentityLinked
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
@@ -1,18 +1,23 @@
 package data
 
+import "time"
+
 // UserInterface is the interface for the user type. In order
 // to satisfy this interface, all specified methods must be implemented.
 // We do this so we can test things easily. Both data.User and data.UserTest
 // implement this interface.
 type UserInterface interface {
 	GetAll() ([]*User, error)
+	Search(term string, limit, offset int) ([]*User, int, error)
 	GetByEmail(email string) (*User, error)
 	GetOne(id int) (*User, error)
 	Update(user User) error
+	SetRole(userID int, role Role) error
 	Delete(user User) error
 	DeleteByID(id int) error
 	Insert(user User) (int, error)
-	ResetPassword(password string) error
+	ResetPassword(user User, password string) error
+	RemovePassword(userID int) error
 	PasswordMatches(plainText string) (bool, error)
 }
 
@@ -21,6 +26,104 @@ type UserInterface interface {
 type PlanInterface interface {
 	GetAll() ([]*Plan, error)
 	GetOne(id int) (*Plan, error)
-	SubscribeUserToPlan(user User, plan Plan) error
+	SubscribeUserToPlan(user User, plan Plan, coupon *Coupon) (*Subscription, error)
+	SubscribeOrganizationToPlan(org Organization, owner User, plan Plan) (*Subscription, error)
 	AmountForDisplay() string
 }
+
+// SubscriptionInterface is the type for the subscription type. Both data.Subscription and
+// data.SubscriptionTest implement this interface.
+type SubscriptionInterface interface {
+	GetByUserID(userID int) (*Subscription, error)
+	GetByOrganizationID(orgID int) (*Subscription, error)
+	GetDueForCharge(now time.Time) ([]*Subscription, error)
+	GetTrialsEndingBy(t time.Time) ([]*Subscription, error)
+	AdvanceNextCharge(sub Subscription) (bool, error)
+	MarkTrialReminderSent(sub Subscription) error
+	CancelByUserID(userID int) error
+}
+
+// CouponInterface is the type for the coupon type. Both data.Coupon and
+// data.CouponTest implement this interface.
+type CouponInterface interface {
+	GetAll() ([]*Coupon, error)
+	GetByCode(code string) (*Coupon, error)
+	Insert(coupon Coupon) (int, error)
+}
+
+// EntitlementInterface is the type for the entitlement type. Both data.Entitlement and
+// data.EntitlementTest implement this interface.
+type EntitlementInterface interface {
+	CanUse(user User, feature Feature) (bool, error)
+	Limit(user User, key LimitKey) (int, error)
+}
+
+// OrganizationInterface is the type for the organization type. Both data.Organization and
+// data.OrganizationTest implement this interface.
+type OrganizationInterface interface {
+	GetByUserID(userID int) (*Organization, error)
+	Insert(org Organization) (int, error)
+	Invite(org Organization, email string, invitedBy User) (*Invitation, error)
+	GetInvitation(id int) (*Invitation, error)
+	AcceptInvitation(inv Invitation, user User, token Token) error
+	RemoveMember(org Organization, userID int) error
+}
+
+// TokenInterface is the type for the token type. Both data.Token and
+// data.TokenTest implement this interface.
+type TokenInterface interface {
+	Insert(token Token) error
+	Consume(nonce, purpose string) error
+}
+
+// TwoFactorInterface is the type for the two-factor type. Both data.TwoFactor and
+// data.TwoFactorTest implement this interface.
+type TwoFactorInterface interface {
+	GetByUserID(userID int) (*TwoFactor, error)
+	Enroll(userID int, secret string) error
+	Enable(tf TwoFactor, recoveryCodes []string) error
+	Disable(userID int) error
+	UseRecoveryCode(userID int, code string) (bool, error)
+	UseTimeStep(userID int, step int64) (bool, error)
+}
+
+// IdentityInterface is the type for the identity type. Both data.Identity and
+// data.IdentityTest implement this interface.
+type IdentityInterface interface {
+	GetBySubject(issuer, subject string) (*Identity, error)
+	GetByUserID(userID int) ([]*Identity, error)
+	Insert(identity Identity) (int, error)
+}
+
+// InvoiceInterface is the type for the invoice type. Both data.Invoice and
+// data.InvoiceTest implement this interface.
+type InvoiceInterface interface {
+	Insert(inv Invoice) (int, error)
+	GetByUserID(userID, limit, offset int) ([]*Invoice, int, error)
+}
+
+// AccountDeletionInterface is the type for the account deletion type. Both data.AccountDeletion and
+// data.AccountDeletionTest implement this interface.
+type AccountDeletionInterface interface {
+	Schedule(userID int, deleteAfter time.Time) error
+	GetByUserID(userID int) (*AccountDeletion, error)
+	Cancel(userID int) error
+	GetDue(now time.Time) ([]*AccountDeletion, error)
+}
+
+// APITokenInterface is the type for the api token type. Both data.APIToken and
+// data.APITokenTest implement this interface.
+type APITokenInterface interface {
+	GetByUserID(userID int) ([]*APIToken, error)
+	GetByToken(token string) (*APIToken, error)
+	Insert(apiToken APIToken, token string) (int, error)
+	Touch(id int) error
+	Revoke(userID, id int) error
+}
+
+// AuditInterface is the type for the audit type. Both data.Audit and
+// data.AuditTest implement this interface.
+type AuditInterface interface {
+	Insert(event AuditEvent) error
+	Find(filter AuditFilter, limit, offset int) ([]*AuditEvent, int, error)
+}
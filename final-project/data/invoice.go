@@ -0,0 +1,147 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Invoice is the structure which holds the record of one charge of a subscription, for one interval.
+// The user is null once they have been deleted, as invoices are kept for the books.
+type Invoice struct {
+	ID             int
+	UserID         sql.NullInt32 // the user who paid
+	OrganizationID sql.NullInt32 // set when the user paid for an organization
+	SubscriptionID int
+	PlanID         int
+	PlanName       string
+	Seats          int
+	Currency       Currency
+	Amount         int // the amount charged, in minor units of Currency
+	DiscountAmount int // taken off the amount, in minor units of Currency
+	PeriodStart    time.Time
+	PeriodEnd      time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// NewInvoice returns the invoice of the charge of the subscription which is due, before it's advanced.
+// The subscription must come with its plan.
+func NewInvoice(sub Subscription) Invoice {
+	inv := Invoice{
+		UserID:         sql.NullInt32{Int32: int32(sub.UserID), Valid: true},
+		OrganizationID: sub.OrganizationID,
+		SubscriptionID: sub.ID,
+		PlanID:         sub.PlanID,
+		PlanName:       sub.Plan.PlanName,
+		Seats:          sub.Seats,
+		Currency:       sub.Currency,
+		Amount:         sub.AmountDue(),
+		PeriodStart:    sub.NextChargeAt,
+		PeriodEnd:      sub.Plan.Interval.Next(sub.NextChargeAt),
+	}
+	if sub.HasDiscount() {
+		inv.DiscountAmount = sub.Total() - inv.Amount
+	}
+	return inv
+}
+
+// Insert records one invoice, and returns the ID of the newly inserted row
+func (i *Invoice) Insert(inv Invoice) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into invoices (user_id, organization_id, subscription_id, plan_id, seats, currency, amount,
+			discount_amount, period_start, period_end, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		inv.UserID,
+		inv.OrganizationID,
+		inv.SubscriptionID,
+		inv.PlanID,
+		inv.Seats,
+		inv.Currency,
+		inv.Amount,
+		inv.DiscountAmount,
+		inv.PeriodStart,
+		inv.PeriodEnd,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetByUserID returns the invoices the user has paid, newest first, along with how many there are in all.
+// A limit of 0 returns all of them.
+func (i *Invoice) GetByUserID(userID, limit, offset int) ([]*Invoice, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	// limit null is no limit
+	var limitArg any
+	if limit > 0 {
+		limitArg = limit
+	}
+
+	query := `select i.id, i.user_id, i.organization_id, i.subscription_id, i.plan_id, p.plan_name, i.seats, i.currency,
+			i.amount, i.discount_amount, i.period_start, i.period_end, i.created_at, i.updated_at, count(*) over ()
+			from invoices i
+			join plans p on (p.id = i.plan_id)
+			where i.user_id = $1
+			order by i.created_at desc, i.id desc
+			limit $2 offset $3`
+
+	rows, err := db.QueryContext(ctx, query, userID, limitArg, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var invoices []*Invoice
+	var total int
+	for rows.Next() {
+		var inv Invoice
+		err := rows.Scan(
+			&inv.ID,
+			&inv.UserID,
+			&inv.OrganizationID,
+			&inv.SubscriptionID,
+			&inv.PlanID,
+			&inv.PlanName,
+			&inv.Seats,
+			&inv.Currency,
+			&inv.Amount,
+			&inv.DiscountAmount,
+			&inv.PeriodStart,
+			&inv.PeriodEnd,
+			&inv.CreatedAt,
+			&inv.UpdatedAt,
+			&total,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		invoices = append(invoices, &inv)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// past the last page, there is no row to count the invoices with
+	if len(invoices) == 0 && offset > 0 {
+		query = `select count(*) from invoices where user_id = $1`
+		if err := db.QueryRowContext(ctx, query, userID).Scan(&total); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return invoices, total, nil
+}
@@ -15,8 +15,20 @@ func New(dbPool *sql.DB) Models {
 	db = dbPool
 
 	return Models{
-		User: &User{}, // allows us to use methods on the User type through the Models
-		Plan: &Plan{}, // allows us to use methods on the Plan type through the Models
+		User:         &User{},         // allows us to use methods on the User type through the Models
+		Plan:         &Plan{},         // allows us to use methods on the Plan type through the Models
+		Subscription: &Subscription{}, // allows us to use methods on the Subscription type through the Models
+		Coupon:       &Coupon{},       // allows us to use methods on the Coupon type through the Models
+		Entitlement:  &Entitlement{},  // allows us to use methods on the Entitlement type through the Models
+		Organization: &Organization{}, // allows us to use methods on the Organization type through the Models
+		Token:        &Token{},        // allows us to use methods on the Token type through the Models
+		TwoFactor:    &TwoFactor{},    // allows us to use methods on the TwoFactor type through the Models
+		Audit:        &Audit{},        // allows us to use methods on the Audit type through the Models
+		Identity:     &Identity{},     // allows us to use methods on the Identity type through the Models
+		APIToken:     &APIToken{},     // allows us to use methods on the APIToken type through the Models
+		Invoice:      &Invoice{},      // allows us to use methods on the Invoice type through the Models
+
+		AccountDeletion: &AccountDeletion{}, // allows us to use methods on the AccountDeletion type through the Models
 	}
 }
 
@@ -24,6 +36,18 @@ func New(dbPool *sql.DB) Models {
 // in this type is available to us throughout the application, anywhere that the
 // app variable is used, provided that the model is also added in the New function.
 type Models struct {
-	User UserInterface
-	Plan PlanInterface
+	User         UserInterface
+	Plan         PlanInterface
+	Subscription SubscriptionInterface
+	Coupon       CouponInterface
+	Entitlement  EntitlementInterface
+	Organization OrganizationInterface
+	Token        TokenInterface
+	TwoFactor    TwoFactorInterface
+	Audit        AuditInterface
+	Identity     IdentityInterface
+	APIToken     APITokenInterface
+	Invoice      InvoiceInterface
+
+	AccountDeletion AccountDeletionInterface
 }
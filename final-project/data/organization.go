@@ -0,0 +1,346 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAlreadyMember      = errors.New("user is already a member of an organization")
+	ErrInvitationAccepted = errors.New("invitation has already been accepted")
+	ErrInvitationEmail    = errors.New("invitation was sent to another email")
+	ErrRemoveOwner        = errors.New("the owner can't be removed from the organization")
+)
+
+// OrgRole is the role of a member in an organization
+type OrgRole string
+
+const (
+	Owner  OrgRole = "owner"  // manages the members and pays for the plan of the organization
+	Member OrgRole = "member" // is covered by the plan of the organization
+)
+
+// coveredByPlan is the condition on user_plans (up) for the subscriptions covering the user $1:
+// their own subscription and the subscription of the organization they are a member of
+const coveredByPlan = `(up.user_id = $1 and up.organization_id is null
+			or up.organization_id in (select organization_id from organization_members where user_id = $1))`
+
+// Organization is the structure which holds one organization, such as a company buying for a whole team
+type Organization struct {
+	ID        int
+	Name      string
+	OwnerID   int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Members   []*OrganizationMember
+}
+
+// OrganizationMember is the structure which holds one member of an organization
+type OrganizationMember struct {
+	ID             int
+	OrganizationID int
+	UserID         int
+	Role           OrgRole
+	Email          string
+	FirstName      string
+	LastName       string
+	CreatedAt      time.Time
+}
+
+// Invitation is the structure which holds one invitation by email to join an organization
+type Invitation struct {
+	ID             int
+	OrganizationID int
+	Email          string
+	InvitedBy      int
+	AcceptedAt     sql.NullTime
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// IsOwner reports whether the user owns the organization
+func (o *Organization) IsOwner(userID int) bool {
+	return o.OwnerID == userID
+}
+
+// GetByUserID returns the organization the user is a member of, along with its members
+func (o *Organization) GetByUserID(userID int) (*Organization, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select o.id, o.name, o.owner_id, o.created_at, o.updated_at
+			from organizations o
+			join organization_members om on (om.organization_id = o.id)
+			where om.user_id = $1`
+
+	var org Organization
+	row := db.QueryRowContext(ctx, query, userID)
+
+	err := row.Scan(
+		&org.ID,
+		&org.Name,
+		&org.OwnerID,
+		&org.CreatedAt,
+		&org.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `select om.id, om.organization_id, om.user_id, om.role, u.email, u.first_name, u.last_name, om.created_at
+			from organization_members om
+			join users u on (u.id = om.user_id)
+			where om.organization_id = $1
+			order by om.role desc, u.last_name`
+
+	rows, err := db.QueryContext(ctx, query, org.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var member OrganizationMember
+		err := rows.Scan(
+			&member.ID,
+			&member.OrganizationID,
+			&member.UserID,
+			&member.Role,
+			&member.Email,
+			&member.FirstName,
+			&member.LastName,
+			&member.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		org.Members = append(org.Members, &member)
+	}
+
+	return &org, nil
+}
+
+// Insert inserts a new organization into the database with its owner as the first member,
+// and returns the ID of the newly inserted row
+func (o *Organization) Insert(org Organization) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := checkNotMember(ctx, tx, org.OwnerID); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+
+	var newID int
+	stmt := `insert into organizations (name, owner_id, created_at, updated_at)
+			values ($1, $2, $3, $4) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt, org.Name, org.OwnerID, now, now).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `insert into organization_members (organization_id, user_id, role, created_at, updated_at)
+			values ($1, $2, $3, $4, $5)`
+
+	_, err = tx.ExecContext(ctx, stmt, newID, org.OwnerID, Owner, now, now)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Invite records an invitation to join the organization sent to the email
+func (o *Organization) Invite(org Organization, email string, invitedBy User) (*Invitation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	inv := Invitation{
+		OrganizationID: org.ID,
+		Email:          strings.ToLower(strings.TrimSpace(email)),
+		InvitedBy:      invitedBy.ID,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+
+	stmt := `insert into organization_invitations (organization_id, email, invited_by, created_at, updated_at)
+			values ($1, $2, $3, $4, $5) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		inv.OrganizationID,
+		inv.Email,
+		inv.InvitedBy,
+		inv.CreatedAt,
+		inv.UpdatedAt,
+	).Scan(&inv.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &inv, nil
+}
+
+// GetInvitation returns one invitation by id
+func (o *Organization) GetInvitation(id int) (*Invitation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, organization_id, email, invited_by, accepted_at, created_at, updated_at
+			from organization_invitations where id = $1`
+
+	var inv Invitation
+	row := db.QueryRowContext(ctx, query, id)
+
+	err := row.Scan(
+		&inv.ID,
+		&inv.OrganizationID,
+		&inv.Email,
+		&inv.InvitedBy,
+		&inv.AcceptedAt,
+		&inv.CreatedAt,
+		&inv.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &inv, nil
+}
+
+// AcceptInvitation adds the user the invitation was sent to as a member of the organization,
+// and updates the seats its subscription, if any, is charged for. The token of the link the
+// invitation was accepted with is consumed in the same transaction, so that the link is only
+// used up once the user has joined. ErrTokenUsed is returned if it has been used already.
+func (o *Organization) AcceptInvitation(inv Invitation, user User, token Token) error {
+	if inv.AcceptedAt.Valid {
+		return ErrInvitationAccepted
+	}
+
+	if !strings.EqualFold(inv.Email, user.Email) {
+		return ErrInvitationEmail
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkNotMember(ctx, tx, user.ID); err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	// only accept the invitation once, even if the link is followed twice at the same time
+	stmt := `update organization_invitations set accepted_at = $1, updated_at = $1
+			where id = $2 and accepted_at is null`
+
+	res, err := tx.ExecContext(ctx, stmt, now, inv.ID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInvitationAccepted
+	}
+
+	if err := consumeToken(ctx, tx, token.Nonce, token.Purpose); err != nil {
+		return err
+	}
+
+	stmt = `insert into organization_members (organization_id, user_id, role, created_at, updated_at)
+			values ($1, $2, $3, $4, $5)`
+
+	_, err = tx.ExecContext(ctx, stmt, inv.OrganizationID, user.ID, Member, now, now)
+	if err != nil {
+		return err
+	}
+
+	if err := updateSeats(ctx, tx, inv.OrganizationID, now); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RemoveMember removes the user from the organization, and updates the seats
+// its subscription, if any, is charged for. The owner can't be removed.
+func (o *Organization) RemoveMember(org Organization, userID int) error {
+	if org.IsOwner(userID) {
+		return ErrRemoveOwner
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `delete from organization_members where organization_id = $1 and user_id = $2 and role <> $3`
+
+	_, err = tx.ExecContext(ctx, stmt, org.ID, userID, Owner)
+	if err != nil {
+		return err
+	}
+
+	if err := updateSeats(ctx, tx, org.ID, time.Now()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// checkNotMember returns ErrAlreadyMember if the user is already a member of an organization
+func checkNotMember(ctx context.Context, tx *sql.Tx, userID int) error {
+	var isMember bool
+	query := `select count(id) > 0 from organization_members where user_id = $1`
+	if err := tx.QueryRowContext(ctx, query, userID).Scan(&isMember); err != nil {
+		return err
+	}
+
+	if isMember {
+		return ErrAlreadyMember
+	}
+	return nil
+}
+
+// updateSeats makes the subscription of the organization, if any, pay for its current members
+// from the next charge on
+func updateSeats(ctx context.Context, tx *sql.Tx, orgID int, now time.Time) error {
+	stmt := `update user_plans
+			set seats = (select count(id) from organization_members where organization_id = $1), updated_at = $2
+			where organization_id = $1`
+
+	_, err := tx.ExecContext(ctx, stmt, orgID, now)
+	return err
+}
@@ -2,17 +2,45 @@ package data
 
 import (
 	"context"
-	"fmt"
+	"database/sql"
+	"errors"
 	"log"
 	"time"
 )
 
+var ErrNotSeatBased = errors.New("plan is not seat based")
+
+// Interval is how often a plan is billed
+type Interval string
+
+const (
+	Monthly Interval = "month"
+	Yearly  Interval = "year"
+)
+
+// Next returns the time one billing interval after t
+func (i Interval) Next(t time.Time) time.Time {
+	switch i {
+	case Yearly:
+		return t.AddDate(1, 0, 0)
+	default:
+		return t.AddDate(0, 1, 0)
+	}
+}
+
 // Plan is the type for subscription plans
 type Plan struct {
 	ID                  int
 	PlanName            string
-	PlanAmount          int
+	PlanAmount          int // in minor units of Currency
 	PlanAmountFormatted string
+	Currency            Currency
+	Prices              map[Currency]int // in minor units of each currency
+	Interval            Interval
+	TrialDays           int
+	SeatBased           bool // charged per member of an organization
+	Features            []Feature
+	Limits              map[LimitKey]int
 	CreatedAt           time.Time
 	UpdatedAt           time.Time
 }
@@ -21,7 +49,7 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, plan_name, plan_amount, created_at, updated_at
+	query := `select id, plan_name, plan_amount, billing_interval, trial_days, seat_based, created_at, updated_at
 	from plans order by id`
 
 	rows, err := db.QueryContext(ctx, query)
@@ -38,10 +66,14 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 			&plan.ID,
 			&plan.PlanName,
 			&plan.PlanAmount,
+			&plan.Interval,
+			&plan.TrialDays,
+			&plan.SeatBased,
 			&plan.CreatedAt,
 			&plan.UpdatedAt,
 		)
 
+		plan.Currency = DefaultCurrency
 		plan.PlanAmountFormatted = plan.AmountForDisplay()
 		if err != nil {
 			log.Println("Error scanning", err)
@@ -51,6 +83,16 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 		plans = append(plans, &plan)
 	}
 
+	for _, plan := range plans {
+		if err := plan.loadEntitlements(ctx); err != nil {
+			return nil, err
+		}
+
+		if err := plan.loadPrices(ctx); err != nil {
+			return nil, err
+		}
+	}
+
 	return plans, nil
 }
 
@@ -59,7 +101,8 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, plan_name, plan_amount, created_at, updated_at from plans where id = $1`
+	query := `select id, plan_name, plan_amount, billing_interval, trial_days, seat_based, created_at, updated_at
+	from plans where id = $1`
 
 	var plan Plan
 	row := db.QueryRowContext(ctx, query, id)
@@ -68,6 +111,9 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
+		&plan.Interval,
+		&plan.TrialDays,
+		&plan.SeatBased,
 		&plan.CreatedAt,
 		&plan.UpdatedAt,
 	)
@@ -76,37 +122,263 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 		return nil, err
 	}
 
+	plan.Currency = DefaultCurrency
 	plan.PlanAmountFormatted = plan.AmountForDisplay()
 
+	if err := plan.loadEntitlements(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := plan.loadPrices(ctx); err != nil {
+		return nil, err
+	}
+
 	return &plan, nil
 }
 
+// loadEntitlements fills in the features and limits granted by the plan
+func (p *Plan) loadEntitlements(ctx context.Context) error {
+	query := `select feature from plan_features where plan_id = $1 order by id`
+
+	rows, err := db.QueryContext(ctx, query, p.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	p.Features = nil
+	for rows.Next() {
+		var feature Feature
+		if err := rows.Scan(&feature); err != nil {
+			log.Println("Error scanning", err)
+			return err
+		}
+		p.Features = append(p.Features, feature)
+	}
+
+	query = `select limit_key, limit_value from plan_limits where plan_id = $1`
+
+	rows, err = db.QueryContext(ctx, query, p.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	p.Limits = make(map[LimitKey]int)
+	for rows.Next() {
+		var key LimitKey
+		var value int
+		if err := rows.Scan(&key, &value); err != nil {
+			log.Println("Error scanning", err)
+			return err
+		}
+		p.Limits[key] = value
+	}
+
+	return nil
+}
+
 // SubscribeUserToPlan subscribes a user to one plan by insert
-// values into user_plans table
-func (p *Plan) SubscribeUserToPlan(user User, plan Plan) error {
+// values into user_plans table. When the plan has a trial period, the first charge
+// is due at the end of the trial; a user only gets one trial, so switching plans
+// after a trial makes the first charge due right away.
+// The coupon is optional; if given, it's redeemed in the same transaction, and
+// ErrCouponNotRedeemable is returned when it has run out of redemptions meanwhile.
+func (p *Plan) SubscribeUserToPlan(user User, plan Plan, coupon *Coupon) (*Subscription, error) {
+	sub := Subscription{
+		UserID: user.ID,
+		Seats:  1,
+	}
+
+	// the own subscription of the user, not the ones they pay for their organizations
+	scope := `user_id = $1 and organization_id is null`
+
+	return p.subscribe(sub, scope, "users", user.ID, user, plan, coupon)
+}
+
+// SubscribeOrganizationToPlan subscribes an organization to one seat based plan. The owner
+// pays for one seat per member of the organization, and every member is covered by the plan.
+func (p *Plan) SubscribeOrganizationToPlan(org Organization, owner User, plan Plan) (*Subscription, error) {
+	if !plan.SeatBased {
+		return nil, ErrNotSeatBased
+	}
+
+	sub := Subscription{
+		UserID:         owner.ID,
+		OrganizationID: sql.NullInt32{Int32: int32(org.ID), Valid: true},
+	}
+
+	scope := `organization_id = $1`
+
+	return p.subscribe(sub, scope, "organizations", org.ID, owner, plan, nil)
+}
+
+// subscribe replaces the subscriptions in scope, a condition on user_plans taking scopeID,
+// with a new subscription to the plan. The subscriber is the table of the user or organization
+// whose id is scopeID, which records whether they have had a trial.
+func (p *Plan) subscribe(sub Subscription, scope, subscriber string, scopeID int, payer User, plan Plan, coupon *Coupon) (*Subscription, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// check if the subscriber has already had a trial; it's recorded on the subscriber rather than
+	// on their subscriptions, which are deleted on every change of plan
+	var hadTrial bool
+	query := `select trial_used_at is not null from ` + subscriber + ` where id = $1 for update`
+	if err := tx.QueryRowContext(ctx, query, scopeID).Scan(&hadTrial); err != nil {
+		return nil, err
+	}
+
 	// delete existing plan, if any
-	stmt := `delete from user_plans where user_id = $1`
-	_, err := db.ExecContext(ctx, stmt, user.ID)
+	stmt := `delete from user_plans where ` + scope
+	_, err = tx.ExecContext(ctx, stmt, scopeID)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// an organization pays for every member
+	if sub.OrganizationID.Valid {
+		query = `select count(id) from organization_members where organization_id = $1`
+		if err := tx.QueryRowContext(ctx, query, sub.OrganizationID).Scan(&sub.Seats); err != nil {
+			return nil, err
+		}
+	}
+
+	// postgres keeps timestamps in microseconds, so do the same to be able to compare them later
+	now := time.Now().Truncate(time.Microsecond)
+	sub.PlanID = plan.ID
+	sub.Currency = plan.Currency
+	sub.Amount = plan.PlanAmount
+	sub.NextChargeAt = now // the first interval is charged right away
+	sub.CreatedAt = now
+	sub.UpdatedAt = now
+	if plan.startTrial(&sub, hadTrial, now) {
+		stmt = `update ` + subscriber + ` set trial_used_at = $1 where id = $2`
+		if _, err := tx.ExecContext(ctx, stmt, now, scopeID); err != nil {
+			return nil, err
+		}
+	}
+
+	if coupon != nil {
+		sub.CouponID = sql.NullInt32{Int32: int32(coupon.ID), Valid: true}
+		sub.DiscountAmount = coupon.DiscountFor(sub.Total())
+		if intervals := coupon.Intervals(); intervals >= 0 {
+			sub.DiscountIntervalsLeft = sql.NullInt32{Int32: int32(intervals), Valid: true}
+		}
 	}
 
 	// subscribe to new plan
-	stmt = `insert into user_plans (user_id, plan_id, created_at, updated_at)
-			values ($1, $2, $3, $4)`
+	stmt = `insert into user_plans (user_id, organization_id, plan_id, seats, currency, amount, coupon_id,
+			discount_amount, discount_intervals_left, trial_starts_at, trial_ends_at, next_charge_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) returning id`
 
-	_, err = db.ExecContext(ctx, stmt, user.ID, plan.ID, time.Now(), time.Now())
+	err = tx.QueryRowContext(ctx, stmt,
+		sub.UserID,
+		sub.OrganizationID,
+		sub.PlanID,
+		sub.Seats,
+		sub.Currency,
+		sub.Amount,
+		sub.CouponID,
+		sub.DiscountAmount,
+		sub.DiscountIntervalsLeft,
+		sub.TrialStartsAt,
+		sub.TrialEndsAt,
+		sub.NextChargeAt,
+		sub.CreatedAt,
+		sub.UpdatedAt,
+	).Scan(&sub.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if coupon != nil {
+		if err := coupon.redeem(ctx, tx, sub, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	sub.User = &payer
+	sub.Plan = &plan
+
+	return &sub, nil
+}
+
+// startTrial starts the trial of the plan on the new subscription, unless the plan has none or the
+// subscriber has already had one, in which case the first charge stays due right away. It reports
+// whether the trial has started.
+func (p *Plan) startTrial(sub *Subscription, hadTrial bool, now time.Time) bool {
+	if p.TrialDays <= 0 || hadTrial {
+		return false
+	}
+
+	trialEndsAt := now.AddDate(0, 0, p.TrialDays)
+	sub.TrialStartsAt = sql.NullTime{Time: now, Valid: true}
+	sub.TrialEndsAt = sql.NullTime{Time: trialEndsAt, Valid: true}
+	sub.NextChargeAt = trialEndsAt
+
+	return true
+}
+
+// AmountForDisplay formats the price of the plan as a currency string in the default locale
+func (p *Plan) AmountForDisplay() string {
+	return FormatAmount(p.PlanAmount, p.Currency, DefaultLocale)
+}
+
+// loadPrices fills in the prices of the plan in every currency it's priced in
+func (p *Plan) loadPrices(ctx context.Context) error {
+	query := `select currency, amount from plan_prices where plan_id = $1`
+
+	rows, err := db.QueryContext(ctx, query, p.ID)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
+
+	p.Prices = make(map[Currency]int)
+	for rows.Next() {
+		var currency Currency
+		var amount int
+		if err := rows.Scan(&currency, &amount); err != nil {
+			log.Println("Error scanning", err)
+			return err
+		}
+		p.Prices[currency] = amount
+	}
+
 	return nil
 }
 
-// AmountForDisplay formats the price we have in the DB as a currency string
-func (p *Plan) AmountForDisplay() string {
-	amount := float64(p.PlanAmount) / 100.0
-	return fmt.Sprintf("$%.2f", amount)
+// Localize switches the price of the plan to the given currency, if the plan is priced in it,
+// and formats it for the locale. Otherwise the price stays in the currency it was in.
+func (p *Plan) Localize(c Currency, locale string) {
+	if amount, ok := p.Prices[c]; ok {
+		p.PlanAmount = amount
+		p.Currency = c
+	}
+	p.PlanAmountFormatted = FormatAmount(p.PlanAmount, p.Currency, locale)
+}
+
+// HasFeature reports whether the plan grants the given feature
+func (p *Plan) HasFeature(feature Feature) bool {
+	for _, f := range p.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// LimitFor returns the value of the given limit for the plan, or 0 when the plan doesn't set it
+func (p *Plan) LimitFor(key LimitKey) int {
+	return p.Limits[key]
 }
@@ -0,0 +1,99 @@
+package data
+
+// Role is what a user is allowed to do on the site, as a bundle of permissions
+type Role string
+
+const (
+	RoleAdmin   Role = "admin"
+	RoleSupport Role = "support"
+	RoleBilling Role = "billing"
+	RoleMember  Role = "member"
+)
+
+// AllRoles lists every role, from the most to the least privileged
+var AllRoles = []Role{
+	RoleAdmin,
+	RoleSupport,
+	RoleBilling,
+	RoleMember,
+}
+
+// Name returns a human readable name for the role
+func (r Role) Name() string {
+	switch r {
+	case RoleAdmin:
+		return "Admin"
+	case RoleSupport:
+		return "Support"
+	case RoleBilling:
+		return "Billing"
+	case RoleMember:
+		return "Member"
+	default:
+		return string(r)
+	}
+}
+
+// Permission is a named action on the site which only some roles may take
+type Permission string
+
+const (
+	ViewAdmin      Permission = "admin:view"
+	ManageCoupons  Permission = "coupons:manage"
+	UnlockAccounts Permission = "accounts:unlock"
+	ViewUsers      Permission = "users:view"
+	ManageUsers    Permission = "users:manage"
+	ManageBilling  Permission = "billing:manage"
+	ResetPasswords Permission = "passwords:reset"
+
+	ImpersonateUsers Permission = "users:impersonate"
+	ViewAuditLog     Permission = "audit:view"
+)
+
+// rolePermissions are the permissions granted to each role. Members have none of them.
+var rolePermissions = map[Role][]Permission{
+	RoleAdmin: {
+		ViewAdmin,
+		ManageCoupons,
+		UnlockAccounts,
+		ViewUsers,
+		ManageUsers,
+		ManageBilling,
+		ResetPasswords,
+		ImpersonateUsers,
+		ViewAuditLog,
+	},
+	RoleSupport: {
+		ViewAdmin,
+		UnlockAccounts,
+		ViewUsers,
+		ResetPasswords,
+		ImpersonateUsers,
+	},
+	RoleBilling: {
+		ViewAdmin,
+		ManageCoupons,
+		ViewUsers,
+		ManageBilling,
+	},
+}
+
+// Can reports whether the role grants the permission
+func (r Role) Can(p Permission) bool {
+	for _, granted := range rolePermissions[r] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Valid reports whether the role is one of AllRoles
+func (r Role) Valid() bool {
+	for _, role := range AllRoles {
+		if role == r {
+			return true
+		}
+	}
+	return false
+}
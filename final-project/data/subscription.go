@@ -0,0 +1,299 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Subscription is the structure which holds one subscription of a user to a plan
+type Subscription struct {
+	ID                    int
+	UserID                int           // the user who pays
+	OrganizationID        sql.NullInt32 // set when the user pays for an organization
+	PlanID                int
+	Seats                 int      // the number of members paid for
+	Currency              Currency // the currency the subscription is charged in
+	Amount                int      // the amount charged every interval, in minor units of Currency
+	CouponID              sql.NullInt32
+	DiscountAmount        int           // taken off Amount while the discount lasts, in minor units of Currency
+	DiscountIntervalsLeft sql.NullInt32 // charges the discount still applies to; null means forever
+	TrialStartsAt         sql.NullTime
+	TrialEndsAt           sql.NullTime
+	NextChargeAt          time.Time
+	TrialReminderSentAt   sql.NullTime
+	CreatedAt             time.Time
+	UpdatedAt             time.Time
+	User                  *User
+	Plan                  *Plan
+}
+
+// InTrial reports whether the subscription is in its trial period at the given time
+func (s *Subscription) InTrial(now time.Time) bool {
+	return s.TrialEndsAt.Valid && now.Before(s.TrialEndsAt.Time)
+}
+
+// Total returns the amount of a charge for all seats, before any discount
+func (s *Subscription) Total() int {
+	if s.Seats < 1 {
+		return s.Amount
+	}
+	return s.Amount * s.Seats
+}
+
+// AmountDue returns the amount of the next charge, after the discount if one still applies
+func (s *Subscription) AmountDue() int {
+	total := s.Total()
+	if !s.HasDiscount() {
+		return total
+	}
+
+	if s.DiscountAmount > total {
+		return 0
+	}
+	return total - s.DiscountAmount
+}
+
+// HasDiscount reports whether the next charge is discounted by a coupon
+func (s *Subscription) HasDiscount() bool {
+	if s.DiscountAmount == 0 {
+		return false
+	}
+	return !s.DiscountIntervalsLeft.Valid || s.DiscountIntervalsLeft.Int32 > 0
+}
+
+// GetByUserID returns the own subscription of one user
+func (s *Subscription) GetByUserID(userID int) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select up.id, up.user_id, up.organization_id, up.plan_id, up.seats, up.currency, coalesce(up.amount, p.plan_amount),
+			up.coupon_id, up.discount_amount, up.discount_intervals_left, up.trial_starts_at, up.trial_ends_at, up.next_charge_at, up.trial_reminder_sent_at, up.created_at, up.updated_at
+			from user_plans up
+			join plans p on (p.id = up.plan_id)
+			where up.user_id = $1 and up.organization_id is null`
+
+	var sub Subscription
+	row := db.QueryRowContext(ctx, query, userID)
+
+	err := row.Scan(
+		&sub.ID,
+		&sub.UserID,
+		&sub.OrganizationID,
+		&sub.PlanID,
+		&sub.Seats,
+		&sub.Currency,
+		&sub.Amount,
+		&sub.CouponID,
+		&sub.DiscountAmount,
+		&sub.DiscountIntervalsLeft,
+		&sub.TrialStartsAt,
+		&sub.TrialEndsAt,
+		&sub.NextChargeAt,
+		&sub.TrialReminderSentAt,
+		&sub.CreatedAt,
+		&sub.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sub, nil
+}
+
+// GetByOrganizationID returns the subscription of one organization
+func (s *Subscription) GetByOrganizationID(orgID int) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select up.id, up.user_id, up.organization_id, up.plan_id, up.seats, up.currency, coalesce(up.amount, p.plan_amount),
+			up.coupon_id, up.discount_amount, up.discount_intervals_left, up.trial_starts_at, up.trial_ends_at, up.next_charge_at, up.trial_reminder_sent_at, up.created_at, up.updated_at
+			from user_plans up
+			join plans p on (p.id = up.plan_id)
+			where up.organization_id = $1`
+
+	var sub Subscription
+	row := db.QueryRowContext(ctx, query, orgID)
+
+	err := row.Scan(
+		&sub.ID,
+		&sub.UserID,
+		&sub.OrganizationID,
+		&sub.PlanID,
+		&sub.Seats,
+		&sub.Currency,
+		&sub.Amount,
+		&sub.CouponID,
+		&sub.DiscountAmount,
+		&sub.DiscountIntervalsLeft,
+		&sub.TrialStartsAt,
+		&sub.TrialEndsAt,
+		&sub.NextChargeAt,
+		&sub.TrialReminderSentAt,
+		&sub.CreatedAt,
+		&sub.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sub, nil
+}
+
+// GetDueForCharge returns all subscriptions whose next charge is due at the given time,
+// along with their users and plans
+func (s *Subscription) GetDueForCharge(now time.Time) ([]*Subscription, error) {
+	where := `up.next_charge_at <= $1`
+	return s.getWithUserAndPlan(where, now)
+}
+
+// GetTrialsEndingBy returns all subscriptions whose trial ends by the given time
+// and whose users haven't been reminded yet, along with their users and plans
+func (s *Subscription) GetTrialsEndingBy(t time.Time) ([]*Subscription, error) {
+	where := `up.trial_ends_at <= $1 and up.trial_reminder_sent_at is null`
+	return s.getWithUserAndPlan(where, t)
+}
+
+func (s *Subscription) getWithUserAndPlan(where string, args ...any) ([]*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select up.id, up.user_id, up.organization_id, up.plan_id, up.seats, up.currency, coalesce(up.amount, p.plan_amount),
+			up.coupon_id, up.discount_amount, up.discount_intervals_left, up.trial_starts_at, up.trial_ends_at, up.next_charge_at, up.trial_reminder_sent_at, up.created_at, up.updated_at,
+			u.email, u.first_name, u.last_name, u.currency, u.locale,
+			p.plan_name, p.billing_interval, p.trial_days, p.seat_based
+			from user_plans up
+			join users u on (u.id = up.user_id)
+			join plans p on (p.id = up.plan_id)
+			where ` + where + `
+			order by up.id`
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []*Subscription
+
+	for rows.Next() {
+		var sub Subscription
+		var user User
+		var plan Plan
+		err := rows.Scan(
+			&sub.ID,
+			&sub.UserID,
+			&sub.OrganizationID,
+			&sub.PlanID,
+			&sub.Seats,
+			&sub.Currency,
+			&sub.Amount,
+			&sub.CouponID,
+			&sub.DiscountAmount,
+			&sub.DiscountIntervalsLeft,
+			&sub.TrialStartsAt,
+			&sub.TrialEndsAt,
+			&sub.NextChargeAt,
+			&sub.TrialReminderSentAt,
+			&sub.CreatedAt,
+			&sub.UpdatedAt,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Currency,
+			&user.Locale,
+			&plan.PlanName,
+			&plan.Interval,
+			&plan.TrialDays,
+			&plan.SeatBased,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		user.ID = sub.UserID
+		plan.ID = sub.PlanID
+		// the plan is charged at the price the user subscribed at
+		plan.PlanAmount = sub.Amount
+		plan.Currency = sub.Currency
+		plan.PlanAmountFormatted = FormatAmount(plan.PlanAmount, plan.Currency, user.Locale)
+		sub.User = &user
+		sub.Plan = &plan
+
+		subs = append(subs, &sub)
+	}
+
+	return subs, nil
+}
+
+// AdvanceNextCharge moves the next charge of the subscription one billing interval forward,
+// claiming the charge that is due and using up one interval of its discount, if any.
+// The update only applies if nobody else has claimed it in the meantime, which is
+// reported by the returned bool.
+func (s *Subscription) AdvanceNextCharge(sub Subscription) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set next_charge_at = $1, updated_at = $2,
+			discount_intervals_left = case when discount_intervals_left > 0
+				then discount_intervals_left - 1 else discount_intervals_left end
+			where id = $3 and next_charge_at = $4`
+
+	res, err := db.ExecContext(ctx, stmt,
+		sub.Plan.Interval.Next(sub.NextChargeAt),
+		time.Now(),
+		sub.ID,
+		sub.NextChargeAt,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// CancelByUserID ends the own subscription of the user at once. Nothing more is charged, and the invoices
+// are kept. It returns sql.ErrNoRows if the user has no subscription.
+func (s *Subscription) CancelByUserID(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from user_plans where user_id = $1 and organization_id is null`
+
+	res, err := db.ExecContext(ctx, stmt, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// MarkTrialReminderSent records that the user has been reminded of the end of the trial
+func (s *Subscription) MarkTrialReminderSent(sub Subscription) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set trial_reminder_sent_at = $1, updated_at = $1 where id = $2`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), sub.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
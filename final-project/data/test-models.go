@@ -2,8 +2,11 @@ package data
 
 import (
 	"database/sql"
-	"fmt"
+	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 // TestNew is the function used to create an instance of the data package. It returns the type
@@ -12,9 +15,24 @@ import (
 func TestNew(dbPool *sql.DB) Models {
 	db = dbPool
 
+	subscribed := &subscribedPlans{byUser: map[int]Plan{}}
+	tokens := &TokenTest{used: map[string]bool{}}
+
 	return Models{
-		User: &UserTest{},
-		Plan: &PlanTest{},
+		User:         &UserTest{},
+		Plan:         &PlanTest{trialsUsed: map[trialSubscriber]bool{}, couponsRedeemed: map[couponRedemption]bool{}, subscribed: subscribed},
+		Subscription: &SubscriptionTest{},
+		Coupon:       &CouponTest{},
+		Entitlement:  &EntitlementTest{subscribed: subscribed},
+		Organization: &OrganizationTest{tokens: tokens},
+		Token:        tokens,
+		TwoFactor:    &TwoFactorTest{},
+		Audit:        &AuditTest{},
+		Identity:     &IdentityTest{},
+		APIToken:     &APITokenTest{},
+		Invoice:      &InvoiceTest{},
+
+		AccountDeletion: &AccountDeletionTest{deletions: map[int]AccountDeletion{}},
 	}
 }
 
@@ -27,7 +45,9 @@ type UserTest struct {
 	LastName  string
 	Password  string
 	Active    int
-	IsAdmin   int
+	Role      Role
+	Currency  Currency
+	Locale    string
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	Plan      *Plan
@@ -38,9 +58,11 @@ var sampleUser = User{
 	Email:     "admin@example.com",
 	FirstName: "Admin",
 	LastName:  "Admin",
-	Password:  "abc",
+	Password:  testPasswordHash,
 	IsActive:  Active,
-	IsAdmin:   Admin,
+	Role:      RoleAdmin,
+	Currency:  DefaultCurrency,
+	Locale:    DefaultLocale,
 	CreatedAt: time.Now(),
 	UpdatedAt: time.Now(),
 }
@@ -56,15 +78,114 @@ func (u *UserTest) GetAll() ([]*User, error) {
 	return users, nil
 }
 
-// GetByEmail returns one user by email
+// sampleTwoFactorUser has enabled two-factor authentication
+var sampleTwoFactorUser = User{
+	ID:        2,
+	Email:     "2fa@example.com",
+	FirstName: "Two",
+	LastName:  "Factor",
+	Password:  testPasswordHash,
+	IsActive:  Active,
+	Role:      RoleMember,
+	Currency:  DefaultCurrency,
+	Locale:    DefaultLocale,
+	CreatedAt: time.Now(),
+	UpdatedAt: time.Now(),
+}
+
+// sampleInactiveUser has yet to activate their account
+var sampleInactiveUser = User{
+	ID:        3,
+	Email:     "inactive@example.com",
+	FirstName: "Not",
+	LastName:  "Activated",
+	Password:  testPasswordHash,
+	IsActive:  Inactive,
+	Role:      RoleMember,
+	Currency:  DefaultCurrency,
+	Locale:    DefaultLocale,
+	CreatedAt: time.Now(),
+	UpdatedAt: time.Now(),
+}
+
+// sampleNoPasswordUser has signed up with an identity provider, and only logs in with it
+var sampleNoPasswordUser = User{
+	ID:        6,
+	Email:     "sso@example.com",
+	FirstName: "Single",
+	LastName:  "SignOn",
+	IsActive:  Active,
+	Role:      RoleMember,
+	Currency:  DefaultCurrency,
+	Locale:    DefaultLocale,
+	CreatedAt: time.Now(),
+	UpdatedAt: time.Now(),
+}
+
+// Search returns one page of the sample users whose email or name contains the term
+func (u *UserTest) Search(term string, limit, offset int) ([]*User, int, error) {
+	var matches []*User
+	for _, sample := range []User{sampleUser, sampleTwoFactorUser, sampleInactiveUser} {
+		name := strings.ToLower(sample.Email + " " + sample.FirstName + " " + sample.LastName)
+		if strings.Contains(name, strings.ToLower(term)) {
+			user := sample
+			matches = append(matches, &user)
+		}
+	}
+
+	total := len(matches)
+	if offset > total {
+		offset = total
+	}
+	if offset+limit < total {
+		matches = matches[:offset+limit]
+	}
+
+	return matches[offset:], total, nil
+}
+
+// TestPassword is the password of the sample users who have one
+const TestPassword = "abc123abc123abc123abc123"
+
+// testPasswordHash is TestPassword as stored, hashed at the lowest cost to keep the tests fast
+var testPasswordHash = func() string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(TestPassword), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	return string(hash)
+}()
+
+// TestUnregisteredDomain is the domain of the emails no user has registered with
+const TestUnregisteredDomain = "unregistered.example.com"
+
+// TestNewUserID is the ID of every user inserted
+const TestNewUserID = 10
+
+// GetByEmail returns one user by email. Any email other than those of the other sample users
+// is the one of sampleUser, but for those at TestUnregisteredDomain.
 func (u *UserTest) GetByEmail(email string) (*User, error) {
+	if strings.HasSuffix(strings.ToLower(email), "@"+TestUnregisteredDomain) {
+		return nil, sql.ErrNoRows
+	}
+
 	user := sampleUser
+	for _, other := range []User{sampleTwoFactorUser, sampleInactiveUser, sampleNoPasswordUser} {
+		if strings.EqualFold(email, other.Email) {
+			user = other
+		}
+	}
 
 	return &user, nil
 }
 
 // GetOne returns one user by id
 func (u *UserTest) GetOne(id int) (*User, error) {
+	for _, other := range []User{sampleTwoFactorUser, sampleInactiveUser, sampleNoPasswordUser} {
+		if id == other.ID {
+			return u.GetByEmail(other.Email)
+		}
+	}
 	return u.GetByEmail("")
 }
 
@@ -74,6 +195,11 @@ func (u *UserTest) Update(user User) error {
 	return nil
 }
 
+// SetRole changes the role of one user
+func (u *UserTest) SetRole(userID int, role Role) error {
+	return nil
+}
+
 // Delete deletes one user from the database, by User.ID
 func (u *UserTest) Delete(user User) error {
 	return nil
@@ -86,19 +212,26 @@ func (u *UserTest) DeleteByID(id int) error {
 
 // Insert inserts a new user into the database, and returns the ID of the newly inserted row
 func (u *UserTest) Insert(user User) (int, error) {
-	return 2, nil
+	if strings.EqualFold(user.Email, sampleUser.Email) {
+		return 0, ErrDuplicateEmail
+	}
+	return TestNewUserID, nil
 }
 
 // ResetPassword is the method we will use to change a user's password.
-func (u *UserTest) ResetPassword(password string) error {
+func (u *UserTest) ResetPassword(user User, password string) error {
 	return nil
 }
 
-// PasswordMatches uses Go's bcrypt package to compare a user supplied password
-// with the hash we have stored for a given user in the database. If the password
-// and hash match, we return true; otherwise, we return false.
+// RemovePassword removes the password of a user
+func (u *UserTest) RemovePassword(userID int) error {
+	return nil
+}
+
+// PasswordMatches compares a user supplied password with TestPassword, the password
+// of the sample users. If they match, we return true; otherwise, we return false.
 func (u *UserTest) PasswordMatches(plainText string) (bool, error) {
-	return true, nil
+	return plainText == TestPassword, nil
 }
 
 type PlanTest struct {
@@ -106,43 +239,781 @@ type PlanTest struct {
 	PlanName            string
 	PlanAmount          int
 	PlanAmountFormatted string
+	Currency            Currency
+	Prices              map[Currency]int
+	Interval            Interval
+	TrialDays           int
+	SeatBased           bool
+	Features            []Feature
+	Limits              map[LimitKey]int
 	CreatedAt           time.Time
 	UpdatedAt           time.Time
+
+	mu              sync.Mutex
+	trialsUsed      map[trialSubscriber]bool // as trial_used_at of users and organizations
+	couponsRedeemed map[couponRedemption]bool
+	subscribed      *subscribedPlans
+}
+
+// couponRedemption is a coupon redeemed by a user, which they only redeem once
+type couponRedemption struct {
+	couponID int
+	userID   int
+}
+
+// subscribedPlans are the plans users have subscribed to with the test models, shared by
+// PlanTest and EntitlementTest. Users who haven't subscribed to any are on the sample plan.
+type subscribedPlans struct {
+	mu     sync.Mutex
+	byUser map[int]Plan
+}
+
+// of returns the plan of the user
+func (s *subscribedPlans) of(userID int) Plan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if plan, ok := s.byUser[userID]; ok {
+		return plan
+	}
+	return samplePlan
+}
+
+// set changes the plan of the user
+func (s *subscribedPlans) set(userID int, plan Plan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.byUser[userID] = plan
+}
+
+// trialSubscriber is a user or an organization, which only gets one trial
+type trialSubscriber struct {
+	organization bool
+	id           int
 }
 
 var samplePlan = Plan{
 	ID:         1,
 	PlanName:   "Bronze Plan",
 	PlanAmount: 1000,
-	CreatedAt:  time.Now(),
-	UpdatedAt:  time.Now(),
+	Currency:   DefaultCurrency,
+	Prices: map[Currency]int{
+		USD: 1000,
+		EUR: 900,
+		JPY: 1500,
+	},
+	Interval:  Monthly,
+	TrialDays: 0,
+	Features:  []Feature{EmailSupport, APIAccess},
+	Limits: map[LimitKey]int{
+		MaxSessions:  1,
+		MaxAPITokens: 2,
+	},
+	CreatedAt: time.Now(),
+	UpdatedAt: time.Now(),
 }
 
 func (p *PlanTest) GetAll() ([]*Plan, error) {
 	var plans []*Plan
 
-	plan := samplePlan
+	for _, sample := range []Plan{samplePlan, sampleTeamPlan} {
+		plan := sample
+		plan.PlanAmountFormatted = plan.AmountForDisplay()
 
-	plans = append(plans, &plan)
+		plans = append(plans, &plan)
+	}
 
 	return plans, nil
 }
 
-// GetOne returns one plan by id
+var sampleTeamPlan = Plan{
+	ID:         5,
+	PlanName:   "Team Plan",
+	PlanAmount: 1500,
+	Currency:   DefaultCurrency,
+	Prices: map[Currency]int{
+		USD: 1500,
+	},
+	Interval:  Monthly,
+	SeatBased: true,
+	Features:  []Feature{EmailSupport, UserManual, PrioritySupport},
+	Limits: map[LimitKey]int{
+		MaxSessions:  3,
+		MaxAPITokens: 0,
+	},
+	CreatedAt: time.Now(),
+	UpdatedAt: time.Now(),
+}
+
+// GetOne returns one plan by id, the sample team plan for its id and the sample plan otherwise
 func (p *PlanTest) GetOne(id int) (*Plan, error) {
 	plan := samplePlan
+	if id == sampleTeamPlan.ID {
+		plan = sampleTeamPlan
+	}
+	plan.PlanAmountFormatted = plan.AmountForDisplay()
 
 	return &plan, nil
 }
 
 // SubscribeUserToPlan subscribes a user to one plan by insert
 // values into user_plans table
-func (p *PlanTest) SubscribeUserToPlan(user User, plan Plan) error {
+func (p *PlanTest) SubscribeUserToPlan(user User, plan Plan, coupon *Coupon) (*Subscription, error) {
+	sub := sampleSubscription
+	sub.UserID = user.ID
+	sub.PlanID = plan.ID
+	p.startTrial(&sub, trialSubscriber{id: user.ID}, plan)
+	if coupon != nil {
+		if err := p.redeem(couponRedemption{couponID: coupon.ID, userID: user.ID}); err != nil {
+			return nil, err
+		}
+		sub.CouponID = sql.NullInt32{Int32: int32(coupon.ID), Valid: true}
+		sub.DiscountAmount = coupon.DiscountFor(plan.PlanAmount)
+	}
+	sub.User = &user
+	sub.Plan = &plan
+	p.subscribed.set(user.ID, plan)
+
+	return &sub, nil
+}
+
+// SubscribeOrganizationToPlan subscribes an organization to one seat based plan
+func (p *PlanTest) SubscribeOrganizationToPlan(org Organization, owner User, plan Plan) (*Subscription, error) {
+	if !plan.SeatBased {
+		return nil, ErrNotSeatBased
+	}
+
+	sub := sampleSubscription
+	sub.UserID = owner.ID
+	sub.OrganizationID = sql.NullInt32{Int32: int32(org.ID), Valid: true}
+	sub.PlanID = plan.ID
+	sub.Seats = len(org.Members)
+	sub.Amount = plan.PlanAmount
+	p.startTrial(&sub, trialSubscriber{organization: true, id: org.ID}, plan)
+	sub.User = &owner
+	sub.Plan = &plan
+
+	return &sub, nil
+}
+
+// startTrial starts the trial of the plan on the subscription, unless the subscriber has already had one
+func (p *PlanTest) startTrial(sub *Subscription, subscriber trialSubscriber, plan Plan) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if plan.startTrial(sub, p.trialsUsed[subscriber], time.Now()) {
+		p.trialsUsed[subscriber] = true
+	}
+}
+
+// redeem records the redemption, unless the user has already redeemed the coupon
+func (p *PlanTest) redeem(redemption couponRedemption) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.couponsRedeemed[redemption] {
+		return ErrCouponRedeemed
+	}
+	p.couponsRedeemed[redemption] = true
+
 	return nil
 }
 
-// AmountForDisplay formats the price we have in the DB as a currency string
+// AmountForDisplay formats the price of the plan as a currency string in the default locale
 func (p *PlanTest) AmountForDisplay() string {
-	amount := float64(p.PlanAmount) / 100.0
-	return fmt.Sprintf("$%.2f", amount)
+	return FormatAmount(p.PlanAmount, p.Currency, DefaultLocale)
+}
+
+var sampleSubscription = Subscription{
+	ID:           1,
+	UserID:       1,
+	PlanID:       1,
+	Currency:     DefaultCurrency,
+	Seats:        1,
+	Amount:       1000,
+	NextChargeAt: time.Now().AddDate(0, 1, 0),
+	CreatedAt:    time.Now(),
+	UpdatedAt:    time.Now(),
+}
+
+// SubscriptionTest is the structure which holds one subscription from the database,
+// and is used for testing.
+type SubscriptionTest struct{}
+
+// GetByUserID returns the subscription of one user
+func (s *SubscriptionTest) GetByUserID(userID int) (*Subscription, error) {
+	sub := sampleSubscription
+
+	return &sub, nil
+}
+
+// GetByOrganizationID returns no subscription, as the sample organization has none
+func (s *SubscriptionTest) GetByOrganizationID(orgID int) (*Subscription, error) {
+	return nil, sql.ErrNoRows
+}
+
+// GetDueForCharge returns the sample subscription with its user and plan, as if it were due
+func (s *SubscriptionTest) GetDueForCharge(now time.Time) ([]*Subscription, error) {
+	sub := sampleSubscription
+	user := sampleUser
+	plan := samplePlan
+	sub.User = &user
+	sub.Plan = &plan
+
+	return []*Subscription{&sub}, nil
+}
+
+// GetTrialsEndingBy returns no subscriptions, as the sample plan has no trial
+func (s *SubscriptionTest) GetTrialsEndingBy(t time.Time) ([]*Subscription, error) {
+	return nil, nil
+}
+
+// CancelByUserID ends the subscription of the user
+func (s *SubscriptionTest) CancelByUserID(userID int) error {
+	return nil
+}
+
+// AdvanceNextCharge moves the next charge of the subscription one billing interval forward
+func (s *SubscriptionTest) AdvanceNextCharge(sub Subscription) (bool, error) {
+	return true, nil
+}
+
+// MarkTrialReminderSent records that the user has been reminded of the end of the trial
+func (s *SubscriptionTest) MarkTrialReminderSent(sub Subscription) error {
+	return nil
+}
+
+var sampleCoupon = Coupon{
+	ID:         1,
+	Code:       "WELCOME10",
+	PercentOff: 10,
+	Currency:   DefaultCurrency,
+	Duration:   Once,
+	CreatedAt:  time.Now(),
+	UpdatedAt:  time.Now(),
+}
+
+// CouponTest is the structure which holds one coupon from the database,
+// and is used for testing.
+type CouponTest struct{}
+
+// GetAll returns a slice of all coupons, newest first
+func (c *CouponTest) GetAll() ([]*Coupon, error) {
+	coupon := sampleCoupon
+
+	return []*Coupon{&coupon}, nil
+}
+
+// GetByCode returns the sample coupon if the code matches it
+func (c *CouponTest) GetByCode(code string) (*Coupon, error) {
+	if NormalizeCouponCode(code) != sampleCoupon.Code {
+		return nil, sql.ErrNoRows
+	}
+	coupon := sampleCoupon
+
+	return &coupon, nil
+}
+
+// Insert inserts a new coupon into the database, and returns the ID of the newly inserted row
+func (c *CouponTest) Insert(coupon Coupon) (int, error) {
+	return 2, nil
+}
+
+// EntitlementTest treats every user as a subscriber of the plan they have last subscribed to with PlanTest,
+// or of the sample plan if they haven't, and is used for testing.
+type EntitlementTest struct {
+	subscribed *subscribedPlans
+}
+
+// CanUse reports whether the plan of the user grants the feature
+func (e *EntitlementTest) CanUse(user User, feature Feature) (bool, error) {
+	plan := e.subscribed.of(user.ID)
+	return plan.HasFeature(feature), nil
+}
+
+// Limit returns the value of the limit set by the plan of the user
+func (e *EntitlementTest) Limit(user User, key LimitKey) (int, error) {
+	plan := e.subscribed.of(user.ID)
+	return plan.LimitFor(key), nil
+}
+
+var sampleOrganization = Organization{
+	ID:        1,
+	Name:      "Example Inc.",
+	OwnerID:   1,
+	CreatedAt: time.Now(),
+	UpdatedAt: time.Now(),
+	Members: []*OrganizationMember{
+		{
+			ID:             1,
+			OrganizationID: 1,
+			UserID:         1,
+			Role:           Owner,
+			Email:          "admin@example.com",
+			FirstName:      "Admin",
+			LastName:       "Admin",
+			CreatedAt:      time.Now(),
+		},
+		{
+			ID:             2,
+			OrganizationID: 1,
+			UserID:         4,
+			Role:           Member,
+			Email:          "colleague@example.com",
+			FirstName:      "Col",
+			LastName:       "League",
+			CreatedAt:      time.Now(),
+		},
+	},
+}
+
+var sampleInvitation = Invitation{
+	ID:             1,
+	OrganizationID: 1,
+	Email:          "member@example.com",
+	InvitedBy:      1,
+	CreatedAt:      time.Now(),
+	UpdatedAt:      time.Now(),
+}
+
+// OrganizationTest is the structure which holds one organization from the database,
+// and is used for testing. The sample user owns the sample organization, which has one other member.
+type OrganizationTest struct {
+	tokens *TokenTest // the tokens of the links invitations are accepted with
+}
+
+// GetByUserID returns the sample organization if the user is a member of it
+func (o *OrganizationTest) GetByUserID(userID int) (*Organization, error) {
+	for _, member := range sampleOrganization.Members {
+		if member.UserID == userID {
+			org := sampleOrganization
+			return &org, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// Insert inserts a new organization into the database, and returns the ID of the newly inserted row
+func (o *OrganizationTest) Insert(org Organization) (int, error) {
+	if _, err := o.GetByUserID(org.OwnerID); err == nil {
+		return 0, ErrAlreadyMember
+	}
+
+	return 2, nil
+}
+
+// Invite records an invitation to join the organization sent to the email
+func (o *OrganizationTest) Invite(org Organization, email string, invitedBy User) (*Invitation, error) {
+	inv := sampleInvitation
+	inv.OrganizationID = org.ID
+	inv.Email = email
+	inv.InvitedBy = invitedBy.ID
+
+	return &inv, nil
+}
+
+// GetInvitation returns the sample invitation if the id matches it
+func (o *OrganizationTest) GetInvitation(id int) (*Invitation, error) {
+	if id != sampleInvitation.ID {
+		return nil, sql.ErrNoRows
+	}
+	inv := sampleInvitation
+
+	return &inv, nil
+}
+
+// AcceptInvitation adds the user the invitation was sent to as a member of the organization,
+// unless they are a member of the sample organization already, and consumes the token
+func (o *OrganizationTest) AcceptInvitation(inv Invitation, user User, token Token) error {
+	if !strings.EqualFold(inv.Email, user.Email) {
+		return ErrInvitationEmail
+	}
+	for _, m := range sampleOrganization.Members {
+		if m.UserID == user.ID {
+			return ErrAlreadyMember
+		}
+	}
+
+	return o.tokens.Consume(token.Nonce, token.Purpose)
+}
+
+// RemoveMember removes the user from the organization. The owner can't be removed.
+func (o *OrganizationTest) RemoveMember(org Organization, userID int) error {
+	if org.IsOwner(userID) {
+		return ErrRemoveOwner
+	}
+
+	return nil
+}
+
+// UsedTokenNonce is the nonce of a token TokenTest treats as used
+const UsedTokenNonce = "used"
+
+// TokenTest is the structure which holds the record of one signed token, and is used for testing.
+type TokenTest struct {
+	used  map[string]bool // the nonces of the tokens consumed
+	mutex sync.Mutex
+}
+
+// Insert records a newly issued token
+func (t *TokenTest) Insert(token Token) error {
+	return nil
+}
+
+// Consume marks the token with the nonce as used. The token with UsedTokenNonce is used already.
+func (t *TokenTest) Consume(nonce, purpose string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if nonce == UsedTokenNonce || t.used[nonce] {
+		return ErrTokenUsed
+	}
+	t.used[nonce] = true
+
+	return nil
+}
+
+// TestTOTPSecret is the secret of the authenticators TwoFactorTest has
+const TestTOTPSecret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+
+// TestRecoveryCode is the only recovery code TwoFactorTest accepts
+const TestRecoveryCode = "abcd-efgh"
+
+// TwoFactorTest is the structure which holds the authenticator of one user, and is used for testing.
+type TwoFactorTest struct{}
+
+// GetByUserID returns an enabled authenticator for sampleTwoFactorUser,
+// a pending one for sampleUser, and none for anyone else
+func (t *TwoFactorTest) GetByUserID(userID int) (*TwoFactor, error) {
+	tf := TwoFactor{
+		ID:        userID,
+		UserID:    userID,
+		Secret:    TestTOTPSecret,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	switch userID {
+	case sampleTwoFactorUser.ID:
+		tf.EnabledAt = sql.NullTime{Time: time.Now(), Valid: true}
+		return &tf, nil
+	case sampleUser.ID:
+		return &tf, nil
+	default:
+		return nil, sql.ErrNoRows
+	}
+}
+
+// Enroll records a pending authenticator for the user
+func (t *TwoFactorTest) Enroll(userID int, secret string) error {
+	if userID == sampleTwoFactorUser.ID {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// Enable enables the pending authenticator
+func (t *TwoFactorTest) Enable(tf TwoFactor, recoveryCodes []string) error {
+	return nil
+}
+
+// Disable removes the authenticator of the user
+func (t *TwoFactorTest) Disable(userID int) error {
+	return nil
+}
+
+// UseRecoveryCode reports whether the code is TestRecoveryCode
+func (t *TwoFactorTest) UseRecoveryCode(userID int, code string) (bool, error) {
+	return userID == sampleTwoFactorUser.ID && code == TestRecoveryCode, nil
+}
+
+// UseTimeStep accepts every time step of the authenticator of sampleTwoFactorUser, which is
+// returned by GetByUserID as if it had never been used
+func (t *TwoFactorTest) UseTimeStep(userID int, step int64) (bool, error) {
+	return userID == sampleTwoFactorUser.ID, nil
+}
+
+// AuditTest keeps the events in memory, so that tests can check what has been recorded
+type AuditTest struct {
+	mutex  sync.Mutex
+	events []AuditEvent
+}
+
+// Insert appends one event to the audit log
+func (a *AuditTest) Insert(event AuditEvent) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	event.ID = len(a.events) + 1
+	event.CreatedAt = time.Now()
+	a.events = append(a.events, event)
+
+	return nil
+}
+
+// Events returns the events recorded so far, oldest first
+func (a *AuditTest) Events() []AuditEvent {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return append([]AuditEvent(nil), a.events...)
+}
+
+// Find returns the events matching the filter, newest first, along with how many there are in all
+func (a *AuditTest) Find(filter AuditFilter, limit, offset int) ([]*AuditEvent, int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var matches []*AuditEvent
+	for i := len(a.events) - 1; i >= 0; i-- {
+		if filter.matches(a.events[i]) {
+			event := a.events[i]
+			matches = append(matches, &event)
+		}
+	}
+
+	total := len(matches)
+	if offset > total {
+		offset = total
+	}
+	if limit > 0 && offset+limit < total {
+		matches = matches[:offset+limit]
+	}
+
+	return matches[offset:], total, nil
+}
+
+// IdentityTest keeps the identities in memory, so that tests can check which have been linked
+type IdentityTest struct {
+	mutex      sync.Mutex
+	identities []Identity
+}
+
+// GetBySubject returns the identity of the subject at the issuer
+func (i *IdentityTest) GetBySubject(issuer, subject string) (*Identity, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	for _, identity := range i.identities {
+		if identity.Issuer == issuer && identity.Subject == subject {
+			return &identity, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// GetByUserID returns the identities linked to the user, oldest first
+func (i *IdentityTest) GetByUserID(userID int) ([]*Identity, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	var identities []*Identity
+	for _, identity := range i.identities {
+		if identity.UserID == userID {
+			identity := identity
+			identities = append(identities, &identity)
+		}
+	}
+	return identities, nil
+}
+
+// Insert links an identity to a user
+func (i *IdentityTest) Insert(identity Identity) (int, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	for _, other := range i.identities {
+		if other.Issuer == identity.Issuer && other.Subject == identity.Subject {
+			return 0, ErrIdentityLinked
+		}
+	}
+
+	identity.ID = len(i.identities) + 1
+	identity.CreatedAt = time.Now()
+	identity.UpdatedAt = time.Now()
+	i.identities = append(i.identities, identity)
+
+	return identity.ID, nil
+}
+
+// APITokenTest keeps the api tokens in memory, along with their hashes, so that tests can use them
+type APITokenTest struct {
+	mutex  sync.Mutex
+	tokens []APIToken
+	hashes []string
+}
+
+// GetByUserID returns the api tokens of the user, newest first
+func (t *APITokenTest) GetByUserID(userID int) ([]*APIToken, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var tokens []*APIToken
+	for i := len(t.tokens) - 1; i >= 0; i-- {
+		if t.tokens[i].UserID == userID {
+			token := t.tokens[i]
+			tokens = append(tokens, &token)
+		}
+	}
+	return tokens, nil
+}
+
+// GetByToken returns the record of the token, whether it has expired or not
+func (t *APITokenTest) GetByToken(token string) (*APIToken, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i, hash := range t.hashes {
+		if hash == hashAPIToken(token) {
+			apiToken := t.tokens[i]
+			return &apiToken, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// Insert records the token
+func (t *APITokenTest) Insert(apiToken APIToken, token string) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	apiToken.ID = len(t.tokens) + 1
+	apiToken.Prefix = apiTokenPrefix(token)
+	apiToken.CreatedAt = time.Now()
+	apiToken.UpdatedAt = time.Now()
+	t.tokens = append(t.tokens, apiToken)
+	t.hashes = append(t.hashes, hashAPIToken(token))
+
+	return apiToken.ID, nil
+}
+
+// Touch records that the token has just been used
+func (t *APITokenTest) Touch(id int) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i := range t.tokens {
+		if t.tokens[i].ID == id {
+			t.tokens[i].LastUsedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+	}
+	return nil
+}
+
+// Revoke deletes one api token of the user
+func (t *APITokenTest) Revoke(userID, id int) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i := range t.tokens {
+		if t.tokens[i].ID == id && t.tokens[i].UserID == userID {
+			// keep the ids of the others
+			t.tokens[i].UserID = 0
+			t.hashes[i] = ""
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// InvoiceTest keeps the invoices in memory, so that tests can check which have been recorded
+type InvoiceTest struct {
+	mutex    sync.Mutex
+	invoices []Invoice
+}
+
+// Insert records one invoice
+func (i *InvoiceTest) Insert(inv Invoice) (int, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	inv.ID = len(i.invoices) + 1
+	inv.CreatedAt = time.Now()
+	inv.UpdatedAt = time.Now()
+	i.invoices = append(i.invoices, inv)
+
+	return inv.ID, nil
+}
+
+// GetByUserID returns the invoices the user has paid, newest first, along with how many there are in all
+func (i *InvoiceTest) GetByUserID(userID, limit, offset int) ([]*Invoice, int, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	var matches []*Invoice
+	for j := len(i.invoices) - 1; j >= 0; j-- {
+		if i.invoices[j].UserID.Valid && int(i.invoices[j].UserID.Int32) == userID {
+			inv := i.invoices[j]
+			matches = append(matches, &inv)
+		}
+	}
+
+	total := len(matches)
+	if offset >= total {
+		return nil, total, nil
+	}
+	if limit > 0 && offset+limit < total {
+		return matches[offset : offset+limit], total, nil
+	}
+	return matches[offset:], total, nil
+}
+
+// AccountDeletionTest keeps the scheduled deletions in memory, by user id
+type AccountDeletionTest struct {
+	mutex     sync.Mutex
+	deletions map[int]AccountDeletion
+}
+
+// Schedule schedules the deletion of the account of the user
+func (d *AccountDeletionTest) Schedule(userID int, deleteAfter time.Time) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.deletions[userID] = AccountDeletion{UserID: userID, DeleteAfter: deleteAfter, CreatedAt: time.Now()}
+	return nil
+}
+
+// GetByUserID returns the scheduled deletion of the account of the user, or sql.ErrNoRows if there is none
+func (d *AccountDeletionTest) GetByUserID(userID int) (*AccountDeletion, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	deletion, ok := d.deletions[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &deletion, nil
+}
+
+// Cancel cancels the scheduled deletion of the account of the user
+func (d *AccountDeletionTest) Cancel(userID int) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.deletions[userID]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(d.deletions, userID)
+	return nil
+}
+
+// GetDue returns the deletions whose grace period is over by now, along with the sample user
+func (d *AccountDeletionTest) GetDue(now time.Time) ([]*AccountDeletion, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var due []*AccountDeletion
+	for _, deletion := range d.deletions {
+		if deletion.DeleteAfter.After(now) {
+			continue
+		}
+		deletion := deletion
+		user := sampleUser
+		user.ID = deletion.UserID
+		deletion.User = &user
+		due = append(due, &deletion)
+	}
+	return due, nil
 }
@@ -0,0 +1,81 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrTokenUsed = errors.New("token has already been used")
+
+// Token is the structure which holds the server side record of one signed token.
+// Each token carries a random nonce, which can only be consumed once.
+type Token struct {
+	ID        int
+	Nonce     string
+	Purpose   string
+	ExpiresAt time.Time
+	UsedAt    sql.NullTime
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Insert records a newly issued token
+func (t *Token) Insert(token Token) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into signed_tokens (nonce, purpose, expires_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5)`
+
+	_, err := db.ExecContext(ctx, stmt,
+		token.Nonce,
+		token.Purpose,
+		token.ExpiresAt,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Consume marks the token with the nonce as used. It returns ErrTokenUsed if the token
+// has been used already, or was never issued for the purpose.
+func (t *Token) Consume(nonce, purpose string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return consumeToken(ctx, db, nonce, purpose)
+}
+
+// execer runs statements, either on their own or within a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// consumeToken is Consume, with the statement run by e, e.g. within the transaction
+// of what the token is used for, so that it's only used up if that succeeds
+func consumeToken(ctx context.Context, e execer, nonce, purpose string) error {
+	// only one of concurrent requests with the same token can set used_at
+	stmt := `update signed_tokens set used_at = $1, updated_at = $1
+			where nonce = $2 and purpose = $3 and used_at is null and expires_at > $1`
+
+	res, err := e.ExecContext(ctx, stmt, time.Now(), nonce, purpose)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTokenUsed
+	}
+
+	return nil
+}
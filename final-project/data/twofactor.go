@@ -0,0 +1,213 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+
+// TwoFactor is the structure which holds the TOTP authenticator of one user.
+// It's pending until the user has verified a first code, and enabled from then on.
+type TwoFactor struct {
+	ID        int
+	UserID    int
+	Secret    string // base32 encoded, as shared with the authenticator
+	EnabledAt sql.NullTime
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// LastUsedStep is the time step of the last code accepted from the authenticator;
+	// neither its code nor older ones are accepted again
+	LastUsedStep int64
+}
+
+// Enabled reports whether codes are required to log in
+func (t *TwoFactor) Enabled() bool {
+	return t.EnabledAt.Valid
+}
+
+// GetByUserID returns the authenticator of one user
+func (t *TwoFactor) GetByUserID(userID int) (*TwoFactor, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, secret, enabled_at, created_at, updated_at, coalesce(last_used_step, 0)
+			from user_two_factor where user_id = $1`
+
+	var tf TwoFactor
+	row := db.QueryRowContext(ctx, query, userID)
+
+	err := row.Scan(
+		&tf.ID,
+		&tf.UserID,
+		&tf.Secret,
+		&tf.EnabledAt,
+		&tf.CreatedAt,
+		&tf.UpdatedAt,
+		&tf.LastUsedStep,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tf, nil
+}
+
+// Enroll records a pending authenticator for the user, replacing any other pending one.
+// It returns ErrTwoFactorEnabled if the user already has an enabled authenticator.
+func (t *TwoFactor) Enroll(userID int, secret string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	stmt := `insert into user_two_factor (user_id, secret, created_at, updated_at)
+			values ($1, $2, $3, $3)
+			on conflict (user_id) do update set secret = excluded.secret, updated_at = excluded.updated_at
+			where user_two_factor.enabled_at is null`
+
+	res, err := db.ExecContext(ctx, stmt, userID, secret, now)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTwoFactorEnabled
+	}
+
+	return nil
+}
+
+// Enable enables the pending authenticator, along with the time step of the code it was verified with,
+// and replaces the recovery codes of its user, which are only stored hashed
+func (t *TwoFactor) Enable(tf TwoFactor, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	// the secret must still be the one the code was verified against
+	stmt := `update user_two_factor set enabled_at = $1, last_used_step = $4, updated_at = $1
+			where id = $2 and secret = $3 and enabled_at is null`
+
+	res, err := tx.ExecContext(ctx, stmt, now, tf.ID, tf.Secret, tf.LastUsedStep)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTwoFactorEnabled
+	}
+
+	if _, err := tx.ExecContext(ctx, `delete from user_recovery_codes where user_id = $1`, tf.UserID); err != nil {
+		return err
+	}
+
+	stmt = `insert into user_recovery_codes (user_id, code_hash, created_at, updated_at)
+			values ($1, $2, $3, $3)`
+
+	for _, code := range recoveryCodes {
+		if _, err := tx.ExecContext(ctx, stmt, tf.UserID, hashRecoveryCode(code), now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Disable removes the authenticator and the recovery codes of the user
+func (t *TwoFactor) Disable(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `delete from user_recovery_codes where user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `delete from user_two_factor where user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode uses up one of the recovery codes of the user, and reports whether
+// the code was one which hadn't been used yet
+func (t *TwoFactor) UseRecoveryCode(userID int, code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	// only one of concurrent requests with the same code can set used_at
+	stmt := `update user_recovery_codes set used_at = $1, updated_at = $1
+			where user_id = $2 and code_hash = $3 and used_at is null`
+
+	res, err := db.ExecContext(ctx, stmt, time.Now(), userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// UseTimeStep records that a code of the enabled authenticator of the user has been accepted for the time step,
+// and reports whether it's later than the last one accepted, i.e. whether the code may be accepted at all
+func (t *TwoFactor) UseTimeStep(userID int, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	// only one of concurrent requests with the same code can move last_used_step forward
+	stmt := `update user_two_factor set last_used_step = $1, updated_at = $2
+			where user_id = $3 and enabled_at is not null and coalesce(last_used_step, 0) < $1`
+
+	res, err := db.ExecContext(ctx, stmt, step, time.Now(), userID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// hashRecoveryCode hashes the code regardless of case, spaces and dashes.
+// Recovery codes are random, so a fast hash is enough.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
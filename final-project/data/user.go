@@ -2,13 +2,22 @@ package data
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgconn"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// uniqueViolation is the postgres error code for a duplicate key
+const uniqueViolation = "23505"
+
+var ErrDuplicateEmail = errors.New("email is already registered")
+
 type IsActive uint8
 
 const (
@@ -16,13 +25,6 @@ const (
 	Active
 )
 
-type IsAdmin uint8
-
-const (
-	NotAdmin IsAdmin = iota
-	Admin
-)
-
 // User is the structure which holds one user from the database.
 type User struct {
 	ID        int
@@ -31,7 +33,9 @@ type User struct {
 	LastName  string
 	Password  string
 	IsActive  IsActive
-	IsAdmin   IsAdmin
+	Role      Role     // what the user is allowed to do besides being a member
+	Currency  Currency // the currency the user prefers to pay in
+	Locale    string   // the locale amounts are formatted for, e.g. "en-US"
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	Plan      *Plan
@@ -50,7 +54,9 @@ func (u *User) GetAll() ([]*User, error) {
        	last_name, 
        	password, 
        	user_active, 
-       	is_admin, 
+       	role, 
+       	currency, 
+       	locale, 
        	created_at, 
        	updated_at
 	from 
@@ -75,7 +81,9 @@ func (u *User) GetAll() ([]*User, error) {
 			&user.LastName,
 			&user.Password,
 			&user.IsActive,
-			&user.IsAdmin,
+			&user.Role,
+			&user.Currency,
+			&user.Locale,
 			&user.CreatedAt,
 			&user.UpdatedAt,
 		)
@@ -90,6 +98,71 @@ func (u *User) GetAll() ([]*User, error) {
 	return users, nil
 }
 
+// Search returns one page of the users whose email or name contains the term, sorted by last name,
+// along with how many users match in all. An empty term matches every user.
+func (u *User) Search(term string, limit, offset int) ([]*User, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	// the term is matched literally, even if it contains wildcards
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term) + "%"
+
+	query := `select id, email, first_name, last_name, password, user_active, role, currency, locale,
+			created_at, updated_at, count(*) over ()
+			from users
+			where email ilike $1 or first_name ilike $1 or last_name ilike $1
+				or (first_name || ' ' || last_name) ilike $1
+			order by last_name, first_name, id
+			limit $2 offset $3`
+
+	rows, err := db.QueryContext(ctx, query, pattern, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	var total int
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.IsActive,
+			&user.Role,
+			&user.Currency,
+			&user.Locale,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&total,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// past the last page, there is no row to count the matching users with
+	if len(users) == 0 && offset > 0 {
+		query = `select count(*) from users
+			where email ilike $1 or first_name ilike $1 or last_name ilike $1
+				or (first_name || ' ' || last_name) ilike $1`
+		if err := db.QueryRowContext(ctx, query, pattern).Scan(&total); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return users, total, nil
+}
+
 // GetByEmail returns one user by email
 func (u *User) GetByEmail(email string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
@@ -103,13 +176,15 @@ func (u *User) GetByEmail(email string) (*User, error) {
 			    last_name, 
 			    password, 
 			    user_active, 
-			    is_admin, 
+			    role, 
+			    currency, 
+			    locale, 
 			    created_at, 
 			    updated_at 
 			from 
 			    users 
 			where 
-			    email = $1`
+			    lower(email) = lower($1)`
 
 	var user User
 	row := db.QueryRowContext(ctx, query, email)
@@ -121,7 +196,9 @@ func (u *User) GetByEmail(email string) (*User, error) {
 		&user.LastName,
 		&user.Password,
 		&user.IsActive,
-		&user.IsAdmin,
+		&user.Role,
+		&user.Currency,
+		&user.Locale,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -130,11 +207,13 @@ func (u *User) GetByEmail(email string) (*User, error) {
 		return nil, err
 	}
 
-	// get plan, if any
-	query = `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at from 
+	// get plan, if any, preferring the user's own plan over the plan of their organization
+	query = `select p.id, p.plan_name, coalesce(up.amount, p.plan_amount), up.currency, p.billing_interval, p.trial_days,
+			p.seat_based, p.created_at, p.updated_at from 
 			plans p
 			left join user_plans up on (p.id = up.plan_id)
-			where up.user_id = $1`
+			where ` + coveredByPlan + `
+			order by up.organization_id nulls first limit 1`
 
 	var plan Plan
 	row = db.QueryRowContext(ctx, query, user.ID)
@@ -143,11 +222,16 @@ func (u *User) GetByEmail(email string) (*User, error) {
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
+		&plan.Currency,
+		&plan.Interval,
+		&plan.TrialDays,
+		&plan.SeatBased,
 		&plan.CreatedAt,
 		&plan.UpdatedAt,
 	)
 
 	if err == nil {
+		plan.PlanAmountFormatted = FormatAmount(plan.PlanAmount, plan.Currency, user.Locale)
 		user.Plan = &plan
 	}
 
@@ -159,7 +243,8 @@ func (u *User) GetOne(id int) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, is_admin, created_at, updated_at 
+	query := `select id, email, first_name, last_name, password, user_active, role, currency, locale,
+				created_at, updated_at 
 				from users 
 				where id = $1`
 
@@ -173,7 +258,9 @@ func (u *User) GetOne(id int) (*User, error) {
 		&user.LastName,
 		&user.Password,
 		&user.IsActive,
-		&user.IsAdmin,
+		&user.Role,
+		&user.Currency,
+		&user.Locale,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -182,11 +269,13 @@ func (u *User) GetOne(id int) (*User, error) {
 		return nil, err
 	}
 
-	// get plan, if any
-	query = `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at from 
+	// get plan, if any, preferring the user's own plan over the plan of their organization
+	query = `select p.id, p.plan_name, coalesce(up.amount, p.plan_amount), up.currency, p.billing_interval, p.trial_days,
+			p.seat_based, p.created_at, p.updated_at from 
 			plans p
 			left join user_plans up on (p.id = up.plan_id)
-			where up.user_id = $1`
+			where ` + coveredByPlan + `
+			order by up.organization_id nulls first limit 1`
 
 	var plan Plan
 	row = db.QueryRowContext(ctx, query, user.ID)
@@ -195,11 +284,16 @@ func (u *User) GetOne(id int) (*User, error) {
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
+		&plan.Currency,
+		&plan.Interval,
+		&plan.TrialDays,
+		&plan.SeatBased,
 		&plan.CreatedAt,
 		&plan.UpdatedAt,
 	)
 
 	if err == nil {
+		plan.PlanAmountFormatted = FormatAmount(plan.PlanAmount, plan.Currency, user.Locale)
 		user.Plan = &plan
 	} else {
 		log.Println("Error getting plan", err)
@@ -219,18 +313,26 @@ func (u *User) Update(user User) error {
 		first_name = $2,
 		last_name = $3,
 		user_active = $4,
-		updated_at = $5
-		where id = $6`
+		currency = $5,
+		locale = $6,
+		updated_at = $7
+		where id = $8`
 
 	_, err := db.ExecContext(ctx, stmt,
 		user.Email,
 		user.FirstName,
 		user.LastName,
 		user.IsActive,
+		user.Currency,
+		user.Locale,
 		time.Now(),
 		user.ID,
 	)
 
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return ErrDuplicateEmail
+	}
 	if err != nil {
 		return err
 	}
@@ -238,7 +340,23 @@ func (u *User) Update(user User) error {
 	return nil
 }
 
-// Delete deletes one user from the database, by User.ID
+// SetRole changes the role of one user
+func (u *User) SetRole(userID int, role Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set role = $1, updated_at = $2 where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, role, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete deletes one user from the database, by User.ID.
+// Their invoices are kept for the books, but no longer tell who they were billed to.
 func (u *User) Delete(user User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
@@ -273,25 +391,44 @@ func (u *User) Insert(user User) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
-	if err != nil {
-		return 0, err
+	// users signing in with an identity provider have no password until they add one
+	var hashedPassword []byte
+	if user.Password != "" {
+		var err error
+		hashedPassword, err = bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if user.Currency == "" {
+		user.Currency = DefaultCurrency
+	}
+	if user.Locale == "" {
+		user.Locale = DefaultLocale
 	}
 
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, user_active, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	stmt := `insert into users (email, first_name, last_name, password, user_active, currency, locale, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
 
-	err = db.QueryRowContext(ctx, stmt,
+	err := db.QueryRowContext(ctx, stmt,
 		user.Email,
 		user.FirstName,
 		user.LastName,
-		hashedPassword,
+		string(hashedPassword),
 		user.IsActive,
+		user.Currency,
+		user.Locale,
 		time.Now(),
 		time.Now(),
 	).Scan(&newID)
 
+	// emails are unique regardless of case
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return 0, ErrDuplicateEmail
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -300,7 +437,7 @@ func (u *User) Insert(user User) (int, error) {
 }
 
 // ResetPassword is the method we will use to change a user's password.
-func (u *User) ResetPassword(password string) error {
+func (u *User) ResetPassword(user User, password string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
@@ -309,8 +446,8 @@ func (u *User) ResetPassword(password string) error {
 		return err
 	}
 
-	stmt := `update users set password = $1 where id = $2`
-	_, err = db.ExecContext(ctx, stmt, hashedPassword, u.ID)
+	stmt := `update users set password = $1, updated_at = $2 where id = $3`
+	_, err = db.ExecContext(ctx, stmt, hashedPassword, time.Now(), user.ID)
 	if err != nil {
 		return err
 	}
@@ -318,6 +455,32 @@ func (u *User) ResetPassword(password string) error {
 	return nil
 }
 
+// RemovePassword removes the password of a user, who can then only log in with an identity provider
+func (u *User) RemovePassword(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set password = '', updated_at = $1 where id = $2`
+	_, err := db.ExecContext(ctx, stmt, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// HasPassword reports whether the user can log in with a password
+func (u *User) HasPassword() bool {
+	return u.Password != ""
+}
+
+// PasswordFingerprint returns a short digest of the password hash, which changes whenever
+// the password does. Links that must stop working once the password has changed embed it.
+func (u *User) PasswordFingerprint() string {
+	sum := sha256.Sum256([]byte(u.Password))
+	return hex.EncodeToString(sum[:8])
+}
+
 // PasswordMatches uses Go's bcrypt package to compare a user supplied password
 // with the hash we have stored for a given user in the database. If the password
 // and hash match, we return true; otherwise, we return false.
@@ -335,3 +498,8 @@ func (u *User) PasswordMatches(plainText string) (bool, error) {
 
 	return true, nil
 }
+
+// Can reports whether the role of the user grants the permission
+func (u *User) Can(p Permission) bool {
+	return u.Role.Can(p)
+}
@@ -6,6 +6,9 @@ CREATE TABLE public.plans (
                               id integer NOT NULL,
                               plan_name character varying(255),
                               plan_amount integer,
+                              billing_interval character varying(10) DEFAULT 'month'::character varying NOT NULL,
+                              trial_days integer DEFAULT 0 NOT NULL,
+                              seat_based boolean DEFAULT false NOT NULL,
                               created_at timestamp without time zone,
                               updated_at timestamp without time zone
 );
@@ -25,6 +28,132 @@ ALTER TABLE public.plans ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
 );
 
 
+--
+-- Name: coupons; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.coupons (
+                                id integer NOT NULL,
+                                code character varying(64) NOT NULL,
+                                percent_off integer DEFAULT 0 NOT NULL,
+                                amount_off integer DEFAULT 0 NOT NULL,
+                                currency character(3) DEFAULT 'USD'::bpchar NOT NULL,
+                                duration character varying(10) DEFAULT 'once'::character varying NOT NULL,
+                                duration_in_intervals integer DEFAULT 0 NOT NULL,
+                                max_redemptions integer DEFAULT 0 NOT NULL,
+                                times_redeemed integer DEFAULT 0 NOT NULL,
+                                expires_at timestamp without time zone,
+                                created_at timestamp without time zone,
+                                updated_at timestamp without time zone
+);
+
+
+ALTER TABLE public.coupons ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.coupons_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: coupon_redemptions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.coupon_redemptions (
+                                           id integer NOT NULL,
+                                           coupon_id integer,
+                                           user_id integer,
+                                           user_plan_id integer,
+                                           discount_amount integer,
+                                           created_at timestamp without time zone,
+                                           updated_at timestamp without time zone
+);
+
+
+ALTER TABLE public.coupon_redemptions ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.coupon_redemptions_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: plan_features; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.plan_features (
+                                      id integer NOT NULL,
+                                      plan_id integer,
+                                      feature character varying(255),
+                                      created_at timestamp without time zone,
+                                      updated_at timestamp without time zone
+);
+
+
+ALTER TABLE public.plan_features ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.plan_features_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: plan_limits; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.plan_limits (
+                                    id integer NOT NULL,
+                                    plan_id integer,
+                                    limit_key character varying(255),
+                                    limit_value integer,
+                                    created_at timestamp without time zone,
+                                    updated_at timestamp without time zone
+);
+
+
+ALTER TABLE public.plan_limits ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.plan_limits_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: plan_prices; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.plan_prices (
+                                    id integer NOT NULL,
+                                    plan_id integer,
+                                    currency character(3) NOT NULL,
+                                    amount integer NOT NULL,
+                                    created_at timestamp without time zone,
+                                    updated_at timestamp without time zone
+);
+
+
+ALTER TABLE public.plan_prices ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.plan_prices_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
 --
 -- Name: user_id_seq; Type: SEQUENCE; Schema: public; Owner: -
 --
@@ -37,6 +166,295 @@ CREATE SEQUENCE public.user_id_seq
     CACHE 1;
 
 
+--
+-- Name: organizations; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.organizations (
+                                      id integer NOT NULL,
+                                      name character varying(255),
+                                      owner_id integer,
+                                      trial_used_at timestamp without time zone,
+                                      created_at timestamp without time zone,
+                                      updated_at timestamp without time zone
+);
+
+
+ALTER TABLE public.organizations ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.organizations_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: organization_members; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.organization_members (
+                                             id integer NOT NULL,
+                                             organization_id integer,
+                                             user_id integer,
+                                             role character varying(10) DEFAULT 'member'::character varying NOT NULL,
+                                             created_at timestamp without time zone,
+                                             updated_at timestamp without time zone
+);
+
+
+ALTER TABLE public.organization_members ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.organization_members_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: organization_invitations; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.organization_invitations (
+                                                 id integer NOT NULL,
+                                                 organization_id integer,
+                                                 email character varying(255),
+                                                 invited_by integer,
+                                                 accepted_at timestamp without time zone,
+                                                 created_at timestamp without time zone,
+                                                 updated_at timestamp without time zone
+);
+
+
+ALTER TABLE public.organization_invitations ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.organization_invitations_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: signed_tokens; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.signed_tokens (
+                                      id integer NOT NULL,
+                                      nonce character varying(64) NOT NULL,
+                                      purpose character varying(20) NOT NULL,
+                                      expires_at timestamp without time zone NOT NULL,
+                                      used_at timestamp without time zone,
+                                      created_at timestamp without time zone,
+                                      updated_at timestamp without time zone
+);
+
+
+ALTER TABLE public.signed_tokens ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.signed_tokens_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: user_two_factor; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.user_two_factor (
+                                        id integer NOT NULL,
+                                        user_id integer NOT NULL,
+                                        secret character varying(64) NOT NULL,
+                                        enabled_at timestamp without time zone,
+                                        last_used_step bigint,
+                                        created_at timestamp without time zone,
+                                        updated_at timestamp without time zone
+);
+
+
+ALTER TABLE public.user_two_factor ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.user_two_factor_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: user_recovery_codes; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.user_recovery_codes (
+                                            id integer NOT NULL,
+                                            user_id integer NOT NULL,
+                                            code_hash character varying(64) NOT NULL,
+                                            used_at timestamp without time zone,
+                                            created_at timestamp without time zone,
+                                            updated_at timestamp without time zone
+);
+
+
+ALTER TABLE public.user_recovery_codes ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.user_recovery_codes_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: audit_log_append_only(); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE FUNCTION public.audit_log_append_only() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    -- deleting a user only forgets who the actor or the target was; nothing else may change
+    IF TG_OP = 'UPDATE'
+        AND (NEW.actor_id IS NULL OR NEW.actor_id = OLD.actor_id)
+        AND (NEW.target_id IS NULL OR NEW.target_id = OLD.target_id)
+        AND (NEW.id, NEW.action, NEW.ip, NEW.request_id, NEW.diff, NEW.created_at)
+            IS NOT DISTINCT FROM (OLD.id, OLD.action, OLD.ip, OLD.request_id, OLD.diff, OLD.created_at) THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$;
+
+
+--
+-- Name: audit_log; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.audit_log (
+                                  id integer NOT NULL,
+                                  action character varying(50) NOT NULL,
+                                  actor_id integer,
+                                  target_id integer,
+                                  ip character varying(45),
+                                  request_id character varying(255),
+                                  diff jsonb,
+                                  created_at timestamp without time zone NOT NULL
+);
+
+
+ALTER TABLE public.audit_log ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.audit_log_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: user_identities; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.user_identities (
+                                        id integer NOT NULL,
+                                        user_id integer NOT NULL,
+                                        issuer character varying(255) NOT NULL,
+                                        subject character varying(255) NOT NULL,
+                                        email character varying(255) NOT NULL,
+                                        created_at timestamp without time zone,
+                                        updated_at timestamp without time zone
+);
+
+
+ALTER TABLE public.user_identities ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.user_identities_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: api_tokens; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.api_tokens (
+                                   id integer NOT NULL,
+                                   user_id integer NOT NULL,
+                                   name character varying(255) NOT NULL,
+                                   prefix character varying(16) NOT NULL,
+                                   token_hash character(64) NOT NULL,
+                                   scopes character varying(255) NOT NULL,
+                                   expires_at timestamp without time zone,
+                                   last_used_at timestamp without time zone,
+                                   created_at timestamp without time zone,
+                                   updated_at timestamp without time zone
+);
+
+
+ALTER TABLE public.api_tokens ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.api_tokens_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: invoices; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.invoices (
+                                 id integer NOT NULL,
+                                 user_id integer,
+                                 organization_id integer,
+                                 subscription_id integer NOT NULL,
+                                 plan_id integer NOT NULL,
+                                 seats integer DEFAULT 1 NOT NULL,
+                                 currency character(3) NOT NULL,
+                                 amount integer NOT NULL,
+                                 discount_amount integer DEFAULT 0 NOT NULL,
+                                 period_start timestamp without time zone NOT NULL,
+                                 period_end timestamp without time zone NOT NULL,
+                                 created_at timestamp without time zone,
+                                 updated_at timestamp without time zone
+);
+
+
+ALTER TABLE public.invoices ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.invoices_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: account_deletions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.account_deletions (
+                                          user_id integer NOT NULL,
+                                          delete_after timestamp without time zone NOT NULL,
+                                          created_at timestamp without time zone
+);
+
+
 --
 -- Name: user_plans; Type: TABLE; Schema: public; Owner: -
 --
@@ -44,7 +462,18 @@ CREATE SEQUENCE public.user_id_seq
 CREATE TABLE public.user_plans (
                                    id integer NOT NULL,
                                    user_id integer,
+                                   organization_id integer,
                                    plan_id integer,
+                                   seats integer DEFAULT 1 NOT NULL,
+                                   currency character(3) DEFAULT 'USD'::bpchar NOT NULL,
+                                   amount integer,
+                                   coupon_id integer,
+                                   discount_amount integer DEFAULT 0 NOT NULL,
+                                   discount_intervals_left integer,
+                                   trial_starts_at timestamp without time zone,
+                                   trial_ends_at timestamp without time zone,
+                                   next_charge_at timestamp without time zone,
+                                   trial_reminder_sent_at timestamp without time zone,
                                    created_at timestamp without time zone,
                                    updated_at timestamp without time zone
 );
@@ -71,15 +500,18 @@ CREATE TABLE public.users (
                               last_name character varying(255),
                               password character varying(60),
                               user_active integer DEFAULT 0,
-                              is_admin integer default 0,
+                              role character varying(20) DEFAULT 'member'::character varying NOT NULL,
+                              currency character(3) DEFAULT 'USD'::bpchar NOT NULL,
+                              locale character varying(35) DEFAULT 'en-US'::character varying NOT NULL,
+                              trial_used_at timestamp without time zone,
                               created_at timestamp without time zone,
                               updated_at timestamp without time zone
 );
 
 
-INSERT INTO "public"."users"("email","first_name","last_name","password","user_active", "is_admin", "created_at","updated_at")
+INSERT INTO "public"."users"("email","first_name","last_name","password","user_active", "role", "created_at","updated_at")
 VALUES
-    (E'admin@example.com',E'Admin',E'User',E'$2a$12$1zGLuYDDNvATh4RA4avbKuheAMpb1svexSzrQm7up.bnpwQHs0jNe',1,1,E'2022-03-14 00:00:00',E'2022-03-14 00:00:00');
+    (E'admin@example.com',E'Admin',E'User',E'$2a$12$1zGLuYDDNvATh4RA4avbKuheAMpb1svexSzrQm7up.bnpwQHs0jNe',1,'admin',E'2022-03-14 00:00:00',E'2022-03-14 00:00:00');
 
 SELECT pg_catalog.setval('public.plans_id_seq', 1, false);
 
@@ -89,17 +521,175 @@ SELECT pg_catalog.setval('public.user_id_seq', 2, true);
 
 SELECT pg_catalog.setval('public.user_plans_id_seq', 1, false);
 
-INSERT INTO "public"."plans"("plan_name","plan_amount","created_at","updated_at")
+INSERT INTO "public"."plans"("plan_name","plan_amount","billing_interval","trial_days","seat_based","created_at","updated_at")
+VALUES
+    (E'Bronze Plan',1000,E'month',0,false,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (E'Silver Plan',2000,E'month',7,false,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (E'Gold Plan',3000,E'month',14,false,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (E'Gold Plan (Yearly)',30000,E'year',30,false,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (E'Team Plan',1500,E'month',0,true,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00');
+
+INSERT INTO "public"."coupons"("code","percent_off","duration","max_redemptions","created_at","updated_at")
+VALUES
+    (E'WELCOME10',10,E'once',100,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00');
+
+INSERT INTO "public"."plan_features"("plan_id","feature","created_at","updated_at")
 VALUES
-    (E'Bronze Plan',1000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
-    (E'Silver Plan',2000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
-    (E'Gold Plan',3000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00');
+    (1,E'email-support',E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (2,E'email-support',E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (2,E'user-manual',E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (3,E'email-support',E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (3,E'user-manual',E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (3,E'priority-support',E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (3,E'api-access',E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (4,E'email-support',E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (4,E'user-manual',E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (4,E'priority-support',E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (4,E'api-access',E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (5,E'email-support',E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (5,E'user-manual',E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (5,E'priority-support',E'2022-05-12 00:00:00',E'2022-05-12 00:00:00');
+
+INSERT INTO "public"."plan_prices"("plan_id","currency","amount","created_at","updated_at")
+VALUES
+    (1,E'USD',1000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (1,E'EUR',900,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (1,E'JPY',1500,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (2,E'USD',2000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (2,E'EUR',1800,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (2,E'JPY',3000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (3,E'USD',3000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (3,E'EUR',2700,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (3,E'JPY',4500,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (4,E'USD',30000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (4,E'EUR',27000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (4,E'JPY',45000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (5,E'USD',1500,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (5,E'EUR',1350,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (5,E'JPY',2200,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00');
+
+INSERT INTO "public"."plan_limits"("plan_id","limit_key","limit_value","created_at","updated_at")
+VALUES
+    (1,E'max-sessions',1,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (1,E'max-api-tokens',0,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (2,E'max-sessions',3,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (2,E'max-api-tokens',0,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (3,E'max-sessions',10,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (3,E'max-api-tokens',5,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (4,E'max-sessions',10,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (4,E'max-api-tokens',5,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (5,E'max-sessions',3,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (5,E'max-api-tokens',0,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00');
 
 
 ALTER TABLE ONLY public.plans
     ADD CONSTRAINT plans_pkey PRIMARY KEY (id);
 
 
+ALTER TABLE ONLY public.coupons
+    ADD CONSTRAINT coupons_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.coupons
+    ADD CONSTRAINT coupons_code_key UNIQUE (code);
+
+
+ALTER TABLE ONLY public.coupon_redemptions
+    ADD CONSTRAINT coupon_redemptions_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.coupon_redemptions
+    ADD CONSTRAINT coupon_redemptions_coupon_id_user_id_key UNIQUE (coupon_id, user_id);
+
+
+ALTER TABLE ONLY public.plan_features
+    ADD CONSTRAINT plan_features_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.plan_features
+    ADD CONSTRAINT plan_features_plan_id_feature_key UNIQUE (plan_id, feature);
+
+
+ALTER TABLE ONLY public.plan_limits
+    ADD CONSTRAINT plan_limits_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.plan_limits
+    ADD CONSTRAINT plan_limits_plan_id_limit_key_key UNIQUE (plan_id, limit_key);
+
+
+ALTER TABLE ONLY public.plan_prices
+    ADD CONSTRAINT plan_prices_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.plan_prices
+    ADD CONSTRAINT plan_prices_plan_id_currency_key UNIQUE (plan_id, currency);
+
+
+ALTER TABLE ONLY public.organizations
+    ADD CONSTRAINT organizations_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.organization_members
+    ADD CONSTRAINT organization_members_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.organization_members
+    ADD CONSTRAINT organization_members_user_id_key UNIQUE (user_id);
+
+
+ALTER TABLE ONLY public.organization_invitations
+    ADD CONSTRAINT organization_invitations_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.signed_tokens
+    ADD CONSTRAINT signed_tokens_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.signed_tokens
+    ADD CONSTRAINT signed_tokens_nonce_key UNIQUE (nonce);
+
+
+ALTER TABLE ONLY public.user_two_factor
+    ADD CONSTRAINT user_two_factor_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.user_two_factor
+    ADD CONSTRAINT user_two_factor_user_id_key UNIQUE (user_id);
+
+
+ALTER TABLE ONLY public.user_recovery_codes
+    ADD CONSTRAINT user_recovery_codes_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.audit_log
+    ADD CONSTRAINT audit_log_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.user_identities
+    ADD CONSTRAINT user_identities_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.user_identities
+    ADD CONSTRAINT user_identities_issuer_subject_key UNIQUE (issuer, subject);
+
+
+ALTER TABLE ONLY public.api_tokens
+    ADD CONSTRAINT api_tokens_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.api_tokens
+    ADD CONSTRAINT api_tokens_token_hash_key UNIQUE (token_hash);
+
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.account_deletions
+    ADD CONSTRAINT account_deletions_pkey PRIMARY KEY (user_id);
+
+
 ALTER TABLE ONLY public.user_plans
     ADD CONSTRAINT user_plans_pkey PRIMARY KEY (id);
 
@@ -108,6 +698,52 @@ ALTER TABLE ONLY public.users
     ADD CONSTRAINT users_pkey PRIMARY KEY (id);
 
 
+CREATE UNIQUE INDEX users_email_key ON public.users USING btree (lower((email)::text));
+
+
+CREATE INDEX audit_log_created_at_idx ON public.audit_log USING btree (created_at);
+
+
+CREATE INDEX invoices_user_id_idx ON public.invoices USING btree (user_id, created_at);
+
+
+CREATE INDEX account_deletions_delete_after_idx ON public.account_deletions USING btree (delete_after);
+
+
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON public.audit_log FOR EACH ROW EXECUTE FUNCTION public.audit_log_append_only();
+
+
+CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON public.audit_log FOR EACH STATEMENT EXECUTE FUNCTION public.audit_log_append_only();
+
+
+ALTER TABLE ONLY public.coupon_redemptions
+    ADD CONSTRAINT coupon_redemptions_coupon_id_fkey FOREIGN KEY (coupon_id) REFERENCES public.coupons(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.coupon_redemptions
+    ADD CONSTRAINT coupon_redemptions_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.coupon_redemptions
+    ADD CONSTRAINT coupon_redemptions_user_plan_id_fkey FOREIGN KEY (user_plan_id) REFERENCES public.user_plans(id) ON UPDATE RESTRICT ON DELETE SET NULL;
+
+
+ALTER TABLE ONLY public.user_plans
+    ADD CONSTRAINT user_plans_coupon_id_fkey FOREIGN KEY (coupon_id) REFERENCES public.coupons(id) ON UPDATE RESTRICT ON DELETE SET NULL;
+
+
+ALTER TABLE ONLY public.plan_features
+    ADD CONSTRAINT plan_features_plan_id_fkey FOREIGN KEY (plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.plan_limits
+    ADD CONSTRAINT plan_limits_plan_id_fkey FOREIGN KEY (plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.plan_prices
+    ADD CONSTRAINT plan_prices_plan_id_fkey FOREIGN KEY (plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
 ALTER TABLE ONLY public.user_plans
     ADD CONSTRAINT user_plans_plan_id_fkey FOREIGN KEY (plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE CASCADE;
 
@@ -116,4 +752,62 @@ ALTER TABLE ONLY public.user_plans
     ADD CONSTRAINT user_plans_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
 
 
+ALTER TABLE ONLY public.organizations
+    ADD CONSTRAINT organizations_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.organization_members
+    ADD CONSTRAINT organization_members_organization_id_fkey FOREIGN KEY (organization_id) REFERENCES public.organizations(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.organization_members
+    ADD CONSTRAINT organization_members_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.organization_invitations
+    ADD CONSTRAINT organization_invitations_organization_id_fkey FOREIGN KEY (organization_id) REFERENCES public.organizations(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.organization_invitations
+    ADD CONSTRAINT organization_invitations_invited_by_fkey FOREIGN KEY (invited_by) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE SET NULL;
+
+
+ALTER TABLE ONLY public.user_plans
+    ADD CONSTRAINT user_plans_organization_id_fkey FOREIGN KEY (organization_id) REFERENCES public.organizations(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.user_two_factor
+    ADD CONSTRAINT user_two_factor_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.user_recovery_codes
+    ADD CONSTRAINT user_recovery_codes_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+
+ALTER TABLE ONLY public.audit_log
+    ADD CONSTRAINT audit_log_actor_id_fkey FOREIGN KEY (actor_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE SET NULL;
+
+
+ALTER TABLE ONLY public.audit_log
+    ADD CONSTRAINT audit_log_target_id_fkey FOREIGN KEY (target_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE SET NULL;
+
+
+ALTER TABLE ONLY public.user_identities
+    ADD CONSTRAINT user_identities_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.api_tokens
+    ADD CONSTRAINT api_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE SET NULL;
+
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_plan_id_fkey FOREIGN KEY (plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE RESTRICT;
+
 
+ALTER TABLE ONLY public.account_deletions
+    ADD CONSTRAINT account_deletions_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
\ No newline at end of file
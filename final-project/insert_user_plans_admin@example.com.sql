@@ -1,6 +1,7 @@
 insert into "user_plans" (
     "created_at",
     "id",
+    "next_charge_at",
     "plan_id",
     "updated_at",
     "user_id"
@@ -8,6 +9,7 @@ insert into "user_plans" (
 values (
     '2023-08-20 00:00:00',
     1,
+    '2023-09-20 00:00:00',
     1,
     '2023-08-20 00:00:00',
     1